@@ -0,0 +1,86 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// AdminOIDC authorizes admin requests by the groups of OpenID Connect bearer tokens
+type AdminOIDC struct {
+	Verifier    *JWTVerifier
+	GroupsClaim string
+	// Groups allowed to use the whole admin api
+	AdminGroups []string
+	// Groups only allowed to read
+	ReadGroups []string
+}
+
+func (o *AdminOIDC) authorize(token string, readOnly bool) error {
+	claims, err := o.Verifier.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+
+	groups := append([]string{}, o.AdminGroups...)
+	if readOnly {
+		groups = append(groups, o.ReadGroups...)
+	}
+	for _, group := range groups {
+		if ClaimContains(claims, o.GroupsClaim, group) {
+			return nil
+		}
+	}
+
+	subject, _ := claims["sub"].(string)
+	return fmt.Errorf("subject %s is in none of the allowed groups", subject)
+}
+
+// Returns whether the admin api is enabled
+func AdminEnabled() bool {
+	return adminToken != "" || adminOIDC != nil
+}
+
+// Returns whether the request carries the admin token or an OpenID Connect token of an authorized group
+func AdminAuthorized(r *http.Request) bool {
+	token := BearerToken(r)
+
+	authorized := adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+	if !authorized && adminOIDC != nil && token != "" {
+		if err := adminOIDC.authorize(token, r.Method == "GET" || r.Method == "HEAD"); err != nil {
+			globalLogger.Warning(fmt.Sprintf("%s %s from %s denied: %s", r.Method, r.URL.Path, r.RemoteAddr, err))
+		} else {
+			authorized = true
+		}
+	}
+
+	return authorized
+}
+
+// Wraps a handler of the admin api, which requires the admin token or an OpenID Connect token
+// of an allowed group as bearer token. Read groups may only use GET requests.
+func AdminHandler(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !AdminAuthorized(r) {
+			globalLogger.Warning(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr, " without valid admin credentials")
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+
+		globalLogger.Info(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
+		handler(w, r)
+	}
+}
+
+// Writes the given value as json response
+func WriteJSON(w http.ResponseWriter, status int, value interface{}) {
+	output, err := json.Marshal(value)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(status)
+	w.Write(output)
+}
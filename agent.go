@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Agent connects outbound to a hub and deploys the forwarded events to its own cluster,
+// so clusters without inbound connectivity don't expose a webhook or their kubernetes api
+type Agent struct {
+	HubURL string
+	Token  string
+}
+
+// Longest silence on the stream before reconnecting, the hub pings every 30 seconds
+const agentStreamTimeout = 90 * time.Second
+
+// Connects to the hub and reconnects with a backoff whenever the connection is lost. With leader
+// election only the leader connects, as the hub keeps a single stream per agent and other replicas
+// would replace the stream of the leader without being allowed to deploy.
+func (a *Agent) Run() {
+	if !leaderElection.IsLeader() {
+		globalLogger.Info("Waiting for the leadership before connecting to the hub")
+		for !leaderElection.IsLeader() {
+			time.Sleep(time.Second)
+		}
+	}
+
+	backoff := time.Second
+	for {
+		connected := time.Now()
+		err := a.stream()
+		if time.Since(connected) > time.Minute {
+			backoff = time.Second
+		}
+		globalLogger.Warning(fmt.Sprintf("Connection to the hub lost: %s. Reconnecting in %s...", err, backoff))
+		time.Sleep(backoff)
+		if backoff < time.Minute {
+			backoff *= 2
+		}
+	}
+}
+
+func (a *Agent) request(method string, path string, body []byte) (*http.Request, error) {
+	request, err := http.NewRequest(method, a.HubURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Authorization", "Bearer "+a.Token)
+	request.Header.Set("User-Agent", "kubernetes-internal-cd")
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	return request, nil
+}
+
+// Reads the stream of the hub until it fails
+func (a *Agent) stream() error {
+	request, err := a.request(http.MethodGet, "/agent/stream", nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode == 401 {
+		return errors.New("the hub rejected the agent token")
+	}
+	if response.StatusCode == 503 {
+		return errors.New("the hub replica is not the leader or not ready")
+	}
+	if response.StatusCode != 200 {
+		return fmt.Errorf("hub responded with status %d", response.StatusCode)
+	}
+	globalLogger.Info("Connected to the hub " + a.HubURL)
+
+	// Cancel the request if the hub went silent, e.g. behind a proxy dropping the connection
+	watchdog := time.AfterFunc(agentStreamTimeout, cancel)
+	defer watchdog.Stop()
+
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		watchdog.Reset(agentStreamTimeout)
+
+		var message AgentMessage
+		if err := json.Unmarshal(scanner.Bytes(), &message); err != nil {
+			globalLogger.Warning("Invalid message from the hub: " + err.Error())
+			continue
+		}
+		if message.Type != AgentMessageDeploy || message.Event == nil {
+			continue
+		}
+		if !beginDeploy() {
+			globalLogger.Warning(fmt.Sprintf("Shutting down, not deploying request %s", message.Event.RequestID))
+			continue
+		}
+		go func(event DeployEvent) {
+			defer deploysInFlight.Done()
+			a.deploy(event)
+		}(*message.Event)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return errors.New("the hub closed the stream")
+}
+
+// Deploys a forwarded event and reports the results to the hub
+func (a *Agent) deploy(event DeployEvent) {
+	results := AgentResults{Event: event}
+	deployResults, err := deployQueue.Run(context.Background(), event)
+	results.Results = deployResults
+	if err != nil {
+		results.Error = err.Error()
+	}
+
+	body, err := json.Marshal(results)
+	if err != nil {
+		globalLogger.Error(err)
+		return
+	}
+	request, err := a.request(http.MethodPost, "/agent/results", body)
+	if err != nil {
+		globalLogger.Error(err)
+		return
+	}
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		globalLogger.Warning(fmt.Sprintf("Could not report the results of request %s to the hub: %s", event.RequestID, err))
+		return
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		globalLogger.Warning(fmt.Sprintf("Could not report the results of request %s to the hub: status %d", event.RequestID, response.StatusCode))
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const GitHubMetaURL = "https://api.github.com/meta"
+
+type IPAllowlist struct {
+	static []*net.IPNet
+
+	mutex  sync.RWMutex
+	github []*net.IPNet
+}
+
+// Parses a comma separated list of CIDRs or single IP addresses
+func ParseCIDRs(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the address of the client. X-Forwarded-For is only respected for requests from trusted proxies.
+func ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+
+	forwardedFor := strings.Split(r.Header.Get("x-forwarded-for"), ",")
+	// Walk from the closest proxy to the client, stopping at the first untrusted address
+	for i := len(forwardedFor) - 1; i >= 0 && ip != nil && containsIP(trustedProxies, ip); i-- {
+		forwardedIP := net.ParseIP(strings.TrimSpace(forwardedFor[i]))
+		if forwardedIP == nil {
+			break
+		}
+		ip = forwardedIP
+	}
+
+	return ip
+}
+
+func NewIPAllowlist(static []*net.IPNet) *IPAllowlist {
+	return &IPAllowlist{static: static}
+}
+
+// Returns whether requests from the given address are allowed
+func (a *IPAllowlist) Allowed(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	if containsIP(a.static, ip) {
+		return true
+	}
+
+	a.mutex.RLock()
+	defer a.mutex.RUnlock()
+
+	return containsIP(a.github, ip)
+}
+
+// Fetches the published hook ranges of GitHub
+func (a *IPAllowlist) refreshGitHub() error {
+	client := http.Client{Timeout: 30 * time.Second}
+	response, err := client.Get(GitHubMetaURL)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	var meta struct {
+		Hooks []string `json:"hooks"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&meta); err != nil {
+		return err
+	}
+	github, err := ParseCIDRs(strings.Join(meta.Hooks, ","))
+	if err != nil {
+		return err
+	}
+	if len(github) == 0 {
+		return fmt.Errorf("no hook ranges published")
+	}
+
+	a.mutex.Lock()
+	a.github = github
+	a.mutex.Unlock()
+
+	globalLogger.Info(fmt.Sprintf("Allowing %d GitHub hook ranges", len(github)))
+
+	return nil
+}
+
+// Periodically refreshes the GitHub hook ranges. Previous ranges are kept if a refresh fails.
+func (a *IPAllowlist) WatchGitHub(interval time.Duration) {
+	if err := a.refreshGitHub(); err != nil {
+		globalLogger.Error("Could not fetch GitHub hook ranges: " + err.Error())
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := a.refreshGitHub(); err != nil {
+				globalLogger.Error("Could not refresh GitHub hook ranges: " + err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	AuditOutcomeRejected        = "rejected"
+	AuditOutcomeError           = "error"
+	AuditOutcomeNoTargets       = "no_targets"
+	AuditOutcomeSucceeded       = "succeeded"
+	AuditOutcomeFailed          = "failed"
+	AuditOutcomePartiallyFailed = "partially_failed"
+	// A newer push of the branch arrived within the debounce window
+	AuditOutcomeSuperseded = "superseded"
+)
+
+// AuditEntry records a single webhook request, whether it was verified and what it changed
+type AuditEntry struct {
+	ID         string         `json:"id"`
+	RequestID  string         `json:"requestId,omitempty"`
+	Time       time.Time      `json:"time"`
+	Source     string         `json:"source"`
+	Repository string         `json:"repository,omitempty"`
+	Branch     string         `json:"branch,omitempty"`
+	Sha        string         `json:"sha,omitempty"`
+	Image      string         `json:"image,omitempty"`
+	Verified   bool           `json:"verified"`
+	Outcome    string         `json:"outcome"`
+	Reason     string         `json:"reason,omitempty"`
+	Targets    []TargetResult `json:"targets,omitempty"`
+	// Summary of the request headers without secrets
+	Headers map[string]string `json:"headers,omitempty"`
+	// Status code of the response
+	Status int `json:"status,omitempty"`
+	// Whether the request was handled in dry run mode without changing the cluster
+	DryRun bool `json:"dryRun,omitempty"`
+	// Path of the webhook endpoint which received the request
+	Endpoint string `json:"endpoint,omitempty"`
+	// Metadata of version 2 payloads
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Sets the outcome of the entry from the results of a deploy
+func (e *AuditEntry) SetResults(results []TargetResult) {
+	e.Targets = results
+
+	failed := 0
+	for _, result := range results {
+		if !result.Succeeded() {
+			failed++
+		}
+	}
+
+	switch {
+	case len(results) == 0:
+		e.Outcome = AuditOutcomeNoTargets
+	case failed == 0:
+		e.Outcome = AuditOutcomeSucceeded
+	case failed == len(results):
+		e.Outcome = AuditOutcomeFailed
+	default:
+		e.Outcome = AuditOutcomePartiallyFailed
+	}
+}
+
+// Entries are written to the ConfigMap in batches collected for this long
+const auditPersistInterval = time.Second
+
+// Data of the ConfigMap is kept below the 1MiB object limit of the kubernetes api, leaving room for
+// its metadata
+const maxAuditConfigMapBytes = 900 * 1024
+
+// AuditLog keeps the latest entries in memory and, if configured, in a ConfigMap ring buffer
+// with one data key per entry so it survives restarts. Entries are persisted in batches by a
+// background goroutine, so requests don't wait for the kubernetes api. Unverified requests are
+// only kept in memory and sent to the sinks, so junk traffic doesn't turn into cluster writes.
+type AuditLog struct {
+	Namespace string
+	Name      string
+	Size      int
+
+	// External sinks receiving every entry
+	Sinks []AuditSink
+
+	mutex     sync.Mutex
+	entries   []AuditEntry
+	sinkQueue chan AuditEntry
+	// Entries waiting to be persisted and whether a batch is being written
+	pending    []AuditEntry
+	persisting bool
+	persisted  *sync.Cond
+	persist    chan struct{}
+}
+
+func NewAuditLog(namespace string, name string, size int) *AuditLog {
+	a := &AuditLog{Namespace: namespace, Name: name, Size: size, persist: make(chan struct{}, 1)}
+	a.persisted = sync.NewCond(&a.mutex)
+	if a.persistent() {
+		go a.runPersist()
+	}
+
+	return a
+}
+
+// Adds an external sink, which must happen before entries are recorded
+func (a *AuditLog) AddSink(sink AuditSink) {
+	if a.sinkQueue == nil {
+		a.sinkQueue = make(chan AuditEntry, 1000)
+		go a.runSinks()
+	}
+	a.Sinks = append(a.Sinks, sink)
+}
+
+func (a *AuditLog) persistent() bool {
+	return a.Name != ""
+}
+
+// Loads previously persisted entries, preferring the database if configured
+func (a *AuditLog) Load() error {
+	if store != nil {
+		entries, err := store.Deliveries(a.Size)
+		if err != nil {
+			return err
+		}
+
+		a.mutex.Lock()
+		a.entries = entries
+		a.mutex.Unlock()
+
+		return nil
+	}
+	if !a.persistent() {
+		return nil
+	}
+
+	ctx, cancel := apiContext(context.Background())
+	defer cancel()
+	configMap, err := kubeSet.CoreV1().ConfigMaps(a.Namespace).Get(ctx, a.Name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []AuditEntry
+	for _, value := range configMap.Data {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			globalLogger.Warning("Skipping malformed audit entry: " + err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].ID < entries[j].ID })
+
+	a.mutex.Lock()
+	a.entries = entries
+	a.mutex.Unlock()
+
+	return nil
+}
+
+// Returns the ID of an entry received at the given time, sortable by time and unique enough for the ring buffer
+func AuditID(receivedAt time.Time) string {
+	return fmt.Sprintf("%019d", receivedAt.UnixNano())
+}
+
+// Records an entry. Entries are never dropped because persisting them failed.
+func (a *AuditLog) Record(entry AuditEntry) {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	if entry.ID == "" {
+		entry.ID = AuditID(entry.Time)
+	}
+	entry.DryRun = dryRun
+
+	if a.sinkQueue != nil {
+		select {
+		case a.sinkQueue <- entry:
+		default:
+			globalLogger.Error(fmt.Sprintf("Audit sink queue is full, dropping entry %s for external sinks", entry.ID))
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.entries = append(a.entries, entry)
+	if len(a.entries) > a.Size {
+		a.entries = a.entries[len(a.entries)-a.Size:]
+	}
+
+	// Dry runs don't write to the cluster, including the audit log ConfigMap
+	if a.persistent() && !dryRun && entry.Verified {
+		a.pending = append(a.pending, entry)
+		if len(a.pending) > a.Size {
+			a.pending = a.pending[len(a.pending)-a.Size:]
+		}
+		select {
+		case a.persist <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Persists the pending entries in batches
+func (a *AuditLog) runPersist() {
+	for range a.persist {
+		time.Sleep(auditPersistInterval)
+
+		a.mutex.Lock()
+		batch := a.pending
+		a.pending = nil
+		a.persisting = true
+		a.mutex.Unlock()
+
+		err := a.persistBatch(batch)
+
+		a.mutex.Lock()
+		if err != nil {
+			globalLogger.Error(fmt.Sprintf("Could not persist %d audit entries, retrying with the next batch: %s", len(batch), err))
+			// Failed entries are written with the next batch
+			a.pending = append(batch, a.pending...)
+			if len(a.pending) > a.Size {
+				a.pending = a.pending[len(a.pending)-a.Size:]
+			}
+		}
+		a.persisting = false
+		a.persisted.Broadcast()
+		a.mutex.Unlock()
+	}
+}
+
+// Waits until the pending entries were persisted, or the context expires
+func (a *AuditLog) Flush(ctx context.Context) error {
+	if !a.persistent() {
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		a.mutex.Lock()
+		for len(a.pending) > 0 || a.persisting {
+			a.persisted.Wait()
+		}
+		a.mutex.Unlock()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Writes the entries to the ConfigMap with a single update, dropping the oldest entries beyond the
+// size or the byte limit
+func (a *AuditLog) persistBatch(batch []AuditEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	values := make(map[string]string, len(batch))
+	for _, entry := range batch {
+		value, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		values[entry.ID] = string(value)
+	}
+
+	return retry.RetryOnConflict(kubeRetry, func() error {
+		ctx, cancel := apiContext(context.Background())
+		defer cancel()
+		configMap, err := kubeSet.CoreV1().ConfigMaps(a.Namespace).Get(ctx, a.Name, metav1.GetOptions{})
+		create := errors.IsNotFound(err)
+		if create {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: a.Name, Namespace: a.Namespace}}
+		} else if err != nil {
+			return err
+		}
+
+		if configMap.Data == nil {
+			configMap.Data = make(map[string]string)
+		}
+		for id, value := range values {
+			configMap.Data[id] = value
+		}
+		trimAuditData(configMap.Data, a.Size, maxAuditConfigMapBytes)
+
+		if create {
+			_, err = kubeSet.CoreV1().ConfigMaps(a.Namespace).Create(ctx, configMap, metav1.CreateOptions{})
+		} else {
+			_, err = kubeSet.CoreV1().ConfigMaps(a.Namespace).Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
+
+// Drops the oldest entries of the ConfigMap data until at most size entries with at most maxBytes
+// of keys and values are left
+func trimAuditData(data map[string]string, size int, maxBytes int) {
+	ids := make([]string, 0, len(data))
+	total := 0
+	for id, value := range data {
+		ids = append(ids, id)
+		total += len(id) + len(value)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if len(data) <= size && total <= maxBytes {
+			break
+		}
+		total -= len(id) + len(data[id])
+		delete(data, id)
+	}
+}
+
+// Returns the entries, newest first
+func (a *AuditLog) Entries() []AuditEntry {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	entries := make([]AuditEntry, len(a.entries))
+	for i, entry := range a.entries {
+		entries[len(a.entries)-1-i] = entry
+	}
+
+	return entries
+}
+
+// Returns the latest audit entries, filtered by the optional repository, namespace, outcome, since and
+// until parameters. limit and cursor page through the entries.
+func AuditHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	query, err := ParseAuditQuery(r.URL.Query(), auditLog.Size)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	entries, next, err := auditLog.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	WritePage(w, entries, next)
+}
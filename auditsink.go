@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/syslog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Schema of exported audit records
+const AuditSchema = "kubernetes-internal-cd/audit/v1"
+
+// AuditRecord is an audit entry as exported to external sinks
+type AuditRecord struct {
+	Schema string `json:"schema"`
+	AuditEntry
+}
+
+// AuditSink receives every audit entry, e.g. to keep deployment records outside of the cluster
+type AuditSink interface {
+	Send(record []byte, entry AuditEntry) error
+	String() string
+}
+
+// HTTPAuditSink posts each record to an https endpoint
+type HTTPAuditSink struct {
+	URL   string
+	Token string
+
+	client http.Client
+}
+
+func (s *HTTPAuditSink) Send(record []byte, entry AuditEntry) error {
+	request, err := http.NewRequest("POST", s.URL, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	if s.Token != "" {
+		request.Header.Set("authorization", "Bearer "+s.Token)
+	}
+
+	s.client.Timeout = 10 * time.Second
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (s *HTTPAuditSink) String() string {
+	return "https endpoint"
+}
+
+// SyslogAuditSink writes each record as one syslog message
+type SyslogAuditSink struct {
+	writer *syslog.Writer
+}
+
+// Connects to a syslog server given as udp://host:port or tcp://host:port
+func NewSyslogAuditSink(address string) (*SyslogAuditSink, error) {
+	parsed, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+	writer, err := syslog.Dial(parsed.Scheme, parsed.Host, syslog.LOG_INFO|syslog.LOG_AUTH, "kubernetes-internal-cd")
+	if err != nil {
+		return nil, err
+	}
+
+	return &SyslogAuditSink{writer: writer}, nil
+}
+
+func (s *SyslogAuditSink) Send(record []byte, entry AuditEntry) error {
+	return s.writer.Info(string(record))
+}
+
+func (s *SyslogAuditSink) String() string {
+	return "syslog"
+}
+
+// S3AuditSink stores each record as <prefix><id>.json in an S3 (compatible) bucket
+type S3AuditSink struct {
+	Bucket string
+	Region string
+	Prefix string
+	// Optional endpoint of S3 compatible storage, path style is used then
+	Endpoint        string
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	client http.Client
+}
+
+func (s *S3AuditSink) Send(record []byte, entry AuditEntry) error {
+	key := s.Prefix + entry.ID + ".json"
+	var objectURL string
+	if s.Endpoint != "" {
+		objectURL = strings.TrimRight(s.Endpoint, "/") + "/" + s.Bucket + "/" + key
+	} else {
+		objectURL = fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, key)
+	}
+
+	request, err := http.NewRequest("PUT", objectURL, bytes.NewReader(record))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	s.sign(request, record, time.Now().UTC())
+
+	s.client.Timeout = 10 * time.Second
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// Signs the request with AWS signature version 4
+func (s *S3AuditSink) sign(request *http.Request, payload []byte, now time.Time) {
+	payloadHash := sha256.Sum256(payload)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	request.Header.Set("host", request.URL.Host)
+	request.Header.Set("x-amz-date", amzDate)
+	request.Header.Set("x-amz-content-sha256", hex.EncodeToString(payloadHash[:]))
+	if s.SessionToken != "" {
+		request.Header.Set("x-amz-security-token", s.SessionToken)
+	}
+
+	signedHeaders := []string{"content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	if s.SessionToken != "" {
+		signedHeaders = append(signedHeaders, "x-amz-security-token")
+	}
+	var canonicalHeaders string
+	for _, header := range signedHeaders {
+		canonicalHeaders += header + ":" + strings.TrimSpace(request.Header.Get(header)) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func (s *S3AuditSink) String() string {
+	return "s3 bucket " + s.Bucket
+}
+
+// Sends the entries to all sinks in order, in the background so requests are never delayed
+func (a *AuditLog) runSinks() {
+	for entry := range a.sinkQueue {
+		record, err := json.Marshal(AuditRecord{Schema: AuditSchema, AuditEntry: entry})
+		if err != nil {
+			globalLogger.Error(fmt.Sprintf("Could not encode audit entry %s: %s", entry.ID, err))
+			continue
+		}
+
+		for _, sink := range a.Sinks {
+			// Retry a few times, the sink may be briefly unavailable
+			for attempt := 1; ; attempt++ {
+				err := sink.Send(record, entry)
+				if err == nil {
+					break
+				}
+				if attempt == 3 {
+					globalLogger.Error(fmt.Sprintf("Could not send audit entry %s to %s: %s", entry.ID, sink, err))
+					break
+				}
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+		}
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("the kubernetes api is unavailable")
+
+var circuitOpenGauge = NewGaugeVec("kicd_kube_circuit_open", "Whether deploys to a cluster are paused because its kubernetes api is failing.", "cluster")
+
+// Consecutive failed requests to the kubernetes api of a cluster which open its circuit, 0 disables the breaker
+var kubeCircuitThreshold = 5
+
+// Time after which an open circuit lets a request through to check whether the api recovered
+var kubeCircuitCooldown = 30 * time.Second
+
+// CircuitBreaker stops requests to the kubernetes api of a cluster after consecutive failures, so an
+// outage of the api server doesn't burn the retries of deploys. While the circuit is open, requests
+// fail immediately, new webhooks are answered with 503 and queued deploys wait. After the cooldown
+// a single request is let through and closes the circuit again if it succeeds.
+type CircuitBreaker struct {
+	Cluster   string
+	Threshold int
+	Cooldown  time.Duration
+	// Request checking whether the api recovered, sent after each cooldown while open
+	Probe func() error
+
+	mutex    sync.Mutex
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// Returns whether the circuit is open
+func (b *CircuitBreaker) Open() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return !b.openedAt.IsZero()
+}
+
+// Returns whether a request may be sent, letting one request through after each cooldown while open
+func (b *CircuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if b.openedAt.IsZero() {
+		return true
+	}
+	if b.probing || time.Since(b.openedAt) < b.Cooldown {
+		return false
+	}
+	b.probing = true
+
+	return true
+}
+
+// Records the outcome of a request, opening or closing the circuit
+func (b *CircuitBreaker) record(failed bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	wasOpen := !b.openedAt.IsZero()
+	b.probing = false
+	if !failed {
+		b.failures = 0
+		b.openedAt = time.Time{}
+		if wasOpen {
+			b.closed()
+		}
+		return
+	}
+
+	b.failures++
+	if wasOpen {
+		b.openedAt = time.Now()
+	} else if b.failures >= b.Threshold {
+		b.openedAt = time.Now()
+		b.opened()
+	}
+}
+
+// Lets the next request through after a request whose outcome says nothing about the api
+func (b *CircuitBreaker) release() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.probing = false
+}
+
+func (b *CircuitBreaker) opened() {
+	text := fmt.Sprintf("The kubernetes api of cluster %s failed %d times in a row, deploys to it are paused until it recovers", b.Cluster, b.failures)
+	globalLogger.Error(text)
+	circuitOpenGauge.Set(1, b.Cluster)
+	go Notify(context.Background(), Notification{Type: NotificationAPIUnavailable, Text: text})
+	go b.probe()
+}
+
+func (b *CircuitBreaker) closed() {
+	text := fmt.Sprintf("The kubernetes api of cluster %s recovered, deploys to it resume", b.Cluster)
+	globalLogger.Info(text)
+	circuitOpenGauge.Set(0, b.Cluster)
+	go Notify(context.Background(), Notification{Type: NotificationAPIRecovered, Text: text})
+}
+
+// Checks after each cooldown whether the api recovered, also if no deploy sends a request
+func (b *CircuitBreaker) probe() {
+	for b.Open() {
+		time.Sleep(b.Cooldown)
+		if b.Probe != nil {
+			b.Probe()
+		}
+	}
+}
+
+// Returns a round tripper counting failed requests and failing requests while the circuit is open.
+// Watches are long-running and retried by their informers, so they are neither blocked nor counted.
+func (b *CircuitBreaker) wrap(next http.RoundTripper) http.RoundTripper {
+	return &circuitBreakerTransport{next: next, breaker: b}
+}
+
+type circuitBreakerTransport struct {
+	next    http.RoundTripper
+	breaker *CircuitBreaker
+}
+
+func (t *circuitBreakerTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Query().Get("watch") == "true" {
+		return t.next.RoundTrip(request)
+	}
+	if !t.breaker.allow() {
+		return nil, errCircuitOpen
+	}
+
+	response, err := t.next.RoundTrip(request)
+	if err != nil && errors.Is(request.Context().Err(), context.Canceled) {
+		// Canceled by the caller, which says nothing about the api
+		t.breaker.release()
+		return response, err
+	}
+	t.breaker.record(err != nil || response.StatusCode == http.StatusBadGateway || response.StatusCode == http.StatusServiceUnavailable || response.StatusCode == http.StatusGatewayTimeout)
+
+	return response, err
+}
+
+// Returns the names of the clusters whose circuit is open
+func OpenCircuits() []string {
+	var open []string
+	for _, cluster := range AllClusters() {
+		if cluster.Breaker != nil && cluster.Breaker.Open() {
+			open = append(open, cluster.Breaker.Cluster)
+		}
+	}
+	sort.Strings(open)
+
+	return open
+}
+
+// Waits until the circuits of all clusters are closed
+func waitForCircuits() {
+	for len(OpenCircuits()) > 0 {
+		time.Sleep(time.Second)
+	}
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/flowcontrol"
+	"k8s.io/client-go/util/retry"
+)
+
+// Name of the cluster this controller runs in (or of its kubeconfig) in the clusters of config targets.
+// Targets of the local cluster have an empty cluster.
+const LocalClusterName = "local"
+
+const DefaultClusterSecretKey = "kubeconfig"
+
+// ClusterConfig is an additional cluster reached with a kubeconfig stored in a secret of the local cluster
+type ClusterConfig struct {
+	Name string `json:"name"`
+	// Secret holding the kubeconfig, in SECRET_NAMESPACE if no namespace is set
+	SecretName      string `json:"secretName"`
+	SecretNamespace string `json:"secretNamespace,omitempty"`
+	// Key of the kubeconfig in the secret, kubeconfig by default
+	Key string `json:"key,omitempty"`
+	// Context of the kubeconfig, its current context by default
+	Context string `json:"context,omitempty"`
+	// Rate limits and concurrent requests of the cluster, KUBE_QPS, KUBE_BURST and
+	// KUBE_MAX_CONCURRENT_REQUESTS by default
+	QPS                   float32 `json:"qps,omitempty"`
+	Burst                 int     `json:"burst,omitempty"`
+	MaxConcurrentRequests int     `json:"maxConcurrentRequests,omitempty"`
+}
+
+func (c ClusterConfig) validate() error {
+	if c.Name == "" {
+		return errors.New("name is required")
+	}
+	if c.Name == LocalClusterName {
+		return fmt.Errorf("%s is the name of the local cluster", LocalClusterName)
+	}
+	if c.SecretName == "" {
+		return errors.New("secretName is required")
+	}
+	if c.QPS < 0 || c.Burst < 0 || c.MaxConcurrentRequests < 0 {
+		return errors.New("qps, burst and maxConcurrentRequests must not be negative")
+	}
+
+	return nil
+}
+
+// Deadline of a single operation on the kubernetes api of any cluster
+var kubeTimeout = 30 * time.Second
+
+// Backoff of retried conflicting updates of kubernetes objects
+var kubeRetry = retry.DefaultRetry
+
+// Client side rate limit of the kubernetes api of each cluster, the defaults of client-go
+var kubeQPS float32 = 5
+var kubeBurst = 10
+
+// Maximum concurrent requests to the kubernetes api of each cluster, not counting watches. 0 is unlimited.
+var kubeMaxConcurrentRequests = 0
+
+// Limits the requests of all clients created from the config with a shared rate limiter and at
+// most the given number of concurrent requests, falling back to the global settings for zeros
+func LimitRequests(config *rest.Config, qps float32, burst int, maxConcurrentRequests int) {
+	if qps == 0 {
+		qps = kubeQPS
+	}
+	if burst == 0 {
+		burst = kubeBurst
+	}
+	if maxConcurrentRequests == 0 {
+		maxConcurrentRequests = kubeMaxConcurrentRequests
+	}
+	config.QPS = qps
+	config.Burst = burst
+	config.RateLimiter = flowcontrol.NewTokenBucketRateLimiter(qps, burst)
+	if maxConcurrentRequests > 0 {
+		slots := make(chan struct{}, maxConcurrentRequests)
+		config.Wrap(func(next http.RoundTripper) http.RoundTripper {
+			return &concurrencyLimiter{next: next, slots: slots}
+		})
+	}
+}
+
+// Round tripper waiting for a free slot before sending requests other than long-running watches
+type concurrencyLimiter struct {
+	next  http.RoundTripper
+	slots chan struct{}
+}
+
+func (l *concurrencyLimiter) RoundTrip(request *http.Request) (*http.Response, error) {
+	if request.URL.Query().Get("watch") == "true" {
+		return l.next.RoundTrip(request)
+	}
+	select {
+	case l.slots <- struct{}{}:
+	case <-request.Context().Done():
+		return nil, request.Context().Err()
+	}
+	defer func() { <-l.slots }()
+
+	return l.next.RoundTrip(request)
+}
+
+// Returns the context of an operation on the kubernetes api, which ends after KUBE_TIMEOUT at the latest
+func apiContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(ctx, kubeTimeout)
+}
+
+// Cluster is a kubernetes cluster workloads are deployed to
+type Cluster struct {
+	Name string
+	// Config of the clients, e.g. for the workload cache
+	Config  *rest.Config
+	Kube    kubernetes.Interface
+	Dynamic dynamic.Interface
+	// Cached deployments and stateful sets, nil if they are listed on every request
+	Workloads *WorkloadCache
+	// Breaker of the kubernetes api, nil if disabled
+	Breaker *CircuitBreaker
+}
+
+// Clusters by name, the local cluster with an empty name
+var clusters = make(map[string]*Cluster)
+
+// Creates the clients of a cluster, whose requests pass its circuit breaker unless it is disabled
+func NewCluster(name string, config *rest.Config) (*Cluster, error) {
+	cluster := &Cluster{Name: name, Config: config}
+	if kubeCircuitThreshold > 0 {
+		breakerName := name
+		if breakerName == "" {
+			breakerName = LocalClusterName
+		}
+		cluster.Breaker = &CircuitBreaker{Cluster: breakerName, Threshold: kubeCircuitThreshold, Cooldown: kubeCircuitCooldown}
+		cluster.Config = rest.CopyConfig(config)
+		cluster.Config.Wrap(cluster.Breaker.wrap)
+	}
+
+	var err error
+	if cluster.Kube, err = kubernetes.NewForConfig(cluster.Config); err != nil {
+		return nil, err
+	}
+	if cluster.Dynamic, err = dynamic.NewForConfig(cluster.Config); err != nil {
+		return nil, err
+	}
+	if cluster.Breaker != nil {
+		cluster.Breaker.Probe = func() error {
+			ctx, cancel := apiContext(context.Background())
+			defer cancel()
+			_, err := cluster.Kube.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+			return err
+		}
+	}
+
+	return cluster, nil
+}
+
+// Loads the kubeconfigs of the configured clusters from their secrets and registers the clusters
+func LoadClusters(configs []ClusterConfig, defaultNamespace string) error {
+	for _, clusterConfig := range configs {
+		namespace := clusterConfig.SecretNamespace
+		if namespace == "" {
+			namespace = defaultNamespace
+		}
+		key := clusterConfig.Key
+		if key == "" {
+			key = DefaultClusterSecretKey
+		}
+
+		ctx, cancel := apiContext(context.Background())
+		secret, err := kubeSet.CoreV1().Secrets(namespace).Get(ctx, clusterConfig.SecretName, metav1.GetOptions{})
+		cancel()
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", clusterConfig.Name, err)
+		}
+		kubeconfig, ok := secret.Data[key]
+		if !ok {
+			return fmt.Errorf("cluster %s: secret %s has no key %s", clusterConfig.Name, clusterConfig.SecretName, key)
+		}
+		apiConfig, err := clientcmd.Load(kubeconfig)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", clusterConfig.Name, err)
+		}
+		config, err := clientcmd.NewNonInteractiveClientConfig(*apiConfig, clusterConfig.Context, &clientcmd.ConfigOverrides{}, nil).ClientConfig()
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", clusterConfig.Name, err)
+		}
+
+		LimitRequests(config, clusterConfig.QPS, clusterConfig.Burst, clusterConfig.MaxConcurrentRequests)
+		cluster, err := NewCluster(clusterConfig.Name, config)
+		if err != nil {
+			return fmt.Errorf("cluster %s: %s", clusterConfig.Name, err)
+		}
+		clusters[cluster.Name] = cluster
+		globalLogger.Info(fmt.Sprintf("Loaded cluster %s (%s)", cluster.Name, config.Host))
+	}
+
+	return nil
+}
+
+// Returns the cluster of the given name, where an empty name or local is the local cluster
+func ClusterFor(name string) (*Cluster, error) {
+	if name == LocalClusterName {
+		name = ""
+	}
+	cluster, ok := clusters[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %s", name)
+	}
+
+	return cluster, nil
+}
+
+// Returns all clusters, the local cluster first
+func AllClusters() []*Cluster {
+	var all []*Cluster
+	for _, cluster := range clusters {
+		all = append(all, cluster)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Name < all[j].Name
+	})
+
+	return all
+}
@@ -0,0 +1,461 @@
+// kicd is the companion CLI of kubernetes-internal-cd. It sends signed deploy requests from CI
+// pipelines and queries the status, targets and rollbacks of the controller.
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const usage = `kicd is the companion CLI of kubernetes-internal-cd.
+
+Usage:
+  kicd deploy    Send a signed deploy request (webhook)
+  kicd status    Show (or wait for) the deploy status of a repository
+  kicd targets   List the targets of the controller (admin api)
+  kicd rollback  Roll a workload back to a sha of its history (admin api)
+  kicd redeliver Deploy a recent delivery again (admin api)
+  kicd config    Export or import the target mappings as yaml (admin api)
+
+Run kicd <command> -h for the flags of a command. Flags default to the environment variables
+KICD_URL, KICD_KEY, KICD_MASTER_KEY, KICD_PRODUCTION_KEY and KICD_TOKEN.
+`
+
+type messageGithub struct {
+	Sha             string `json:"sha"`
+	Repository      string `json:"repository"`
+	Ref             string `json:"ref"`
+	DefaultBranch   string `json:"default_branch,omitempty"`
+	CommitTimestamp int64  `json:"commit_timestamp,omitempty"`
+	Message         string `json:"message,omitempty"`
+	Author          string `json:"author,omitempty"`
+	Before          string `json:"before,omitempty"`
+}
+
+type messageData struct {
+	Github    messageGithub `json:"github"`
+	Image     string        `json:"image"`
+	Provider  string        `json:"provider,omitempty"`
+	Timestamp int64         `json:"timestamp"`
+	Nonce     string        `json:"nonce"`
+}
+
+type message struct {
+	Data messageData `json:"data"`
+}
+
+// Version 2 payload, sent for tags and metadata, or version 3 with the commit message, author or before
+type messageV2 struct {
+	Version         int               `json:"version"`
+	Repository      string            `json:"repository"`
+	Provider        string            `json:"provider,omitempty"`
+	Ref             string            `json:"ref"`
+	DefaultBranch   string            `json:"defaultBranch,omitempty"`
+	Sha             string            `json:"sha"`
+	Image           string            `json:"image"`
+	Tag             string            `json:"tag,omitempty"`
+	CommitTimestamp int64             `json:"commitTimestamp,omitempty"`
+	Timestamp       int64             `json:"timestamp"`
+	Nonce           string            `json:"nonce"`
+	Metadata        map[string]string `json:"metadata,omitempty"`
+	CommitMessage   string            `json:"commitMessage,omitempty"`
+	CommitAuthor    string            `json:"commitAuthor,omitempty"`
+	Before          string            `json:"before,omitempty"`
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "deploy":
+		err = deploy(os.Args[2:])
+	case "status":
+		err = status(os.Args[2:])
+	case "targets":
+		err = targets(os.Args[2:])
+	case "rollback":
+		err = rollback(os.Args[2:])
+	case "redeliver":
+		err = redeliver(os.Args[2:])
+	case "config":
+		err = config(os.Args[2:])
+	case "-h", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %s\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+// Flags shared by all commands
+type client struct {
+	url   string
+	token string
+}
+
+func (c *client) register(flags *flag.FlagSet) {
+	flags.StringVar(&c.url, "url", os.Getenv("KICD_URL"), "url of kubernetes-internal-cd, e.g. https://cd.example.com")
+	flags.StringVar(&c.token, "token", os.Getenv("KICD_TOKEN"), "bearer token, the admin token or a token accepted for the repository")
+}
+
+// Sends the request and returns the response body, failing on non 2xx responses
+func (c *client) do(method string, path string, body []byte, header http.Header) ([]byte, error) {
+	if c.url == "" {
+		return nil, errors.New("-url or KICD_URL is required")
+	}
+	request, err := http.NewRequest(method, strings.TrimRight(c.url, "/")+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if body != nil && request.Header.Get("content-type") == "" {
+		request.Header.Set("content-type", "application/json")
+	}
+	if c.token != "" {
+		request.Header.Set("authorization", "Bearer "+c.token)
+	}
+
+	httpClient := http.Client{Timeout: 2 * time.Minute}
+	response, err := httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: status %d: %s", method, path, response.StatusCode, strings.TrimSpace(string(responseBody)))
+	}
+
+	return responseBody, nil
+}
+
+// Prints the json response indented
+func printJSON(body []byte) error {
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return err
+	}
+	fmt.Println(indented.String())
+
+	return nil
+}
+
+// Returns the "sha256=..." signature of the payload like x-hub-signature-256
+func signature256(payload []byte, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(payload)
+
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Returns the signing key of the repository derived from the master key, hex(hmac_sha1(master_key, repository))
+func deriveKey(masterKey string, repository string) string {
+	h := hmac.New(sha1.New, []byte(masterKey))
+	h.Write([]byte(repository))
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func randomNonce() (string, error) {
+	bytes := make([]byte, 16)
+	if _, err := rand.Read(bytes); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(bytes), nil
+}
+
+func deploy(args []string) error {
+	flags := flag.NewFlagSet("deploy", flag.ExitOnError)
+	var c client
+	c.register(flags)
+	repository := flags.String("repository", os.Getenv("GITHUB_REPOSITORY"), "repository as <owner>/<repository>")
+	sha := flags.String("sha", os.Getenv("GITHUB_SHA"), "sha of the commit, the tag of the image")
+	ref := flags.String("ref", os.Getenv("GITHUB_REF"), "pushed ref, e.g. refs/heads/main")
+	defaultBranch := flags.String("default-branch", "", "default branch of the repository")
+	image := flags.String("image", "", "image without tag, e.g. ghcr.io/owner/repository")
+	provider := flags.String("provider", "", "git provider of the repository, github (default) or gitlab")
+	commitTime := flags.Int64("commit-timestamp", 0, "unix seconds of the commit, to measure the lead time")
+	key := flags.String("key", os.Getenv("KICD_KEY"), "signing key of the repository (or shared secret)")
+	masterKey := flags.String("master-key", os.Getenv("KICD_MASTER_KEY"), "master key to derive the signing key of the repository from")
+	productionKey := flags.String("production-key", os.Getenv("KICD_PRODUCTION_KEY"), "optional production key for protected namespaces")
+	path := flags.String("path", os.Getenv("KICD_WEBHOOK_PATH"), "webhook endpoint of the controller, / by default")
+	tag := flags.String("tag", "", "tag of the image if it is not the sha (sends a version 2 payload)")
+	metadata := flags.String("metadata", "", "comma separated key=value metadata of the deploy (sends a version 2 payload)")
+	commitMessage := flags.String("message", "", "message of the commit, shown in notifications")
+	commitAuthor := flags.String("author", "", "author of the commit, shown in notifications")
+	before := flags.String("before", "", "sha the branch pointed to before the push, to link the changes in notifications")
+	flags.Parse(args)
+
+	if *repository == "" || *sha == "" || *ref == "" || *image == "" {
+		return errors.New("-repository, -sha, -ref and -image are required")
+	}
+	if *path == "" {
+		*path = "/"
+	}
+	signingKey := *key
+	if signingKey == "" && *masterKey != "" {
+		signingKey = deriveKey(*masterKey, *repository)
+	}
+	if signingKey == "" && c.token == "" {
+		return errors.New("-key, -master-key or -token is required")
+	}
+
+	nonce, err := randomNonce()
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	if *tag != "" || *metadata != "" {
+		v2 := messageV2{Version: 2, Repository: *repository, Provider: *provider, Ref: *ref, DefaultBranch: *defaultBranch, Sha: *sha, Image: *image, Tag: *tag, CommitTimestamp: *commitTime, Timestamp: time.Now().Unix(), Nonce: nonce}
+		// Version 2 rejects the commit fields
+		if *commitMessage != "" || *commitAuthor != "" || *before != "" {
+			v2.Version, v2.CommitMessage, v2.CommitAuthor, v2.Before = 3, *commitMessage, *commitAuthor, *before
+		}
+		for _, entry := range strings.Split(*metadata, ",") {
+			if entry = strings.TrimSpace(entry); entry == "" {
+				continue
+			}
+			values := strings.SplitN(entry, "=", 2)
+			if len(values) != 2 {
+				return fmt.Errorf("metadata %q must be key=value", entry)
+			}
+			if v2.Metadata == nil {
+				v2.Metadata = make(map[string]string)
+			}
+			v2.Metadata[values[0]] = values[1]
+		}
+		payload, err = json.Marshal(v2)
+	} else {
+		payload, err = json.Marshal(message{Data: messageData{
+			Github:    messageGithub{Sha: *sha, Repository: *repository, Ref: *ref, DefaultBranch: *defaultBranch, CommitTimestamp: *commitTime, Message: *commitMessage, Author: *commitAuthor, Before: *before},
+			Image:     *image,
+			Provider:  *provider,
+			Timestamp: time.Now().Unix(),
+			Nonce:     nonce,
+		}})
+	}
+	if err != nil {
+		return err
+	}
+
+	header := http.Header{}
+	if signingKey != "" {
+		header.Set("x-hub-signature-256", signature256(payload, []byte(signingKey)))
+		// Tokens take precedence over signatures
+		c.token = ""
+	}
+	if *productionKey != "" {
+		header.Set("x-production-signature-256", signature256(payload, []byte(*productionKey)))
+	}
+
+	body, err := c.do(http.MethodPost, *path, payload, header)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(body)
+}
+
+func status(args []string) error {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	var c client
+	c.register(flags)
+	repository := flags.String("repository", os.Getenv("GITHUB_REPOSITORY"), "repository as <owner>/<repository>")
+	sha := flags.String("sha", "", "optional sha the targets must run")
+	wait := flags.Duration("wait", 0, "wait up to this duration until the rollout completed, e.g. 10m")
+	flags.Parse(args)
+
+	if *repository == "" {
+		return errors.New("-repository is required")
+	}
+	path := "/status/" + *repository
+	if *sha != "" {
+		path += "?sha=" + url.QueryEscape(*sha)
+	}
+
+	deadline := time.Now().Add(*wait)
+	for {
+		body, err := c.do(http.MethodGet, path, nil, nil)
+		if err != nil {
+			return err
+		}
+		var result struct {
+			State string `json:"state"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return err
+		}
+
+		if *wait == 0 || result.State == "complete" || result.State == "failed" || time.Now().After(deadline) {
+			if err := printJSON(body); err != nil {
+				return err
+			}
+			if *wait > 0 && result.State != "complete" {
+				return fmt.Errorf("rollout is %s", result.State)
+			}
+			return nil
+		}
+
+		fmt.Fprintf(os.Stderr, "rollout is %s, waiting...\n", result.State)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func targets(args []string) error {
+	flags := flag.NewFlagSet("targets", flag.ExitOnError)
+	var c client
+	c.register(flags)
+	repository := flags.String("repository", "", "only targets of the repository")
+	namespace := flags.String("namespace", "", "only targets in the namespace")
+	cluster := flags.String("cluster", "", "only targets of the cluster, local for the cluster of the controller")
+	flags.Parse(args)
+
+	query := url.Values{}
+	if *repository != "" {
+		query.Set("repository", *repository)
+	}
+	if *namespace != "" {
+		query.Set("namespace", *namespace)
+	}
+	if *cluster != "" {
+		query.Set("cluster", *cluster)
+	}
+
+	body, err := c.do(http.MethodGet, "/admin/targets?"+query.Encode(), nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(body)
+}
+
+func rollback(args []string) error {
+	flags := flag.NewFlagSet("rollback", flag.ExitOnError)
+	var c client
+	c.register(flags)
+	kind := flags.String("kind", "deployment", "kind of the workload, deployment or statefulSet")
+	namespace := flags.String("namespace", "", "namespace of the workload")
+	name := flags.String("name", "", "name of the workload")
+	sha := flags.String("sha", "", "sha of a successful deploy in the history of the workload")
+	container := flags.Int("container", -1, "container position, if the workload is mapped more than once")
+	cluster := flags.String("cluster", "", "cluster of the workload, the cluster of the controller by default")
+	force := flags.Bool("force", false, "roll back even if deploys of the workload are paused")
+	flags.Parse(args)
+
+	if *namespace == "" || *name == "" || *sha == "" {
+		return errors.New("-namespace, -name and -sha are required")
+	}
+	request := map[string]interface{}{"kind": *kind, "namespace": *namespace, "name": *name, "sha": *sha}
+	if *container >= 0 {
+		request["container"] = *container
+	}
+	if *cluster != "" {
+		request["cluster"] = *cluster
+	}
+	if *force {
+		request["force"] = true
+	}
+	payload, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	body, err := c.do(http.MethodPost, "/admin/rollback", payload, nil)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(body)
+}
+
+func redeliver(args []string) error {
+	flags := flag.NewFlagSet("redeliver", flag.ExitOnError)
+	var c client
+	c.register(flags)
+	delivery := flags.String("delivery", "", "audit or request ID of the delivery")
+	flags.Parse(args)
+
+	if *delivery == "" {
+		return errors.New("-delivery is required")
+	}
+
+	body, err := c.do(http.MethodPost, "/admin/deliveries/"+url.PathEscape(*delivery)+"/redeliver", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(body)
+}
+
+func config(args []string) error {
+	if len(args) < 1 || (args[0] != "export" && args[0] != "import") {
+		return errors.New("usage: kicd config export|import [flags]")
+	}
+
+	flags := flag.NewFlagSet("config "+args[0], flag.ExitOnError)
+	var c client
+	c.register(flags)
+	file := flags.String("file", "", "yaml file of the target mappings, written by export (stdout by default) and read by import")
+	dryRun := flags.Bool("dry-run", false, "only validate the imported target mappings")
+	flags.Parse(args[1:])
+
+	if args[0] == "export" {
+		body, err := c.do(http.MethodGet, "/admin/config", nil, nil)
+		if err != nil {
+			return err
+		}
+		if *file == "" {
+			_, err = os.Stdout.Write(body)
+			return err
+		}
+
+		return ioutil.WriteFile(*file, body, 0644)
+	}
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+	payload, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return err
+	}
+	path := "/admin/config"
+	if *dryRun {
+		path += "?dryRun=true"
+	}
+
+	body, err := c.do(http.MethodPut, path, payload, http.Header{"Content-Type": {"application/yaml"}})
+	if err != nil {
+		return err
+	}
+
+	return printJSON(body)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+// Returns the annotation key holding the sha of the commit a workload and its pods run
+func CommitShaAnnotationKey() string {
+	return labelPrefix + "commit-sha"
+}
+
+// Returns the annotation key holding the branch of the deployed commit
+func CommitBranchAnnotationKey() string {
+	return labelPrefix + "commit-branch"
+}
+
+// Returns the annotation key holding the repository of the deployed commit
+func CommitRepositoryAnnotationKey() string {
+	return labelPrefix + "commit-repository"
+}
+
+// Returns the annotation key holding the time of the deploy
+func DeployedAtAnnotationKey() string {
+	return labelPrefix + "deployed-at"
+}
+
+// Returns the annotation key holding the ID of the audit entry of the deploy
+func DeliveryAnnotationKey() string {
+	return labelPrefix + "delivery"
+}
+
+// Returns the annotations describing the commit of the event, set on the workload and its pod
+// template with the image. Unknown values are empty so they don't describe a previous deploy.
+func CommitAnnotations(event DeployEvent) map[string]string {
+	return map[string]string{
+		CommitShaAnnotationKey():        event.Sha,
+		CommitBranchAnnotationKey():     event.Branch,
+		CommitRepositoryAnnotationKey(): event.Repository,
+		DeployedAtAnnotationKey():       time.Now().UTC().Format(time.RFC3339),
+		DeliveryAnnotationKey():         event.Delivery,
+	}
+}
+
+// Returns json patch operations setting the annotations of the object at the path with the existing
+// annotations, adding the whole annotations object if the object has none
+func annotationOperations(path string, existing map[string]string, annotations map[string]string) []map[string]interface{} {
+	if len(annotations) == 0 {
+		return nil
+	}
+	if existing == nil {
+		return []map[string]interface{}{{"op": "add", "path": path + "/annotations", "value": annotations}}
+	}
+
+	escaper := strings.NewReplacer("~", "~0", "/", "~1")
+	var operations []map[string]interface{}
+	for key, value := range annotations {
+		operations = append(operations, map[string]interface{}{"op": "add", "path": path + "/annotations/" + escaper.Replace(key), "value": value})
+	}
+
+	return operations
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+type TargetConfig struct {
+	Repository string `json:"repository"`
+	Branch     string `json:"branch,omitempty"`
+	Namespace  string `json:"namespace,omitempty"`
+	Selector   string `json:"selector"`
+	Container  int    `json:"container"`
+	// Deployment stage of the target, e.g. dev, staging or prod
+	Environment string `json:"environment,omitempty"`
+	// Deploy pushes to the default branch of the repository if no branch is set
+	DefaultBranch bool `json:"defaultBranch,omitempty"`
+	// Email recipients of notifications about the matched workloads
+	Email []string `json:"email,omitempty"`
+	// Slack channel of notifications about the matched workloads
+	SlackChannel string `json:"slackChannel,omitempty"`
+	// Clusters the selector is matched in, only the local cluster if empty
+	Clusters []string `json:"clusters,omitempty"`
+}
+
+type Config struct {
+	Targets []TargetConfig `json:"targets"`
+	Owners  []OwnerConfig  `json:"owners,omitempty"`
+	// Generic webhook notifiers
+	Webhooks []WebhookConfig `json:"webhooks,omitempty"`
+	// Slack channels or webhooks of notifications by namespace
+	SlackRoutes []SlackRoute `json:"slackRoutes,omitempty"`
+	// Additional clusters with their kubeconfigs stored in secrets
+	Clusters []ClusterConfig `json:"clusters,omitempty"`
+	// Additional webhook endpoints besides WEBHOOK_PATH
+	Endpoints []EndpointConfig `json:"endpoints,omitempty"`
+}
+
+// Load the target mapping configuration from the given yaml (or json) file
+func LoadConfig(path string) (*Config, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := yaml.Unmarshal(bytes, &config); err != nil {
+		return nil, err
+	}
+
+	for i, cluster := range config.Clusters {
+		if err := cluster.validate(); err != nil {
+			return nil, fmt.Errorf("cluster %d: %s", i, err)
+		}
+	}
+	if err := validateTargets(config.Targets, config.Clusters); err != nil {
+		return nil, err
+	}
+
+	for i, owner := range config.Owners {
+		if err := owner.validate(); err != nil {
+			return nil, fmt.Errorf("owner %d: %s", i, err)
+		}
+	}
+
+	for i, route := range config.SlackRoutes {
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("slack route %d: %s", i, err)
+		}
+	}
+
+	for i, endpoint := range config.Endpoints {
+		if err := endpoint.validate(); err != nil {
+			return nil, fmt.Errorf("endpoint %d: %s", i, err)
+		}
+	}
+
+	for i, webhook := range config.Webhooks {
+		if err := webhook.validate(); err != nil {
+			return nil, fmt.Errorf("webhook %d: %s", i, err)
+		}
+	}
+
+	return &config, nil
+}
+
+// Validates the target mappings, which may only use the given clusters
+func validateTargets(targets []TargetConfig, clusters []ClusterConfig) error {
+	clusterNames := map[string]bool{LocalClusterName: true}
+	for i, cluster := range clusters {
+		if clusterNames[cluster.Name] {
+			return fmt.Errorf("cluster %d: duplicate name %s", i, cluster.Name)
+		}
+		clusterNames[cluster.Name] = true
+	}
+
+	for i, target := range targets {
+		if target.Repository == "" {
+			return fmt.Errorf("target %d: repository is required", i)
+		}
+		if target.Branch == "" && !target.DefaultBranch {
+			return fmt.Errorf("target %d: either branch or defaultBranch is required", i)
+		}
+		if target.Branch != "" && target.DefaultBranch {
+			return fmt.Errorf("target %d: branch and defaultBranch are mutually exclusive", i)
+		}
+		if strings.TrimSpace(target.Selector) == "" {
+			return fmt.Errorf("target %d: selector is required", i)
+		}
+		if _, err := labels.Parse(target.Selector); err != nil {
+			return fmt.Errorf("target %d: invalid selector %q: %s", i, target.Selector, err)
+		}
+		if target.Container < 0 {
+			return fmt.Errorf("target %d: container position must not be negative", i)
+		}
+		for _, cluster := range target.Clusters {
+			if !clusterNames[cluster] {
+				return fmt.Errorf("target %d: unknown cluster %s", i, cluster)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Returns the Target for a workload of the cluster matched by this configuration
+func (t TargetConfig) Target(cluster string, kind string, meta metav1.ObjectMeta) Target {
+	return Target{
+		Kind:              kind,
+		Name:              meta.Name,
+		Namespace:         meta.Namespace,
+		ContainerPosition: t.Container,
+		Environment:       t.Environment,
+		Email:             strings.Join(t.Email, ","),
+		SlackChannel:      t.SlackChannel,
+		Cluster:           cluster,
+		Paused:            meta.Annotations[PausedAnnotationKey()],
+	}
+}
+
+// Returns the names of the clusters of this configuration, where the local cluster is empty
+func (t TargetConfig) TargetClusters() []string {
+	if len(t.Clusters) == 0 {
+		return []string{""}
+	}
+
+	var names []string
+	for _, cluster := range t.Clusters {
+		if cluster == LocalClusterName {
+			cluster = ""
+		}
+		names = append(names, cluster)
+	}
+
+	return names
+}
+
+// Returns whether a push to the given branch should be deployed to this target
+func (t TargetConfig) MatchesBranch(branch string, isDefaultBranch bool) bool {
+	if t.DefaultBranch {
+		return isDefaultBranch
+	}
+	return t.Branch == branch
+}
+
+// Returns all configured targets for the given repository and branch
+func (c *Config) TargetsFor(repository string, branch string, isDefaultBranch bool) []TargetConfig {
+	var targets []TargetConfig
+	if c == nil {
+		return targets
+	}
+
+	for _, target := range c.Targets {
+		if strings.EqualFold(target.Repository, repository) && target.MatchesBranch(branch, isDefaultBranch) {
+			targets = append(targets, target)
+		}
+	}
+
+	return targets
+}
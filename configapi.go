@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/ghodss/yaml"
+)
+
+// TargetMappings is the document exported and imported by the config api
+type TargetMappings struct {
+	Targets []TargetConfig `json:"targets"`
+}
+
+// ConfigImportResponse is the response of an import
+type ConfigImportResponse struct {
+	Targets  int  `json:"targets"`
+	Previous int  `json:"previous"`
+	DryRun   bool `json:"dryRun,omitempty"`
+}
+
+// Serializes imports, readers keep using the config they loaded until the next request
+var configLock sync.Mutex
+
+// Replaces the target mappings of the global config at once, keeping the other sections
+func ImportTargets(targets []TargetConfig) (int, error) {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	var config Config
+	if globalConfig != nil {
+		config = *globalConfig
+	}
+	if err := validateTargets(targets, config.Clusters); err != nil {
+		return 0, err
+	}
+	previous := len(config.Targets)
+	config.Targets = targets
+	globalConfig = &config
+
+	return previous, nil
+}
+
+// Exports the effective target mappings as yaml on GET and replaces them with the posted yaml
+// (or json) mappings on PUT. With dryRun=true the mappings are only validated. Imports are kept
+// in memory, so CONFIG_PATH applies again after a restart.
+func ConfigHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		var mappings TargetMappings
+		if config := globalConfig; config != nil {
+			mappings.Targets = config.Targets
+		}
+		if mappings.Targets == nil {
+			mappings.Targets = []TargetConfig{}
+		}
+		output, err := yaml.Marshal(mappings)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		w.Header().Set("content-type", "application/yaml")
+		w.Write(output)
+	case "PUT":
+		bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+		defer r.Body.Close()
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		var mappings TargetMappings
+		if err := yaml.Unmarshal(bytes, &mappings); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+
+		response := ConfigImportResponse{Targets: len(mappings.Targets), DryRun: r.URL.Query().Get("dryRun") == "true"}
+		if response.DryRun {
+			var clusters []ClusterConfig
+			if config := globalConfig; config != nil {
+				clusters = config.Clusters
+				response.Previous = len(config.Targets)
+			}
+			if err := validateTargets(mappings.Targets, clusters); err != nil {
+				http.Error(w, err.Error(), 400)
+				return
+			}
+			WriteJSON(w, 200, response)
+			return
+		}
+
+		response.Previous, err = ImportTargets(mappings.Targets)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		globalLogger.Info(fmt.Sprintf("Imported %d target mappings replacing %d from %s", response.Targets, response.Previous, ClientIP(r)))
+		WriteJSON(w, 200, response)
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dashboardSessionCookie = "kicd_dashboard_session"
+	dashboardStateCookie   = "kicd_dashboard_state"
+)
+
+// Number of recent deliveries shown on the dashboard
+const dashboardDeliveries = 50
+
+// Dashboard serves an overview of the targets, their rollouts and the recent deliveries to users
+// logging in with the OpenID Connect issuer of the admin api. It is read-only unless rollbacks are allowed.
+type Dashboard struct {
+	// External url of this instance, e.g. https://cd.example.com
+	URL          string
+	ClientSecret string
+	Scopes       []string
+	// Whether users of the admin groups may roll targets back
+	AllowRollback bool
+
+	oidc          *AdminOIDC
+	configuration OIDCConfiguration
+	csrfKey       []byte
+}
+
+func NewDashboard(dashboardURL string, clientSecret string, scopes []string, allowRollback bool) (*Dashboard, error) {
+	if adminOIDC == nil {
+		return nil, errors.New("the dashboard requires ADMIN_OIDC_ISSUER")
+	}
+	if clientSecret == "" {
+		return nil, errors.New("the dashboard requires DASHBOARD_OIDC_CLIENT_SECRET")
+	}
+	if _, err := url.Parse(dashboardURL); err != nil {
+		return nil, err
+	}
+	configuration, err := DiscoverOIDC(adminOIDC.Verifier.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	if configuration.AuthorizationEndpoint == "" || configuration.TokenEndpoint == "" {
+		return nil, errors.New("openid configuration contains no authorization or token endpoint")
+	}
+
+	return &Dashboard{
+		URL:           strings.TrimRight(dashboardURL, "/"),
+		ClientSecret:  clientSecret,
+		Scopes:        scopes,
+		AllowRollback: allowRollback,
+		oidc:          adminOIDC,
+		configuration: configuration,
+		csrfKey:       []byte(randomHex(32)),
+	}, nil
+}
+
+// Registers the handlers of the dashboard under /dashboard/
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/dashboard/", d.PageHandler)
+	mux.HandleFunc("/dashboard/login", d.LoginHandler)
+	mux.HandleFunc("/dashboard/callback", d.CallbackHandler)
+	mux.HandleFunc("/dashboard/logout", d.LogoutHandler)
+	mux.HandleFunc("/dashboard/rollback", d.RollbackHandler)
+}
+
+func (d *Dashboard) redirectURL() string {
+	return d.URL + "/dashboard/callback"
+}
+
+func (d *Dashboard) setCookie(w http.ResponseWriter, name string, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     "/dashboard/",
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(d.URL, "https://"),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// Returns the ID token of the session, or an error if there is no valid session
+func (d *Dashboard) session(r *http.Request) (string, map[string]interface{}, error) {
+	cookie, err := r.Cookie(dashboardSessionCookie)
+	if err != nil {
+		return "", nil, err
+	}
+	claims, err := d.oidc.Verifier.VerifyToken(cookie.Value)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return cookie.Value, claims, nil
+}
+
+// Returns whether the session may roll targets back
+func (d *Dashboard) canRollback(token string) bool {
+	return d.AllowRollback && d.oidc.authorize(token, false) == nil
+}
+
+// Returns the token which rollback requests of the session have to send, so other sites can't trigger them
+func (d *Dashboard) csrfToken(token string) string {
+	return hex.EncodeToString(hmacSHA256(d.csrfKey, token))
+}
+
+// Redirects to the authorization endpoint of the issuer
+func (d *Dashboard) LoginHandler(w http.ResponseWriter, r *http.Request) {
+	state := randomHex(16)
+	d.setCookie(w, dashboardStateCookie, state, 600)
+
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {d.oidc.Verifier.Audience},
+		"redirect_uri":  {d.redirectURL()},
+		"scope":         {strings.Join(d.Scopes, " ")},
+		"state":         {state},
+	}
+	separator := "?"
+	if strings.Contains(d.configuration.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, d.configuration.AuthorizationEndpoint+separator+query.Encode(), 302)
+}
+
+// Exchanges the code of the issuer for an ID token, which becomes the session of members of the admin or read groups
+func (d *Dashboard) CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if errorCode := query.Get("error"); errorCode != "" {
+		http.Error(w, "login failed: "+errorCode+" "+query.Get("error_description"), 401)
+		return
+	}
+	state, err := r.Cookie(dashboardStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.Value), []byte(query.Get("state"))) != 1 {
+		http.Error(w, "invalid login state", 400)
+		return
+	}
+	d.setCookie(w, dashboardStateCookie, "", -1)
+
+	token, err := d.exchange(query.Get("code"))
+	if err != nil {
+		globalLogger.Warning("Dashboard login from " + r.RemoteAddr + " failed: " + err.Error())
+		http.Error(w, "login failed", 401)
+		return
+	}
+	if err := d.oidc.authorize(token, true); err != nil {
+		globalLogger.Warning("Dashboard login from " + r.RemoteAddr + " denied: " + err.Error())
+		http.Error(w, "forbidden", 403)
+		return
+	}
+
+	d.setCookie(w, dashboardSessionCookie, token, 0)
+	http.Redirect(w, r, "/dashboard/", 302)
+}
+
+func (d *Dashboard) exchange(code string) (string, error) {
+	if code == "" {
+		return "", errors.New("no code")
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.PostForm(d.configuration.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {d.redirectURL()},
+		"client_id":     {d.oidc.Verifier.Audience},
+		"client_secret": {d.ClientSecret},
+	})
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %d from the token endpoint", response.StatusCode)
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&tokens); err != nil {
+		return "", err
+	}
+	if tokens.IDToken == "" {
+		return "", errors.New("token response contains no id_token")
+	}
+
+	return tokens.IDToken, nil
+}
+
+func (d *Dashboard) LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	d.setCookie(w, dashboardSessionCookie, "", -1)
+	http.Redirect(w, r, "/dashboard/", 302)
+}
+
+// dashboardTarget is a managed target with the state of its rollout
+type dashboardTarget struct {
+	ManagedTarget
+	Rollout string
+	// Sha of the latest successful deploy before the current one, if it can be rolled back
+	RollbackSha string
+}
+
+type dashboardPage struct {
+	User        string
+	Targets     []dashboardTarget
+	TargetError string
+	Deliveries  []AuditEntry
+	Failures    []AuditEntry
+	CanRollback bool
+	CSRFToken   string
+	DryRun      bool
+}
+
+// Returns the state of a rollout for display
+func rolloutState(complete bool, err error) string {
+	switch {
+	case err != nil:
+		return "failed: " + err.Error()
+	case complete:
+		return "complete"
+	}
+
+	return "progressing"
+}
+
+// Returns the sha of the latest successful deploy of the target other than the current one, from
+// the store or else the history of the listed workload
+func previousSha(ctx context.Context, target ManagedTarget) string {
+	if store == nil {
+		for i := len(target.history) - 1; i >= 0; i-- {
+			if entry := target.history[i]; entry.Outcome == AuditOutcomeSucceeded && entry.Sha != target.Sha {
+				return entry.Sha
+			}
+		}
+		return ""
+	}
+
+	history, err := TargetHistory(ctx, target.Cluster, target.Kind, target.Namespace, target.Name)
+	if err != nil {
+		return ""
+	}
+	for _, entry := range history {
+		if entry.Outcome == AuditOutcomeSucceeded && entry.Sha != target.Sha {
+			return entry.Sha
+		}
+	}
+
+	return ""
+}
+
+// Renders the dashboard, redirecting to the login without a valid session
+func (d *Dashboard) PageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/dashboard/" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	token, claims, err := d.session(r)
+	if err != nil {
+		http.Redirect(w, r, "/dashboard/login", 302)
+		return
+	}
+	if err := d.oidc.authorize(token, true); err != nil {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+
+	page := dashboardPage{CanRollback: d.canRollback(token), DryRun: dryRun}
+	for _, claim := range []string{"email", "preferred_username", "sub"} {
+		if user, ok := claims[claim].(string); ok && user != "" {
+			page.User = user
+			break
+		}
+	}
+	if page.CanRollback {
+		page.CSRFToken = d.csrfToken(token)
+	}
+
+	targets, err := ListManagedTargets(r.Context())
+	if err != nil {
+		page.TargetError = err.Error()
+	}
+	for _, target := range targets {
+		if !NamespaceAllowed(target.Namespace) {
+			continue
+		}
+		entry := dashboardTarget{ManagedTarget: target, Rollout: target.rollout}
+		if page.CanRollback {
+			entry.RollbackSha = previousSha(r.Context(), target)
+		}
+		page.Targets = append(page.Targets, entry)
+	}
+
+	for _, entry := range auditLog.Entries() {
+		if len(page.Deliveries) < dashboardDeliveries {
+			page.Deliveries = append(page.Deliveries, entry)
+		}
+		if entry.Outcome == AuditOutcomeFailed || entry.Outcome == AuditOutcomePartiallyFailed || entry.Outcome == AuditOutcomeError {
+			page.Failures = append(page.Failures, entry)
+		}
+		if len(page.Deliveries) == dashboardDeliveries && len(page.Failures) >= 10 {
+			break
+		}
+	}
+	if len(page.Failures) > 10 {
+		page.Failures = page.Failures[:10]
+	}
+
+	w.Header().Set("content-type", "text/html; charset=utf-8")
+	w.Header().Set("cache-control", "no-store")
+	w.Header().Set("x-frame-options", "DENY")
+	if err := dashboardTemplate.Execute(w, page); err != nil {
+		globalLogger.Error("Could not render the dashboard: " + err.Error())
+	}
+}
+
+// Rolls a target back for sessions of the admin groups, if rollbacks are allowed
+func (d *Dashboard) RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	token, claims, err := d.session(r)
+	if err != nil || !d.canRollback(token) {
+		http.Error(w, "forbidden", 403)
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(r.Header.Get("x-csrf-token")), []byte(d.csrfToken(token))) != 1 {
+		http.Error(w, "invalid csrf token", 403)
+		return
+	}
+
+	subject, _ := claims["sub"].(string)
+	globalLogger.Info(fmt.Sprintf("Dashboard rollback by %s from %s", subject, r.RemoteAddr))
+	RollbackHandler(w, r)
+}
+
+func formatTime(t *time.Time) string {
+	if t == nil || t.IsZero() {
+		return ""
+	}
+
+	return t.UTC().Format("2006-01-02 15:04:05")
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time":        func(t time.Time) string { return formatTime(&t) },
+	"timePointer": formatTime,
+	"tag":         ImageTag,
+	"failed":      func(result TargetResult) bool { return !result.Succeeded() },
+}).Parse(dashboardHTML))
+
+const dashboardHTML = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>kubernetes-internal-cd</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; margin: 2em; color: #24292e; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.2em; margin-top: 2em; }
+table { border-collapse: collapse; width: 100%; font-size: 0.9em; }
+th, td { text-align: left; padding: 0.4em 0.6em; border-bottom: 1px solid #e1e4e8; vertical-align: top; }
+th { background: #f6f8fa; }
+code { font-size: 0.95em; }
+.succeeded, .complete { color: #22863a; }
+.failed, .partially_failed, .error, .rejected { color: #cb2431; }
+.progressing, .no_targets { color: #b08800; }
+.header { display: flex; justify-content: space-between; align-items: baseline; }
+.notice { background: #fff5b1; padding: 0.5em 1em; }
+</style>
+</head>
+<body>
+<div class="header">
+<h1>kubernetes-internal-cd</h1>
+<div>{{.User}} · <a href="/dashboard/logout">Log out</a></div>
+</div>
+{{if .DryRun}}<p class="notice">Dry run: nothing is written to the clusters.</p>{{end}}
+
+<h2>Targets</h2>
+{{if .TargetError}}<p class="failed">Could not list the targets: {{.TargetError}}</p>{{end}}
+<table>
+<tr><th>Cluster</th><th>Namespace</th><th>Workload</th><th>Repository</th><th>Image</th><th>Last deploy</th><th>Rollout</th>{{if .CanRollback}}<th></th>{{end}}</tr>
+{{range .Targets}}
+<tr>
+<td>{{if .Cluster}}{{.Cluster}}{{else}}local{{end}}</td>
+<td>{{.Namespace}}</td>
+<td>{{.Kind}} {{.Name}}{{if .Environment}} ({{.Environment}}){{end}}</td>
+<td>{{.Repository}}{{if .Branch}}@{{.Branch}}{{end}}</td>
+<td><code>{{tag .Image}}</code></td>
+<td>{{timePointer .LastDeployed}} <span class="{{.LastOutcome}}">{{.LastOutcome}}</span></td>
+<td class="{{if eq .Rollout "complete"}}complete{{else if eq .Rollout "progressing"}}progressing{{else}}failed{{end}}">{{.Rollout}}</td>
+{{if $.CanRollback}}<td>{{if .RollbackSha}}<button data-cluster="{{.Cluster}}" data-kind="{{.Kind}}" data-namespace="{{.Namespace}}" data-name="{{.Name}}" data-container="{{.ContainerPosition}}" data-sha="{{.RollbackSha}}" onclick="rollback(this)">Roll back to {{.RollbackSha}}</button>{{end}}</td>{{end}}
+</tr>
+{{else}}
+<tr><td colspan="8">No targets</td></tr>
+{{end}}
+</table>
+
+<h2>Recent failures</h2>
+<table>
+<tr><th>Time</th><th>Repository</th><th>Sha</th><th>Outcome</th><th>Errors</th></tr>
+{{range .Failures}}
+<tr>
+<td>{{time .Time}}</td>
+<td>{{.Repository}}</td>
+<td><code>{{.Sha}}</code></td>
+<td class="{{.Outcome}}">{{.Outcome}}</td>
+<td>{{if .Reason}}{{.Reason}}<br>{{end}}{{range .Targets}}{{if failed .}}{{.Target}}: {{.Error}}<br>{{end}}{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="5">No failures</td></tr>
+{{end}}
+</table>
+
+<h2>Recent deliveries</h2>
+<table>
+<tr><th>Time</th><th>Repository</th><th>Branch</th><th>Sha</th><th>Source</th><th>Outcome</th><th>Targets</th></tr>
+{{range .Deliveries}}
+<tr>
+<td>{{time .Time}}</td>
+<td>{{.Repository}}</td>
+<td>{{.Branch}}</td>
+<td><code>{{.Sha}}</code></td>
+<td>{{.Source}}</td>
+<td class="{{.Outcome}}">{{.Outcome}}{{if .Reason}} ({{.Reason}}){{end}}</td>
+<td>{{range .Targets}}{{.Target}}<br>{{end}}</td>
+</tr>
+{{else}}
+<tr><td colspan="7">No deliveries</td></tr>
+{{end}}
+</table>
+
+{{if .CanRollback}}
+<script>
+function rollback(button) {
+	var data = button.dataset;
+	if (!confirm("Roll " + data.kind + " " + data.name + " in namespace " + data.namespace + " back to " + data.sha + "?")) {
+		return;
+	}
+	fetch("/dashboard/rollback", {
+		method: "POST",
+		credentials: "same-origin",
+		headers: {"content-type": "application/json", "x-csrf-token": "{{.CSRFToken}}"},
+		body: JSON.stringify({cluster: data.cluster, kind: data.kind, namespace: data.namespace, name: data.name, container: Number(data.container), sha: data.sha})
+	}).then(function (response) {
+		return response.text().then(function (text) {
+			alert(response.ok ? "Rolled back" : "Rollback failed: " + text);
+			location.reload();
+		});
+	});
+}
+</script>
+{{end}}
+</body>
+</html>
+`
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const DefaultDatadogSite = "datadoghq.com"
+
+// DatadogNotifier sends an event per completed or failed rollout, tagged with service, env and
+// version so dashboards show deploy markers, and optionally tracks the deployment for DORA metrics
+type DatadogNotifier struct {
+	APIKey string
+	// Site of the account, e.g. datadoghq.eu or us5.datadoghq.com
+	Site string
+	// Whether rollouts are also sent to the deployment tracking of the DORA metrics api
+	DORA bool
+}
+
+// Returns the unified service tags of the target of the notification
+func datadogTags(notification Notification) []string {
+	target := notification.Result.Target
+	tags := []string{
+		"source:kubernetes-internal-cd",
+		"service:" + target.Name,
+		"version:" + ImageTag(notification.Result.Image),
+		"kube_namespace:" + target.Namespace,
+	}
+	if target.Environment != "" {
+		tags = append(tags, "env:"+target.Environment)
+	}
+	if target.Cluster != "" {
+		tags = append(tags, "kube_cluster_name:"+target.Cluster)
+	}
+	if notification.Event.Repository != "" {
+		tags = append(tags, "repository:"+notification.Event.Repository, "branch:"+notification.Event.Branch)
+	}
+
+	return tags
+}
+
+// Returns the url of the repository of the event at its git provider
+func repositoryURL(event DeployEvent) string {
+	if event.Provider == ProviderGitLab {
+		return fmt.Sprintf("%s/%s", gitlabURL, event.Repository)
+	}
+
+	return fmt.Sprintf("%s/%s", githubURL, event.Repository)
+}
+
+func (n *DatadogNotifier) Notify(notification Notification) error {
+	if notification.Result == nil {
+		return nil
+	}
+	target := notification.Result.Target
+	headers := map[string]string{"dd-api-key": n.APIKey}
+
+	title, alertType := fmt.Sprintf("Deployed %s to %s", notification.Result.Image, target), "success"
+	if notification.Type == NotificationRolloutFailed {
+		title, alertType = fmt.Sprintf("Failed to deploy %s to %s", notification.Result.Image, target), "error"
+	}
+	if err := postJSONWithHeaders("https://api."+n.Site+"/api/v1/events", headers, map[string]interface{}{
+		"title":            title,
+		"text":             notificationText(notification),
+		"alert_type":       alertType,
+		"source_type_name": "kubernetes-internal-cd",
+		"aggregation_key":  DedupKey(target),
+		"tags":             datadogTags(notification),
+	}); err != nil {
+		return err
+	}
+	if !n.DORA || notification.Type != NotificationRolloutSucceeded {
+		return nil
+	}
+
+	deployment := map[string]interface{}{
+		"service":     target.Name,
+		"version":     ImageTag(notification.Result.Image),
+		"started_at":  notification.Event.ReceivedAt.UnixNano(),
+		"finished_at": time.Now().UnixNano(),
+	}
+	if target.Environment != "" {
+		deployment["env"] = target.Environment
+	}
+	if notification.Event.Repository != "" && notification.Event.Sha != "" {
+		deployment["git"] = map[string]string{"commit_sha": notification.Event.Sha, "repository_url": repositoryURL(notification.Event)}
+	}
+
+	return postJSONWithHeaders("https://api."+n.Site+"/api/v2/dora/deployment", headers, map[string]interface{}{
+		"data": map[string]interface{}{"attributes": deployment},
+	})
+}
+
+// Validates the api key
+func (n *DatadogNotifier) Check() error {
+	return getURL("https://api."+n.Site+"/api/v1/validate", map[string]string{"dd-api-key": n.APIKey})
+}
+
+func (n *DatadogNotifier) Name() string {
+	return "datadog"
+}
+
+func (n *DatadogNotifier) Types() []string {
+	return []string{NotificationRolloutSucceeded, NotificationRolloutFailed}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var deploysSupersededTotal = NewCounterVec("kicd_deploys_superseded_total", "Pushes which were not deployed because a newer push of the branch arrived within the debounce window.")
+
+// Push waiting for the end of the debounce window of its repository and branch
+type debouncedDeploy struct {
+	ctx   context.Context
+	event DeployEvent
+	audit AuditEntry
+}
+
+// Debouncer coalesces pushes of the same repository and branch arriving within a window after the
+// first one and only deploys the newest, so streaks of commits don't restart workloads for every one
+type Debouncer struct {
+	Window time.Duration
+	// Deploys the newest push of a window
+	Deploy func(ctx context.Context, event DeployEvent, audit AuditEntry)
+
+	lock    sync.Mutex
+	pending map[string]*debouncedDeploy
+}
+
+// Holds the push until the window of its branch passed, superseding a push waiting in that window.
+// Returns errShuttingDown once shutting down.
+func (d *Debouncer) Add(ctx context.Context, event DeployEvent, audit AuditEntry) error {
+	key := strings.ToLower(event.Repository) + " " + event.Branch
+	ctx = detachContext(ctx)
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.pending == nil {
+		d.pending = make(map[string]*debouncedDeploy)
+	}
+
+	if pending, ok := d.pending[key]; ok {
+		superseded := pending.audit
+		superseded.Outcome = AuditOutcomeSuperseded
+		superseded.Reason = fmt.Sprintf("superseded by %s of request %s", event.Sha, event.RequestID)
+		auditLog.Record(superseded)
+		deploysSupersededTotal.Inc()
+		globalLogger.With(LogFields{"requestId": pending.event.RequestID, "repository": event.Repository, "branch": event.Branch}).Info(fmt.Sprintf("Skipping the deploy of %s, superseded by %s", pending.event.Sha, event.Sha))
+
+		pending.ctx, pending.event, pending.audit = ctx, event, audit
+		return nil
+	}
+
+	// Shutdowns wait for the window, so the push isn't lost
+	if !beginDeploy() {
+		return errShuttingDown
+	}
+	d.pending[key] = &debouncedDeploy{ctx: ctx, event: event, audit: audit}
+	time.AfterFunc(d.Window, func() {
+		defer deploysInFlight.Done()
+
+		d.lock.Lock()
+		pending := d.pending[key]
+		delete(d.pending, key)
+		d.lock.Unlock()
+
+		d.Deploy(pending.ctx, pending.event, pending.audit)
+	})
+
+	return nil
+}
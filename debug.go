@@ -0,0 +1,23 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// Serves the pprof handlers on a separate listener which only accepts connections from the loopback interface
+func ServeDebug(port string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	address := net.JoinHostPort("127.0.0.1", port)
+	globalLogger.Info("Debug server listening on " + address)
+	if err := http.ListenAndServe(address, mux); err != nil {
+		globalLogger.Error("Debug server stopped: " + err.Error())
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// Headers included in the summary of a delivery
+var summaryHeaders = []string{"user-agent", "content-type", "content-length", "x-github-event", "x-github-delivery", "x-request-id", "x-forwarded-for", "traceparent"}
+
+// Returns a summary of the request headers without secrets, for debugging deliveries
+func HeaderSummary(r *http.Request) map[string]string {
+	summary := make(map[string]string)
+	for _, header := range summaryHeaders {
+		if value := r.Header.Get(header); value != "" {
+			summary[header] = value
+		}
+	}
+	for header, values := range r.Header {
+		if !IsSensitiveName(header) || len(values) == 0 {
+			continue
+		}
+		// Keep the scheme like "Bearer" or "sha256" to see how the request was authenticated
+		header = strings.ToLower(header)
+		summary[header] = redacted
+		if fields := strings.FieldsFunc(values[0], func(r rune) bool { return r == ' ' || r == '=' }); len(fields) > 1 {
+			summary[header] = fields[0] + " " + redacted
+		}
+	}
+
+	return summary
+}
+
+// Returns the recent deliveries, newest first, like the recent deliveries of GitHub webhooks.
+// /admin/deliveries/<id> returns a single delivery, the list can be filtered and paged like the audit
+// log. POST /admin/deliveries/<id>/redeliver deploys a delivery again.
+func DeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.HasSuffix(r.URL.Path, "/redeliver") {
+		RedeliverHandler(w, r)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	if id := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/deliveries"), "/"); id != "" {
+		for _, entry := range auditLog.Entries() {
+			if entry.ID == id || entry.RequestID == id {
+				WriteJSON(w, 200, entry)
+				return
+			}
+		}
+		http.Error(w, "delivery not found", 404)
+		return
+	}
+
+	query, err := ParseAuditQuery(r.URL.Query(), 50)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	deliveries, next, err := auditLog.Query(query)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	WritePage(w, deliveries, next)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// DeployEvent is a verified request to deploy a new image of a repository branch
+type DeployEvent struct {
+	Repository string `json:"repository"`
+	// Git provider of the repository, empty for github
+	Provider      string    `json:"provider,omitempty"`
+	Branch        string    `json:"branch"`
+	DefaultBranch string    `json:"defaultBranch"`
+	Sha           string    `json:"sha"`
+	Image         string    `json:"image"`
+	Source        string    `json:"source"`
+	ReceivedAt    time.Time `json:"receivedAt"`
+	// Optional time of the commit, to measure the lead time
+	CommitTime time.Time `json:"commitTime,omitempty"`
+	// Optional message and author of the commit, read from the github api if the payload has none
+	CommitMessage string `json:"commitMessage,omitempty"`
+	CommitAuthor  string `json:"commitAuthor,omitempty"`
+	// Optional sha the branch pointed to before the push, the base of compare urls
+	Before string `json:"before,omitempty"`
+	// Whether the request carried a valid production signature for protected namespaces
+	ProductionVerified bool `json:"productionVerified"`
+	// ID of the audit entry of the triggering request
+	Delivery string `json:"delivery,omitempty"`
+	// ID correlating logs, notifications and events of the request
+	RequestID string `json:"requestId,omitempty"`
+	// Metadata of version 2 payloads, e.g. the pipeline of the deploy
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Target rolled back to the image instead of the targets of the repository, set by rollbacks
+	Rollback *Target `json:"rollback,omitempty"`
+	// Whether the rollback also updates a paused target
+	Force bool `json:"force,omitempty"`
+}
+
+// TargetResult is the outcome of updating a single target
+type TargetResult struct {
+	Target        Target `json:"target"`
+	PreviousImage string `json:"previousImage,omitempty"`
+	Image         string `json:"image"`
+	Error         string `json:"error,omitempty"`
+	// Whether the update failed transiently, so the deploy may be retried
+	Retryable bool `json:"retryable,omitempty"`
+	// Whether the container already ran the image and wasn't updated
+	UpToDate bool `json:"upToDate,omitempty"`
+}
+
+// Returns the url of the commit at the git provider of the repository
+func (e DeployEvent) CommitURL() string {
+	if e.Provider == ProviderGitLab {
+		return fmt.Sprintf("%s/%s/-/commit/%s", gitlabURL, e.Repository, e.Sha)
+	}
+
+	return CommitURL(e.Repository, e.Sha)
+}
+
+func (r TargetResult) Succeeded() bool {
+	return r.Error == ""
+}
+
+var rolloutDurationSeconds = NewHistogramVec("kicd_rollout_duration_seconds", "Time from receiving the webhook to the completed (or failed) rollout of a workload.", []float64{5, 10, 30, 60, 120, 300, 600, 1200, 1800, 3600}, "cluster", "namespace", "kind", "workload", "environment", "outcome")
+
+// Reads the message and author of the commit of the event from the github api, if the payload has
+// none, so notifications show what changed instead of only the sha
+func describeCommit(event *DeployEvent, logger *Logger) {
+	if commitLookup != nil && event.CommitMessage == "" && event.Sha != "" && event.Provider != ProviderGitLab {
+		if err := commitLookup.DescribeCommit(event); err != nil {
+			logger.Warning(fmt.Sprintf("Could not read the commit %s of %s: %s", event.Sha, event.Repository, err))
+		}
+	}
+}
+
+// Forwards the event to the agents of other clusters, which deploy it on their own and report back
+// to the hub. Called once per accepted event, not by Deploy, so retries don't forward it again.
+func forwardToAgents(event DeployEvent) {
+	// Rollbacks update a single target of this controller
+	if hub == nil || event.Rollback != nil {
+		return
+	}
+	eventLogger := globalLogger.With(LogFields{"requestId": event.RequestID, "repository": event.Repository, "branch": event.Branch, "image": event.Image})
+	describeCommit(&event, eventLogger)
+	agents := hub.Forward(event)
+	if len(agents) > 0 {
+		eventLogger.Info(fmt.Sprintf("Forwarded the deploy to the agents %s", strings.Join(agents, ", ")))
+	}
+}
+
+// Updates all targets of the event to the new image
+func Deploy(ctx context.Context, event DeployEvent) ([]TargetResult, error) {
+	deploysInFlight.Add(1)
+	defer deploysInFlight.Done()
+	// Finding and updating all targets must not take longer than DEPLOY_TIMEOUT
+	ctx, cancel := context.WithTimeout(ctx, deployTimeout)
+	defer cancel()
+
+	eventLogger := globalLogger.With(LogFields{"requestId": event.RequestID, "repository": event.Repository, "branch": event.Branch, "image": event.Image})
+	describeCommit(&event, eventLogger)
+	if event.Rollback != nil {
+		return []TargetResult{deployRollback(ctx, event, eventLogger)}, nil
+	}
+	eventLogger.Info(fmt.Sprintf("Deploying new version of %s on branch %s", event.Repository, event.Branch))
+
+	repositoryDefaultBranch := event.DefaultBranch
+	if repositoryDefaultBranch == "" {
+		repositoryDefaultBranch = defaultBranch
+	}
+	// Flux updates the workloads from its image policies
+	if fluxAutomation != nil {
+		return fluxAutomation.Deploy(ctx, event, event.Branch == repositoryDefaultBranch, eventLogger)
+	}
+
+	_, findSpan := tracer.StartSpan(ctx, "find targets", SpanKindClient)
+	targets, problems, err := FindTargets(ctx, event.Repository, event.Branch, event.Branch == repositoryDefaultBranch)
+	findSpan.SetAttribute("targets", len(targets))
+	findSpan.SetError(err)
+	findSpan.Finish()
+	if err != nil {
+		eventLogger.Error("Could not find targets")
+		eventLogger.Error(err)
+		errorReporter.Capture(err, LogFields{"requestId": event.RequestID, "repository": event.Repository})
+		Notify(ctx, Notification{Type: NotificationFailed, Text: fmt.Sprintf("Could not find the targets of %s on branch %s: %s", event.Repository, event.Branch, err), Event: event})
+		return nil, err
+	}
+
+	// Workloads which were meant to be deployed but can't be
+	for _, problem := range problems {
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("Skipping a workload of %s: %s", event.Repository, problem), Event: event})
+	}
+
+	if len(targets) == 0 && hub.HasAgents() {
+		eventLogger.Info(fmt.Sprintf("No local targets for %s on branch %s", event.Repository, event.Branch))
+	} else if len(targets) == 0 {
+		eventLogger.Info(fmt.Sprintf("No targets for %s on branch %s", event.Repository, event.Branch))
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("No workloads matched %s on branch %s. Nothing was deployed.", event.Repository, event.Branch), Event: event})
+	} else {
+		Notify(ctx, Notification{Type: NotificationStarted, Text: fmt.Sprintf("Deploying %s to %d targets.", event.Image, len(targets)), Event: event})
+	}
+
+	results := deployTargets(ctx, event, targets, eventLogger)
+
+	// Summary of all successfully updated targets
+	var updated []TargetResult
+	var changed []TargetResult
+	for _, result := range results {
+		if result.Succeeded() && !result.UpToDate {
+			updated = append(updated, result)
+		}
+		if !result.UpToDate {
+			changed = append(changed, result)
+		}
+	}
+	if len(updated) > 0 {
+		text := fmt.Sprintf("Successfully updated %d targets with %s:", len(updated), event.Image)
+		for _, result := range updated {
+			text += fmt.Sprintf("\n- %s (%s → %s)", result.Target, ImageTag(result.PreviousImage), ImageTag(result.Image))
+		}
+		Notify(ctx, Notification{Type: NotificationDeployed, Text: text, Event: event, Results: updated})
+	}
+
+	// Rollouts complete in the background, dry runs and up to date targets didn't start any
+	if len(changed) > 0 && !dryRun {
+		go trackRollouts(event, changed)
+	}
+
+	return results, nil
+}
+
+// Targets of a deploy updated at the same time
+var targetConcurrency = 4
+
+// Environments whose targets are updated before those of the next one, e.g. dev, staging, prod
+var targetOrder []string
+
+// Updates the targets in the order of the environments of TARGET_ORDER, targets of the same
+// environment in parallel with at most TARGET_CONCURRENCY at once. Returns the results in the
+// order of the targets.
+func deployTargets(ctx context.Context, event DeployEvent, targets []Target, logger *Logger) []TargetResult {
+	results := make([]TargetResult, len(targets))
+	for _, stage := range targetStages(targets) {
+		slots := make(chan struct{}, targetConcurrency)
+		var wait sync.WaitGroup
+		for _, i := range stage {
+			wait.Add(1)
+			slots <- struct{}{}
+			go func(i int) {
+				defer wait.Done()
+				defer func() { <-slots }()
+				results[i] = deployTarget(ctx, event, targets[i], logger)
+			}(i)
+		}
+		wait.Wait()
+	}
+
+	return results
+}
+
+// Groups the indexes of the targets into stages by the position of their environment in
+// TARGET_ORDER. Targets of other environments are deployed in a last stage.
+func targetStages(targets []Target) [][]int {
+	stages := make([][]int, len(targetOrder)+1)
+	for i, target := range targets {
+		position := len(targetOrder)
+		for j, environment := range targetOrder {
+			if strings.EqualFold(environment, target.Environment) {
+				position = j
+				break
+			}
+		}
+		stages[position] = append(stages[position], i)
+	}
+
+	var nonEmpty [][]int
+	for _, stage := range stages {
+		if len(stage) > 0 {
+			nonEmpty = append(nonEmpty, stage)
+		}
+	}
+
+	return nonEmpty
+}
+
+// Updates a single target, recording its history and event and notifying about the outcome
+func deployTarget(ctx context.Context, event DeployEvent, target Target, logger *Logger) TargetResult {
+	targetLogger := logger.With(LogFields{"namespace": target.Namespace, "workload": target.Name, "kind": target.Kind})
+	if NamespaceProtected(target.Namespace) && !event.ProductionVerified {
+		targetLogger.Warning(fmt.Sprintf("Skipping %s. The namespace is protected and the request has no production signature.", target))
+		result := TargetResult{Target: target, Image: event.Image, Error: "namespace is protected and requires the production signature"}
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("Skipping %s. The namespace is protected and the request has no production signature.", target), Event: event, Result: &result})
+		return result
+	}
+
+	if target.Paused != "" {
+		targetLogger.Warning(fmt.Sprintf("Skipping %s. Deploys are paused by %s.", target, target.Paused))
+		result := TargetResult{Target: target, Image: event.Image, Error: "deploys are paused by " + target.Paused}
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("Skipping %s. Deploys are paused by %s.", target, target.Paused), Event: event, Result: &result})
+		return result
+	}
+
+	targetLogger.Info(fmt.Sprintf("Ready to update %s...", target))
+	// The drift reconciler skips the target until its history entry was recorded
+	targetsDeploying.begin(target)
+	defer targetsDeploying.end(target)
+
+	_, updateSpan := tracer.StartSpan(ctx, "update target", SpanKindClient)
+	updateSpan.SetAttribute("target", target)
+	previousImage, err := UpdateTarget(ctx, target, event.Image, CommitAnnotations(event))
+	updateSpan.SetError(err)
+	updateSpan.Finish()
+
+	// Retried and replayed webhooks of a running image change nothing
+	if err == nil && previousImage == event.Image {
+		upToDateText := fmt.Sprintf("%s is already up to date with %s.", target, event.Image)
+		targetLogger.Info(upToDateText)
+		result := TargetResult{Target: target, PreviousImage: previousImage, Image: event.Image, UpToDate: true}
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: upToDateText, Event: event, Result: &result})
+		return result
+	}
+
+	// Keep the deploy in the history of the workload
+	historyEntry := HistoryEntry{Time: time.Now(), Sha: event.Sha, Image: event.Image, PreviousImage: previousImage, Outcome: AuditOutcomeSucceeded, Delivery: event.Delivery, RequestID: event.RequestID}
+	if err != nil {
+		historyEntry.Outcome = AuditOutcomeFailed
+		historyEntry.Error = err.Error()
+	}
+	if historyErr := RecordHistory(ctx, target, historyEntry); historyErr != nil {
+		targetLogger.Warning(fmt.Sprintf("Could not record the history of %s: %s", target, historyErr))
+	}
+
+	// Kubernetes event on the workload
+	eventType, reason, message := corev1.EventTypeNormal, "ImageUpdated", fmt.Sprintf("Updated image to %s (request %s)", event.Image, event.RequestID)
+	if err != nil {
+		eventType, reason, message = corev1.EventTypeWarning, "ImageUpdateFailed", fmt.Sprintf("Could not update image to %s: %s (request %s)", event.Image, err, event.RequestID)
+	}
+	if eventErr := RecordEvent(ctx, target, eventType, reason, message); eventErr != nil {
+		targetLogger.Warning(fmt.Sprintf("Could not record an event for %s: %s", target, eventErr))
+	}
+
+	result := TargetResult{Target: target, PreviousImage: previousImage, Image: event.Image}
+	if err != nil {
+		targetLogger.Error(fmt.Sprintf("Failure updating %s. --- %s", target, err))
+		errorReporter.Capture(err, LogFields{"requestId": event.RequestID, "repository": event.Repository, "namespace": target.Namespace, "workload": target.Name, "image": event.Image})
+		result.Error = err.Error()
+		result.Retryable = transientError(err)
+		Notify(ctx, Notification{Type: NotificationFailed, Text: fmt.Sprintf("Failed to update %s: %s", target, err), Event: event, Result: &result})
+		return result
+	}
+
+	successText := fmt.Sprintf("Successfully updated %s with the newest image tag.", target)
+
+	targetLogger.Info(successText)
+
+	// Notify about the update
+	Notify(ctx, Notification{Type: NotificationSucceeded, Text: successText, Event: event, Result: &result})
+
+	return result
+}
+
+// Waits for the rollouts of the updated targets, measures their durations and records the deploy for the DORA metrics
+func trackRollouts(event DeployEvent, results []TargetResult) {
+	var wait sync.WaitGroup
+	var mutex sync.Mutex
+	failed := false
+	// Results including the failed rollouts
+	completed := make([]TargetResult, len(results))
+	copy(completed, results)
+	for i, result := range results {
+		if !result.Succeeded() {
+			failed = true
+			continue
+		}
+
+		wait.Add(1)
+		go func(i int, result TargetResult) {
+			defer wait.Done()
+
+			target := result.Target
+			outcome := AuditOutcomeSucceeded
+			if err := WaitForRollout(context.Background(), target, rolloutTimeout); err != nil {
+				globalLogger.With(LogFields{"requestId": event.RequestID, "namespace": target.Namespace, "workload": target.Name}).Warning(fmt.Sprintf("Rollout of %s failed: %s", target, err))
+				outcome = AuditOutcomeFailed
+				mutex.Lock()
+				failed = true
+				completed[i].Error = err.Error()
+				mutex.Unlock()
+
+				result.Error = err.Error()
+				Notify(context.Background(), Notification{Type: NotificationRolloutFailed, Text: fmt.Sprintf("Rollout of %s failed: %s", target, err), Event: event, Result: &result})
+			} else {
+				Notify(context.Background(), Notification{Type: NotificationRolloutSucceeded, Text: fmt.Sprintf("Rollout of %s completed.", target), Event: event, Result: &result})
+			}
+			rolloutDurationSeconds.Observe(time.Since(event.ReceivedAt).Seconds(), target.Cluster, target.Namespace, target.Kind, target.Name, target.Environment, outcome)
+		}(i, result)
+	}
+	wait.Wait()
+
+	var leadTime time.Duration
+	if !event.CommitTime.IsZero() {
+		leadTime = time.Since(event.CommitTime)
+	}
+	doraTracker.Record(event.Repository, leadTime, failed)
+
+	text := fmt.Sprintf("Deploy of %s to %d targets completed.", event.Image, len(completed))
+	if failed {
+		text = fmt.Sprintf("Deploy of %s to %d targets failed.", event.Image, len(completed))
+	}
+	Notify(context.Background(), Notification{Type: NotificationCompleted, Text: text, Event: event, Results: completed})
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var deployQueueLength = NewGaugeVec("kicd_deploy_queue_length", "Deploys waiting for a free worker.")
+
+var errDeployQueueFull = errors.New("deploy queue is full")
+
+// Bounds of the Retry-After of webhooks rejected because the queue is full
+const (
+	minQueueRetryAfter = 5 * time.Second
+	maxQueueRetryAfter = 5 * time.Minute
+)
+
+// Moving average of the durations of deploys, from which the wait for a free worker is estimated
+type deployDurations struct {
+	mutex   sync.Mutex
+	average time.Duration
+}
+
+var queuedDeployDurations deployDurations
+
+func (d *deployDurations) observe(duration time.Duration) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.average == 0 {
+		d.average = duration
+	} else {
+		d.average = (4*d.average + duration) / 5
+	}
+}
+
+// Returns the estimated time until the workers deployed the given number of queued deploys
+func (d *deployDurations) wait(queued int, workers int) time.Duration {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if workers < 1 {
+		workers = 1
+	}
+	wait := d.average * time.Duration(queued) / time.Duration(workers)
+	if wait < minQueueRetryAfter {
+		return minQueueRetryAfter
+	}
+	if wait > maxQueueRetryAfter {
+		return maxQueueRetryAfter
+	}
+
+	return wait
+}
+
+type deployJob struct {
+	ctx   context.Context
+	event DeployEvent
+	done  func([]TargetResult, error)
+}
+
+// DeployQueue runs deploys in a fixed number of workers, so bursts of webhooks don't start an
+// unbounded number of concurrent updates of the cluster
+type DeployQueue struct {
+	jobs    chan deployJob
+	workers int
+}
+
+// Starts the workers of a queue holding up to size waiting deploys
+func NewDeployQueue(workers int, size int) *DeployQueue {
+	q := &DeployQueue{jobs: make(chan deployJob, size), workers: workers}
+	for i := 0; i < workers; i++ {
+		go q.work()
+	}
+
+	return q
+}
+
+// Returns how long senders of deploys rejected with errDeployQueueFull should wait before retrying,
+// the estimated time until the workers deployed the full queue
+func (q *DeployQueue) RetryAfter() time.Duration {
+	return queuedDeployDurations.wait(cap(q.jobs), q.workers)
+}
+
+func (q *DeployQueue) work() {
+	for job := range q.jobs {
+		deployQueueLength.Set(float64(len(q.jobs)))
+		// Queued deploys wait for the kubernetes api instead of failing
+		waitForCircuits()
+		started := time.Now()
+		results, err := Deploy(job.ctx, job.event)
+		queuedDeployDurations.observe(time.Since(started))
+		job.done(results, err)
+		deploysInFlight.Done()
+	}
+}
+
+// Keeps the span of the context, but not its cancellation which ends with the request
+func detachContext(ctx context.Context) context.Context {
+	if span, ok := ctx.Value(spanContextKey{}).(*Span); ok {
+		return context.WithValue(context.Background(), spanContextKey{}, span)
+	}
+
+	return context.Background()
+}
+
+// Queues the deploy of the event and calls done with its results once a worker deployed it.
+// Returns errDeployQueueFull without waiting if no more deploys can be queued and errNotLeader if
+// another replica deploys.
+func (q *DeployQueue) Enqueue(ctx context.Context, event DeployEvent, done func([]TargetResult, error)) error {
+	if !leaderElection.IsLeader() {
+		return errNotLeader
+	}
+	// Callers are requests or deploys in flight, which the shutdown waits for
+	deploysInFlight.Add(1)
+	select {
+	case q.jobs <- deployJob{ctx: detachContext(ctx), event: event, done: done}:
+		deployQueueLength.Set(float64(len(q.jobs)))
+		return nil
+	default:
+		deploysInFlight.Done()
+		globalLogger.With(LogFields{"requestId": event.RequestID, "repository": event.Repository}).Warning("Deploy queue is full, rejecting the deploy of " + event.Image)
+		return errDeployQueueFull
+	}
+}
+
+// Queues the deploy of the event and waits for its results. Returns errCircuitOpen without waiting
+// while the kubernetes api of any cluster is unavailable.
+func (q *DeployQueue) Run(ctx context.Context, event DeployEvent) ([]TargetResult, error) {
+	if len(OpenCircuits()) > 0 {
+		return nil, errCircuitOpen
+	}
+	type outcome struct {
+		results []TargetResult
+		err     error
+	}
+	done := make(chan outcome, 1)
+	if err := q.Enqueue(ctx, event, func(results []TargetResult, err error) {
+		done <- outcome{results, err}
+	}); err != nil {
+		return nil, err
+	}
+	forwardToAgents(event)
+	result := <-done
+
+	return result.results, result.err
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	deploymentsTotal     = NewCounterVec("kicd_deployments_total", "Deploys per repository by outcome.", "repository", "outcome")
+	changeFailuresTotal  = NewCounterVec("kicd_change_failures_total", "Deploys per repository which failed to update or roll out.", "repository")
+	leadTimeSeconds      = NewHistogramVec("kicd_lead_time_seconds", "Time from commit to completed rollout.", DurationBuckets, "repository")
+	timeToRestoreSeconds = NewHistogramVec("kicd_time_to_restore_seconds", "Time from a failed deploy to the next successful deploy of the repository.", DurationBuckets, "repository")
+)
+
+// DoraRecord is a completed deploy of a repository
+type DoraRecord struct {
+	Repository  string
+	Time        time.Time
+	LeadTime    time.Duration
+	Failed      bool
+	RestoreTime time.Duration
+}
+
+// DoraMetrics are the DORA metrics of a repository over a window
+type DoraMetrics struct {
+	Repository  string `json:"repository"`
+	Deployments int    `json:"deployments"`
+	// Successful deploys per day
+	DeploymentFrequency float64 `json:"deploymentFrequency"`
+	// Median time from commit to completed rollout in seconds, of deploys which sent the commit timestamp
+	LeadTimeSeconds   float64 `json:"leadTimeSeconds"`
+	ChangeFailureRate float64 `json:"changeFailureRate"`
+	// Mean time from a failed deploy to the next successful one in seconds
+	TimeToRestoreSeconds float64 `json:"timeToRestoreSeconds"`
+}
+
+// DoraTracker records completed deploys and computes the DORA metrics per repository
+type DoraTracker struct {
+	Window time.Duration
+
+	mutex        sync.Mutex
+	records      []DoraRecord
+	failingSince map[string]time.Time
+}
+
+func NewDoraTracker(window time.Duration) *DoraTracker {
+	return &DoraTracker{Window: window, failingSince: make(map[string]time.Time)}
+}
+
+// Records a completed deploy. The lead time is zero if the commit time is unknown.
+func (d *DoraTracker) Record(repository string, leadTime time.Duration, failed bool) {
+	repository = strings.ToLower(repository)
+	now := time.Now()
+	record := DoraRecord{Repository: repository, Time: now, LeadTime: leadTime, Failed: failed}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if failed {
+		if _, ok := d.failingSince[repository]; !ok {
+			d.failingSince[repository] = now
+		}
+		deploymentsTotal.Inc(repository, "failed")
+		changeFailuresTotal.Inc(repository)
+	} else {
+		if since, ok := d.failingSince[repository]; ok {
+			record.RestoreTime = now.Sub(since)
+			delete(d.failingSince, repository)
+			timeToRestoreSeconds.Observe(record.RestoreTime.Seconds(), repository)
+		}
+		deploymentsTotal.Inc(repository, "succeeded")
+		if leadTime > 0 {
+			leadTimeSeconds.Observe(leadTime.Seconds(), repository)
+		}
+	}
+
+	if store != nil {
+		if err := store.RecordOutcome(record); err != nil {
+			globalLogger.Error(fmt.Sprintf("Could not store the deploy outcome of %s: %s", repository, err))
+		}
+	}
+
+	d.records = append(d.records, record)
+	// Drop records outside of the window
+	for len(d.records) > 0 && now.Sub(d.records[0].Time) > d.Window {
+		d.records = d.records[1:]
+	}
+}
+
+// Restores stored records, oldest first, including the repositories which are still failing
+func (d *DoraTracker) Load(records []DoraRecord) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, record := range records {
+		if record.Failed {
+			if _, ok := d.failingSince[record.Repository]; !ok {
+				d.failingSince[record.Repository] = record.Time
+			}
+		} else {
+			delete(d.failingSince, record.Repository)
+		}
+	}
+	d.records = append(records, d.records...)
+}
+
+// Returns the metrics of all repositories (or only the given one) within the window
+func (d *DoraTracker) Metrics(repository string) []DoraMetrics {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	byRepository := make(map[string][]DoraRecord)
+	for _, record := range d.records {
+		if time.Since(record.Time) > d.Window {
+			continue
+		}
+		if repository != "" && record.Repository != strings.ToLower(repository) {
+			continue
+		}
+		byRepository[record.Repository] = append(byRepository[record.Repository], record)
+	}
+
+	var metrics []DoraMetrics
+	for name, records := range byRepository {
+		m := DoraMetrics{Repository: name, Deployments: len(records)}
+
+		var successful, failed, restores int
+		var leadTimes []float64
+		var restoreTotal time.Duration
+		for _, record := range records {
+			if record.Failed {
+				failed++
+				continue
+			}
+			successful++
+			if record.LeadTime > 0 {
+				leadTimes = append(leadTimes, record.LeadTime.Seconds())
+			}
+			if record.RestoreTime > 0 {
+				restores++
+				restoreTotal += record.RestoreTime
+			}
+		}
+
+		m.DeploymentFrequency = float64(successful) / (d.Window.Hours() / 24)
+		m.ChangeFailureRate = float64(failed) / float64(len(records))
+		if len(leadTimes) > 0 {
+			sort.Float64s(leadTimes)
+			m.LeadTimeSeconds = leadTimes[len(leadTimes)/2]
+		}
+		if restores > 0 {
+			m.TimeToRestoreSeconds = (restoreTotal / time.Duration(restores)).Seconds()
+		}
+		metrics = append(metrics, m)
+	}
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].Repository < metrics[j].Repository })
+
+	return metrics
+}
+
+// Returns the DORA metrics, optionally only of the given repository parameter
+func DoraHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	WriteJSON(w, 200, doraTracker.Metrics(r.URL.Query().Get("repository")))
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+var (
+	driftedTargetsGauge = NewGaugeVec("kicd_drifted_targets", "Targets whose image differs from the image last deployed by ki-cd.")
+	driftRevertedTotal  = NewCounterVec("kicd_drift_reverted_total", "Drifted targets whose deployed image was applied again.")
+)
+
+// Cached workloads may lag behind the history entry of a deploy for this long after it finished
+const deploySettleTime = 30 * time.Second
+
+// Targets with a deploy in progress, whose image is updated before their history entry is recorded
+type deployingTargets struct {
+	mutex  sync.Mutex
+	active map[Target]int
+	ended  map[Target]time.Time
+}
+
+var targetsDeploying deployingTargets
+
+// Marks a deploy of the target in progress until end is called
+func (d *deployingTargets) begin(target Target) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.add(target)
+}
+
+// Marks an update of the target in progress like begin, unless it is busy. Returns whether it was marked.
+func (d *deployingTargets) tryBegin(target Target) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.active[target] > 0 {
+		return false
+	}
+	d.add(target)
+
+	return true
+}
+
+func (d *deployingTargets) add(target Target) {
+	if d.active == nil {
+		d.active = make(map[Target]int)
+		d.ended = make(map[Target]time.Time)
+	}
+	d.active[target]++
+}
+
+func (d *deployingTargets) end(target Target) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.active[target]--
+	if d.active[target] <= 0 {
+		delete(d.active, target)
+	}
+	d.ended[target] = time.Now()
+}
+
+// Returns whether a deploy of the target is in progress or finished within deploySettleTime
+func (d *deployingTargets) busy(target Target) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for ended, at := range d.ended {
+		if time.Since(at) > deploySettleTime {
+			delete(d.ended, ended)
+		}
+	}
+	_, recent := d.ended[target]
+
+	return d.active[target] > 0 || recent
+}
+
+// DriftReconciler periodically compares the image of each managed target with the image last
+// deployed to it according to its history, so manual edits and reverts by operators don't
+// silently undo deploys. Drifted targets are reported or, with Revert, set to the deployed image again.
+type DriftReconciler struct {
+	Interval time.Duration
+	Revert   bool
+
+	lock sync.Mutex
+	// Drifted image by target, each drift is only notified once
+	notified map[Target]string
+}
+
+// Reconciles in the interval until the context ends. Runs in the manager, only on the leader.
+func (d *DriftReconciler) Start(ctx context.Context) error {
+	ticker := time.NewTicker(d.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+			if len(UnsyncedCaches()) == 0 {
+				d.reconcile(ctx)
+			}
+		}
+	}
+}
+
+func (d *DriftReconciler) reconcile(ctx context.Context) {
+	targets, err := ListManagedTargets(ctx)
+	if err != nil {
+		globalLogger.Error("Could not list the targets for drift detection: " + err.Error())
+		return
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.notified == nil {
+		d.notified = make(map[Target]string)
+	}
+
+	drifted := make(map[Target]string)
+	for _, managed := range targets {
+		// Paused workloads may be changed on purpose, deploys in progress update the image before
+		// their history entry
+		if managed.Paused != "" || managed.DeployedImage == "" || managed.Image == managed.DeployedImage || targetsDeploying.busy(managed.Target) {
+			continue
+		}
+		drifted[managed.Target] = managed.Image
+		if d.notified[managed.Target] == managed.Image {
+			continue
+		}
+		d.notified[managed.Target] = managed.Image
+		d.drifted(ctx, managed)
+	}
+	for target := range d.notified {
+		if _, ok := drifted[target]; !ok {
+			delete(d.notified, target)
+		}
+	}
+	driftedTargetsGauge.Set(float64(len(drifted)))
+}
+
+// Reports the drift of the target and reverts it if enabled
+func (d *DriftReconciler) drifted(ctx context.Context, managed ManagedTarget) {
+	target := managed.Target
+	event := DeployEvent{Repository: managed.Repository, Branch: managed.Branch, Sha: ImageTag(managed.DeployedImage), Image: managed.DeployedImage, Source: "drift", ReceivedAt: time.Now(), RequestID: randomHex(16)}
+	logger := globalLogger.With(LogFields{"requestId": event.RequestID, "namespace": target.Namespace, "workload": target.Name, "image": managed.Image})
+	text := fmt.Sprintf("%s drifted from the deployed image %s to %s.", target, managed.DeployedImage, managed.Image)
+	logger.Warning(text)
+
+	if !d.Revert || dryRun {
+		Notify(ctx, Notification{Type: NotificationDrifted, Text: text, Event: event, Result: &TargetResult{Target: target, PreviousImage: managed.Image, Image: managed.DeployedImage}})
+		return
+	}
+
+	// A deploy may have started since the targets were listed
+	if !targetsDeploying.tryBegin(target) {
+		return
+	}
+	defer targetsDeploying.end(target)
+
+	result := TargetResult{Target: target, Image: managed.DeployedImage}
+	// The commit annotations of the workload still describe the deployed image
+	previousImage, err := UpdateTarget(ctx, target, managed.DeployedImage, nil)
+	result.PreviousImage = previousImage
+	eventType, reason, message := corev1.EventTypeNormal, "DriftReverted", fmt.Sprintf("Reverted the image from %s to the deployed %s", managed.Image, managed.DeployedImage)
+	if err != nil {
+		result.Error = err.Error()
+		text += fmt.Sprintf(" Reverting it failed: %s", err)
+		eventType, reason, message = corev1.EventTypeWarning, "DriftRevertFailed", fmt.Sprintf("Could not revert the image from %s to the deployed %s: %s", managed.Image, managed.DeployedImage, err)
+		logger.Error(fmt.Sprintf("Could not revert the drift of %s: %s", target, err))
+	} else {
+		text += " Reverted it to the deployed image."
+		driftRevertedTotal.Inc()
+	}
+	if eventErr := RecordEvent(ctx, target, eventType, reason, message); eventErr != nil {
+		logger.Warning(fmt.Sprintf("Could not record an event for %s: %s", target, eventErr))
+	}
+	Notify(ctx, Notification{Type: NotificationDrifted, Text: text, Event: event, Result: &result})
+}
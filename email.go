@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+const (
+	SMTPSecurityStartTLS = "starttls"
+	SMTPSecurityTLS      = "tls"
+	SMTPSecurityNone     = "none"
+)
+
+// EmailNotifier sends deploy results via smtp to default recipients and the recipients of the target
+type EmailNotifier struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+	// Recipients of all notifications
+	To []string
+	// starttls (default), tls or none
+	Security string
+}
+
+// Returns the email recipients of a target, from the email annotation or configuration
+func (t Target) EmailRecipients() []string {
+	return splitList(t.Email)
+}
+
+// Returns the annotation key holding the comma separated email recipients of workloads
+func EmailAnnotationKey() string {
+	return labelPrefix + "email"
+}
+
+func (n *EmailNotifier) client() (*smtp.Client, error) {
+	address := net.JoinHostPort(n.Host, n.Port)
+	tlsConfig := &tls.Config{ServerName: n.Host, MinVersion: tls.VersionTLS12}
+
+	var client *smtp.Client
+	if n.Security == SMTPSecurityTLS {
+		connection, err := tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", address, tlsConfig)
+		if err != nil {
+			return nil, err
+		}
+		if client, err = smtp.NewClient(connection, n.Host); err != nil {
+			return nil, err
+		}
+	} else {
+		connection, err := net.DialTimeout("tcp", address, 10*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		if client, err = smtp.NewClient(connection, n.Host); err != nil {
+			return nil, err
+		}
+		if n.Security != SMTPSecurityNone {
+			if err := client.StartTLS(tlsConfig); err != nil {
+				client.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+
+	return client, nil
+}
+
+func (n *EmailNotifier) Notify(notification Notification) error {
+	recipients := append([]string{}, n.To...)
+	if notification.Result != nil {
+		recipients = append(recipients, notification.Result.Target.EmailRecipients()...)
+	}
+	if len(recipients) == 0 {
+		return nil
+	}
+
+	subject := fmt.Sprintf("[%s] %s", notification.Type, notification.Event.Repository)
+	if notification.Result != nil {
+		subject += " to " + notification.Result.Target.String()
+	}
+	body := notificationText(notification) + "\r\n\r\n" +
+		"Repository: " + notification.Event.Repository + "\r\n" +
+		"Branch: " + notification.Event.Branch + "\r\n" +
+		"Image: " + notification.Event.Image + "\r\n"
+	if notification.Result != nil && notification.Result.PreviousImage != "" {
+		body += "Previous image: " + notification.Result.PreviousImage + "\r\n"
+	}
+	if subject := commitSubject(notification.Event, 200); subject != "" {
+		body += "Commit: " + subject + "\r\n"
+	}
+	if notification.Event.CommitAuthor != "" {
+		body += "Author: " + notification.Event.CommitAuthor + "\r\n"
+	}
+	if compareURL := notification.CompareURL(); compareURL != "" {
+		body += "Changes: " + compareURL + "\r\n"
+	}
+
+	// Header values must not contain line breaks
+	sanitize := strings.NewReplacer("\r", "", "\n", "")
+	message := "From: " + sanitize.Replace(n.From) + "\r\n" +
+		"To: " + sanitize.Replace(strings.Join(recipients, ", ")) + "\r\n" +
+		"Subject: " + sanitize.Replace(subject) + "\r\n" +
+		"Date: " + time.Now().Format(time.RFC1123Z) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=utf-8\r\n" +
+		"\r\n" + body
+
+	client, err := n.client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	for _, recipient := range recipients {
+		if err := client.Rcpt(recipient); err != nil {
+			return err
+		}
+	}
+	writer, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := writer.Write([]byte(message)); err != nil {
+		return err
+	}
+	if err := writer.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Verifies that the server accepts the connection and credentials
+func (n *EmailNotifier) Check() error {
+	client, err := n.client()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	return client.Quit()
+}
+
+func (n *EmailNotifier) Name() string {
+	return "email"
+}
+
+func (n *EmailNotifier) Types() []string {
+	return []string{NotificationSucceeded, NotificationRolledBack, NotificationFailed, NotificationRolloutFailed, NotificationSkipped, NotificationRejected, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// Bearer tokens if given, the hmac signature otherwise
+	EndpointAuthAny       = "any"
+	EndpointAuthSignature = "signature"
+	EndpointAuthToken     = "token"
+)
+
+// Paths of the other handlers, which can't be used by webhook endpoints
+var reservedPaths = []string{"/healthz", "/readyz", "/metrics", "/status/", "/admin/", "/agent/", "/dashboard/", "/slack/"}
+
+// EndpointConfig is an additional path receiving webhooks, e.g. per source with its own authentication
+type EndpointConfig struct {
+	Path string `json:"path"`
+	// Accepted authentication, any (default), signature or token
+	Auth string `json:"auth,omitempty"`
+	// CIDRs or addresses allowed to call the endpoint, instead of IP_ALLOWLIST
+	AllowedIPs []string `json:"allowedIPs,omitempty"`
+	// Repositories which may be deployed through the endpoint, all if empty
+	Repositories []string `json:"repositories,omitempty"`
+}
+
+func validateEndpointPath(path string) error {
+	if !strings.HasPrefix(path, "/") {
+		return errors.New("path must start with /")
+	}
+	for _, reserved := range reservedPaths {
+		if path == strings.TrimSuffix(reserved, "/") || strings.HasPrefix(path, reserved) {
+			return fmt.Errorf("path %s is reserved", path)
+		}
+	}
+
+	return nil
+}
+
+func (e EndpointConfig) validate() error {
+	if err := validateEndpointPath(e.Path); err != nil {
+		return err
+	}
+	if e.Auth != "" && e.Auth != EndpointAuthAny && e.Auth != EndpointAuthSignature && e.Auth != EndpointAuthToken {
+		return fmt.Errorf("unknown auth %s, one of any, signature or token is required", e.Auth)
+	}
+	if _, err := ParseCIDRs(strings.Join(e.AllowedIPs, ",")); err != nil {
+		return fmt.Errorf("invalid allowedIPs: %s", err)
+	}
+
+	return nil
+}
+
+// WebhookEndpoint is a path receiving webhooks with its authentication and allowed sources
+type WebhookEndpoint struct {
+	Path string
+	Auth string
+	// Nil if all addresses are allowed
+	Allowlist    *IPAllowlist
+	Repositories []string
+}
+
+// Creates the endpoint of the configuration, falling back to the global allowlist
+func NewWebhookEndpoint(config EndpointConfig) (*WebhookEndpoint, error) {
+	endpoint := &WebhookEndpoint{Path: config.Path, Auth: config.Auth, Allowlist: ipAllowlist, Repositories: config.Repositories}
+	if endpoint.Auth == "" {
+		endpoint.Auth = EndpointAuthAny
+	}
+	if endpoint.Auth == EndpointAuthToken && jwtVerifier == nil {
+		return nil, fmt.Errorf("endpoint %s: token auth requires JWT_JWKS_URL or JWT_PUBLIC_KEY_PATH", config.Path)
+	}
+	if len(config.AllowedIPs) > 0 {
+		allowedIPs, err := ParseCIDRs(strings.Join(config.AllowedIPs, ","))
+		if err != nil {
+			return nil, fmt.Errorf("endpoint %s: %s", config.Path, err)
+		}
+		endpoint.Allowlist = NewIPAllowlist(allowedIPs)
+	}
+
+	return endpoint, nil
+}
+
+// Returns whether the repository may be deployed through the endpoint
+func (e *WebhookEndpoint) RepositoryAllowed(repository string) bool {
+	if len(e.Repositories) == 0 {
+		return true
+	}
+	for _, allowed := range e.Repositories {
+		if strings.EqualFold(allowed, repository) {
+			return true
+		}
+	}
+
+	return false
+}
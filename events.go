@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Records a kubernetes event on the target workload, so deploys show up in `kubectl describe`
+func RecordEvent(ctx context.Context, target Target, eventType string, reason string, message string) error {
+	if dryRun {
+		return nil
+	}
+	cluster, err := ClusterFor(target.Cluster)
+	if err != nil {
+		return err
+	}
+
+	kind := "Deployment"
+	if target.Kind == KindStatefulSet {
+		kind = "StatefulSet"
+	}
+
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s.%x", target.Name, now.UnixNano()),
+			Namespace: target.Namespace,
+		},
+		InvolvedObject: corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       kind,
+			Name:       target.Name,
+			Namespace:  target.Namespace,
+		},
+		Type:           eventType,
+		Reason:         reason,
+		Message:        message,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source:         corev1.EventSource{Component: "kubernetes-internal-cd"},
+	}
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	_, err = cluster.Kube.CoreV1().Events(target.Namespace).Create(ctx, event, metav1.CreateOptions{})
+
+	return err
+}
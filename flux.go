@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Annotation requesting an immediate reconciliation of a flux object
+const fluxRequestedAtAnnotation = "reconcile.fluxcd.io/requestedAt"
+
+// FluxImageAutomation leaves the workloads to the image automation of flux and only triggers it:
+// image repositories of the pushed image are scanned immediately, image policies with the pin
+// annotation are pinned to the pushed tag and the image update automations of their namespaces
+// run. Image repositories and policies of images without any are created if a namespace is set.
+// Only objects annotated with the repository of the verified push are triggered, like labeled
+// workloads, and protected namespaces and paused objects are skipped like targets.
+type FluxImageAutomation struct {
+	// API version of the image.toolkit.fluxcd.io objects, e.g. v1beta2
+	APIVersion string
+	// Namespace of created image repositories and policies, none are created if empty
+	Namespace string
+	// Scan interval of created image repositories
+	Interval time.Duration
+}
+
+// Active flux integration, nil if workloads are patched
+var fluxAutomation *FluxImageAutomation
+
+// Returns the annotation key of image policies pinned to the tag of each push of the branch in its
+// value, the default branch if empty
+func FluxPinAnnotationKey() string {
+	return labelPrefix + "flux-pin"
+}
+
+// Returns the annotation key holding the repository whose pushes may trigger a flux image
+// repository or policy, as pushes of any repository may push any image
+func FluxRepositoryAnnotationKey() string {
+	return labelPrefix + "repository"
+}
+
+// Returns whether the flux object is annotated with the repository of the push
+func fluxObjectOf(object unstructured.Unstructured, repository string) bool {
+	return strings.EqualFold(object.GetAnnotations()[FluxRepositoryAnnotationKey()], repository)
+}
+
+// Returns why the push may not trigger the flux object like it may not update a target: its
+// namespace is protected and the push has no production signature or it is paused. Empty if it may.
+func fluxSkipReason(object unstructured.Unstructured, event DeployEvent) string {
+	if NamespaceProtected(object.GetNamespace()) && !event.ProductionVerified {
+		return "namespace is protected and requires the production signature"
+	}
+	if by := object.GetAnnotations()[PausedAnnotationKey()]; by != "" {
+		return "deploys are paused by " + by
+	}
+
+	return ""
+}
+
+// Returns the result of a flux object which was skipped and notifies about it
+func (f *FluxImageAutomation) skipped(ctx context.Context, event DeployEvent, target Target, reason string) TargetResult {
+	text := fmt.Sprintf("Skipping %s %s/%s: %s.", target.Kind, target.Namespace, target.Name, reason)
+	globalLogger.With(LogFields{"requestId": event.RequestID, "namespace": target.Namespace}).Warning(text)
+	result := TargetResult{Target: target, Image: event.Image, Error: reason}
+	Notify(ctx, Notification{Type: NotificationSkipped, Text: text, Event: event, Result: &result})
+
+	return result
+}
+
+func (f *FluxImageAutomation) resource(resource string) schema.GroupVersionResource {
+	return schema.GroupVersionResource{Group: "image.toolkit.fluxcd.io", Version: f.APIVersion, Resource: resource}
+}
+
+// Returns the name of created flux objects of the image repository
+func fluxObjectName(repository string) string {
+	name := strings.Trim(regexp.MustCompile(`[^a-z0-9]+`).ReplaceAllString(strings.ToLower(repository), "-"), "-")
+	if len(name) > 63 {
+		name = strings.Trim(name[len(name)-63:], "-")
+	}
+
+	return name
+}
+
+// Triggers the image automation of the pushed image and returns a result per pinned image policy
+// and scanned image repository
+func (f *FluxImageAutomation) Deploy(ctx context.Context, event DeployEvent, defaultBranch bool, logger *Logger) ([]TargetResult, error) {
+	cluster, err := ClusterFor("")
+	if err != nil {
+		return nil, err
+	}
+	repository := ImageRepository(event.Image)
+
+	var repositories []unstructured.Unstructured
+	untied := 0
+	for _, namespace := range ListNamespaces("") {
+		listCtx, cancel := apiContext(ctx)
+		list, err := cluster.Dynamic.Resource(f.resource("imagerepositories")).Namespace(namespace).List(listCtx, metav1.ListOptions{})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, imageRepository := range list.Items {
+			if image, _, _ := unstructured.NestedString(imageRepository.Object, "spec", "image"); image != repository {
+				continue
+			}
+			if !fluxObjectOf(imageRepository, event.Repository) {
+				untied++
+				continue
+			}
+			repositories = append(repositories, imageRepository)
+		}
+	}
+	if len(repositories) == 0 && untied > 0 {
+		text := fmt.Sprintf("No flux image repository of %s is annotated with %s: %s. Nothing was triggered.", repository, FluxRepositoryAnnotationKey(), event.Repository)
+		logger.Warning(text)
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: text, Event: event})
+		return nil, nil
+	}
+	if len(repositories) == 0 && f.Namespace != "" {
+		if NamespaceProtected(f.Namespace) && !event.ProductionVerified {
+			target := Target{Kind: "ImageRepository", Name: fluxObjectName(repository), Namespace: f.Namespace}
+			return []TargetResult{f.skipped(ctx, event, target, "namespace is protected and requires the production signature")}, nil
+		}
+		created, err := f.create(ctx, cluster, event, repository)
+		if err != nil {
+			return nil, fmt.Errorf("could not create the image repository of %s: %s", repository, err)
+		}
+		repositories = append(repositories, *created)
+	}
+	if len(repositories) == 0 {
+		logger.Info(fmt.Sprintf("No flux image repository of %s", repository))
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("No flux image repository scans %s. Nothing was triggered.", repository), Event: event})
+		return nil, nil
+	}
+
+	Notify(ctx, Notification{Type: NotificationStarted, Text: fmt.Sprintf("Triggering the flux image automation of %s.", event.Image), Event: event})
+	// Skipped objects were notified already
+	var results, skipped []TargetResult
+	namespaces := make(map[string]bool)
+	for _, imageRepository := range repositories {
+		target := Target{Kind: "ImageRepository", Name: imageRepository.GetName(), Namespace: imageRepository.GetNamespace()}
+		if reason := fluxSkipReason(imageRepository, event); reason != "" {
+			skipped = append(skipped, f.skipped(ctx, event, target, reason))
+			continue
+		}
+		namespaces[imageRepository.GetNamespace()] = true
+		policies, skippedPolicies, err := f.pinPolicies(ctx, cluster, event, defaultBranch, imageRepository)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, policies...)
+		skipped = append(skipped, skippedPolicies...)
+
+		result := TargetResult{Target: target, Image: event.Image}
+		if err := f.reconcile(ctx, cluster, "imagerepositories", imageRepository.GetNamespace(), imageRepository.GetName()); err != nil {
+			result.Error = err.Error()
+			result.Retryable = transientError(err)
+		}
+		results = append(results, result)
+	}
+
+	// The automations commit the new tags of the policies
+	for namespace := range namespaces {
+		listCtx, cancel := apiContext(ctx)
+		automations, err := cluster.Dynamic.Resource(f.resource("imageupdateautomations")).Namespace(namespace).List(listCtx, metav1.ListOptions{})
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		for _, automation := range automations.Items {
+			if err := f.reconcile(ctx, cluster, "imageupdateautomations", namespace, automation.GetName()); err != nil {
+				logger.Warning(fmt.Sprintf("Could not trigger the image update automation %s/%s: %s", namespace, automation.GetName(), err))
+			}
+		}
+	}
+
+	var updated []TargetResult
+	for _, result := range results {
+		if result.Succeeded() {
+			updated = append(updated, result)
+		} else {
+			Notify(ctx, Notification{Type: NotificationFailed, Text: fmt.Sprintf("Failed to trigger %s: %s", result.Target, result.Error), Event: event, Result: &result})
+		}
+	}
+	if len(updated) > 0 {
+		text := fmt.Sprintf("Triggered the flux image automation of %s:", event.Image)
+		for _, result := range updated {
+			text += fmt.Sprintf("\n- %s", result.Target)
+		}
+		Notify(ctx, Notification{Type: NotificationDeployed, Text: text, Event: event, Results: updated})
+	}
+
+	return append(results, skipped...), nil
+}
+
+// Pins the image policies of the image repository with the pin annotation of the branch and the
+// annotation of the repository of the push to the tag. Returns the results of the pinned and of the
+// skipped policies.
+func (f *FluxImageAutomation) pinPolicies(ctx context.Context, cluster *Cluster, event DeployEvent, defaultBranch bool, imageRepository unstructured.Unstructured) ([]TargetResult, []TargetResult, error) {
+	listCtx, cancel := apiContext(ctx)
+	policies, err := cluster.Dynamic.Resource(f.resource("imagepolicies")).Namespace(imageRepository.GetNamespace()).List(listCtx, metav1.ListOptions{})
+	cancel()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var results, skipped []TargetResult
+	for _, policy := range policies.Items {
+		branch, pinned := policy.GetAnnotations()[FluxPinAnnotationKey()]
+		if name, _, _ := unstructured.NestedString(policy.Object, "spec", "imageRepositoryRef", "name"); !pinned || name != imageRepository.GetName() || !fluxObjectOf(policy, event.Repository) {
+			continue
+		}
+		if (branch == "" && !defaultBranch) || (branch != "" && branch != event.Branch) {
+			continue
+		}
+
+		target := Target{Kind: "ImagePolicy", Name: policy.GetName(), Namespace: policy.GetNamespace()}
+		if reason := fluxSkipReason(policy, event); reason != "" {
+			skipped = append(skipped, f.skipped(ctx, event, target, reason))
+			continue
+		}
+		previousImage, _, _ := unstructured.NestedString(policy.Object, "status", "latestImage")
+		result := TargetResult{Target: target, PreviousImage: previousImage, Image: event.Image}
+		if err := f.pin(ctx, cluster, policy.GetNamespace(), policy.GetName(), ImageTag(event.Image)); err != nil {
+			result.Error = err.Error()
+			result.Retryable = transientError(err)
+		}
+		results = append(results, result)
+	}
+
+	return results, skipped, nil
+}
+
+// Selects exactly the tag with the filter of the image policy
+func (f *FluxImageAutomation) pin(ctx context.Context, cluster *Cluster, namespace string, name string, tag string) error {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"filterTags": map[string]interface{}{"pattern": "^" + regexp.QuoteMeta(tag) + "$"},
+			"policy":     map[string]interface{}{"alphabetical": map[string]string{"order": "asc"}, "semver": nil, "numerical": nil},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		globalLogger.Info(fmt.Sprintf("Dry run, not pinning the image policy %s/%s to %s", namespace, name, tag))
+		return nil
+	}
+
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	_, err = cluster.Dynamic.Resource(f.resource("imagepolicies")).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+
+	return err
+}
+
+// Requests an immediate reconciliation of the flux object
+func (f *FluxImageAutomation) reconcile(ctx context.Context, cluster *Cluster, resource string, namespace string, name string) error {
+	if dryRun {
+		globalLogger.Info(fmt.Sprintf("Dry run, not reconciling %s %s/%s", resource, namespace, name))
+		return nil
+	}
+	patch, err := annotationsPatch(map[string]interface{}{fluxRequestedAtAnnotation: time.Now().Format(time.RFC3339Nano)}, "")
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	_, err = cluster.Dynamic.Resource(f.resource(resource)).Namespace(namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{FieldManager: fieldManager})
+
+	return err
+}
+
+// Creates an image repository of the image and an image policy pinned to pushes of the branch
+func (f *FluxImageAutomation) create(ctx context.Context, cluster *Cluster, event DeployEvent, repository string) (*unstructured.Unstructured, error) {
+	name := fluxObjectName(repository)
+	apiVersion := "image.toolkit.fluxcd.io/" + f.APIVersion
+	imageRepository := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "ImageRepository",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   f.Namespace,
+			"annotations": map[string]interface{}{FluxRepositoryAnnotationKey(): event.Repository},
+		},
+		"spec": map[string]interface{}{"image": repository, "interval": f.Interval.String()},
+	}}
+	policy := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": apiVersion,
+		"kind":       "ImagePolicy",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   f.Namespace,
+			"annotations": map[string]interface{}{FluxPinAnnotationKey(): event.Branch, FluxRepositoryAnnotationKey(): event.Repository},
+		},
+		"spec": map[string]interface{}{
+			"imageRepositoryRef": map[string]interface{}{"name": name},
+			"filterTags":         map[string]interface{}{"pattern": "^" + regexp.QuoteMeta(ImageTag(event.Image)) + "$"},
+			"policy":             map[string]interface{}{"alphabetical": map[string]interface{}{"order": "asc"}},
+		},
+	}}
+	if dryRun {
+		globalLogger.Info(fmt.Sprintf("Dry run, not creating the image repository and policy %s/%s", f.Namespace, name))
+		return imageRepository, nil
+	}
+
+	globalLogger.Info(fmt.Sprintf("Creating the image repository and policy %s/%s of %s", f.Namespace, name, repository))
+	createCtx, cancel := apiContext(ctx)
+	defer cancel()
+	created, err := cluster.Dynamic.Resource(f.resource("imagerepositories")).Namespace(f.Namespace).Create(createCtx, imageRepository, metav1.CreateOptions{FieldManager: fieldManager})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cluster.Dynamic.Resource(f.resource("imagepolicies")).Namespace(f.Namespace).Create(createCtx, policy, metav1.CreateOptions{FieldManager: fieldManager}); err != nil && !apierrors.IsAlreadyExists(err) {
+		return nil, err
+	}
+
+	return created, nil
+}
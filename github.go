@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProviderGitHub = "github"
+	ProviderGitLab = "gitlab"
+)
+
+const (
+	GitHubReportDeployments = "deployments"
+	GitHubReportStatuses    = "statuses"
+	GitHubReportChecks      = "checks"
+)
+
+// Default name of the check run of deploys, which branch protection can require
+const DefaultGitHubCheckName = "kubernetes-internal-cd"
+
+// GitHubNotifier reports deploys to github as deployments with statuses, commit statuses and/or
+// check runs, so the outcome is visible on the commit and pull request
+type GitHubNotifier struct {
+	Token  string
+	APIURL string
+	// Deployments, commit statuses, check runs or any combination
+	Deployments bool
+	Statuses    bool
+	Checks      bool
+	// Name of the check run of each deploy
+	CheckName string
+
+	mutex sync.Mutex
+	// IDs of the created deployments by request and target
+	deployments map[string]providerDeployment
+	// IDs of the created check runs by request
+	checkRuns map[string]providerDeployment
+}
+
+type providerDeployment struct {
+	ID      int64
+	Created time.Time
+}
+
+// Deployments older than this are forgotten
+const providerDeploymentTTL = 24 * time.Hour
+
+// Returns the github api url of the github instance, https://api.github.com or <url>/api/v3 for enterprise servers
+func GitHubAPIURL(url string) string {
+	if url == "https://github.com" {
+		return "https://api.github.com"
+	}
+
+	return url + "/api/v3"
+}
+
+// Returns the environment of the target at the git provider
+func deploymentEnvironment(target Target) string {
+	if target.Environment != "" {
+		return target.Environment
+	}
+	if target.Cluster != "" {
+		return target.Cluster + "/" + target.Namespace
+	}
+
+	return target.Namespace
+}
+
+// Returns the context of commit statuses of the target, one per workload
+func statusContext(target Target) string {
+	if target.Cluster != "" {
+		return fmt.Sprintf("kubernetes-internal-cd/%s/%s/%s", target.Cluster, target.Namespace, target.Name)
+	}
+
+	return fmt.Sprintf("kubernetes-internal-cd/%s/%s", target.Namespace, target.Name)
+}
+
+// Sends a request to the github api and decodes the response into result, if given. Requests
+// without a payload have no body.
+func (n *GitHubNotifier) request(method string, path string, payload interface{}, result interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	request, err := http.NewRequest(method, n.APIURL+path, body)
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("accept", "application/vnd.github+json")
+	request.Header.Set("authorization", "Bearer "+n.Token)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from %s %s", response.StatusCode, method, path)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Github api reading the message and author of commits missing from the payload, nil without GITHUB_TOKEN
+var commitLookup *GitHubNotifier
+
+// Sets the message and author of the commit of the event from the github api
+func (n *GitHubNotifier) DescribeCommit(event *DeployEvent) error {
+	var commit struct {
+		Commit struct {
+			Message string `json:"message"`
+			Author  struct {
+				Name string `json:"name"`
+			} `json:"author"`
+		} `json:"commit"`
+		// The github user of the commit author, if known
+		Author *struct {
+			Login string `json:"login"`
+		} `json:"author"`
+	}
+	if err := n.request(http.MethodGet, fmt.Sprintf("/repos/%s/commits/%s", event.Repository, event.Sha), nil, &commit); err != nil {
+		return err
+	}
+
+	event.CommitMessage = commit.Commit.Message
+	event.CommitAuthor = commit.Commit.Author.Name
+	if commit.Author != nil && commit.Author.Login != "" {
+		event.CommitAuthor = fmt.Sprintf("%s (@%s)", commit.Commit.Author.Name, commit.Author.Login)
+	}
+
+	return nil
+}
+
+// Returns the deployment of the target of the request, creating it if necessary
+func (n *GitHubNotifier) deployment(notification Notification) (int64, error) {
+	target := notification.Result.Target
+	key := notification.Event.RequestID + "/" + DedupKey(target)
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if deployment, ok := n.deployments[key]; ok {
+		return deployment.ID, nil
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err := n.request(http.MethodPost, fmt.Sprintf("/repos/%s/deployments", notification.Event.Repository), map[string]interface{}{
+		"ref":         notification.Event.Sha,
+		"environment": deploymentEnvironment(target),
+		"description": fmt.Sprintf("Deploy %s to %s", ImageTag(notification.Result.Image), target),
+		"auto_merge":  false,
+		// Checks of the commit already passed before the image was built
+		"required_contexts":      []string{},
+		"transient_environment":  false,
+		"production_environment": NamespaceProtected(target.Namespace),
+		"payload": map[string]string{
+			"namespace": target.Namespace,
+			"workload":  target.Name,
+			"kind":      target.Kind,
+			"image":     notification.Result.Image,
+			"requestId": notification.Event.RequestID,
+		},
+	}, &created)
+	if err != nil {
+		return 0, err
+	}
+
+	if n.deployments == nil {
+		n.deployments = make(map[string]providerDeployment)
+	}
+	for deploymentKey, deployment := range n.deployments {
+		if time.Since(deployment.Created) > providerDeploymentTTL {
+			delete(n.deployments, deploymentKey)
+		}
+	}
+	n.deployments[key] = providerDeployment{ID: created.ID, Created: time.Now()}
+
+	return created.ID, nil
+}
+
+// Returns the markdown summary of the results of a deploy for its check run
+func checkRunSummary(results []TargetResult) string {
+	summary := "| Workload | Image | Result |\n| --- | --- | --- |\n"
+	for _, result := range results {
+		outcome := "succeeded"
+		if !result.Succeeded() {
+			outcome = "failed: " + strings.Replace(result.Error, "|", "\\|", -1)
+		}
+		summary += fmt.Sprintf("| %s | `%s` | %s |\n", result.Target, ImageTag(result.Image), outcome)
+	}
+
+	return summary
+}
+
+// Creates the check run of the deploy when it started and completes it once all rollouts completed
+func (n *GitHubNotifier) reportCheckRun(notification Notification) error {
+	event := notification.Event
+	key := event.RequestID
+
+	n.mutex.Lock()
+	checkRun, ok := n.checkRuns[key]
+	n.mutex.Unlock()
+
+	payload := map[string]interface{}{
+		"name":        n.CheckName,
+		"head_sha":    event.Sha,
+		"external_id": event.RequestID,
+	}
+	if notification.Type == NotificationStarted {
+		if ok {
+			return nil
+		}
+		payload["status"] = "in_progress"
+		payload["started_at"] = event.ReceivedAt.UTC().Format(time.RFC3339)
+		payload["output"] = map[string]string{"title": "Deploying " + ImageTag(event.Image), "summary": notification.Text}
+	} else {
+		conclusion := "success"
+		for _, result := range notification.Results {
+			if !result.Succeeded() {
+				conclusion = "failure"
+			}
+		}
+		payload["status"] = "completed"
+		payload["conclusion"] = conclusion
+		payload["completed_at"] = time.Now().UTC().Format(time.RFC3339)
+		payload["output"] = map[string]string{"title": notification.Text, "summary": checkRunSummary(notification.Results)}
+	}
+
+	if ok {
+		return n.request(http.MethodPatch, fmt.Sprintf("/repos/%s/check-runs/%d", event.Repository, checkRun.ID), payload, nil)
+	}
+
+	// Deploys without a started notification, e.g. rollbacks, get a completed check run right away
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	if err := n.request(http.MethodPost, fmt.Sprintf("/repos/%s/check-runs", event.Repository), payload, &created); err != nil {
+		return err
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if n.checkRuns == nil {
+		n.checkRuns = make(map[string]providerDeployment)
+	}
+	for checkRunKey, checkRun := range n.checkRuns {
+		if time.Since(checkRun.Created) > providerDeploymentTTL {
+			delete(n.checkRuns, checkRunKey)
+		}
+	}
+	n.checkRuns[key] = providerDeployment{ID: created.ID, Created: time.Now()}
+
+	return nil
+}
+
+func (n *GitHubNotifier) Notify(notification Notification) error {
+	if notification.Type == NotificationStarted || notification.Type == NotificationCompleted {
+		if !n.Checks || notification.Event.Sha == "" || notification.Event.Provider == ProviderGitLab {
+			return nil
+		}
+		return n.reportCheckRun(notification)
+	}
+	if notification.Result == nil || notification.Event.Sha == "" || notification.Event.Provider == ProviderGitLab {
+		return nil
+	}
+	target := notification.Result.Target
+
+	// Image updated means the rollout is in progress
+	deploymentState, commitState := "in_progress", "pending"
+	switch notification.Type {
+	case NotificationRolloutSucceeded:
+		deploymentState, commitState = "success", "success"
+	case NotificationFailed, NotificationRolloutFailed:
+		deploymentState, commitState = "failure", "failure"
+	}
+	// Github limits descriptions to 140 characters
+	description := notification.Text
+	if len(description) > 140 {
+		description = description[:137] + "..."
+	}
+
+	if n.Deployments {
+		deploymentID, err := n.deployment(notification)
+		if err != nil {
+			return err
+		}
+		err = n.request(http.MethodPost, fmt.Sprintf("/repos/%s/deployments/%d/statuses", notification.Event.Repository, deploymentID), map[string]interface{}{
+			"state":         deploymentState,
+			"description":   description,
+			"environment":   deploymentEnvironment(target),
+			"auto_inactive": deploymentState == "success",
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	if n.Statuses {
+		err := n.request(http.MethodPost, fmt.Sprintf("/repos/%s/statuses/%s", notification.Event.Repository, notification.Event.Sha), map[string]string{
+			"state":       commitState,
+			"description": description,
+			"context":     statusContext(target),
+		}, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (n *GitHubNotifier) Name() string {
+	return "github"
+}
+
+func (n *GitHubNotifier) Types() []string {
+	types := []string{NotificationSucceeded, NotificationRolledBack, NotificationFailed, NotificationRolloutSucceeded, NotificationRolloutFailed}
+	if n.Checks {
+		types = append(types, NotificationStarted, NotificationCompleted)
+	}
+
+	return types
+}
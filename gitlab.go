@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// GitLabNotifier reports deploys of gitlab repositories to the deployments api,
+// so the environments of the project show what reached the cluster
+type GitLabNotifier struct {
+	Token  string
+	APIURL string
+
+	mutex sync.Mutex
+	// IDs of the created deployments by request and target
+	deployments map[string]providerDeployment
+}
+
+// Sends a request to the gitlab api and decodes the response into result, if given
+func (n *GitLabNotifier) request(method string, path string, payload interface{}, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(method, n.APIURL+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	request.Header.Set("private-token", n.Token)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from %s %s", response.StatusCode, method, path)
+	}
+	if result == nil {
+		return nil
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+func (n *GitLabNotifier) Notify(notification Notification) error {
+	if notification.Result == nil || notification.Event.Sha == "" || notification.Event.Provider != ProviderGitLab {
+		return nil
+	}
+	target := notification.Result.Target
+	project := "/projects/" + url.PathEscape(notification.Event.Repository)
+	key := notification.Event.RequestID + "/" + DedupKey(target)
+
+	// Image updated means the rollout is running
+	status := "running"
+	switch notification.Type {
+	case NotificationRolloutSucceeded:
+		status = "success"
+	case NotificationFailed, NotificationRolloutFailed:
+		status = "failed"
+	}
+
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if deployment, ok := n.deployments[key]; ok {
+		return n.request(http.MethodPut, fmt.Sprintf("%s/deployments/%d", project, deployment.ID), map[string]string{"status": status}, nil)
+	}
+
+	var created struct {
+		ID int64 `json:"id"`
+	}
+	err := n.request(http.MethodPost, project+"/deployments", map[string]interface{}{
+		"environment": deploymentEnvironment(target),
+		"sha":         notification.Event.Sha,
+		"ref":         notification.Event.Branch,
+		"tag":         false,
+		"status":      status,
+	}, &created)
+	if err != nil {
+		return err
+	}
+
+	if n.deployments == nil {
+		n.deployments = make(map[string]providerDeployment)
+	}
+	for deploymentKey, deployment := range n.deployments {
+		if time.Since(deployment.Created) > providerDeploymentTTL {
+			delete(n.deployments, deploymentKey)
+		}
+	}
+	n.deployments[key] = providerDeployment{ID: created.ID, Created: time.Now()}
+
+	return nil
+}
+
+func (n *GitLabNotifier) Name() string {
+	return "gitlab"
+}
+
+func (n *GitLabNotifier) Types() []string {
+	return []string{NotificationSucceeded, NotificationRolledBack, NotificationFailed, NotificationRolloutSucceeded, NotificationRolloutFailed}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"text/template"
+)
+
+var gitWriteBacksTotal = NewCounterVec("kicd_git_write_backs_total", "Images committed to the manifests repository per outcome.", "outcome")
+
+// GitWriteBack commits deployed images to a repository of manifests, so git stays consistent with
+// the cluster for GitOps tools syncing the repository. The repository is cloned once and reset to
+// the remote branch before each commit.
+type GitWriteBack struct {
+	// https or ssh url of the repository
+	URL    string
+	Branch string
+	// Token sent as basic auth password to https urls
+	Token string
+	// Private key and optional known hosts file for ssh urls
+	SSHKeyPath     string
+	KnownHostsPath string
+	// Template of the path of the manifest of a target in the repository, unless set by the git-path
+	// annotation of the workload
+	Path        *template.Template
+	AuthorName  string
+	AuthorEmail string
+	// Only commit the image without patching the workloads, which are updated by the GitOps tool
+	Only bool
+	// Directory of the clone
+	Dir string
+
+	mutex sync.Mutex
+}
+
+// Active write-back, nil if images are only patched in the cluster
+var gitWriteBack *GitWriteBack
+
+// Pushes rejected because the branch moved are retried on top of it
+const gitPushAttempts = 3
+
+// Returns the annotation key holding the path of the manifest of a workload in the manifests repository
+func GitPathAnnotationKey() string {
+	return labelPrefix + "git-path"
+}
+
+// Returns the image without its tag or digest
+func ImageRepository(image string) string {
+	if position := strings.Index(image, "@"); position >= 0 {
+		image = image[:position]
+	}
+	if position := strings.LastIndex(image, ":"); position >= 0 && !strings.Contains(image[position:], "/") {
+		image = image[:position]
+	}
+
+	return image
+}
+
+// Returns the manifest with all images of the repository of the image replaced by the image and
+// whether any image of the repository was found
+func replaceManifestImages(manifest []byte, image string) ([]byte, bool) {
+	pattern := regexp.MustCompile(`(?m)(image:[ \t]*["']?)` + regexp.QuoteMeta(ImageRepository(image)) + `(?::[\w.-]+)?(?:@sha256:[0-9a-fA-F]+)?(["']?[ \t]*(?:#.*)?)$`)
+	if !pattern.Match(manifest) {
+		return manifest, false
+	}
+
+	return pattern.ReplaceAll(manifest, []byte("${1}"+strings.Replace(image, "$", "$$", -1)+"${2}")), true
+}
+
+// Clones the repository, or resets an existing clone to the remote branch
+func (g *GitWriteBack) Sync(ctx context.Context) error {
+	if _, err := os.Stat(filepath.Join(g.Dir, ".git")); os.IsNotExist(err) {
+		_, err := g.git(ctx, "", "clone", "--branch", g.Branch, "--single-branch", g.URL, g.Dir)
+		return err
+	}
+
+	for _, args := range [][]string{
+		{"fetch", "origin", g.Branch},
+		{"reset", "--hard", "origin/" + g.Branch},
+		{"clean", "-fd"},
+	} {
+		if _, err := g.git(ctx, g.Dir, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Commits the image to the manifest of the target at the path, the path template if empty, and
+// pushes the commit. Kustomizations, also of a directory at the path, get the image in their images
+// transformer. Nothing is committed if the manifest already has the image.
+func (g *GitWriteBack) Commit(ctx context.Context, target Target, path string, image string) error {
+	// The image is written into YAML and the commit message as is
+	if !imageReferencePattern.MatchString(image) {
+		gitWriteBacksTotal.Inc("failed")
+		return fmt.Errorf("%q is not a valid image reference", image)
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if path == "" {
+		var rendered bytes.Buffer
+		if err := g.Path.Execute(&rendered, target); err != nil {
+			return err
+		}
+		path = rendered.String()
+	}
+	path = filepath.Clean("/" + path)[1:]
+
+	var err error
+	for attempt := 1; attempt <= gitPushAttempts; attempt++ {
+		if err = g.Sync(ctx); err != nil {
+			break
+		}
+
+		file := filepath.Join(g.Dir, path)
+		// The kustomization of a directory
+		if info, statErr := os.Stat(file); statErr == nil && info.IsDir() {
+			for _, name := range kustomizationFileNames {
+				if _, statErr := os.Stat(filepath.Join(file, name)); statErr == nil {
+					file = filepath.Join(file, name)
+					break
+				}
+			}
+		}
+
+		manifest, readErr := ioutil.ReadFile(file)
+		if readErr != nil {
+			err = fmt.Errorf("could not read %s: %s", path, readErr)
+			break
+		}
+		var updated []byte
+		var found bool
+		if isKustomization(file) {
+			if updated, found, err = updateKustomizationImages(manifest, image); err != nil {
+				err = fmt.Errorf("could not parse %s: %s", path, err)
+				break
+			}
+		} else {
+			updated, found = replaceManifestImages(manifest, image)
+		}
+		if !found {
+			err = fmt.Errorf("%s has no image of %s", path, ImageRepository(image))
+			break
+		}
+		if bytes.Equal(updated, manifest) {
+			return nil
+		}
+		if err = ioutil.WriteFile(file, updated, 0644); err != nil {
+			break
+		}
+
+		message := fmt.Sprintf("Deploy %s to %s", image, target)
+		if _, err = g.git(ctx, g.Dir, "add", "--", file); err != nil {
+			break
+		}
+		if _, err = g.git(ctx, g.Dir, "commit", "-m", message); err != nil {
+			break
+		}
+		// The branch may have moved since the fetch
+		if _, err = g.git(ctx, g.Dir, "push", "origin", "HEAD:"+g.Branch); err == nil {
+			globalLogger.Info(fmt.Sprintf("Committed %s of %s to %s", image, target, path))
+			gitWriteBacksTotal.Inc("succeeded")
+			return nil
+		}
+	}
+
+	gitWriteBacksTotal.Inc("failed")
+	return err
+}
+
+// Runs git in the directory as the author, authenticating with the token or ssh key without
+// exposing them in the arguments. Returns the output.
+func (g *GitWriteBack) git(ctx context.Context, dir string, args ...string) (string, error) {
+	command := exec.CommandContext(ctx, "git", args...)
+	command.Dir = dir
+	command.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0",
+		"GIT_AUTHOR_NAME="+g.AuthorName, "GIT_AUTHOR_EMAIL="+g.AuthorEmail,
+		"GIT_COMMITTER_NAME="+g.AuthorName, "GIT_COMMITTER_EMAIL="+g.AuthorEmail)
+	if g.Token != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + g.Token))
+		command.Env = append(command.Env, "GIT_CONFIG_COUNT=1", "GIT_CONFIG_KEY_0=http.extraHeader", "GIT_CONFIG_VALUE_0=Authorization: Basic "+credentials)
+	}
+	if g.SSHKeyPath != "" {
+		sshCommand := "ssh -o IdentitiesOnly=yes -o BatchMode=yes -i " + g.SSHKeyPath
+		if g.KnownHostsPath != "" {
+			sshCommand += " -o UserKnownHostsFile=" + g.KnownHostsPath
+		} else {
+			sshCommand += " -o StrictHostKeyChecking=accept-new"
+		}
+		command.Env = append(command.Env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+
+	output, err := command.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
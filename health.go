@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Informer caches which have to be synced before the server is ready, by name
+var cacheSyncs = struct {
+	sync.Mutex
+	checks map[string]func() bool
+}{checks: make(map[string]func() bool)}
+
+// Registers a cache, e.g. the HasSynced of an informer, which has to be synced before the server
+// becomes ready and accepts webhooks
+func RegisterCacheSync(name string, synced func() bool) {
+	cacheSyncs.Lock()
+	defer cacheSyncs.Unlock()
+	cacheSyncs.checks[name] = synced
+}
+
+// Returns the names of the registered caches which are not synced yet
+func UnsyncedCaches() []string {
+	cacheSyncs.Lock()
+	defer cacheSyncs.Unlock()
+
+	var unsynced []string
+	for name, synced := range cacheSyncs.checks {
+		if !synced() {
+			unsynced = append(unsynced, name)
+		}
+	}
+	sort.Strings(unsynced)
+
+	return unsynced
+}
+
+// Liveness probe, the server is alive as long as it responds
+func HealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+}
+
+// Readiness probe, checks the connection to the kubernetes api, that the signing keys are available
+// and the caches are synced and fails once the server is shutting down or isn't the leader
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+
+	// Stop receiving traffic while in-flight deploys finish
+	if ShuttingDown() {
+		checks["shutdown"] = "shutting down"
+		ready = false
+	}
+
+	if _, err := kubeSet.Discovery().ServerVersion(); err != nil {
+		checks["kubernetes"] = err.Error()
+		ready = false
+	} else {
+		checks["kubernetes"] = "ok"
+	}
+
+	if keys, err := keySource.Keys(); err != nil {
+		checks["signingKeys"] = err.Error()
+		ready = false
+	} else if len(keys) == 0 {
+		checks["signingKeys"] = "no signing keys found"
+		ready = false
+	} else {
+		checks["signingKeys"] = "ok"
+	}
+
+	if leaderElection != nil {
+		if leaderElection.IsLeader() {
+			checks["leader"] = "ok"
+		} else {
+			checks["leader"] = "another replica is the leader"
+			ready = false
+		}
+	}
+
+	if unsynced := UnsyncedCaches(); len(unsynced) > 0 {
+		checks["caches"] = "not synced: " + strings.Join(unsynced, ", ")
+		ready = false
+	} else {
+		checks["caches"] = "ok"
+	}
+
+	status := 200
+	if !ready {
+		globalLogger.Warning("Not ready: ", checks)
+		status = 503
+	}
+	WriteJSON(w, status, checks)
+}
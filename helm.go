@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Annotations helm sets on the resources of a release
+const (
+	helmReleaseNameAnnotation      = "meta.helm.sh/release-name"
+	helmReleaseNamespaceAnnotation = "meta.helm.sh/release-namespace"
+)
+
+// Value of the release set to the tag of the image, unless set by the helm-value annotation
+const DefaultHelmValue = "image.tag"
+
+// HelmRelease is the helm release of a workload, which is upgraded with the tag of the new image as
+// a value instead of patching the workload, as the next upgrade of the release would revert the patch
+type HelmRelease struct {
+	Name      string
+	Namespace string
+	// Chart the release is upgraded with, e.g. oci://registry.example.com/charts/api, and its repository
+	Chart      string
+	Repository string
+	// Dot separated path of the value set to the tag, e.g. image.tag
+	Value string
+}
+
+// Returns the annotation key holding the chart of the release of a workload, which opts its
+// workload into helm upgrades
+func HelmChartAnnotationKey() string {
+	return labelPrefix + "helm-chart"
+}
+
+// Returns the annotation key holding the url of the chart repository of a workload
+func HelmRepositoryAnnotationKey() string {
+	return labelPrefix + "helm-repository"
+}
+
+// Returns the annotation key holding the path of the value set to the image tag
+func HelmValueAnnotationKey() string {
+	return labelPrefix + "helm-value"
+}
+
+// Returns the helm release of the workload if it was installed by helm and has a chart annotation,
+// nil otherwise
+func HelmReleaseOf(meta metav1.ObjectMeta) *HelmRelease {
+	chart := meta.Annotations[HelmChartAnnotationKey()]
+	name := meta.Annotations[helmReleaseNameAnnotation]
+	if chart == "" || name == "" {
+		return nil
+	}
+
+	release := &HelmRelease{
+		Name:       name,
+		Namespace:  meta.Annotations[helmReleaseNamespaceAnnotation],
+		Chart:      chart,
+		Repository: meta.Annotations[HelmRepositoryAnnotationKey()],
+		Value:      meta.Annotations[HelmValueAnnotationKey()],
+	}
+	if release.Namespace == "" {
+		release.Namespace = meta.Namespace
+	}
+	if release.Value == "" {
+		release.Value = DefaultHelmValue
+	}
+
+	return release
+}
+
+// Upgrades of a release by namespace and name, helm fails upgrades of a release with another in progress
+var helmReleaseLocks = struct {
+	sync.Mutex
+	locks map[string]*sync.Mutex
+}{locks: make(map[string]*sync.Mutex)}
+
+func helmReleaseLock(namespace string, name string) *sync.Mutex {
+	helmReleaseLocks.Lock()
+	defer helmReleaseLocks.Unlock()
+	key := namespace + "/" + name
+	if helmReleaseLocks.locks[key] == nil {
+		helmReleaseLocks.locks[key] = &sync.Mutex{}
+	}
+
+	return helmReleaseLocks.locks[key]
+}
+
+// Returns the value at the dot separated path of the values of a release
+func helmValue(values map[string]interface{}, path string) (interface{}, bool) {
+	parts := strings.Split(path, ".")
+	for _, part := range parts[:len(parts)-1] {
+		nested, ok := values[part].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		values = nested
+	}
+	value, ok := values[parts[len(parts)-1]]
+
+	return value, ok
+}
+
+// Returns the image repository the chart renders with the tag value, from the repository value next
+// to it (e.g. image.repository for image.tag) with an optional registry value, or the repository of
+// the current image of the workload if the chart has no such value
+func (r *HelmRelease) chartRepository(values map[string]interface{}, currentImage string) string {
+	parent := ""
+	if position := strings.LastIndex(r.Value, "."); position >= 0 {
+		parent = r.Value[:position+1]
+	}
+	repository, _ := helmValue(values, parent+"repository")
+	if repository, ok := repository.(string); ok && repository != "" {
+		registry, _ := helmValue(values, parent+"registry")
+		if registry, ok := registry.(string); ok && registry != "" {
+			repository = strings.TrimSuffix(registry, "/") + "/" + repository
+		}
+		return repository
+	}
+
+	return ImageRepository(currentImage)
+}
+
+// Upgrades the release to the tag of the image, keeping its other values and the version of its
+// chart. Only the tag is set, so images of another repository than the one of the chart are
+// rejected. Upgrades of a release are serialized, targets of a release deployed together share
+// the first upgrade.
+func (r *HelmRelease) Upgrade(ctx context.Context, image string, currentImage string) error {
+	// Tags of version 1 payloads aren't validated, and --set-string parses commas and brackets
+	if tag := ImageTag(image); !imageTagPattern.MatchString(tag) {
+		return fmt.Errorf("the tag %q of %s is not a valid image tag", tag, image)
+	}
+
+	lock := helmReleaseLock(r.Namespace, r.Name)
+	lock.Lock()
+	defer lock.Unlock()
+
+	output, err := helm(ctx, "get", "values", r.Name, "--namespace", r.Namespace, "--all", "--output", "json")
+	if err != nil {
+		return err
+	}
+	var values map[string]interface{}
+	if err := json.Unmarshal([]byte(output), &values); err != nil {
+		return fmt.Errorf("could not parse the values of release %s: %s", r.Name, err)
+	}
+	if repository := r.chartRepository(values, currentImage); NormalizeImage(repository) != NormalizeImage(ImageRepository(image)) {
+		return fmt.Errorf("the image %s is not of the repository %s of release %s, which only sets %s", image, repository, r.Name, r.Value)
+	}
+	if tag, ok := helmValue(values, r.Value); ok && fmt.Sprint(tag) == ImageTag(image) {
+		globalLogger.Info(fmt.Sprintf("Helm release %s in namespace %s already has %s=%s", r.Name, r.Namespace, r.Value, ImageTag(image)))
+		return nil
+	}
+
+	output, err = helm(ctx, "get", "metadata", r.Name, "--namespace", r.Namespace, "--output", "json")
+	if err != nil {
+		return err
+	}
+	var metadata struct {
+		Version string `json:"version"`
+	}
+	if err := json.Unmarshal([]byte(output), &metadata); err != nil {
+		return fmt.Errorf("could not parse the metadata of release %s: %s", r.Name, err)
+	}
+
+	args := []string{"upgrade", r.Name, r.Chart, "--namespace", r.Namespace, "--version", metadata.Version, "--reuse-values", "--set-string", r.Value + "=" + ImageTag(image)}
+	if r.Repository != "" {
+		args = append(args, "--repo", r.Repository)
+	}
+	if _, err := helm(ctx, args...); err != nil {
+		return err
+	}
+	globalLogger.Info(fmt.Sprintf("Upgraded helm release %s in namespace %s with %s=%s", r.Name, r.Namespace, r.Value, ImageTag(image)))
+
+	return nil
+}
+
+// Runs helm and returns its output, without the warnings written to stderr
+func helm(ctx context.Context, args ...string) (string, error) {
+	output, err := exec.CommandContext(ctx, "helm", args...).Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return "", fmt.Errorf("helm %s: %s: %s", args[0], err, strings.TrimSpace(string(exitErr.Stderr)))
+	} else if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
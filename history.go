@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+// HistoryEntry is a single deploy of a target, kept in the history annotation of the workload
+type HistoryEntry struct {
+	Time          time.Time `json:"time"`
+	Sha           string    `json:"sha"`
+	Image         string    `json:"image"`
+	PreviousImage string    `json:"previousImage,omitempty"`
+	Outcome       string    `json:"outcome"`
+	Error         string    `json:"error,omitempty"`
+	// ID of the audit entry of the triggering webhook request
+	Delivery  string `json:"delivery,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+	// Whether the deploy rolled back to an image of the history
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+// Returns the annotation key holding the deploy history of workloads
+func HistoryAnnotationKey() string {
+	return labelPrefix + "history"
+}
+
+// Parses the deploy history of the given annotations, oldest first
+func ParseHistory(annotations map[string]string) ([]HistoryEntry, error) {
+	value, ok := annotations[HistoryAnnotationKey()]
+	if !ok {
+		return nil, nil
+	}
+
+	var history []HistoryEntry
+	if err := json.Unmarshal([]byte(value), &history); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// Returns the history annotation with the entry appended, dropping the oldest entries above historySize
+func appendHistory(meta metav1.ObjectMeta, entry HistoryEntry) (string, error) {
+	history, err := ParseHistory(meta.Annotations)
+	if err != nil {
+		globalLogger.Warning(fmt.Sprintf("Replacing malformed history of %s in namespace %s: %s", meta.Name, meta.Namespace, err))
+		history = nil
+	}
+	history = append(history, entry)
+	if len(history) > historySize {
+		history = history[len(history)-historySize:]
+	}
+
+	value, err := json.Marshal(history)
+
+	return string(value), err
+}
+
+// Records a deploy in the database and the history annotation of the target workload, retrying on conflicts
+func RecordHistory(ctx context.Context, target Target, entry HistoryEntry) error {
+	if dryRun {
+		return nil
+	}
+	if store != nil {
+		if err := store.RecordDeploy(target, entry); err != nil {
+			globalLogger.Error(fmt.Sprintf("Could not store the deploy of %s: %s", target, err))
+		}
+	}
+	if historySize <= 0 {
+		return nil
+	}
+	cluster, err := ClusterFor(target.Cluster)
+	if err != nil {
+		return err
+	}
+
+	// Only the history annotation is patched, conflicting if another deploy appended to it meanwhile
+	return retry.RetryOnConflict(kubeRetry, func() error {
+		ctx, cancel := apiContext(ctx)
+		defer cancel()
+
+		meta, _, err := getWorkload(ctx, cluster, target)
+		if err != nil {
+			return err
+		}
+		value, err := appendHistory(meta, entry)
+		if err != nil {
+			return err
+		}
+		patch, err := annotationsPatch(map[string]interface{}{HistoryAnnotationKey(): value}, meta.ResourceVersion)
+		if err != nil {
+			return err
+		}
+
+		return patchWorkload(ctx, cluster, target, types.MergePatchType, patch)
+	})
+}
+
+// Returns the deploy history of the workload of the cluster, newest first. The database keeps
+// the history beyond HISTORY_SIZE and of deleted workloads.
+func TargetHistory(ctx context.Context, clusterName string, kind string, namespace string, name string) ([]HistoryEntry, error) {
+	cluster, err := ClusterFor(clusterName)
+	if err != nil {
+		return nil, err
+	}
+	if store != nil {
+		return store.History(cluster.Name, kind, namespace, name)
+	}
+
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+	var meta metav1.ObjectMeta
+	switch kind {
+	case KindDeployment:
+		result, err := cluster.Kube.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = result.ObjectMeta
+	case KindStatefulSet:
+		result, err := cluster.Kube.AppsV1().StatefulSets(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		meta = result.ObjectMeta
+	default:
+		return nil, fmt.Errorf("unknown target kind %s", kind)
+	}
+
+	history, err := ParseHistory(meta.Annotations)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(history)-1; i < j; i, j = i+1, j-1 {
+		history[i], history[j] = history[j], history[i]
+	}
+
+	return history, nil
+}
+
+// Returns the deploy history of the workload given by the kind (default deployment), namespace, name and cluster (default local) parameters.
+// The optional outcome, since and until parameters filter the history, limit and cursor page through it.
+func HistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	query := r.URL.Query()
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = KindDeployment
+	}
+	namespace := query.Get("namespace")
+	name := query.Get("name")
+	if namespace == "" || name == "" {
+		http.Error(w, "namespace and name are required", 400)
+		return
+	}
+	if !NamespaceAllowed(namespace) {
+		http.Error(w, "namespace is not in WATCH_NAMESPACES", 403)
+		return
+	}
+
+	cluster := query.Get("cluster")
+	if _, err := ClusterFor(cluster); err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+
+	page, err := ParseAuditQuery(query, 100)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	history, err := TargetHistory(r.Context(), cluster, kind, namespace, name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	entries, next, err := page.HistoryPage(history)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	WritePage(w, entries, next)
+}
@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	AgentMessageDeploy = "deploy"
+	AgentMessagePing   = "ping"
+)
+
+// AgentMessage is a line of the stream from the hub to an agent
+type AgentMessage struct {
+	Type  string       `json:"type"`
+	Event *DeployEvent `json:"event,omitempty"`
+}
+
+// AgentResults are the results of a deploy forwarded to an agent
+type AgentResults struct {
+	Event   DeployEvent    `json:"event"`
+	Results []TargetResult `json:"results"`
+	Error   string         `json:"error,omitempty"`
+}
+
+var agentsConnected = NewGaugeVec("kicd_agents_connected", "Whether the agent is connected to the hub.", "agent")
+var agentEventsDropped = NewCounterVec("kicd_agent_events_dropped_total", "Deploys which could not be forwarded to an agent because its backlog was full.", "agent")
+
+// Deploys kept per agent while it is disconnected or its stream is behind, the newest per repository and branch
+const agentBacklogSize = 100
+
+// Hub forwards verified deploys to agents in clusters without inbound connectivity.
+// Agents connect outbound and receive the deploys as a stream of json lines.
+type Hub struct {
+	// Agent names by their tokens
+	Tokens map[string]string
+
+	mutex  sync.Mutex
+	agents map[string]chan DeployEvent
+	// Deploys not sent to agents yet, oldest first, replayed once the agent connects
+	backlogs map[string][]DeployEvent
+}
+
+// Parses AGENT_TOKENS, a comma separated list of <agent>=<token>
+func ParseAgentTokens(value string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for i, agentToken := range splitList(value) {
+		values := strings.SplitN(agentToken, "=", 2)
+		if len(values) != 2 || values[0] == "" || values[1] == "" {
+			return nil, fmt.Errorf("agent token %d is invalid, <agent>=<token> is required", i)
+		}
+		tokens[values[1]] = values[0]
+	}
+
+	return tokens, nil
+}
+
+// Returns the name of the agent of the bearer token of the request
+func (h *Hub) authorize(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for agentToken, agent := range h.Tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(agentToken)) == 1 {
+			return agent, true
+		}
+	}
+
+	return "", false
+}
+
+// Sends the event to all connected agents and returns their names. Agents which are disconnected or
+// whose stream is behind get the event once they connect.
+func (h *Hub) Forward(event DeployEvent) []string {
+	if h == nil {
+		return nil
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var forwarded []string
+	seen := make(map[string]bool)
+	for _, agent := range h.Tokens {
+		if seen[agent] {
+			continue
+		}
+		seen[agent] = true
+		// Events are sent in order, after the backlog
+		if events, ok := h.agents[agent]; ok {
+			h.replayBacklog(agent, events)
+			if len(h.backlogs[agent]) == 0 {
+				select {
+				case events <- event:
+					forwarded = append(forwarded, agent)
+					continue
+				default:
+				}
+			}
+		}
+		h.addToBacklog(agent, event)
+	}
+
+	return forwarded
+}
+
+// Keeps the event for the agent, replacing an older event of the same repository and branch, which
+// the agent would only deploy to be replaced right away. The oldest event is dropped if the backlog is full.
+// Requires the mutex.
+func (h *Hub) addToBacklog(agent string, event DeployEvent) {
+	if h.backlogs == nil {
+		h.backlogs = make(map[string][]DeployEvent)
+	}
+	var backlog []DeployEvent
+	for _, queued := range h.backlogs[agent] {
+		if !strings.EqualFold(queued.Repository, event.Repository) || queued.Branch != event.Branch {
+			backlog = append(backlog, queued)
+		}
+	}
+	if len(backlog) >= agentBacklogSize {
+		globalLogger.Warning(fmt.Sprintf("Backlog of agent %s is full, dropping request %s", agent, backlog[0].RequestID))
+		agentEventsDropped.Inc(agent)
+		backlog = backlog[1:]
+	}
+	h.backlogs[agent] = append(backlog, event)
+}
+
+// Moves the backlog of the agent into the stream as far as it fits. Requires the mutex.
+func (h *Hub) replayBacklog(agent string, events chan DeployEvent) {
+	backlog := h.backlogs[agent]
+	for len(backlog) > 0 {
+		select {
+		case events <- backlog[0]:
+			backlog = backlog[1:]
+		default:
+			h.backlogs[agent] = backlog
+			return
+		}
+	}
+	delete(h.backlogs, agent)
+}
+
+// Moves the backlog of a connected agent into its stream once the stream caught up
+func (h *Hub) refill(agent string, events chan DeployEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.agents[agent] == events {
+		h.replayBacklog(agent, events)
+	}
+}
+
+// Moves the events of a closed stream, which weren't sent to the agent, back into its backlog. Requires the mutex.
+func (h *Hub) requeue(agent string, events chan DeployEvent) {
+	var unsent []DeployEvent
+	for drained := false; !drained; {
+		select {
+		case event, ok := <-events:
+			if ok {
+				unsent = append(unsent, event)
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	// Unsent events are older than the backlog
+	backlog := h.backlogs[agent]
+	delete(h.backlogs, agent)
+	for _, event := range append(unsent, backlog...) {
+		h.addToBacklog(agent, event)
+	}
+}
+
+// Returns whether any agent is connected, which deploys the targets of other clusters
+func (h *Hub) HasAgents() bool {
+	if h == nil {
+		return false
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return len(h.agents) > 0
+}
+
+// Registers the connection of an agent, replacing a previous connection of the same agent
+func (h *Hub) connect(agent string) chan DeployEvent {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.agents == nil {
+		h.agents = make(map[string]chan DeployEvent)
+	}
+	if previous, ok := h.agents[agent]; ok {
+		close(previous)
+		h.requeue(agent, previous)
+	}
+	events := make(chan DeployEvent, agentBacklogSize)
+	h.agents[agent] = events
+	agentsConnected.Set(1, agent)
+	h.replayBacklog(agent, events)
+
+	return events
+}
+
+func (h *Hub) disconnect(agent string, events chan DeployEvent) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	// A newer connection of the agent already replaced this one
+	if h.agents[agent] != events {
+		return
+	}
+	delete(h.agents, agent)
+	agentsConnected.Set(0, agent)
+	h.requeue(agent, events)
+}
+
+// Streams the deploys to a connected agent, with pings keeping the connection open
+func (h *Hub) StreamHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	agent, ok := h.authorize(r)
+	if !ok {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	// Only the leader forwards deploys, agents connected to other replicas would never receive any
+	// and reconnect until they reach the leader
+	if !leaderElection.IsLeader() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, errNotLeader.Error(), 503)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming is not supported", 500)
+		return
+	}
+
+	events := h.connect(agent)
+	defer h.disconnect(agent, events)
+	logger := globalLogger.With(LogFields{"agent": agent, "source": ClientIP(r).String()})
+	logger.Info(fmt.Sprintf("Agent %s connected", agent))
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(200)
+	flusher.Flush()
+
+	encoder := json.NewEncoder(w)
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	for {
+		var message AgentMessage
+		select {
+		case <-r.Context().Done():
+			logger.Info(fmt.Sprintf("Agent %s disconnected", agent))
+			return
+		case event, ok := <-events:
+			if !ok {
+				logger.Info(fmt.Sprintf("Agent %s reconnected, closing the previous connection", agent))
+				return
+			}
+			message = AgentMessage{Type: AgentMessageDeploy, Event: &event}
+			h.refill(agent, events)
+		case <-ping.C:
+			message = AgentMessage{Type: AgentMessagePing}
+		}
+		if err := encoder.Encode(message); err != nil {
+			logger.Warning(fmt.Sprintf("Could not write to agent %s: %s", agent, err))
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// Receives the results of a forwarded deploy from an agent and notifies about them
+func (h *Hub) ResultsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+	agent, ok := h.authorize(r)
+	if !ok {
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+
+	bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var results AgentResults
+	if err := json.Unmarshal(bytes, &results); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	event := results.Event
+	logger := globalLogger.With(LogFields{"agent": agent, "requestId": event.RequestID, "repository": event.Repository})
+	if results.Error != "" {
+		logger.Error(fmt.Sprintf("Agent %s could not deploy: %s", agent, results.Error))
+		Notify(r.Context(), Notification{Type: NotificationFailed, Text: fmt.Sprintf("Agent %s could not deploy %s: %s", agent, event.Image, results.Error), Event: event})
+		w.WriteHeader(204)
+		return
+	}
+
+	// Targets of agents are reported with the agent as their cluster
+	var updated []TargetResult
+	for i := range results.Results {
+		result := &results.Results[i]
+		result.Target.Cluster = agent
+		if !result.Succeeded() {
+			logger.Error(fmt.Sprintf("Agent %s failed to update %s: %s", agent, result.Target, result.Error))
+			Notify(r.Context(), Notification{Type: NotificationFailed, Text: fmt.Sprintf("Failed to update %s: %s", result.Target, result.Error), Event: event, Result: result})
+			continue
+		}
+		updated = append(updated, *result)
+	}
+	logger.Info(fmt.Sprintf("Agent %s updated %d of %d targets", agent, len(updated), len(results.Results)))
+	if len(updated) > 0 {
+		text := fmt.Sprintf("Agent %s successfully updated %d targets with %s:", agent, len(updated), event.Image)
+		for _, result := range updated {
+			text += fmt.Sprintf("\n- %s (%s → %s)", result.Target, ImageTag(result.PreviousImage), ImageTag(result.Image))
+		}
+		Notify(r.Context(), Notification{Type: NotificationDeployed, Text: text, Event: event, Results: updated})
+	}
+
+	w.WriteHeader(204)
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"strings"
+)
+
+// ImagePolicy restricts deployable images to the given registries or repository prefixes, e.g. ghcr.io/myorg/
+type ImagePolicy struct {
+	Prefixes []string
+}
+
+// Returns the fully qualified name of an image, i.e. with registry and, on docker hub, the library namespace
+func NormalizeImage(image string) string {
+	slash := strings.Index(image, "/")
+	if slash == -1 {
+		return "docker.io/library/" + image
+	}
+	// The first component is a registry if it looks like a host
+	registry := image[:slash]
+	if !strings.ContainsAny(registry, ".:") && registry != "localhost" {
+		return "docker.io/" + image
+	}
+
+	return image
+}
+
+// Returns the prefix in the form of NormalizeImage. A prefix without "/" is a registry if it looks like a host.
+func normalizeImagePrefix(prefix string) string {
+	if !strings.Contains(prefix, "/") && (strings.ContainsAny(prefix, ".:") || prefix == "localhost") {
+		return prefix
+	}
+
+	return NormalizeImage(prefix)
+}
+
+// Returns whether the image may be deployed. Prefixes match whole path components, so
+// ghcr.io/myorg allows ghcr.io/myorg/api but not ghcr.io/myorg-evil/api.
+func (p *ImagePolicy) Allowed(image string) bool {
+	if strings.ContainsAny(image, " \t\n") {
+		return false
+	}
+
+	normalized := NormalizeImage(image)
+	for _, prefix := range p.Prefixes {
+		prefix = normalizeImagePrefix(prefix)
+		if !strings.HasPrefix(normalized, prefix) {
+			continue
+		}
+		// The prefix ends at a component, the image at its tag or digest
+		if rest := normalized[len(prefix):]; strings.HasSuffix(prefix, "/") || rest == "" || strings.ContainsAny(rest[:1], "/:@") {
+			return true
+		}
+	}
+
+	return false
+}
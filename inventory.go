@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ManagedTarget is a workload deployed by this controller with its current state
+type ManagedTarget struct {
+	Target
+	Repository string `json:"repository"`
+	// Empty if the workload follows the default branch of the repository
+	Branch string `json:"branch,omitempty"`
+	// Label or config target mapping the workload
+	Source       string     `json:"source"`
+	Image        string     `json:"image,omitempty"`
+	Sha          string     `json:"sha,omitempty"`
+	LastDeployed *time.Time `json:"lastDeployed,omitempty"`
+	LastOutcome  string     `json:"lastOutcome,omitempty"`
+	// Image of the latest successful deploy, which differs from the image if the workload drifted
+	DeployedImage string `json:"deployedImage,omitempty"`
+
+	// State of the rollout and deploy history of the listed workload, oldest first, so the
+	// dashboard doesn't get every workload again
+	rollout string
+	history []HistoryEntry
+}
+
+// Returns the repository of a label key created by LabelKey. Github owners can't contain
+// underscores, so the first one separates the owner from the repository.
+func repositoryFromLabelKey(key string) string {
+	return strings.Replace(strings.TrimPrefix(key, labelPrefix), "_", "/", 1)
+}
+
+// Returns the managed target of the workload with its current image and latest deploy
+func managedTarget(workload validationWorkload, target Target, repository string, branch string, source string) ManagedTarget {
+	managed := ManagedTarget{Target: target, Repository: repository, Branch: branch, Source: source, rollout: rolloutState(workload.Complete, workload.RolloutError)}
+	if target.ContainerPosition < len(workload.PodSpec.Containers) {
+		managed.Image = workload.PodSpec.Containers[target.ContainerPosition].Image
+		managed.Sha = ImageTag(managed.Image)
+	}
+	if history, err := ParseHistory(workload.Meta.Annotations); err == nil && len(history) > 0 {
+		managed.history = history
+		latest := history[len(history)-1]
+		managed.LastDeployed = &latest.Time
+		managed.LastOutcome = latest.Outcome
+		for i := len(history) - 1; i >= 0; i-- {
+			if history[i].Outcome == AuditOutcomeSucceeded {
+				managed.DeployedImage = history[i].Image
+				break
+			}
+		}
+	}
+
+	return managed
+}
+
+// Lists all labeled and configured targets of all clusters
+func ListManagedTargets(ctx context.Context) ([]ManagedTarget, error) {
+	var workloads []validationWorkload
+	for _, cluster := range AllClusters() {
+		clusterWorkloads, err := listValidationWorkloads(ctx, cluster, "", metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, clusterWorkloads...)
+	}
+
+	var targets []ManagedTarget
+	for _, workload := range workloads {
+		for key, value := range workload.Meta.Labels {
+			if !strings.HasPrefix(key, labelPrefix) || key == EnvironmentLabelKey() {
+				continue
+			}
+			branch, containerPosition, err := ParseLabelValue(value)
+			if err != nil {
+				continue
+			}
+
+			target := Target{
+				Kind:              workload.Kind,
+				Name:              workload.Meta.Name,
+				Namespace:         workload.Meta.Namespace,
+				ContainerPosition: containerPosition,
+				Environment:       workload.Meta.Labels[EnvironmentLabelKey()],
+				Email:             workload.Meta.Annotations[EmailAnnotationKey()],
+				SlackChannel:      workload.Meta.Annotations[SlackChannelAnnotationKey()],
+				Cluster:           workload.Cluster,
+				Paused:            workload.Meta.Annotations[PausedAnnotationKey()],
+			}
+			targets = append(targets, managedTarget(workload, target, repositoryFromLabelKey(key), branch, "label "+key))
+		}
+	}
+
+	if globalConfig != nil {
+		for i, targetConfig := range globalConfig.Targets {
+			for _, clusterName := range targetConfig.TargetClusters() {
+				cluster, err := ClusterFor(clusterName)
+				if err != nil {
+					return nil, err
+				}
+				selected, err := listValidationWorkloads(ctx, cluster, targetConfig.Namespace, metav1.ListOptions{LabelSelector: targetConfig.Selector})
+				if err != nil {
+					return nil, err
+				}
+				for _, workload := range selected {
+					target := targetConfig.Target(cluster.Name, workload.Kind, workload.Meta)
+					targets = append(targets, managedTarget(workload, target, targetConfig.Repository, targetConfig.Branch, fmt.Sprintf("config target %d", i)))
+				}
+			}
+		}
+	}
+
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].Cluster != targets[j].Cluster {
+			return targets[i].Cluster < targets[j].Cluster
+		}
+		if targets[i].Namespace != targets[j].Namespace {
+			return targets[i].Namespace < targets[j].Namespace
+		}
+		return targets[i].Name < targets[j].Name
+	})
+
+	return targets, nil
+}
+
+// Lists all managed targets, optionally filtered by ?repository=, ?namespace= and ?cluster=
+func TargetsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	targets, err := ListManagedTargets(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	query := r.URL.Query()
+	repository := query.Get("repository")
+	namespace := query.Get("namespace")
+	cluster := query.Get("cluster")
+	if cluster == LocalClusterName {
+		cluster = ""
+	}
+	_, filterCluster := query["cluster"]
+	filtered := []ManagedTarget{}
+	for _, target := range targets {
+		if repository != "" && !strings.EqualFold(target.Repository, repository) {
+			continue
+		}
+		if namespace != "" && target.Namespace != namespace {
+			continue
+		}
+		if filterCluster && target.Cluster != cluster {
+			continue
+		}
+		filtered = append(filtered, target)
+	}
+
+	WriteJSON(w, 200, filtered)
+}
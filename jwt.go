@@ -0,0 +1,338 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jwtHeader struct {
+	Algorithm string `json:"alg"`
+	KeyID     string `json:"kid"`
+}
+
+type jsonWebKey struct {
+	KeyType string `json:"kty"`
+	KeyID   string `json:"kid"`
+	N       string `json:"n"`
+	E       string `json:"e"`
+	Curve   string `json:"crv"`
+	X       string `json:"x"`
+	Y       string `json:"y"`
+}
+
+type JWTVerifier struct {
+	JWKSURL         string
+	StaticKey       crypto.PublicKey
+	Issuer          string
+	Audience        string
+	RepositoryClaim string
+
+	mutex     sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	// Serializes fetches of the key set without blocking lookups of known keys
+	fetchMutex sync.Mutex
+}
+
+// Returns the bearer token of the authorization header, if any
+func BearerToken(r *http.Request) string {
+	authorization := r.Header.Get("authorization")
+	if !strings.HasPrefix(authorization, "Bearer ") {
+		return ""
+	}
+
+	return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+}
+
+// Loads a PEM encoded public key used to verify tokens without a JWKS url
+func LoadPublicKey(path string) (crypto.PublicKey, error) {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(bytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	return x509.ParsePKIXPublicKey(block.Bytes)
+}
+
+func decodeSegment(segment string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(segment, "="))
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.KeyType {
+	case "RSA":
+		n, err := decodeSegment(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeSegment(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Curve != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeSegment(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %s", k.KeyType)
+}
+
+// Fetches the key set
+func (v *JWTVerifier) fetchKeys() (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(v.JWKSURL)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d fetching %s", response.StatusCode, v.JWKSURL)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&keySet); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, key := range keySet.Keys {
+		publicKey, err := key.publicKey()
+		if err != nil {
+			globalLogger.Warning(fmt.Sprintf("Skipping key %s of %s: %s", key.KeyID, v.JWKSURL, err))
+			continue
+		}
+		keys[key.KeyID] = publicKey
+	}
+
+	return keys, nil
+}
+
+// Returns the key with the given id and whether the key set was fetched within the last minute
+func (v *JWTVerifier) cachedKey(keyID string) (crypto.PublicKey, bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	return v.keys[keyID], time.Since(v.fetchedAt) < time.Minute
+}
+
+func (v *JWTVerifier) key(keyID string) (crypto.PublicKey, error) {
+	if v.StaticKey != nil {
+		return v.StaticKey, nil
+	}
+
+	if key, _ := v.cachedKey(keyID); key != nil {
+		return key, nil
+	}
+
+	// Unknown key, the key set may have been rotated. It's fetched at most once per minute and
+	// outside of the lock, so lookups of known keys don't wait for it.
+	v.fetchMutex.Lock()
+	defer v.fetchMutex.Unlock()
+	// Another request may have fetched it while waiting
+	key, fresh := v.cachedKey(keyID)
+	if key != nil {
+		return key, nil
+	}
+	if !fresh {
+		keys, err := v.fetchKeys()
+		if err != nil {
+			return nil, err
+		}
+		v.mutex.Lock()
+		v.keys = keys
+		v.fetchedAt = time.Now()
+		v.mutex.Unlock()
+		key = keys[keyID]
+	}
+	if key != nil {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown key id %s", keyID)
+}
+
+// Verifies the signature and claims of the token and checks that it was issued for the given repository
+func (v *JWTVerifier) Verify(token string, repository string) error {
+	claims, err := v.VerifyToken(token)
+	if err != nil {
+		return err
+	}
+
+	if claimRepository, _ := claims[v.RepositoryClaim].(string); !strings.EqualFold(claimRepository, repository) {
+		return fmt.Errorf("token was issued for repository %s", claimRepository)
+	}
+
+	return nil
+}
+
+// Verifies the signature, expiry, issuer and audience of the token and returns its claims
+func (v *JWTVerifier) VerifyToken(token string) (map[string]interface{}, error) {
+	segments := strings.Split(token, ".")
+	if len(segments) != 3 {
+		return nil, errors.New("malformed token")
+	}
+
+	headerBytes, err := decodeSegment(segments[0])
+	if err != nil {
+		return nil, err
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return nil, err
+	}
+	signature, err := decodeSegment(segments[2])
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := v.key(header.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(segments[0] + "." + segments[1]))
+
+	switch header.Algorithm {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("key is not an RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature); err != nil {
+			return nil, err
+		}
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return nil, errors.New("key is not an EC key or signature is malformed")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return nil, errors.New("invalid signature")
+		}
+	default:
+		return nil, fmt.Errorf("unsupported algorithm %s", header.Algorithm)
+	}
+
+	claimBytes, err := decodeSegment(segments[1])
+	if err != nil {
+		return nil, err
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimBytes, &claims); err != nil {
+		return nil, err
+	}
+
+	return claims, v.verifyClaims(claims)
+}
+
+func (v *JWTVerifier) verifyClaims(claims map[string]interface{}) error {
+	now := float64(time.Now().Unix())
+	// Allow for a bit of clock skew
+	leeway := float64(60)
+
+	expiry, ok := claims["exp"].(float64)
+	if !ok || now > expiry+leeway {
+		return errors.New("token is expired")
+	}
+	if notBefore, ok := claims["nbf"].(float64); ok && now < notBefore-leeway {
+		return errors.New("token is not valid yet")
+	}
+	if issuer, _ := claims["iss"].(string); issuer != v.Issuer {
+		return fmt.Errorf("unexpected issuer %s", issuer)
+	}
+	if !ClaimContains(claims, "aud", v.Audience) {
+		return errors.New("token was not issued for this audience")
+	}
+
+	return nil
+}
+
+// Returns whether the claim equals the value or, for list claims, contains it
+func ClaimContains(claims map[string]interface{}, claim string, value string) bool {
+	switch claimValue := claims[claim].(type) {
+	case string:
+		return claimValue == value
+	case []interface{}:
+		for _, v := range claimValue {
+			if v == value {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// OIDCConfiguration are the endpoints of an OpenID Connect issuer
+type OIDCConfiguration struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Discovers the configuration of an OpenID Connect issuer
+func DiscoverOIDC(issuer string) (OIDCConfiguration, error) {
+	var configuration OIDCConfiguration
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Get(strings.TrimRight(issuer, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return configuration, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return configuration, fmt.Errorf("unexpected status %d fetching the openid configuration of %s", response.StatusCode, issuer)
+	}
+
+	if err := json.NewDecoder(response.Body).Decode(&configuration); err != nil {
+		return configuration, err
+	}
+	if configuration.JWKSURI == "" {
+		return configuration, errors.New("openid configuration of " + issuer + " contains no jwks_uri")
+	}
+
+	return configuration, nil
+}
+
+// Discovers the JWKS url of an OpenID Connect issuer
+func DiscoverJWKSURL(issuer string) (string, error) {
+	configuration, err := DiscoverOIDC(issuer)
+	if err != nil {
+		return "", err
+	}
+
+	return configuration.JWKSURI, nil
+}
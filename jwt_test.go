@@ -0,0 +1,337 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Signs a token with RS256 for RSA and ES256 for EC keys, whatever alg the header names
+func signTestToken(t *testing.T, key crypto.Signer, header map[string]interface{}, claims map[string]interface{}) string {
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimBytes, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := base64.RawURLEncoding.EncodeToString(headerBytes) + "." + base64.RawURLEncoding.EncodeToString(claimBytes)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Key set of the RSA key as rsa-1 and the EC key as ec-1
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		encode := func(value *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(value.Bytes())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{KeyType: "RSA", KeyID: "rsa-1", N: encode(rsaKey.N), E: encode(big.NewInt(int64(rsaKey.E)))},
+			{KeyType: "EC", KeyID: "ec-1", Curve: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)},
+		}})
+	}))
+	defer jwks.Close()
+
+	now := time.Now().Unix()
+	validClaims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss":        "https://token.example.com",
+			"aud":        "kubernetes-internal-cd",
+			"exp":        now + 300,
+			"repository": "example/api",
+		}
+	}
+	with := func(changes map[string]interface{}) map[string]interface{} {
+		claims := validClaims()
+		for claim, value := range changes {
+			if value == nil {
+				delete(claims, claim)
+			} else {
+				claims[claim] = value
+			}
+		}
+		return claims
+	}
+	rsaHeader := map[string]interface{}{"alg": "RS256", "kid": "rsa-1"}
+	ecHeader := map[string]interface{}{"alg": "ES256", "kid": "ec-1"}
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		header map[string]interface{}
+		claims map[string]interface{}
+		// Changes the signed token
+		tamper func(token string) string
+		// Part of the expected error, empty if the token is valid
+		err string
+	}{
+		{name: "RS256", key: rsaKey, header: rsaHeader, claims: validClaims()},
+		{name: "ES256", key: ecKey, header: ecHeader, claims: validClaims()},
+		{
+			name:   "bad signature",
+			key:    otherECKey,
+			header: ecHeader,
+			claims: validClaims(),
+			err:    "invalid signature",
+		},
+		{
+			name:   "tampered claims",
+			key:    rsaKey,
+			header: rsaHeader,
+			claims: validClaims(),
+			tamper: func(token string) string {
+				segments := strings.Split(token, ".")
+				claims, _ := json.Marshal(with(map[string]interface{}{"repository": "example/web"}))
+				return segments[0] + "." + base64.RawURLEncoding.EncodeToString(claims) + "." + segments[2]
+			},
+			err: "verification error",
+		},
+		{
+			name:   "unsupported alg",
+			key:    rsaKey,
+			header: map[string]interface{}{"alg": "HS256", "kid": "rsa-1"},
+			claims: validClaims(),
+			err:    "unsupported algorithm HS256",
+		},
+		{
+			name:   "none alg",
+			key:    rsaKey,
+			header: map[string]interface{}{"alg": "none", "kid": "rsa-1"},
+			claims: validClaims(),
+			err:    "unsupported algorithm none",
+		},
+		{
+			name:   "alg of another key type",
+			key:    ecKey,
+			header: map[string]interface{}{"alg": "RS256", "kid": "ec-1"},
+			claims: validClaims(),
+			err:    "key is not an RSA key",
+		},
+		{
+			name:   "unknown kid",
+			key:    rsaKey,
+			header: map[string]interface{}{"alg": "RS256", "kid": "rsa-2"},
+			claims: validClaims(),
+			err:    "unknown key id rsa-2",
+		},
+		{
+			name:   "kid of another key",
+			key:    rsaKey,
+			header: map[string]interface{}{"alg": "ES256", "kid": "ec-1"},
+			claims: validClaims(),
+			err:    "signature is malformed",
+		},
+		{
+			name:   "expired",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"exp": now - 120}),
+			err:    "token is expired",
+		},
+		{
+			name:   "expired within the leeway",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"exp": now - 30}),
+		},
+		{
+			name:   "without expiry",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"exp": nil}),
+			err:    "token is expired",
+		},
+		{
+			name:   "not valid yet",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"nbf": now + 120}),
+			err:    "token is not valid yet",
+		},
+		{
+			name:   "not before within the leeway",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"nbf": now + 30}),
+		},
+		{
+			name:   "other issuer",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"iss": "https://other.example.com"}),
+			err:    "unexpected issuer https://other.example.com",
+		},
+		{
+			name:   "other audience",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"aud": "other"}),
+			err:    "not issued for this audience",
+		},
+		{
+			name:   "audience list",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"aud": []string{"other", "kubernetes-internal-cd"}}),
+		},
+		{
+			name:   "audience list without the audience",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"aud": []string{"other"}}),
+			err:    "not issued for this audience",
+		},
+		{
+			name:   "without audience",
+			key:    ecKey,
+			header: ecHeader,
+			claims: with(map[string]interface{}{"aud": nil}),
+			err:    "not issued for this audience",
+		},
+		{
+			name:   "malformed",
+			key:    ecKey,
+			header: ecHeader,
+			claims: validClaims(),
+			tamper: func(token string) string {
+				return token[:strings.LastIndex(token, ".")]
+			},
+			err: "malformed token",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := &JWTVerifier{JWKSURL: jwks.URL, Issuer: "https://token.example.com", Audience: "kubernetes-internal-cd", RepositoryClaim: "repository"}
+			token := signTestToken(t, test.key, test.header, test.claims)
+			if test.tamper != nil {
+				token = test.tamper(token)
+			}
+
+			_, err := verifier.VerifyToken(token)
+			if test.err == "" && err != nil {
+				t.Fatalf("got error %q, want none", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("got error %v, want %q", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyRepository(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier := &JWTVerifier{StaticKey: &key.PublicKey, Issuer: "https://token.example.com", Audience: "kubernetes-internal-cd", RepositoryClaim: "repository"}
+	token := signTestToken(t, key, map[string]interface{}{"alg": "ES256"}, map[string]interface{}{
+		"iss":        "https://token.example.com",
+		"aud":        "kubernetes-internal-cd",
+		"exp":        time.Now().Add(time.Minute).Unix(),
+		"repository": "Example/API",
+	})
+
+	tests := []struct {
+		repository string
+		valid      bool
+	}{
+		{"example/api", true},
+		{"Example/API", true},
+		{"example/web", false},
+		{"example/api-old", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.repository, func(t *testing.T) {
+			if err := verifier.Verify(token, test.repository); (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %t", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestFailedKeyFetchIsRetried(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The key set is unavailable for the first request
+	requests := 0
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		encode := func(value *big.Int) string {
+			return base64.RawURLEncoding.EncodeToString(value.Bytes())
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []jsonWebKey{
+			{KeyType: "EC", KeyID: "ec-1", Curve: "P-256", X: encode(key.X), Y: encode(key.Y)},
+		}})
+	}))
+	defer jwks.Close()
+
+	verifier := &JWTVerifier{JWKSURL: jwks.URL, Issuer: "https://token.example.com", Audience: "kubernetes-internal-cd", RepositoryClaim: "repository"}
+	token := signTestToken(t, key, map[string]interface{}{"alg": "ES256", "kid": "ec-1"}, map[string]interface{}{
+		"iss": "https://token.example.com",
+		"aud": "kubernetes-internal-cd",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	})
+
+	if _, err := verifier.VerifyToken(token); err == nil || !strings.Contains(err.Error(), "unexpected status 503") {
+		t.Fatalf("got error %v, want the failed fetch", err)
+	}
+	if _, err := verifier.VerifyToken(token); err != nil {
+		t.Fatalf("got error %q after the key set is available again, want none", err)
+	}
+	if requests != 2 {
+		t.Errorf("got %d requests of the key set, want 2", requests)
+	}
+}
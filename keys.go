@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// KeySource provides the signing keys (master_key, repo_..., shared_secret, ...) by name
+type KeySource interface {
+	Keys() (map[string][]byte, error)
+}
+
+// Registers all signing keys for redaction, whenever they are loaded
+func registerSigningKeys(keys map[string][]byte) {
+	for _, key := range keys {
+		RegisterSecret(string(key))
+	}
+}
+
+// SecretKeySource reads the signing keys from a kubernetes secret.
+// Once watched, the keys are served from a cache kept up to date by a watch on the secret.
+type SecretKeySource struct {
+	Namespace string
+	Name      string
+
+	store    cache.Store
+	informer cache.Controller
+}
+
+// Starts watching the secret and waits until it was loaded initially
+func (s *SecretKeySource) Watch(resync time.Duration) error {
+	listWatch := cache.NewListWatchFromClient(kubeSet.CoreV1().RESTClient(), "secrets", s.Namespace, fields.OneTermEqualSelector("metadata.name", s.Name))
+	s.store, s.informer = cache.NewInformer(listWatch, &corev1.Secret{}, resync, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			registerSigningKeys(obj.(*corev1.Secret).Data)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if oldObj.(*corev1.Secret).ResourceVersion != newObj.(*corev1.Secret).ResourceVersion {
+				globalLogger.Info(fmt.Sprintf("Signing key secret %s/%s changed", s.Namespace, s.Name))
+				registerSigningKeys(newObj.(*corev1.Secret).Data)
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			globalLogger.Warning(fmt.Sprintf("Signing key secret %s/%s was deleted", s.Namespace, s.Name))
+		},
+	})
+
+	RegisterCacheSync("signingKeys", s.informer.HasSynced)
+	go s.informer.Run(make(chan struct{}))
+	if !cache.WaitForCacheSync(make(chan struct{}), s.informer.HasSynced) {
+		return errors.New("could not sync the signing key secret")
+	}
+	if _, ok, _ := s.store.GetByKey(s.Namespace + "/" + s.Name); !ok {
+		return fmt.Errorf("secret %s/%s does not exist", s.Namespace, s.Name)
+	}
+
+	return nil
+}
+
+func (s *SecretKeySource) Keys() (map[string][]byte, error) {
+	// Without a synced watch, read the secret directly
+	if s.informer == nil || !s.informer.HasSynced() {
+		ctx, cancel := apiContext(context.Background())
+		defer cancel()
+		secret, err := kubeSet.CoreV1().Secrets(s.Namespace).Get(ctx, s.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		registerSigningKeys(secret.Data)
+
+		return secret.Data, nil
+	}
+
+	obj, ok, err := s.store.GetByKey(s.Namespace + "/" + s.Name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("secret %s/%s does not exist", s.Namespace, s.Name)
+	}
+
+	return obj.(*corev1.Secret).Data, nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+// Returns the in-cluster config or, outside of a cluster or with an explicit kubeconfig or context,
+// the config of the kubeconfig (KUBECONFIG or ~/.kube/config by default), e.g. for development with kind
+func KubeConfig(kubeconfig string, context string) (*rest.Config, error) {
+	if kubeconfig == "" && context == "" {
+		config, err := rest.InClusterConfig()
+		if err != rest.ErrNotInCluster {
+			return config, err
+		}
+		globalLogger.Info("Not running in a cluster, using the kubeconfig")
+	}
+
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = kubeconfig
+	overrides := &clientcmd.ConfigOverrides{CurrentContext: context}
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, overrides).ClientConfig()
+}
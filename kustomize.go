@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// File names kustomize reads in a directory
+var kustomizationFileNames = []string{"kustomization.yaml", "kustomization.yml", "Kustomization"}
+
+// Returns whether the file is a kustomization, whose images transformer is updated instead of the
+// images of its resources
+func isKustomization(path string) bool {
+	for _, name := range kustomizationFileNames {
+		if filepath.Base(path) == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the kustomization with the newTag, or the digest for images with a digest, of all entries
+// of its images transformer for the repository of the image set, and whether any entry matched.
+// Entries match by newName, or by name if they don't rename the image.
+func updateKustomizationImages(kustomization []byte, image string) ([]byte, bool, error) {
+	var document yaml.Node
+	if err := yaml.Unmarshal(kustomization, &document); err != nil {
+		return nil, false, err
+	}
+	if len(document.Content) == 0 || document.Content[0].Kind != yaml.MappingNode {
+		return nil, false, fmt.Errorf("not a kustomization")
+	}
+	images := yamlMappingValue(document.Content[0], "images")
+	if images == nil || images.Kind != yaml.SequenceNode {
+		return kustomization, false, nil
+	}
+
+	repository := ImageRepository(image)
+	tag, digest := ImageTag(image), ""
+	if position := strings.Index(image, "@"); position >= 0 {
+		tag, digest = "", image[position+1:]
+	}
+
+	found, changed := false, false
+	for _, entry := range images.Content {
+		if entry.Kind != yaml.MappingNode {
+			continue
+		}
+		name := yamlMappingValue(entry, "newName")
+		if name == nil {
+			name = yamlMappingValue(entry, "name")
+		}
+		if name == nil || name.Value != repository {
+			continue
+		}
+		found = true
+
+		if digest != "" {
+			changed = setYAMLMappingValue(entry, "digest", digest) || changed
+			changed = removeYAMLMappingValue(entry, "newTag") || changed
+		} else {
+			changed = setYAMLMappingValue(entry, "newTag", tag) || changed
+			changed = removeYAMLMappingValue(entry, "digest") || changed
+		}
+	}
+	if !changed {
+		return kustomization, found, nil
+	}
+
+	var updated bytes.Buffer
+	encoder := yaml.NewEncoder(&updated)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&document); err != nil {
+		return nil, false, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, false, err
+	}
+
+	return updated.Bytes(), true, nil
+}
+
+// Returns the value of the key of the mapping, nil if it has none
+func yamlMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// Sets the string value of the key of the mapping, returns whether it changed
+func setYAMLMappingValue(mapping *yaml.Node, key string, value string) bool {
+	if node := yamlMappingValue(mapping, key); node != nil {
+		if node.Kind == yaml.ScalarNode && node.Value == value {
+			return false
+		}
+		// Keeps the style and comments of the value
+		node.Kind, node.Tag, node.Value, node.Content = yaml.ScalarNode, "!!str", value, nil
+		return true
+	}
+	mapping.Content = append(mapping.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+
+	return true
+}
+
+// Removes the key from the mapping, returns whether it had the key
+func removeYAMLMappingValue(mapping *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+var errNotLeader = errors.New("not the leader")
+
+var leaderGauge = NewGaugeVec("kicd_leader", "Whether this replica is the leader and performs deploys.")
+
+// LeaderElection lets one of several replicas perform deploys by holding a coordination.k8s.io Lease
+// through the leader election of the controller-runtime manager. The lease is renewed by the
+// leader and taken over by another replica once it expired.
+type LeaderElection struct {
+	Namespace     string
+	Name          string
+	LeaseDuration time.Duration
+
+	elected <-chan struct{}
+}
+
+// Returns whether this replica holds the lease. Without leader election every replica is the leader.
+func (l *LeaderElection) IsLeader() bool {
+	if l == nil {
+		return true
+	}
+	select {
+	case <-l.elected:
+		return true
+	default:
+		return false
+	}
+}
+
+// Follows the election of the manager, which closes the channel once this replica became the leader
+func (l *LeaderElection) watch(elected <-chan struct{}) {
+	l.elected = elected
+	leaderGauge.Set(0)
+	go func() {
+		<-elected
+		globalLogger.Info(fmt.Sprintf("Became the leader of %s/%s", l.Namespace, l.Name))
+		leaderGauge.Set(1)
+	}()
+}
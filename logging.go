@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/logger"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+)
+
+// Log levels, in increasing severity
+var logLevels = []string{"debug", "info", "warning", "error", "fatal"}
+
+// LogFields are structured fields attached to log lines, e.g. repository, namespace, workload or image
+type LogFields map[string]interface{}
+
+// Logger writes plain text logs with google/logger or structured json logs, one object per line
+type Logger struct {
+	fields LogFields
+
+	text   *logger.Logger
+	output io.Writer
+	mutex  *sync.Mutex
+	// Minimum level written, shared by all loggers created with With
+	level *int32
+}
+
+// Creates a logger writing in the given format, `text` (default) or `json`
+func NewLogger(format string) (*Logger, error) {
+	level := int32(1)
+	switch format {
+	case "", LogFormatText:
+		return &Logger{text: logger.Init("ConsoleLogger", true, false, ioutil.Discard), level: &level}, nil
+	case LogFormatJSON:
+		return &Logger{output: os.Stderr, mutex: &sync.Mutex{}, level: &level}, nil
+	}
+
+	return nil, fmt.Errorf("unknown log format %s", format)
+}
+
+// Returns a logger adding the given fields to all lines
+func (l *Logger) With(fields LogFields) *Logger {
+	merged := make(LogFields, len(l.fields)+len(fields))
+	for key, value := range l.fields {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+
+	return &Logger{fields: merged, text: l.text, output: l.output, mutex: l.mutex, level: l.level}
+}
+
+// Returns the minimum level which is written
+func (l *Logger) Level() string {
+	return logLevels[atomic.LoadInt32(l.level)]
+}
+
+// Sets the minimum level which is written, for all loggers created from this one
+func (l *Logger) SetLevel(level string) error {
+	for i, name := range logLevels {
+		if name == strings.ToLower(level) {
+			atomic.StoreInt32(l.level, int32(i))
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown log level %s", level)
+}
+
+func (l *Logger) enabled(level string) bool {
+	for i, name := range logLevels {
+		if name == level {
+			return int32(i) >= atomic.LoadInt32(l.level)
+		}
+	}
+
+	return true
+}
+
+func (l *Logger) log(level string, v []interface{}) {
+	if !l.enabled(level) {
+		return
+	}
+
+	// Secrets never end up in the logs
+	message := Redact(fmt.Sprint(v...))
+	fields := make(LogFields, len(l.fields))
+	for key, value := range l.fields {
+		if IsSensitiveName(key) {
+			value = redacted
+		} else if err, ok := value.(error); ok {
+			value = Redact(err.Error())
+		} else if text, ok := value.(string); ok {
+			value = Redact(text)
+		}
+		fields[key] = value
+	}
+
+	if l.text != nil {
+		// Append the fields sorted as key=value
+		keys := make([]string, 0, len(fields))
+		for key := range fields {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			message += fmt.Sprintf(" %s=%v", key, fields[key])
+		}
+
+		switch level {
+		case "debug":
+			l.text.InfoDepth(2, "DEBUG "+message)
+		case "info":
+			l.text.InfoDepth(2, message)
+		case "warning":
+			l.text.WarningDepth(2, message)
+		case "error":
+			l.text.ErrorDepth(2, message)
+		case "fatal":
+			l.text.FatalDepth(2, message)
+		}
+		return
+	}
+
+	line := make(LogFields, len(fields)+3)
+	for key, value := range fields {
+		line[key] = value
+	}
+	line["level"] = level
+	line["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line["message"] = message
+
+	output, err := json.Marshal(line)
+	if err != nil {
+		output, _ = json.Marshal(LogFields{"level": level, "message": message})
+	}
+	l.mutex.Lock()
+	l.output.Write(append(output, '\n'))
+	l.mutex.Unlock()
+
+	if level == "fatal" {
+		os.Exit(1)
+	}
+}
+
+func (l *Logger) Debug(v ...interface{}) {
+	l.log("debug", v)
+}
+
+func (l *Logger) Info(v ...interface{}) {
+	l.log("info", v)
+}
+
+func (l *Logger) Warning(v ...interface{}) {
+	l.log("warning", v)
+}
+
+func (l *Logger) Error(v ...interface{}) {
+	l.log("error", v)
+}
+
+// Logs the message and exits
+func (l *Logger) Fatal(v ...interface{}) {
+	l.log("fatal", v)
+}
+
+// Toggles debug logging on SIGUSR1, switching back to the previous level on the next signal
+func ToggleDebugOnSignal(l *Logger) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+
+	previous := l.Level()
+	for range signals {
+		if l.Level() == "debug" {
+			l.SetLevel(previous)
+		} else {
+			previous = l.Level()
+			l.SetLevel("debug")
+		}
+		l.Warning("Log level changed to " + l.Level())
+	}
+}
+
+// Returns the log level on GET and changes it on PUT with the level parameter
+func LogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+	case "PUT", "POST":
+		if err := globalLogger.SetLevel(r.URL.Query().Get("level")); err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		globalLogger.Warning("Log level changed to " + globalLogger.Level())
+	default:
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	WriteJSON(w, 200, map[string]string{"level": globalLogger.Level()})
+}
@@ -1,50 +1,116 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
-	"crypto/subtle"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"text/template"
+	"time"
 
-	"github.com/google/logger"
-	"github.com/nlopes/slack"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/rest"
-	"k8s.io/client-go/util/retry"
 )
 
 type MessageGithub struct {
 	Sha        string `json:"sha"`
 	Repository string `json:"repository"`
 	Ref        string `json:"ref"`
+	// Optional, the default branch of the repository
+	DefaultBranch string `json:"default_branch"`
+	// Optional unix seconds of the commit, to measure the lead time
+	CommitTimestamp int64 `json:"commit_timestamp"`
+	// Optional message and author of the commit and sha the branch pointed to before the push
+	Message string `json:"message"`
+	Author  string `json:"author"`
+	Before  string `json:"before"`
 }
 
 type MessageData struct {
 	Github MessageGithub `json:"github"`
 	Image  string        `json:"image"`
+	// Optional git provider of the repository, github (default) or gitlab. The github fields are used for both.
+	Provider string `json:"provider"`
+	// Optional replay protection, unix seconds and a unique value per request
+	Timestamp int64  `json:"timestamp"`
+	Nonce     string `json:"nonce"`
+	// Only set by version 2 payloads
+	Tag      string            `json:"-"`
+	Metadata map[string]string `json:"-"`
 }
 
+// Message is the version 1 payload, other versions are converted to it
 type Message struct {
-	Data MessageData `json:"data"`
+	Version int         `json:"version,omitempty"`
+	Data    MessageData `json:"data"`
 }
 
 type ResponseMessage struct {
-	Success bool   `json:"error"`
-	Message string `json:"message"`
+	Success   bool   `json:"error"`
+	Message   string `json:"message"`
+	RequestID string `json:"requestId,omitempty"`
 }
 
 // GLOBAL VARIABLES
-var slackWebhookUrl string
-var globalLogger *logger.Logger
+var notifiers []Notifier
+var dryRun bool
+var serverSideApply bool
+var notificationTemplates *NotificationTemplates
+var hub *Hub
+var redeliveryStore *RedeliveryStore
+var deployQueue *DeployQueue
+var sharedQueue *SharedQueue
+var debouncer *Debouncer
+var pendingDeploys *PendingDeploys
+var leaderElection *LeaderElection
+var globalConfig *Config
+var labelPrefix string
+var watchNamespaces []string
+var protectedNamespaces []string
+var defaultBranch string
+var githubURL string
+var gitlabURL string
+var requireRepositoryKeys bool
+var signatureMode string
+var jwtVerifier *JWTVerifier
+var ipAllowlist *IPAllowlist
+var webhookEndpoints map[string]*WebhookEndpoint
+var trustedProxies []*net.IPNet
+var sourceRateLimiter *RateLimiter
+var repositoryRateLimiter *RateLimiter
+var rejectionNotifyLimiter *RateLimiter
+var replayGuard *ReplayGuard
+var imagePolicy *ImagePolicy
+var maxBodySize int64
+var historySize int
+var rolloutTimeout time.Duration
+var deployTimeout time.Duration
+var doraTracker *DoraTracker
+var keySource KeySource
+var keyRotation *KeyRotation
+var keyUsageTracker = NewKeyUsageTracker()
+var adminToken string
+var adminOIDC *AdminOIDC
+var auditLog *AuditLog
+
+// Optional database of deliveries, deploys and outcomes
+var store *Store
+
+// Optional slack app handling slash commands and interactions
+var slackApp *SlackApp
+var globalLogger *Logger
+var tracer *Tracer
+var errorReporter *SentryReporter
 var kubeSet *kubernetes.Clientset
 
 /// HMAC signature generation
@@ -63,214 +129,752 @@ func CreateSignatureHash(signature []byte) string {
 }
 
 func Webhook(w http.ResponseWriter, r *http.Request) {
-	if r.URL.Path != "/" || r.Method != "POST" {
+	endpoint, ok := webhookEndpoints[r.URL.Path]
+	if !ok || r.Method != "POST" {
 		globalLogger.Warning(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
 		http.NotFound(w, r)
 		return
 	}
 
-	globalLogger.Info(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
+	// Senders retry webhooks rejected while shutting down against another replica or after the restart
+	if ShuttingDown() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "shutting down", 503)
+		return
+	}
+	// Only the leader deploys, other replicas are not ready
+	if !leaderElection.IsLeader() {
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, errNotLeader.Error(), 503)
+		return
+	}
+
+	// Webhooks would be dropped or matched against incomplete caches until they are synced
+	if unsynced := UnsyncedCaches(); len(unsynced) > 0 {
+		globalLogger.Warning("Rejecting ", r.URL.Path, " from ", r.RemoteAddr, ", caches are not synced: ", strings.Join(unsynced, ", "))
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, "not ready", 503)
+		return
+	}
 
-	// Read body
-	bytes, err := ioutil.ReadAll(r.Body)
+	// Senders retry webhooks while the kubernetes api is unavailable instead of them failing
+	if open := OpenCircuits(); len(open) > 0 {
+		globalLogger.Warning("Rejecting ", r.URL.Path, " from ", r.RemoteAddr, ", the kubernetes api is unavailable: ", strings.Join(open, ", "))
+		w.Header().Set("Retry-After", strconv.Itoa(int(kubeCircuitCooldown.Seconds())))
+		http.Error(w, errCircuitOpen.Error(), 503)
+		return
+	}
+
+	// Correlate logs, notifications, events and the response by the request ID
+	requestID := RequestID(r)
+	w.Header().Set("x-request-id", requestID)
+	requestLogger := globalLogger.With(LogFields{"requestId": requestID})
+
+	requestLogger.Info(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr)
+
+	// Continue the trace of the caller, if any
+	ctx, span := tracer.StartSpan(ContextWithTraceparent(r.Context(), r.Header.Get("traceparent")), "webhook", SpanKindServer)
+	defer span.Finish()
+
+	// Every request ends up in the audit log, rejected or not
+	audit := AuditEntry{Time: time.Now(), Source: ClientIP(r).String(), Endpoint: endpoint.Path}
+	audit.ID = AuditID(audit.Time)
+	audit.RequestID = requestID
+	audit.Headers = HeaderSummary(r)
+	requestLogger.Debug(fmt.Sprintf("Request headers: %v", audit.Headers))
+	span.SetAttribute("client.address", audit.Source)
+	span.SetAttribute("request.id", requestID)
+	reject := func(status int, reason string) {
+		span.SetAttribute("http.response.status_code", status)
+		span.SetError(errors.New(reason))
+		audit.Outcome = AuditOutcomeRejected
+		if status >= 500 {
+			audit.Outcome = AuditOutcomeError
+		}
+		audit.Reason = reason
+		audit.Status = status
+		auditLog.Record(audit)
+
+		http.Error(w, reason, status)
+	}
+	// Notifies about rejected requests, at most once per minute and source to not be flooded by scanners
+	notifyRejected := func(text string) {
+		if !rejectionNotifyLimiter.Allow(audit.Source) {
+			return
+		}
+		Notify(ctx, Notification{
+			Type:  NotificationRejected,
+			Text:  text,
+			Event: DeployEvent{Repository: audit.Repository, Branch: audit.Branch, Sha: audit.Sha, Image: audit.Image, Source: audit.Source, ReceivedAt: audit.Time, RequestID: requestID},
+		})
+	}
+
+	// Reject unknown sources before doing any work
+	if endpoint.Allowlist != nil && !endpoint.Allowlist.Allowed(ClientIP(r)) {
+		requestLogger.Warning(fmt.Sprintf("Rejecting request from %s which is not allowlisted", ClientIP(r)))
+		notifyRejected(fmt.Sprintf("Rejected a request from %s which is not allowlisted.", audit.Source))
+		reject(403, "forbidden")
+		return
+	}
+	if sourceRateLimiter != nil && !sourceRateLimiter.Allow(ClientIP(r).String()) {
+		requestLogger.Warning(fmt.Sprintf("Rate limit exceeded for %s", ClientIP(r)))
+		reject(429, "rate limit exceeded")
+		return
+	}
+
+	// Read body, limited to protect against huge payloads
+	bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
 	defer r.Body.Close()
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			requestLogger.Warning(fmt.Sprintf("Request body from %s exceeds %d bytes", r.RemoteAddr, maxBodySize))
+			reject(413, err.Error())
+			return
+		}
+		reject(500, err.Error())
+		return
+	}
+
+	// Decode body of any payload version
+	body, err := ParseMessage(bytes)
+	if err != nil {
+		reject(400, "invalid payload: "+err.Error())
 		return
 	}
+	tag := body.Data.Tag
+	if tag == "" {
+		tag = body.Data.Github.Sha
+	}
+	audit.Repository = body.Data.Github.Repository
+	audit.Branch = strings.TrimPrefix(body.Data.Github.Ref, "refs/heads/")
+	audit.Sha = body.Data.Github.Sha
+	audit.Image = fmt.Sprintf("%s:%s", body.Data.Image, tag)
+	audit.Metadata = body.Data.Metadata
+	span.SetAttribute("repository", audit.Repository)
+	span.SetAttribute("branch", audit.Branch)
+	span.SetAttribute("image", audit.Image)
+	requestLogger = requestLogger.With(LogFields{"repository": audit.Repository, "branch": audit.Branch, "image": audit.Image, "source": audit.Source})
+
+	token := BearerToken(r)
+	if endpoint.Auth == EndpointAuthToken && token == "" {
+		requestLogger.Warning(fmt.Sprintf("Rejecting request from %s without a token on %s", r.RemoteAddr, endpoint.Path))
+		notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s. The endpoint %s requires a token.", body.Data.Github.Repository, audit.Source, endpoint.Path))
 
-	// Decode body
-	var body Message
-	if err = json.Unmarshal(bytes, &body); err != nil {
-		http.Error(w, err.Error(), 500)
+		reject(401, "token required")
 		return
 	}
+	if jwtVerifier != nil && token != "" && endpoint.Auth != EndpointAuthSignature {
+		// Check bearer token instead of hmac signature
+		if err := jwtVerifier.Verify(token, body.Data.Github.Repository); err != nil {
+			requestLogger.Warning(fmt.Sprintf("Token verification failed for host %s and repository %s: %s", r.RemoteAddr, body.Data.Github.Repository, err))
+			notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s. Token verification failed: %s", body.Data.Github.Repository, audit.Source, err))
 
-	// Get hmac master key
-	secret, err := kubeSet.CoreV1().Secrets(os.Getenv("SECRET_NAMESPACE")).Get(os.Getenv("SECRET_NAME"), metav1.GetOptions{})
-	if err != nil {
-		globalLogger.Error("Could not get secret")
-		globalLogger.Error(err)
+			reject(401, "token verification failed")
+			return
+		}
+	} else {
+		// Get hmac signing keys
+		keys, err := keySource.Keys()
+		if err != nil {
+			requestLogger.Error("Could not get signing keys")
+			requestLogger.Error(err)
+			reject(500, "could not get signing keys")
+			return
+		}
+
+		// Check hmac signature
+		key, ok := VerifySignature(keys, body.Data.Github.Repository, bytes, r.Header)
+		if !ok {
+			requestLogger.Warning(fmt.Sprintf("Signature verification failed for host %s and repository %s", r.RemoteAddr, body.Data.Github.Repository))
+			notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s. The signature verification failed.", body.Data.Github.Repository, audit.Source))
+
+			reject(401, "hmac signature verification failed")
+			return
+		}
+		keyUsageTracker.Record(key, body.Data.Github.Repository, ClientIP(r).String())
+	}
+	audit.Verified = true
+
+	// Endpoints may be restricted to the repositories of their source
+	if !endpoint.RepositoryAllowed(body.Data.Github.Repository) {
+		requestLogger.Warning(fmt.Sprintf("Rejecting repository %s which is not allowed on %s", body.Data.Github.Repository, endpoint.Path))
+		notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s. The repository is not allowed on the endpoint %s.", body.Data.Github.Repository, audit.Source, endpoint.Path))
+
+		reject(403, "repository is not allowed on this endpoint")
 		return
 	}
-	hmacSecret := hex.EncodeToString(CreateSignature([]byte(body.Data.Github.Repository), secret.Data["master_key"]))
-	hmacSecretOld := hex.EncodeToString(CreateSignature([]byte(body.Data.Github.Repository), secret.Data["master_key_old"]))
 
-	// Check hmac signature
-	signature := CreateSignatureHash(CreateSignature(bytes, []byte(hmacSecret)))
-	signatureOld := CreateSignatureHash(CreateSignature(bytes, []byte(hmacSecretOld)))
-	if subtle.ConstantTimeCompare([]byte(r.Header.Get("x-hub-signature")), []byte(signature)) != 1 &&
-		subtle.ConstantTimeCompare([]byte(r.Header.Get("x-hub-signature")), []byte(signatureOld)) != 1 {
-		globalLogger.Warning(fmt.Sprintf("Signature verification failed for host %s and repository %s", r.RemoteAddr, body.Data.Github.Repository))
+	// Reject replayed requests
+	if replayGuard != nil {
+		if err := replayGuard.Check(strings.ToLower(body.Data.Github.Repository), body.Data.Timestamp, body.Data.Nonce); err != nil {
+			requestLogger.Warning(fmt.Sprintf("Replay protection rejected request from %s for repository %s: %s", r.RemoteAddr, body.Data.Github.Repository, err))
+			notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s by the replay protection: %s", body.Data.Github.Repository, audit.Source, err))
+
+			reject(401, err.Error())
+			return
+		}
+	}
 
-		http.Error(w, "hmac signature verification failed", 401)
+	// Limit deploys per repository, only counting verified requests
+	if repositoryRateLimiter != nil && !repositoryRateLimiter.Allow(strings.ToLower(body.Data.Github.Repository)) {
+		requestLogger.Warning(fmt.Sprintf("Rate limit exceeded for repository %s", body.Data.Github.Repository))
+		reject(429, "rate limit exceeded")
 		return
 	}
 
+	// Only deploy images of allowed registries
+	if imagePolicy != nil && !imagePolicy.Allowed(audit.Image) {
+		requestLogger.Warning(fmt.Sprintf("Rejecting image %s for repository %s from %s which is not allowed by the image policy", audit.Image, body.Data.Github.Repository, r.RemoteAddr))
+		notifyRejected(fmt.Sprintf("Rejected deploy of image %s for %s from %s. The image is not allowed by the image policy.", audit.Image, body.Data.Github.Repository, audit.Source))
+
+		reject(403, "image is not allowed")
+		return
+	}
+
+	// Second factor for deploys into protected namespaces
+	productionVerified := false
+	if len(protectedNamespaces) > 0 && r.Header.Get("x-production-signature-256") != "" {
+		keys, err := keySource.Keys()
+		if err != nil {
+			requestLogger.Error("Could not get signing keys")
+			requestLogger.Error(err)
+			reject(500, "could not get signing keys")
+			return
+		}
+		if productionVerified = VerifyProductionSignature(keys, bytes, r.Header); !productionVerified {
+			requestLogger.Warning(fmt.Sprintf("Production signature verification failed for host %s and repository %s", r.RemoteAddr, body.Data.Github.Repository))
+			notifyRejected(fmt.Sprintf("Rejected a deploy of %s from %s. The production signature verification failed.", body.Data.Github.Repository, audit.Source))
+
+			reject(401, "production signature verification failed")
+			return
+		}
+	}
+
 	// Respond as early as possible to the webhook
-	message := ResponseMessage{Success: true, Message: "Sucessfully parsed " + body.Data.Github.Repository}
+	message := ResponseMessage{Success: true, Message: "Sucessfully parsed " + body.Data.Github.Repository, RequestID: requestID}
 	output, err := json.Marshal(message)
 	if err != nil {
-		http.Error(w, err.Error(), 500)
+		reject(500, err.Error())
+		return
+	}
+
+	// Deploy new version if possible
+	var commitTime time.Time
+	if body.Data.Github.CommitTimestamp > 0 {
+		commitTime = time.Unix(body.Data.Github.CommitTimestamp, 0)
+	}
+	event := DeployEvent{
+		Repository:         body.Data.Github.Repository,
+		Provider:           body.Data.Provider,
+		Branch:             audit.Branch,
+		DefaultBranch:      body.Data.Github.DefaultBranch,
+		Sha:                body.Data.Github.Sha,
+		CommitTime:         commitTime,
+		CommitMessage:      body.Data.Github.Message,
+		CommitAuthor:       body.Data.Github.Author,
+		Before:             body.Data.Github.Before,
+		Image:              audit.Image,
+		Source:             audit.Source,
+		ReceivedAt:         audit.Time,
+		Delivery:           audit.ID,
+		RequestID:          requestID,
+		ProductionVerified: productionVerified,
+		Metadata:           body.Data.Metadata,
+	}
+	redeliveryStore.Add(event)
+	audit.Status = 200
+	// Pushes are held for the debounce window, which would hide a full queue from the sender
+	if debouncer != nil {
+		if err := debouncer.Add(ctx, event, audit); err != nil {
+			w.Header().Set("Retry-After", "5")
+			reject(503, err.Error())
+			return
+		}
+	} else if err := enqueueDeploy(ctx, event, audit); err == errDeployQueueFull {
+		// Senders back off until the workers caught up instead of the deploy waiting for long
+		w.Header().Set("Retry-After", strconv.Itoa(int(queueRetryAfter().Seconds())))
+		reject(429, err.Error())
+		return
+	} else if err != nil {
+		w.Header().Set("Retry-After", "5")
+		reject(503, err.Error())
 		return
 	}
 	w.Header().Set("content-type", "application/json")
 	w.Write(output)
+}
 
-	// Deploy new version if possible
-	globalLogger.Info(fmt.Sprintf("Deploying new version of %s on branch %s", body.Data.Github.Repository, body.Data.Github.Ref))
+// Queues the deploy of a webhook, whose audit entry is recorded with its results. The deploy runs in
+// a worker, senders retry after queueRetryAfter while all workers are busy and the queue is full.
+func enqueueDeploy(ctx context.Context, event DeployEvent, audit AuditEntry) error {
+	if sharedQueue != nil {
+		return sharedQueue.Enqueue(event, audit)
+	}
 
-	labelKey := "ki-cd/" + strings.Replace(strings.ToLower(body.Data.Github.Repository), "/", "_", -1)
+	return pendingDeploys.Enqueue(ctx, event, audit)
+}
 
-	deployments, err := kubeSet.AppsV1().Deployments("").List(metav1.ListOptions{LabelSelector: labelKey})
-	if err != nil {
-		globalLogger.Error("Could not get deployments")
-		globalLogger.Error(err)
-		return
+// Returns how long senders should wait before retrying webhooks rejected because the queue is full
+func queueRetryAfter() time.Duration {
+	if sharedQueue != nil {
+		return sharedQueue.RetryAfter()
 	}
-	globalLogger.Info(fmt.Sprintf("Got %d deployments with the correct cd label", len(deployments.Items)))
 
-	statefulSets, err := kubeSet.AppsV1().StatefulSets("").List(metav1.ListOptions{LabelSelector: labelKey})
-	if err != nil {
-		globalLogger.Error("Could not get stateful sets")
-		globalLogger.Error(err)
-		return
+	return deployQueue.RetryAfter()
+}
+
+// Splits a comma separated list, ignoring empty values
+func splitList(value string) []string {
+	var values []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
 	}
-	globalLogger.Info(fmt.Sprintf("Got %d stateful sets with the correct cd label", len(statefulSets.Items)))
 
-	// Update deployments
-	for _, deployment := range deployments.Items {
-		labelValue := deployment.Labels[labelKey]
+	return values
+}
+
+// Parses a duration from the given environment variable, using the fallback if it is not set
+func parseDurationEnv(name string, fallback time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		globalLogger.Fatal(name + " must be a positive duration.")
+	}
 
-		// Convert label value to DeploymentLabelValue. Currently <branchName>.<containerPosition>
-		labelValues := strings.Split(labelValue, ".")
-		if len(labelValues) != 2 {
-			globalLogger.Warning("Label value for deployment " + deployment.Name + " in namespace " + deployment.Namespace + " is malformed. Exactly two dot separated values are required. Skipping the deployment...")
-			continue
-		}
-		labelBranchName := labelValues[0]
-		labelContainerPosition, err := strconv.Atoi(labelValues[1])
-		if err != nil {
-			globalLogger.Warning("Label value for deployment " + deployment.Name + " in namespace " + deployment.Namespace + " is malformed. Second value is required to be an integer. Skipping the deployment...")
-			continue
+	return duration
+}
+
+// Parses a fraction of a backoff added randomly, between 0 and 1
+func parseJitterEnv(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	jitter, err := strconv.ParseFloat(value, 64)
+	if err != nil || jitter < 0 || jitter > 1 {
+		globalLogger.Fatal(name + " must be a number between 0 and 1.")
+	}
+
+	return jitter
+}
+
+// Parses a rate limit of the form <requests per minute>[/<burst>]
+func parseRateLimit(name string, value string) (float64, int) {
+	values := strings.SplitN(value, "/", 2)
+	perMinute, err := strconv.ParseFloat(values[0], 64)
+	if err != nil || perMinute <= 0 {
+		globalLogger.Fatal(name + " must be a positive number of requests per minute.")
+	}
+	burst := int(perMinute)
+	if len(values) == 2 {
+		burst, err = strconv.Atoi(values[1])
+		if err != nil || burst <= 0 {
+			globalLogger.Fatal(name + " must have a positive burst.")
 		}
+	}
+	if burst < 1 {
+		burst = 1
+	}
 
-		if labelBranchName != strings.TrimPrefix(body.Data.Github.Ref, "refs/heads/") {
-			globalLogger.Info(fmt.Sprintf("Skipping deployment of %s in namespace %s. Branch mismatch.", deployment.Name, deployment.Namespace))
-			continue
+	return perMinute, burst
+}
+
+func main() {
+	// Setup logger, plain text or structured json
+	var err error
+	globalLogger, err = NewLogger(os.Getenv("LOG_FORMAT"))
+	if err != nil {
+		panic(err)
+	}
+	if level := os.Getenv("LOG_LEVEL"); level != "" {
+		if err := globalLogger.SetLevel(level); err != nil {
+			panic(err)
 		}
+	}
+	go ToggleDebugOnSignal(globalLogger)
 
-		globalLogger.Info(fmt.Sprintf("Deployment %s in namespace %s is ready to be updated...", deployment.Name, deployment.Namespace))
+	// Never log secrets passed via the environment
+	for _, name := range []string{"SLACK_URL", "SLACK_BOT_TOKEN", "DISCORD_WEBHOOK_URL", "TEAMS_WEBHOOK_URL", "TELEGRAM_BOT_TOKEN", "MATRIX_ACCESS_TOKEN", "SMTP_PASSWORD", "PAGERDUTY_ROUTING_KEY", "OPSGENIE_API_KEY", "DATADOG_API_KEY", "GITHUB_TOKEN", "GITLAB_TOKEN", "ADMIN_TOKEN", "VAULT_TOKEN", "VAULT_SECRET_ID", "SENTRY_DSN", "AUDIT_SINK_TOKEN", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN", "AGENT_TOKEN", "GIT_WRITE_BACK_TOKEN", "DATABASE_URL", "DASHBOARD_OIDC_CLIENT_SECRET", "SLACK_SIGNING_SECRET"} {
+		RegisterSecret(os.Getenv(name))
+	}
 
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			// Retrieve the latest version of Deployment before attempting update
-			result, getErr := kubeSet.AppsV1().Deployments(deployment.Namespace).Get(deployment.Name, metav1.GetOptions{})
-			if getErr != nil {
-				return getErr
-			}
+	// Out of cluster, e.g. for development
+	kubeconfig := flag.String("kubeconfig", "", "Path of the kubeconfig used outside of a cluster. Defaults to KUBECONFIG or ~/.kube/config")
+	kubeContext := flag.String("context", os.Getenv("KUBE_CONTEXT"), "Context of the kubeconfig. Defaults to its current context")
+	flag.Parse()
 
-			if len(result.Spec.Template.Spec.Containers) > labelContainerPosition {
-				result.Spec.Template.Spec.Containers[labelContainerPosition].Image = fmt.Sprintf("%s:%s", body.Data.Image, body.Data.Github.Sha)
-				_, updateErr := kubeSet.AppsV1().Deployments(deployment.Namespace).Update(result)
+	// `validate` only checks the targets of the cluster and exits,
+	// `rotate-keys` rotates the signing key if due and exits,
+	// `agent` deploys the events of a hub instead of receiving webhooks
+	mode := flag.Arg(0)
+	validateMode := mode == "validate"
+	rotateMode := mode == "rotate-keys"
+	agentMode := mode == "agent"
 
-				return updateErr
+	// Export traces via OTLP/HTTP if an endpoint is configured
+	if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); endpoint != "" {
+		tracer = &Tracer{Endpoint: endpoint}
+	} else if endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); endpoint != "" {
+		tracer = &Tracer{Endpoint: strings.TrimRight(endpoint, "/") + "/v1/traces"}
+	}
+	if tracer != nil {
+		tracer.ServiceName = os.Getenv("OTEL_SERVICE_NAME")
+		if tracer.ServiceName == "" {
+			tracer.ServiceName = "kubernetes-internal-cd"
+		}
+		tracer.Headers = make(map[string]string)
+		for _, header := range splitList(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")) {
+			if values := strings.SplitN(header, "=", 2); len(values) == 2 {
+				tracer.Headers[strings.TrimSpace(values[0])] = strings.TrimSpace(values[1])
 			}
+		}
+		tracer.Run(5 * time.Second)
+	}
 
-			globalLogger.Warning(fmt.Sprintf("Label %s contains an invalid container position for deployment %s in namespace %s", labelValue, deployment.Name, deployment.Namespace))
+	// Report errors to sentry if configured
+	if dsn := os.Getenv("SENTRY_DSN"); dsn != "" {
+		errorReporter, err = NewSentryReporter(dsn, os.Getenv("SENTRY_ENVIRONMENT"))
+		if err != nil {
+			globalLogger.Fatal("Invalid SENTRY_DSN: " + err.Error())
+		}
+	}
 
-			return errors.New("label contains invalid container position")
-		})
-		if retryErr != nil {
-			globalLogger.Error(fmt.Sprintf("Failure updating deployment %s. Cannot retry. --- %s", deployment.Name, retryErr))
-		} else {
-			successText := fmt.Sprintf("Successfully updated deployment %s in namespace %s with the newest image tag.", deployment.Name, deployment.Namespace)
+	// Label prefix for workloads marked via labels
+	labelPrefix = os.Getenv("LABEL_PREFIX")
+	if labelPrefix == "" {
+		labelPrefix = DefaultLabelPrefix
+	}
+	if !strings.HasSuffix(labelPrefix, "/") {
+		labelPrefix += "/"
+	}
+
+	// Restrict all workload operations to these namespaces, e.g. to run with namespaced roles
+	watchNamespaces = splitList(os.Getenv("WATCH_NAMESPACES"))
+
+	// Deploys into these namespaces additionally require the production signature
+	protectedNamespaces = splitList(os.Getenv("PROTECTED_NAMESPACES"))
 
-			globalLogger.Info(successText)
+	// Default branch for repositories which don't send their own
+	defaultBranch = os.Getenv("DEFAULT_BRANCH")
+	if defaultBranch == "" {
+		defaultBranch = "master"
+	}
+
+	// Links to commits in notifications
+	githubURL = strings.TrimRight(os.Getenv("GITHUB_URL"), "/")
+	if githubURL == "" {
+		githubURL = "https://github.com"
+	}
+	gitlabURL = strings.TrimRight(os.Getenv("GITLAB_URL"), "/")
+	if gitlabURL == "" {
+		gitlabURL = "https://gitlab.com"
+	}
 
-			// Slack notification
-			slackMsg := slack.WebhookMessage{Text: successText}
-			err := slack.PostWebhook(slackWebhookUrl, &slackMsg)
+	// How payload signatures are verified
+	signatureMode = os.Getenv("SIGNATURE_MODE")
+	if signatureMode == "" {
+		signatureMode = SignatureModeDerived
+	}
+	if signatureMode != SignatureModeDerived && signatureMode != SignatureModeShared {
+		globalLogger.Fatal("SIGNATURE_MODE must be derived or shared.")
+	}
+
+	// Optional JWT bearer token authentication
+	jwksURL := os.Getenv("JWT_JWKS_URL")
+	jwtPublicKeyPath := os.Getenv("JWT_PUBLIC_KEY_PATH")
+	if jwksURL != "" || jwtPublicKeyPath != "" {
+		jwtVerifier = &JWTVerifier{
+			JWKSURL:         jwksURL,
+			Issuer:          os.Getenv("JWT_ISSUER"),
+			Audience:        os.Getenv("JWT_AUDIENCE"),
+			RepositoryClaim: os.Getenv("JWT_REPOSITORY_CLAIM"),
+		}
+		if jwtVerifier.Issuer == "" || jwtVerifier.Audience == "" {
+			globalLogger.Fatal("JWT_ISSUER and JWT_AUDIENCE are required for JWT authentication.")
+		}
+		if jwtVerifier.RepositoryClaim == "" {
+			jwtVerifier.RepositoryClaim = "repository"
+		}
+		if jwtPublicKeyPath != "" {
+			publicKey, err := LoadPublicKey(jwtPublicKeyPath)
 			if err != nil {
-				globalLogger.Warning("Couldn't notify slack for deployment update.")
+				globalLogger.Fatal("Could not load JWT public key: " + err.Error())
 			}
+			jwtVerifier.StaticKey = publicKey
+		}
+	}
+
+	// Optional allowlist of callers
+	trustedProxies, err = ParseCIDRs(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		globalLogger.Fatal("Invalid TRUSTED_PROXIES: " + err.Error())
+	}
+	allowedIPs, err := ParseCIDRs(os.Getenv("IP_ALLOWLIST"))
+	if err != nil {
+		globalLogger.Fatal("Invalid IP_ALLOWLIST: " + err.Error())
+	}
+	allowGitHubHooks := os.Getenv("ALLOW_GITHUB_HOOKS") == "true"
+	if len(allowedIPs) > 0 || allowGitHubHooks {
+		ipAllowlist = NewIPAllowlist(allowedIPs)
+		if allowGitHubHooks {
+			ipAllowlist.WatchGitHub(time.Hour)
 		}
 	}
 
-	// Same for stateful sets...
-	for _, statefulSet := range statefulSets.Items {
-		labelValue := statefulSet.Labels[labelKey]
+	// Optional rate limits per source address and repository
+	if limit := os.Getenv("RATE_LIMIT_PER_SOURCE"); limit != "" {
+		sourceRateLimiter = NewRateLimiter(parseRateLimit("RATE_LIMIT_PER_SOURCE", limit))
+	}
+	if limit := os.Getenv("RATE_LIMIT_PER_REPOSITORY"); limit != "" {
+		repositoryRateLimiter = NewRateLimiter(parseRateLimit("RATE_LIMIT_PER_REPOSITORY", limit))
+	}
+	rejectionNotifyLimiter = NewRateLimiter(1, 1)
 
-		// Convert label value to DeploymentLabelValue. Currently <branchName>.<containerPosition>
-		labelValues := strings.Split(labelValue, ".")
-		if len(labelValues) != 2 {
-			globalLogger.Warning("Label value for statefulSet " + statefulSet.Name + " in namespace " + statefulSet.Namespace + " is malformed. Exactly two dot separated values are required. Skipping the deployment...")
-			continue
+	// Maximum size of request bodies
+	maxBodySize = 1 << 20
+	if size := os.Getenv("MAX_BODY_SIZE"); size != "" {
+		maxBodySize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || maxBodySize <= 0 {
+			globalLogger.Fatal("MAX_BODY_SIZE must be a positive number of bytes.")
 		}
-		labelBranchName := labelValues[0]
-		labelContainerPosition, err := strconv.Atoi(labelValues[1])
+	}
+
+	// Replay protection with signed timestamps and nonces
+	replayGuard = NewReplayGuard(parseDurationEnv("REPLAY_WINDOW", 5*time.Minute), os.Getenv("REQUIRE_REPLAY_PROTECTION") == "true")
+
+	// Only accept dedicated repository keys, never keys derived from the master key
+	requireRepositoryKeys = os.Getenv("REQUIRE_REPOSITORY_KEYS") == "true"
+
+	// Only allow images with these prefixes, e.g. ghcr.io/myorg/
+	if prefixes := splitList(os.Getenv("IMAGE_ALLOWLIST")); len(prefixes) > 0 {
+		imagePolicy = &ImagePolicy{Prefixes: prefixes}
+	}
+
+	// Load optional target mapping configuration
+	if configPath := os.Getenv("CONFIG_PATH"); configPath != "" {
+		config, err := LoadConfig(configPath)
 		if err != nil {
-			globalLogger.Warning("Label value for statefulSet " + statefulSet.Name + " in namespace " + statefulSet.Namespace + " is malformed. Second value is required to be an integer. Skipping the deployment...")
-			continue
+			globalLogger.Fatal("Could not load config from " + configPath + ": " + err.Error())
 		}
+		globalConfig = config
+		globalLogger.Info(fmt.Sprintf("Loaded %d configured targets from %s", len(config.Targets), configPath))
+	}
 
-		if labelBranchName != strings.TrimPrefix(body.Data.Github.Ref, "refs/heads/") {
-			globalLogger.Info(fmt.Sprintf("Skipping statefulSet of %s in namespace %s. Branch mismatch.", statefulSet.Name, statefulSet.Namespace))
-			continue
+	// Match, validate and notify without writing to the cluster
+	if value := os.Getenv("DRY_RUN"); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			globalLogger.Fatal("DRY_RUN must be true or false.")
 		}
+		if dryRun {
+			globalLogger.Warning("Running in dry run mode, workloads are not updated.")
+		}
+	}
 
-		globalLogger.Info(fmt.Sprintf("StatefulSet %s in namespace %s is ready to be updated...", statefulSet.Name, statefulSet.Namespace))
-
-		retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-			// Retrieve the latest version of StatefulSet before attempting update
-			result, getErr := kubeSet.AppsV1().StatefulSets(statefulSet.Namespace).Get(statefulSet.Name, metav1.GetOptions{})
-			if getErr != nil {
-				return getErr
-			}
-
-			if len(result.Spec.Template.Spec.Containers) > labelContainerPosition {
-				result.Spec.Template.Spec.Containers[labelContainerPosition].Image = fmt.Sprintf("%s:%s", body.Data.Image, body.Data.Github.Sha)
-				_, updateErr := kubeSet.AppsV1().StatefulSets(statefulSet.Namespace).Update(result)
+	// Images are set with server-side apply, so ownership conflicts fail the deploy
+	if value := os.Getenv("SERVER_SIDE_APPLY"); value != "" {
+		serverSideApply, err = strconv.ParseBool(value)
+		if err != nil {
+			globalLogger.Fatal("SERVER_SIDE_APPLY must be true or false.")
+		}
+	}
 
-				return updateErr
-			}
+	// Images of registries without pull credentials fail before producing pods in ImagePullBackOff
+	if value := os.Getenv("PULL_SECRET_VALIDATION"); value != "" {
+		pullSecretValidation, err = strconv.ParseBool(value)
+		if err != nil {
+			globalLogger.Fatal("PULL_SECRET_VALIDATION must be true or false.")
+		}
+	}
+	publicRegistries = splitList(os.Getenv("PUBLIC_REGISTRIES"))
 
-			globalLogger.Warning(fmt.Sprintf("Label %s contains an invalid container position for statefulSet %s in namespace %s", labelValue, statefulSet.Name, statefulSet.Namespace))
+	// Failed notifications are retried with a backoff
+	if retries := os.Getenv("NOTIFICATION_RETRIES"); retries != "" {
+		notificationRetryAttempts, err = strconv.Atoi(retries)
+		if err != nil || notificationRetryAttempts < 0 {
+			globalLogger.Fatal("NOTIFICATION_RETRIES must be a non-negative number.")
+		}
+	}
+	notificationRetryBackoff = parseDurationEnv("NOTIFICATION_RETRY_BACKOFF", notificationRetryBackoff)
+	notificationRetryJitter = parseJitterEnv("NOTIFICATION_RETRY_JITTER", notificationRetryJitter)
 
-			return errors.New("label contains invalid container position")
-		})
-		if retryErr != nil {
-			globalLogger.Error(fmt.Sprintf("Failure updating statefulSet %s. Cannot retry. --- %s", statefulSet.Name, retryErr))
-		} else {
-			successText := fmt.Sprintf("Successfully updated statefulSet %s in namespace %s with the newest image tag.", statefulSet.Name, statefulSet.Namespace)
+	// Conflicting updates of busy clusters may need more generous retries
+	if attempts := os.Getenv("KUBE_RETRY_ATTEMPTS"); attempts != "" {
+		kubeRetry.Steps, err = strconv.Atoi(attempts)
+		if err != nil || kubeRetry.Steps < 1 {
+			globalLogger.Fatal("KUBE_RETRY_ATTEMPTS must be a positive number.")
+		}
+	}
+	kubeRetry.Duration = parseDurationEnv("KUBE_RETRY_BACKOFF", kubeRetry.Duration)
+	kubeRetry.Jitter = parseJitterEnv("KUBE_RETRY_JITTER", kubeRetry.Jitter)
 
-			globalLogger.Info(successText)
+	// Summarize the updated targets of a push in one notification
+	if aggregate := os.Getenv("AGGREGATE_NOTIFICATIONS"); aggregate != "" {
+		aggregateNotifications, err = strconv.ParseBool(aggregate)
+		if err != nil {
+			globalLogger.Fatal("AGGREGATE_NOTIFICATIONS must be true or false.")
+		}
+	}
 
-			// Slack notification
-			slackMsg := slack.WebhookMessage{Text: successText}
-			err := slack.PostWebhook(slackWebhookUrl, &slackMsg)
+	// Notifiers, selected by their configured urls
+	var slackRoutes []SlackRoute
+	if globalConfig != nil {
+		slackRoutes = globalConfig.SlackRoutes
+		for _, route := range slackRoutes {
+			RegisterSecret(route.URL)
+		}
+	}
+	if slackBotToken := os.Getenv("SLACK_BOT_TOKEN"); slackBotToken != "" {
+		slackChannel := os.Getenv("SLACK_CHANNEL")
+		if slackChannel == "" && len(slackRoutes) == 0 {
+			globalLogger.Fatal("SLACK_CHANNEL or slack routes in the config are required with SLACK_BOT_TOKEN")
+		}
+		notifiers = append(notifiers, &SlackNotifier{Token: slackBotToken, Channel: slackChannel, Routes: slackRoutes})
+	} else if slackWebhookUrl := os.Getenv("SLACK_URL"); slackWebhookUrl != "" || len(slackRoutes) > 0 {
+		notifiers = append(notifiers, &SlackNotifier{URL: slackWebhookUrl, Routes: slackRoutes})
+	}
+	if discordWebhookUrl := os.Getenv("DISCORD_WEBHOOK_URL"); discordWebhookUrl != "" {
+		notifiers = append(notifiers, &DiscordNotifier{URL: discordWebhookUrl})
+	}
+	if teamsWebhookUrl := os.Getenv("TEAMS_WEBHOOK_URL"); teamsWebhookUrl != "" {
+		notifiers = append(notifiers, &TeamsNotifier{URL: teamsWebhookUrl})
+	}
+	if telegramBotToken := os.Getenv("TELEGRAM_BOT_TOKEN"); telegramBotToken != "" {
+		telegramChatID := os.Getenv("TELEGRAM_CHAT_ID")
+		if telegramChatID == "" {
+			globalLogger.Fatal("TELEGRAM_CHAT_ID is required with TELEGRAM_BOT_TOKEN")
+		}
+		notifiers = append(notifiers, &TelegramNotifier{BotToken: telegramBotToken, ChatID: telegramChatID})
+	}
+	if matrixHomeserverURL := os.Getenv("MATRIX_HOMESERVER_URL"); matrixHomeserverURL != "" {
+		matrixNotifier := &MatrixNotifier{HomeserverURL: strings.TrimRight(matrixHomeserverURL, "/"), AccessToken: os.Getenv("MATRIX_ACCESS_TOKEN"), RoomID: os.Getenv("MATRIX_ROOM_ID")}
+		if matrixNotifier.AccessToken == "" || matrixNotifier.RoomID == "" {
+			globalLogger.Fatal("MATRIX_ACCESS_TOKEN and MATRIX_ROOM_ID are required with MATRIX_HOMESERVER_URL")
+		}
+		notifiers = append(notifiers, matrixNotifier)
+	}
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		emailNotifier := &EmailNotifier{
+			Host:     smtpHost,
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("SMTP_FROM"),
+			To:       splitList(os.Getenv("SMTP_TO")),
+			Security: os.Getenv("SMTP_SECURITY"),
+		}
+		if emailNotifier.Port == "" {
+			emailNotifier.Port = "587"
+		}
+		if emailNotifier.Security == "" {
+			emailNotifier.Security = SMTPSecurityStartTLS
+		}
+		if emailNotifier.Security != SMTPSecurityStartTLS && emailNotifier.Security != SMTPSecurityTLS && emailNotifier.Security != SMTPSecurityNone {
+			globalLogger.Fatal("SMTP_SECURITY must be starttls, tls or none.")
+		}
+		if emailNotifier.From == "" {
+			globalLogger.Fatal("SMTP_FROM is required for email notifications.")
+		}
+		notifiers = append(notifiers, emailNotifier)
+	}
+	if routingKey := os.Getenv("PAGERDUTY_ROUTING_KEY"); routingKey != "" {
+		environments := splitList(os.Getenv("PAGERDUTY_ENVIRONMENTS"))
+		if len(environments) == 0 {
+			environments = []string{"prod", "production"}
+		}
+		notifiers = append(notifiers, &PagerDutyNotifier{RoutingKey: routingKey, Environments: environments})
+	}
+	if apiKey := os.Getenv("OPSGENIE_API_KEY"); apiKey != "" {
+		opsgenieURL := os.Getenv("OPSGENIE_API_URL")
+		if opsgenieURL == "" {
+			opsgenieURL = DefaultOpsgenieURL
+		}
+		priorities, err := ParseOpsgeniePriorities(os.Getenv("OPSGENIE_PRIORITIES"))
+		if err != nil {
+			globalLogger.Fatal("OPSGENIE_PRIORITIES is invalid: " + err.Error())
+		}
+		notifiers = append(notifiers, &OpsgenieNotifier{APIKey: apiKey, URL: strings.TrimRight(opsgenieURL, "/"), Priorities: priorities})
+	}
+	if apiKey := os.Getenv("DATADOG_API_KEY"); apiKey != "" {
+		site := os.Getenv("DATADOG_SITE")
+		if site == "" {
+			site = DefaultDatadogSite
+		}
+		notifiers = append(notifiers, &DatadogNotifier{APIKey: apiKey, Site: site, DORA: os.Getenv("DATADOG_DORA") == "true"})
+	}
+	if githubToken := os.Getenv("GITHUB_TOKEN"); githubToken != "" {
+		githubNotifier := &GitHubNotifier{Token: githubToken, APIURL: GitHubAPIURL(githubURL), CheckName: os.Getenv("GITHUB_CHECK_NAME")}
+		if githubNotifier.CheckName == "" {
+			githubNotifier.CheckName = DefaultGitHubCheckName
+		}
+		reports := splitList(os.Getenv("GITHUB_REPORT"))
+		if len(reports) == 0 {
+			reports = []string{GitHubReportDeployments, GitHubReportStatuses}
+		}
+		for _, report := range reports {
+			switch report {
+			case GitHubReportDeployments:
+				githubNotifier.Deployments = true
+			case GitHubReportStatuses:
+				githubNotifier.Statuses = true
+			case GitHubReportChecks:
+				githubNotifier.Checks = true
+			default:
+				globalLogger.Fatal("GITHUB_REPORT must be a list of deployments, statuses and checks.")
+			}
+		}
+		notifiers = append(notifiers, githubNotifier)
+		commitLookup = githubNotifier
+	}
+	if gitlabToken := os.Getenv("GITLAB_TOKEN"); gitlabToken != "" {
+		notifiers = append(notifiers, &GitLabNotifier{Token: gitlabToken, APIURL: gitlabURL + "/api/v4"})
+	}
+	if globalConfig != nil {
+		for _, webhook := range globalConfig.Webhooks {
+			notifier, err := NewWebhookNotifier(webhook)
 			if err != nil {
-				globalLogger.Warning("Couldn't notify slack for statefulSet update.")
+				globalLogger.Fatal("Invalid webhook notifier: " + err.Error())
 			}
+			notifiers = append(notifiers, notifier)
 		}
 	}
-}
-
-func main() {
-	// Setup logger
-	globalLogger = logger.Init("ConsoleLogger", true, false, ioutil.Discard)
-
-	// Get Slack webhook url, setup slack api
-	slackWebhookUrl = os.Getenv("SLACK_URL")
-	if slackWebhookUrl == "" {
-		globalLogger.Fatal("SLACK_URL not provided.")
-		panic("SLACK_URL not provided")
+	if len(notifiers) == 0 && !validateMode && !rotateMode && !agentMode {
+		globalLogger.Fatal("No notifier configured, SLACK_URL, SLACK_BOT_TOKEN, DISCORD_WEBHOOK_URL, TEAMS_WEBHOOK_URL, TELEGRAM_BOT_TOKEN, MATRIX_HOMESERVER_URL, SMTP_HOST, PAGERDUTY_ROUTING_KEY, OPSGENIE_API_KEY, DATADOG_API_KEY, GITHUB_TOKEN, GITLAB_TOKEN or a webhook in the config is required.")
 	}
 
 	// Setup kube cluster config
-	config, err := rest.InClusterConfig()
+	config, err := KubeConfig(*kubeconfig, *kubeContext)
 	if err != nil {
-		panic(err.Error())
+		globalLogger.Fatal("Could not load the kubernetes config: " + err.Error())
+	}
+	// Large clusters may allow more aggressive clients, small ones may need to be protected
+	if value := os.Getenv("KUBE_QPS"); value != "" {
+		qps, err := strconv.ParseFloat(value, 32)
+		if err != nil || qps <= 0 {
+			globalLogger.Fatal("KUBE_QPS must be a positive number.")
+		}
+		kubeQPS = float32(qps)
 	}
+	if value := os.Getenv("KUBE_BURST"); value != "" {
+		kubeBurst, err = strconv.Atoi(value)
+		if err != nil || kubeBurst < 1 {
+			globalLogger.Fatal("KUBE_BURST must be a positive number.")
+		}
+	}
+	if value := os.Getenv("KUBE_MAX_CONCURRENT_REQUESTS"); value != "" {
+		kubeMaxConcurrentRequests, err = strconv.Atoi(value)
+		if err != nil || kubeMaxConcurrentRequests < 0 {
+			globalLogger.Fatal("KUBE_MAX_CONCURRENT_REQUESTS must be a non-negative number.")
+		}
+	}
+	LimitRequests(config, 0, 0, 0)
+
 	// creates the clientset
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -280,14 +884,590 @@ func main() {
 	// Set global kubeSet
 	kubeSet = clientset
 
+	// A hung kubernetes api fails single operations and deploys instead of blocking them forever
+	kubeTimeout = parseDurationEnv("KUBE_TIMEOUT", 30*time.Second)
+	deployTimeout = parseDurationEnv("DEPLOY_TIMEOUT", 5*time.Minute)
+
+	// Sustained failures of the kubernetes api of a cluster pause deploys instead of failing them
+	if value := os.Getenv("KUBE_CIRCUIT_BREAKER_THRESHOLD"); value != "" {
+		kubeCircuitThreshold, err = strconv.Atoi(value)
+		if err != nil || kubeCircuitThreshold < 0 {
+			globalLogger.Fatal("KUBE_CIRCUIT_BREAKER_THRESHOLD must be a non-negative number.")
+		}
+	}
+	kubeCircuitCooldown = parseDurationEnv("KUBE_CIRCUIT_BREAKER_COOLDOWN", 30*time.Second)
+
+	// The local cluster and the additional clusters of the config, with a dynamic client for owners of workloads
+	localCluster, err := NewCluster("", config)
+	if err != nil {
+		panic(err.Error())
+	}
+	clusters[localCluster.Name] = localCluster
+	if globalConfig != nil {
+		if err := LoadClusters(globalConfig.Clusters, os.Getenv("SECRET_NAMESPACE")); err != nil {
+			globalLogger.Fatal("Could not load the clusters: " + err.Error())
+		}
+	}
+
+	// Validation only needs the clusters and the config, not the signing keys, database or audit log
+	if validateMode {
+		problems, err := Validate()
+		if err != nil {
+			globalLogger.Fatal("Validation failed: " + err.Error())
+		}
+		if problems > 0 {
+			fmt.Printf("%d problems found\n", problems)
+			os.Exit(1)
+		}
+		fmt.Println("No problems found")
+		return
+	}
+
+	// Signing keys are read from vault or a kubernetes secret
+	if vaultAddress := os.Getenv("VAULT_ADDR"); vaultAddress != "" {
+		kvVersion := 2
+		if os.Getenv("VAULT_KV_VERSION") == "1" {
+			kvVersion = 1
+		}
+		kvMount := os.Getenv("VAULT_KV_MOUNT")
+		if kvMount == "" {
+			kvMount = "secret"
+		}
+		transitMount := os.Getenv("VAULT_TRANSIT_MOUNT")
+		if transitMount == "" {
+			transitMount = "transit"
+		}
+		if os.Getenv("VAULT_KV_PATH") == "" && os.Getenv("VAULT_TRANSIT_KEYS") == "" {
+			globalLogger.Fatal("VAULT_KV_PATH or VAULT_TRANSIT_KEYS is required with VAULT_ADDR.")
+		}
+
+		vaultKeySource := &VaultKeySource{
+			Address:   vaultAddress,
+			Auth:      os.Getenv("VAULT_AUTH"),
+			AuthMount: os.Getenv("VAULT_AUTH_MOUNT"),
+			Token:     os.Getenv("VAULT_TOKEN"),
+			Role:      os.Getenv("VAULT_ROLE"),
+			RoleID:    os.Getenv("VAULT_ROLE_ID"),
+			SecretID:  os.Getenv("VAULT_SECRET_ID"),
+			KVMount:   kvMount,
+			KVPath:    os.Getenv("VAULT_KV_PATH"),
+			KVVersion: kvVersion,
+
+			TransitMount: transitMount,
+			TransitKeys:  splitList(os.Getenv("VAULT_TRANSIT_KEYS")),
+		}
+		if err := vaultKeySource.Watch(parseDurationEnv("VAULT_REFRESH_INTERVAL", 5*time.Minute)); err != nil {
+			globalLogger.Fatal("Could not read signing keys from vault: " + err.Error())
+		}
+		keySource = vaultKeySource
+	} else {
+		keySource = &SecretKeySource{Namespace: os.Getenv("SECRET_NAMESPACE"), Name: os.Getenv("SECRET_NAME")}
+		keyRotation = &KeyRotation{
+			Namespace:   os.Getenv("SECRET_NAMESPACE"),
+			Name:        os.Getenv("SECRET_NAME"),
+			Key:         os.Getenv("KEY_ROTATION_KEY"),
+			Interval:    parseDurationEnv("KEY_ROTATION_INTERVAL", 30*24*time.Hour),
+			GracePeriod: parseDurationEnv("KEY_ROTATION_GRACE_PERIOD", 7*24*time.Hour),
+			Keep:        1,
+		}
+		if keyRotation.Key == "" {
+			keyRotation.Key = "master_key"
+		}
+		if keep := os.Getenv("KEY_ROTATION_KEEP"); keep != "" {
+			keyRotation.Keep, err = strconv.Atoi(keep)
+			if err != nil || keyRotation.Keep < 1 {
+				globalLogger.Fatal("KEY_ROTATION_KEEP must be a positive number.")
+			}
+		}
+	}
+
+	if rotateMode {
+		if keyRotation == nil {
+			globalLogger.Fatal("Key rotation is only supported for kubernetes secrets.")
+		}
+		rotated, err := keyRotation.Run(false)
+		if err != nil {
+			globalLogger.Fatal("Could not rotate key: " + err.Error())
+		}
+		if rotated {
+			globalLogger.Info(fmt.Sprintf("Rotated key %s", keyRotation.Key))
+		} else {
+			globalLogger.Info(fmt.Sprintf("Key %s is not due for rotation", keyRotation.Key))
+		}
+		return
+	}
+
+	// Serve the signing keys from a watched cache instead of reading the secret on every request.
+	// Agents don't verify requests.
+	if secretKeySource, ok := keySource.(*SecretKeySource); ok && !agentMode {
+		if err := secretKeySource.Watch(10 * time.Minute); err != nil {
+			globalLogger.Fatal("Could not watch the signing key secret: " + err.Error())
+		}
+	}
+
+	// Notification texts overridden by templates
+	if templateConfigMap := os.Getenv("NOTIFICATION_TEMPLATES_CONFIGMAP"); templateConfigMap != "" {
+		notificationTemplates = &NotificationTemplates{Namespace: os.Getenv("NOTIFICATION_TEMPLATES_NAMESPACE"), Name: templateConfigMap}
+		if err := notificationTemplates.Watch(10 * time.Minute); err != nil {
+			globalLogger.Fatal("Could not watch the notification templates: " + err.Error())
+		}
+	}
+
+	// Database keeping deliveries, deploys and outcomes across restarts
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		store, err = OpenStore(databaseURL, parseDurationEnv("DATABASE_RETENTION", 90*24*time.Hour))
+		if err != nil {
+			globalLogger.Fatal("Could not open the database: " + err.Error())
+		}
+		store.PruneEvery(time.Hour)
+		// Nonces are shared by all replicas using the database
+		replayGuard.Store = store
+	}
+
+	// Audit log of all requests, persisted in a ConfigMap or the database if configured
+	auditSize := 500
+	if size := os.Getenv("AUDIT_LOG_SIZE"); size != "" {
+		auditSize, err = strconv.Atoi(size)
+		if err != nil || auditSize < 1 {
+			globalLogger.Fatal("AUDIT_LOG_SIZE must be a positive number.")
+		}
+	}
+	auditLog = NewAuditLog(os.Getenv("AUDIT_NAMESPACE"), os.Getenv("AUDIT_CONFIGMAP"), auditSize)
+	if err := auditLog.Load(); err != nil {
+		globalLogger.Fatal("Could not load audit log: " + err.Error())
+	}
+
+	// External audit sinks
+	if store != nil {
+		auditLog.AddSink(store)
+	}
+	if sinkURL := os.Getenv("AUDIT_SINK_URL"); sinkURL != "" {
+		auditLog.AddSink(&HTTPAuditSink{URL: sinkURL, Token: os.Getenv("AUDIT_SINK_TOKEN")})
+	}
+	if syslogAddress := os.Getenv("AUDIT_SYSLOG_ADDR"); syslogAddress != "" {
+		sink, err := NewSyslogAuditSink(syslogAddress)
+		if err != nil {
+			globalLogger.Fatal("Could not connect to the audit syslog server: " + err.Error())
+		}
+		auditLog.AddSink(sink)
+	}
+	if bucket := os.Getenv("AUDIT_S3_BUCKET"); bucket != "" {
+		auditLog.AddSink(&S3AuditSink{
+			Bucket:          bucket,
+			Region:          os.Getenv("AUDIT_S3_REGION"),
+			Prefix:          os.Getenv("AUDIT_S3_PREFIX"),
+			Endpoint:        os.Getenv("AUDIT_S3_ENDPOINT"),
+			AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+			SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		})
+	}
+
+	// Verified deliveries kept in memory to be redelivered through the admin api
+	redeliverySize := 100
+	if size := os.Getenv("REDELIVERY_STORE_SIZE"); size != "" {
+		redeliverySize, err = strconv.Atoi(size)
+		if err != nil || redeliverySize < 0 {
+			globalLogger.Fatal("REDELIVERY_STORE_SIZE must be a non-negative number.")
+		}
+	}
+	if redeliverySize > 0 {
+		redeliveryStore = NewRedeliveryStore(redeliverySize)
+	}
+
+	// Rollouts are followed to measure the DORA metrics
+	rolloutTimeout = parseDurationEnv("ROLLOUT_TIMEOUT", 10*time.Minute)
+	doraTracker = NewDoraTracker(parseDurationEnv("DORA_WINDOW", 30*24*time.Hour))
+	if store != nil {
+		records, err := store.Outcomes(time.Now().Add(-doraTracker.Window))
+		if err != nil {
+			globalLogger.Fatal("Could not load the deploy outcomes: " + err.Error())
+		}
+		doraTracker.Load(records)
+	}
+
+	// Deploy history kept in an annotation of each workload
+	historySize = 10
+	if size := os.Getenv("HISTORY_SIZE"); size != "" {
+		historySize, err = strconv.Atoi(size)
+		if err != nil || historySize < 0 {
+			globalLogger.Fatal("HISTORY_SIZE must be a non-negative number.")
+		}
+	}
+
+	// With several replicas, only the holder of the lease deploys
+	if os.Getenv("LEADER_ELECTION") == "true" {
+		leaderElection = &LeaderElection{
+			Namespace:     os.Getenv("LEADER_ELECTION_NAMESPACE"),
+			Name:          os.Getenv("LEADER_ELECTION_NAME"),
+			LeaseDuration: parseDurationEnv("LEADER_ELECTION_LEASE_DURATION", 15*time.Second),
+		}
+		if leaderElection.Namespace == "" {
+			leaderElection.Namespace = os.Getenv("SECRET_NAMESPACE")
+		}
+		if leaderElection.Name == "" {
+			leaderElection.Name = "kubernetes-internal-cd"
+		}
+		if leaderElection.LeaseDuration < 3*time.Second {
+			globalLogger.Fatal("LEADER_ELECTION_LEASE_DURATION must be at least 3s.")
+		}
+	}
+
+	// Only the image automation of flux is triggered instead of patching workloads
+	if os.Getenv("FLUX_IMAGE_AUTOMATION") == "true" {
+		fluxAutomation = &FluxImageAutomation{
+			APIVersion: os.Getenv("FLUX_IMAGE_API_VERSION"),
+			Namespace:  os.Getenv("FLUX_NAMESPACE"),
+			Interval:   parseDurationEnv("FLUX_INTERVAL", 10*time.Minute),
+		}
+		if fluxAutomation.APIVersion == "" {
+			fluxAutomation.APIVersion = "v1beta2"
+		}
+	}
+
+	// Missing permissions, unreachable clusters, signing keys and notifier credentials fail the start
+	if os.Getenv("PREFLIGHT") != "false" {
+		var keys KeySource
+		if !agentMode {
+			keys = keySource
+		}
+		if problems := Preflight(keys); len(problems) > 0 {
+			for _, problem := range problems {
+				globalLogger.Error("Startup check failed: " + problem)
+			}
+			globalLogger.Fatal(fmt.Sprintf("%d startup checks failed, fix them or set PREFLIGHT=false to skip the checks.", len(problems)))
+		}
+	}
+
+	// The controller-runtime manager runs the workload caches of all clusters and the leader election
+	mgr, err := NewManager(config, leaderElection)
+	if err != nil {
+		globalLogger.Fatal("Could not create the manager: " + err.Error())
+	}
+
+	// Match targets against informer caches of the workloads instead of listing them on every request
+	if os.Getenv("WORKLOAD_CACHE") != "false" {
+		selector := os.Getenv("WORKLOAD_CACHE_SELECTOR")
+		for _, cluster := range AllClusters() {
+			if err := cluster.WatchWorkloads(mgr, selector, parseDurationEnv("WORKLOAD_CACHE_RESYNC", 10*time.Minute)); err != nil {
+				globalLogger.Fatal("Could not watch the workloads: " + err.Error())
+			}
+		}
+	}
+
+	// Manual edits and reverts of deployed images are reported or reverted, on the leader only
+	switch driftDetection := os.Getenv("DRIFT_DETECTION"); driftDetection {
+	case "", "off":
+	case "alert", "revert":
+		reconciler := &DriftReconciler{Interval: parseDurationEnv("DRIFT_INTERVAL", 5*time.Minute), Revert: driftDetection == "revert"}
+		if err := mgr.Add(reconciler); err != nil {
+			globalLogger.Fatal("Could not add the drift reconciler: " + err.Error())
+		}
+	default:
+		globalLogger.Fatal("DRIFT_DETECTION must be off, alert or revert.")
+	}
+	StartManager(mgr)
+
+	// Deployed images are committed to a manifests repository, in addition to or instead of patching
+	switch mode := os.Getenv("GIT_WRITE_BACK"); mode {
+	case "", "off":
+	case "also", "only":
+		gitWriteBack = &GitWriteBack{
+			URL:            os.Getenv("GIT_WRITE_BACK_URL"),
+			Branch:         os.Getenv("GIT_WRITE_BACK_BRANCH"),
+			Token:          os.Getenv("GIT_WRITE_BACK_TOKEN"),
+			SSHKeyPath:     os.Getenv("GIT_WRITE_BACK_SSH_KEY_PATH"),
+			KnownHostsPath: os.Getenv("GIT_WRITE_BACK_KNOWN_HOSTS_PATH"),
+			AuthorName:     os.Getenv("GIT_WRITE_BACK_AUTHOR_NAME"),
+			AuthorEmail:    os.Getenv("GIT_WRITE_BACK_AUTHOR_EMAIL"),
+			Only:           mode == "only",
+			Dir:            os.Getenv("GIT_WRITE_BACK_DIR"),
+		}
+		if gitWriteBack.URL == "" {
+			globalLogger.Fatal("GIT_WRITE_BACK requires GIT_WRITE_BACK_URL.")
+		}
+		if gitWriteBack.Branch == "" {
+			gitWriteBack.Branch = "main"
+		}
+		if gitWriteBack.AuthorName == "" {
+			gitWriteBack.AuthorName = "kubernetes-internal-cd"
+		}
+		if gitWriteBack.AuthorEmail == "" {
+			gitWriteBack.AuthorEmail = "kubernetes-internal-cd@localhost"
+		}
+		if gitWriteBack.Dir == "" {
+			gitWriteBack.Dir = filepath.Join(os.TempDir(), "kicd-manifests")
+		}
+		pathTemplate := os.Getenv("GIT_WRITE_BACK_PATH")
+		if pathTemplate == "" {
+			pathTemplate = "{{.Namespace}}/{{.Name}}.yaml"
+		}
+		if gitWriteBack.Path, err = template.New("path").Option("missingkey=error").Parse(pathTemplate); err != nil {
+			globalLogger.Fatal("GIT_WRITE_BACK_PATH is not a valid template: " + err.Error())
+		}
+		if err := gitWriteBack.Sync(context.Background()); err != nil {
+			globalLogger.Fatal("Could not clone the manifests repository: " + err.Error())
+		}
+	default:
+		globalLogger.Fatal("GIT_WRITE_BACK must be off, also or only.")
+	}
+
+	// Deploys are run by a fixed number of workers, waiting in a bounded queue
+	deployWorkers, deployQueueSize := 4, 100
+	if workers := os.Getenv("DEPLOY_WORKERS"); workers != "" {
+		deployWorkers, err = strconv.Atoi(workers)
+		if err != nil || deployWorkers < 1 {
+			globalLogger.Fatal("DEPLOY_WORKERS must be a positive number.")
+		}
+	}
+	if size := os.Getenv("DEPLOY_QUEUE_SIZE"); size != "" {
+		deployQueueSize, err = strconv.Atoi(size)
+		if err != nil || deployQueueSize < 0 {
+			globalLogger.Fatal("DEPLOY_QUEUE_SIZE must be a non-negative number.")
+		}
+	}
+	deployQueue = NewDeployQueue(deployWorkers, deployQueueSize)
+
+	// Targets of a deploy are updated in parallel, optionally one environment after another
+	if concurrency := os.Getenv("TARGET_CONCURRENCY"); concurrency != "" {
+		targetConcurrency, err = strconv.Atoi(concurrency)
+		if err != nil || targetConcurrency < 1 {
+			globalLogger.Fatal("TARGET_CONCURRENCY must be a positive number.")
+		}
+	}
+	targetOrder = splitList(os.Getenv("TARGET_ORDER"))
+
+	// Transiently failed deploys of webhooks are retried, with a database also across restarts
+	deployRetryAttempts := 3
+	if attempts := os.Getenv("DEPLOY_RETRY_ATTEMPTS"); attempts != "" {
+		deployRetryAttempts, err = strconv.Atoi(attempts)
+		if err != nil || deployRetryAttempts < 0 {
+			globalLogger.Fatal("DEPLOY_RETRY_ATTEMPTS must be a non-negative number.")
+		}
+	}
+	deployRetryBackoff := parseDurationEnv("DEPLOY_RETRY_BACKOFF", 30*time.Second)
+	pendingDeploys = &PendingDeploys{Attempts: deployRetryAttempts, Backoff: deployRetryBackoff}
+
+	// Webhooks can instead be queued in the database and deployed by the workers of any replica
+	switch os.Getenv("DEPLOY_QUEUE") {
+	case "", "memory":
+	case "database":
+		if store == nil || !store.postgres {
+			globalLogger.Fatal("DEPLOY_QUEUE=database requires a postgres DATABASE_URL.")
+		}
+		if os.Getenv("LEADER_ELECTION") == "true" {
+			globalLogger.Fatal("DEPLOY_QUEUE=database and LEADER_ELECTION are mutually exclusive.")
+		}
+		// Agents report the results of each forwarded deploy to the hub, which queued deploys don't have
+		if agentMode {
+			globalLogger.Fatal("DEPLOY_QUEUE=database is not supported in agent mode.")
+		}
+		sharedQueue = &SharedQueue{
+			Identity:      os.Getenv("POD_NAME"),
+			Size:          deployQueueSize,
+			ClaimTimeout:  parseDurationEnv("DEPLOY_QUEUE_CLAIM_TIMEOUT", 10*time.Minute),
+			PollInterval:  parseDurationEnv("DEPLOY_QUEUE_POLL_INTERVAL", time.Second),
+			RetryAttempts: deployRetryAttempts,
+			RetryBackoff:  deployRetryBackoff,
+		}
+		if sharedQueue.Identity == "" {
+			sharedQueue.Identity, _ = os.Hostname()
+		}
+		sharedQueue.Work(deployWorkers)
+	default:
+		globalLogger.Fatal("DEPLOY_QUEUE must be memory or database.")
+	}
+
+	// Rapid successive pushes of a branch are coalesced to the newest
+	if window := parseDurationEnv("DEBOUNCE_WINDOW", -1); window > 0 {
+		debouncer = &Debouncer{Window: window, Deploy: func(ctx context.Context, event DeployEvent, audit AuditEntry) {
+			if err := enqueueDeploy(ctx, event, audit); err != nil {
+				globalLogger.With(LogFields{"requestId": event.RequestID, "repository": event.Repository}).Error("Could not queue the debounced deploy: " + err.Error())
+				audit.Outcome = AuditOutcomeError
+				audit.Reason = err.Error()
+				auditLog.Record(audit)
+			}
+		}}
+	}
+
+	if sharedQueue == nil && !agentMode {
+		pendingDeploys.Resume()
+	}
+
 	var port string = os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	globalLogger.Info("Server listening on port " + port)
+	// In-flight requests, deploys and notifications get this long to finish on SIGTERM
+	shutdownTimeout := parseDurationEnv("SHUTDOWN_TIMEOUT", 25*time.Second)
+	// Own mux, so handlers registered on the default mux (e.g. by net/http/pprof) are never exposed
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", HealthHandler)
+	mux.HandleFunc("/readyz", ReadyHandler)
+	mux.HandleFunc("/metrics", MetricsHandler)
+
+	// Agents only serve the probes and metrics and connect outbound to the hub
+	if agentMode {
+		agent := &Agent{HubURL: strings.TrimRight(os.Getenv("HUB_URL"), "/"), Token: os.Getenv("AGENT_TOKEN")}
+		if agent.HubURL == "" || agent.Token == "" {
+			globalLogger.Fatal("HUB_URL and AGENT_TOKEN are required in agent mode.")
+		}
+		go agent.Run()
 
-	http.HandleFunc("/", Webhook)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
+		server := &http.Server{Addr: ":" + port, Handler: RecoverHandler(mux)}
+		shutdown := HandleShutdown(server, shutdownTimeout)
+		globalLogger.Info("Agent listening on port " + port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			panic(err)
+		}
+		<-shutdown
+		return
+	}
+
+	mux.HandleFunc("/status/", StatusHandler)
+
+	// Webhooks are received on WEBHOOK_PATH and the endpoints of the config
+	webhookPath := os.Getenv("WEBHOOK_PATH")
+	if webhookPath == "" {
+		webhookPath = "/"
+	}
+	if err := validateEndpointPath(webhookPath); err != nil {
+		globalLogger.Fatal("Invalid WEBHOOK_PATH: " + err.Error())
+	}
+	endpointConfigs := []EndpointConfig{{Path: webhookPath}}
+	if globalConfig != nil {
+		endpointConfigs = append(endpointConfigs, globalConfig.Endpoints...)
+	}
+	webhookEndpoints = make(map[string]*WebhookEndpoint)
+	for _, endpointConfig := range endpointConfigs {
+		if _, ok := webhookEndpoints[endpointConfig.Path]; ok {
+			globalLogger.Fatal("Webhook endpoint " + endpointConfig.Path + " is configured more than once.")
+		}
+		endpoint, err := NewWebhookEndpoint(endpointConfig)
+		if err != nil {
+			globalLogger.Fatal("Invalid webhook endpoint: " + err.Error())
+		}
+		webhookEndpoints[endpoint.Path] = endpoint
+		mux.HandleFunc(endpoint.Path, Webhook)
+	}
+	// Unknown paths are logged and answered with 404 by the webhook handler
+	if _, ok := webhookEndpoints["/"]; !ok {
+		mux.HandleFunc("/", Webhook)
+	}
+
+	// Agents of clusters without inbound connectivity connect to this instance as their hub
+	if agentTokens := os.Getenv("AGENT_TOKENS"); agentTokens != "" {
+		tokens, err := ParseAgentTokens(agentTokens)
+		if err != nil {
+			globalLogger.Fatal("Invalid AGENT_TOKENS: " + err.Error())
+		}
+		for token := range tokens {
+			RegisterSecret(token)
+		}
+		hub = &Hub{Tokens: tokens}
+		mux.HandleFunc("/agent/stream", hub.StreamHandler)
+		mux.HandleFunc("/agent/results", hub.ResultsHandler)
+	}
+
+	// Admin api, only available with an admin token or OpenID Connect
+	adminToken = os.Getenv("ADMIN_TOKEN")
+	if issuer := os.Getenv("ADMIN_OIDC_ISSUER"); issuer != "" {
+		jwksURL, err := DiscoverJWKSURL(issuer)
+		if err != nil {
+			globalLogger.Fatal("Could not discover the OpenID Connect configuration: " + err.Error())
+		}
+		adminOIDC = &AdminOIDC{
+			Verifier:    &JWTVerifier{JWKSURL: jwksURL, Issuer: issuer, Audience: os.Getenv("ADMIN_OIDC_CLIENT_ID")},
+			GroupsClaim: os.Getenv("ADMIN_OIDC_GROUPS_CLAIM"),
+			AdminGroups: splitList(os.Getenv("ADMIN_OIDC_GROUPS")),
+			ReadGroups:  splitList(os.Getenv("ADMIN_OIDC_READ_GROUPS")),
+		}
+		if adminOIDC.Verifier.Audience == "" {
+			globalLogger.Fatal("ADMIN_OIDC_CLIENT_ID is required for OpenID Connect.")
+		}
+		if adminOIDC.GroupsClaim == "" {
+			adminOIDC.GroupsClaim = "groups"
+		}
+	}
+	// Slack app handling slash commands like /kicd status api and the rollback buttons of notifications
+	if signingSecret := os.Getenv("SLACK_SIGNING_SECRET"); signingSecret != "" {
+		slackApp = &SlackApp{SigningSecret: signingSecret, Users: splitList(os.Getenv("SLACK_COMMAND_USERS"))}
+		mux.HandleFunc("/slack/commands", slackApp.CommandHandler)
+		mux.HandleFunc("/slack/interactions", slackApp.InteractionHandler)
+	}
+
+	// Dashboard for users without kubectl, logging in with the OpenID Connect issuer of the admin api
+	if dashboardURL := os.Getenv("DASHBOARD_URL"); dashboardURL != "" {
+		scopes := splitList(os.Getenv("DASHBOARD_OIDC_SCOPES"))
+		if len(scopes) == 0 {
+			scopes = []string{"openid", "email", "profile"}
+		}
+		dashboard, err := NewDashboard(dashboardURL, os.Getenv("DASHBOARD_OIDC_CLIENT_SECRET"), scopes, os.Getenv("DASHBOARD_ALLOW_ROLLBACK") == "true")
+		if err != nil {
+			globalLogger.Fatal("Could not setup the dashboard: " + err.Error())
+		}
+		dashboard.Register(mux)
+	}
+	if AdminEnabled() {
+		mux.HandleFunc("/admin/keys", AdminHandler(KeysHandler))
+		mux.HandleFunc("/admin/audit", AdminHandler(AuditHandler))
+		mux.HandleFunc("/admin/targets", AdminHandler(TargetsHandler))
+		mux.HandleFunc("/admin/deploy", AdminHandler(DeployHandler))
+		mux.HandleFunc("/admin/rollback", AdminHandler(RollbackHandler))
+		mux.HandleFunc("/admin/history", AdminHandler(HistoryHandler))
+		mux.HandleFunc("/admin/dora", AdminHandler(DoraHandler))
+		mux.HandleFunc("/admin/log-level", AdminHandler(LogLevelHandler))
+		mux.HandleFunc("/admin/deliveries", AdminHandler(DeliveriesHandler))
+		mux.HandleFunc("/admin/deliveries/", AdminHandler(DeliveriesHandler))
+		mux.HandleFunc("/admin/config", AdminHandler(ConfigHandler))
+	}
+
+	// Optional pprof handlers, only reachable from within the pod
+	if debugPort := os.Getenv("DEBUG_PORT"); debugPort != "" {
+		go ServeDebug(debugPort)
+	}
+
+	server := &http.Server{Addr: ":" + port, Handler: RecoverHandler(mux)}
+	shutdown := HandleShutdown(server, shutdownTimeout)
+
+	// Serve https if a certificate is given, optionally requiring client certificates.
+	// The certificate is reloaded when it was rotated.
+	certificateReloader := &CertificateReloader{
+		CertPath:        os.Getenv("TLS_CERT_PATH"),
+		KeyPath:         os.Getenv("TLS_KEY_PATH"),
+		SecretNamespace: os.Getenv("TLS_SECRET_NAMESPACE"),
+		SecretName:      os.Getenv("TLS_SECRET_NAME"),
+	}
+	clientCAPath := os.Getenv("TLS_CLIENT_CA_PATH")
+	tlsEnabled := certificateReloader.CertPath != "" || certificateReloader.SecretName != ""
+	if clientCAPath != "" && !tlsEnabled {
+		globalLogger.Fatal("TLS_CLIENT_CA_PATH requires TLS_CERT_PATH and TLS_KEY_PATH or TLS_SECRET_NAME.")
+	}
+	if tlsEnabled {
+		if certificateReloader.SecretNamespace == "" {
+			certificateReloader.SecretNamespace = os.Getenv("SECRET_NAMESPACE")
+		}
+		if err := certificateReloader.Watch(parseDurationEnv("TLS_RELOAD_INTERVAL", time.Minute)); err != nil {
+			globalLogger.Fatal("Could not load the tls certificate: " + err.Error())
+		}
+		tlsConfig, err := NewTLSConfig(clientCAPath)
+		if err != nil {
+			globalLogger.Fatal("Could not setup tls: " + err.Error())
+		}
+		tlsConfig.GetCertificate = certificateReloader.GetCertificate
+		server.TLSConfig = tlsConfig
+
+		globalLogger.Info("Server listening with tls on port " + port)
+		if err := server.ListenAndServeTLS("", ""); err != http.ErrServerClosed {
+			panic(err)
+		}
+		<-shutdown
+		return
+	}
+
+	globalLogger.Info("Server listening on port " + port)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		panic(err)
 	}
+	<-shutdown
 }
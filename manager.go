@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+
+	"github.com/go-logr/logr/funcr"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/log"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+	metricsserver "sigs.k8s.io/controller-runtime/pkg/metrics/server"
+)
+
+// Cancels the context of the running manager and is closed once it stopped
+var managerCancel context.CancelFunc
+var managerDone chan struct{}
+
+// Creates the controller-runtime manager running the workload caches of all clusters and, if
+// enabled, the leader election. The own /metrics and /readyz are served instead of those of the manager.
+func NewManager(config *rest.Config, election *LeaderElection) (manager.Manager, error) {
+	log.SetLogger(funcr.New(func(prefix, args string) {
+		globalLogger.Debug(prefix + " " + args)
+	}, funcr.Options{}))
+
+	options := manager.Options{
+		Scheme:                 scheme.Scheme,
+		Metrics:                metricsserver.Options{BindAddress: "0"},
+		HealthProbeBindAddress: "0",
+	}
+	if election != nil {
+		// Renewed three times per lease duration
+		renewDeadline := election.LeaseDuration * 2 / 3
+		retryPeriod := election.LeaseDuration / 3
+		options.LeaderElection = true
+		options.LeaderElectionID = election.Name
+		options.LeaderElectionNamespace = election.Namespace
+		options.LeaderElectionReleaseOnCancel = true
+		options.LeaseDuration = &election.LeaseDuration
+		options.RenewDeadline = &renewDeadline
+		options.RetryPeriod = &retryPeriod
+	}
+
+	mgr, err := manager.New(config, options)
+	if err != nil {
+		return nil, err
+	}
+	if election != nil {
+		election.watch(mgr.Elected())
+	}
+
+	return mgr, nil
+}
+
+// Starts the manager in the background. The process exits if the manager fails, e.g. when the
+// leader lost its lease, so it restarts as a follower.
+func StartManager(mgr manager.Manager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	managerCancel, managerDone = cancel, make(chan struct{})
+	go func() {
+		defer close(managerDone)
+		if err := mgr.Start(ctx); err != nil {
+			globalLogger.Fatal("The manager stopped: " + err.Error())
+		}
+	}()
+}
+
+// Stops the manager, which releases the lease of the leader, and waits until it stopped or the
+// context expires
+func StopManager(ctx context.Context) error {
+	if managerCancel == nil {
+		return nil
+	}
+	managerCancel()
+
+	select {
+	case <-managerDone:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ManualDeployRequest triggers a deploy without a webhook, e.g. to redeploy or recover from a missed webhook
+type ManualDeployRequest struct {
+	Repository string `json:"repository"`
+	// Optional, defaults to the default branch of the repository
+	Branch        string `json:"branch,omitempty"`
+	DefaultBranch string `json:"defaultBranch,omitempty"`
+	Sha           string `json:"sha"`
+	// Image without tag, tagged with the sha like images of webhooks
+	Image string `json:"image"`
+}
+
+type ManualDeployResponse struct {
+	RequestID string         `json:"requestId"`
+	Delivery  string         `json:"delivery"`
+	Results   []TargetResult `json:"results"`
+	// Whether the deploy was queued in the database and runs on any replica, without results
+	Queued bool `json:"queued,omitempty"`
+}
+
+// Queues the deploy in the shared queue of the database, whose worker records the audit entry with
+// the results, and responds with 202. Returns false if deploys don't use the shared queue.
+func queueSharedDeploy(w http.ResponseWriter, event DeployEvent, audit AuditEntry) bool {
+	if sharedQueue == nil {
+		return false
+	}
+
+	audit.Status = 202
+	err := sharedQueue.Enqueue(event, audit)
+	if err != nil {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+		audit.Status = 503
+		if err == errDeployQueueFull {
+			audit.Status = 429
+			w.Header().Set("Retry-After", strconv.Itoa(int(sharedQueue.RetryAfter().Seconds())))
+		} else {
+			w.Header().Set("Retry-After", "5")
+		}
+		auditLog.Record(audit)
+		http.Error(w, err.Error(), audit.Status)
+		return true
+	}
+
+	WriteJSON(w, 202, ManualDeployResponse{RequestID: event.RequestID, Delivery: audit.ID, Queued: true})
+	return true
+}
+
+// Deploys the image of the posted ManualDeployRequest and responds with the results of all targets.
+// Protected namespaces require the production signature of the body like webhooks.
+func DeployHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	requestID := RequestID(r)
+	w.Header().Set("x-request-id", requestID)
+	ctx, span := tracer.StartSpan(ContextWithTraceparent(r.Context(), r.Header.Get("traceparent")), "manual deploy", SpanKindServer)
+	defer span.Finish()
+
+	bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var request ManualDeployRequest
+	if err := json.Unmarshal(bytes, &request); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if request.Repository == "" || request.Sha == "" || request.Image == "" {
+		http.Error(w, "repository, sha and image are required", 400)
+		return
+	}
+	if request.DefaultBranch == "" {
+		request.DefaultBranch = defaultBranch
+	}
+	if request.Branch == "" {
+		request.Branch = request.DefaultBranch
+	}
+
+	audit := AuditEntry{
+		Time:       time.Now(),
+		Source:     ClientIP(r).String(),
+		RequestID:  requestID,
+		Repository: request.Repository,
+		Branch:     request.Branch,
+		Sha:        request.Sha,
+		Image:      fmt.Sprintf("%s:%s", strings.TrimSpace(request.Image), request.Sha),
+		Verified:   true,
+		Reason:     "manual deploy",
+		Headers:    HeaderSummary(r),
+	}
+	audit.ID = AuditID(audit.Time)
+
+	if imagePolicy != nil && !imagePolicy.Allowed(audit.Image) {
+		audit.Outcome = AuditOutcomeRejected
+		audit.Status = 403
+		auditLog.Record(audit)
+		http.Error(w, "image is not allowed", 403)
+		return
+	}
+
+	productionVerified := false
+	if len(protectedNamespaces) > 0 && r.Header.Get("x-production-signature-256") != "" {
+		keys, err := keySource.Keys()
+		if err != nil {
+			http.Error(w, "could not get signing keys", 500)
+			return
+		}
+		if productionVerified = VerifyProductionSignature(keys, bytes, r.Header); !productionVerified {
+			audit.Outcome = AuditOutcomeRejected
+			audit.Status = 401
+			auditLog.Record(audit)
+			http.Error(w, "production signature verification failed", 401)
+			return
+		}
+	}
+
+	globalLogger.With(LogFields{"requestId": requestID, "repository": request.Repository, "branch": request.Branch, "image": audit.Image, "source": audit.Source}).Info(fmt.Sprintf("Manual deploy of %s requested by %s", audit.Image, audit.Source))
+	event := DeployEvent{
+		Repository:         request.Repository,
+		Branch:             request.Branch,
+		DefaultBranch:      request.DefaultBranch,
+		Sha:                request.Sha,
+		Image:              audit.Image,
+		Source:             audit.Source,
+		ReceivedAt:         audit.Time,
+		Delivery:           audit.ID,
+		RequestID:          requestID,
+		ProductionVerified: productionVerified,
+	}
+	redeliveryStore.Add(event)
+	if queueSharedDeploy(w, event, audit) {
+		return
+	}
+	results, err := deployQueue.Run(ctx, event)
+	if err == errDeployQueueFull {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+		audit.Status = 429
+		auditLog.Record(audit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(deployQueue.RetryAfter().Seconds())))
+		http.Error(w, err.Error(), 429)
+		return
+	}
+	if err == errNotLeader || err == errCircuitOpen {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+		audit.Status = 503
+		auditLog.Record(audit)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if err != nil {
+		span.SetError(err)
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = "manual deploy: " + err.Error()
+		audit.Status = 500
+		auditLog.Record(audit)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	audit.SetResults(results)
+	audit.Status = 200
+	auditLog.Record(audit)
+
+	WriteJSON(w, 200, ManualDeployResponse{RequestID: requestID, Delivery: audit.ID, Results: results})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// Returns the workload cache of the cluster with the parsed selector of the list options, or nil
+// if the cluster has no synced cache
+func cachedWorkloads(cluster *Cluster, listOptions metav1.ListOptions) (*WorkloadCache, labels.Selector, error) {
+	if cluster.Workloads == nil || !cluster.Workloads.Synced() {
+		return nil, nil, nil
+	}
+	selector, err := labels.Parse(listOptions.LabelSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cluster.Workloads, selector, nil
+}
+
+// Returns the namespaces to list for the given namespace, where an empty namespace means all.
+// With WATCH_NAMESPACES set, only those namespaces are listed.
+func ListNamespaces(namespace string) []string {
+	if len(watchNamespaces) == 0 {
+		return []string{namespace}
+	}
+	if namespace == "" {
+		return watchNamespaces
+	}
+	if NamespaceAllowed(namespace) {
+		return []string{namespace}
+	}
+
+	globalLogger.Warning("Namespace " + namespace + " is not in WATCH_NAMESPACES. Skipping it...")
+	return nil
+}
+
+// Returns whether workloads of the namespace may be read and updated
+func NamespaceAllowed(namespace string) bool {
+	if len(watchNamespaces) == 0 {
+		return true
+	}
+	for _, watchNamespace := range watchNamespaces {
+		if watchNamespace == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns whether deploys into the namespace require the production signature
+func NamespaceProtected(namespace string) bool {
+	for _, protectedNamespace := range protectedNamespaces {
+		if protectedNamespace == namespace {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Lists the deployments of the cluster in the given namespace (or all allowed namespaces if empty),
+// from the workload cache once it is synced
+func ListDeployments(ctx context.Context, cluster *Cluster, namespace string, listOptions metav1.ListOptions) ([]appsv1.Deployment, error) {
+	workloads, selector, err := cachedWorkloads(cluster, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var deployments []appsv1.Deployment
+	for _, listNamespace := range ListNamespaces(namespace) {
+		if workloads != nil {
+			cached, err := workloads.Deployments(listNamespace, selector)
+			if err != nil {
+				return nil, err
+			}
+			deployments = append(deployments, cached...)
+			continue
+		}
+		listCtx, cancel := apiContext(ctx)
+		list, err := cluster.Kube.AppsV1().Deployments(listNamespace).List(listCtx, listOptions)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		deployments = append(deployments, list.Items...)
+	}
+
+	return deployments, nil
+}
+
+// Lists the stateful sets of the cluster in the given namespace (or all allowed namespaces if empty),
+// from the workload cache once it is synced
+func ListStatefulSets(ctx context.Context, cluster *Cluster, namespace string, listOptions metav1.ListOptions) ([]appsv1.StatefulSet, error) {
+	workloads, selector, err := cachedWorkloads(cluster, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var statefulSets []appsv1.StatefulSet
+	for _, listNamespace := range ListNamespaces(namespace) {
+		if workloads != nil {
+			cached, err := workloads.StatefulSets(listNamespace, selector)
+			if err != nil {
+				return nil, err
+			}
+			statefulSets = append(statefulSets, cached...)
+			continue
+		}
+		listCtx, cancel := apiContext(ctx)
+		list, err := cluster.Kube.AppsV1().StatefulSets(listNamespace).List(listCtx, listOptions)
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		statefulSets = append(statefulSets, list.Items...)
+	}
+
+	return statefulSets, nil
+}
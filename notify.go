@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	NotificationSucceeded        = "succeeded"
+	NotificationRejected         = "rejected"
+	NotificationRolloutFailed    = "rolloutFailed"
+	NotificationRolloutSucceeded = "rolloutSucceeded"
+	NotificationSkipped          = "skipped"
+	NotificationDeployed         = "deployed"
+	NotificationRolledBack       = "rolledBack"
+	// A target runs another image than last deployed
+	NotificationDrifted = "drifted"
+	// All rollouts of a deploy completed or failed
+	NotificationCompleted = "completed"
+	// The circuit breaker of the kubernetes api of a cluster opened or closed again
+	NotificationAPIUnavailable = "apiUnavailable"
+	NotificationAPIRecovered   = "apiRecovered"
+)
+
+// Notification is a message about a deploy, sent to all configured notifiers
+type Notification struct {
+	// Unique per notification and kept by its retries, so receivers can deduplicate them
+	ID    string      `json:"id"`
+	Type  string      `json:"type"`
+	Text  string      `json:"text"`
+	Event DeployEvent `json:"event"`
+	// The result of the target, if the notification is about a single target
+	Result *TargetResult `json:"result,omitempty"`
+	// The results of all updated targets, if the notification summarizes a deploy
+	Results []TargetResult `json:"results,omitempty"`
+}
+
+// Notifier sends notifications to a chat or other system
+type Notifier interface {
+	Notify(notification Notification) error
+	Name() string
+}
+
+// Whether successful updates of all targets of a push are summarized in a single deployed notification
+// for notifiers which don't select their own types, instead of a succeeded notification per target
+var aggregateNotifications = true
+
+// Returns the notification types sent to notifiers which don't select their own types
+func defaultNotificationTypes() []string {
+	if aggregateNotifications {
+		return []string{NotificationDeployed, NotificationRolledBack, NotificationFailed, NotificationRolloutFailed, NotificationSkipped, NotificationRejected, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered}
+	}
+
+	return []string{NotificationSucceeded, NotificationRolledBack, NotificationFailed, NotificationRolloutFailed, NotificationSkipped, NotificationRejected, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered}
+}
+
+// Returns whether the notifier wants notifications of the given type
+func notifierWants(notifier Notifier, notificationType string) bool {
+	types := defaultNotificationTypes()
+	if typed, ok := notifier.(interface{ Types() []string }); ok {
+		types = typed.Types()
+	}
+	for _, t := range types {
+		if t == notificationType {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sends the notification to all notifiers. Failures are only logged and reported.
+func Notify(ctx context.Context, notification Notification) {
+	fields := LogFields{"requestId": notification.Event.RequestID, "repository": notification.Event.Repository}
+	if notification.Result != nil {
+		fields["namespace"] = notification.Result.Target.Namespace
+		fields["workload"] = notification.Result.Target.Name
+	}
+
+	notification.ID = randomHex(16)
+	notification.Text = notificationTemplates.Render(notification)
+	if dryRun {
+		notification.Text = "[dry run] " + notification.Text
+	}
+
+	for _, notifier := range notifiers {
+		if !notifierWants(notifier, notification.Type) {
+			continue
+		}
+
+		_, span := tracer.StartSpan(ctx, "notify "+notifier.Name(), SpanKindClient)
+		err := notifier.Notify(notification)
+		span.SetError(err)
+		span.Finish()
+		if err != nil {
+			notifierFields := LogFields{"notifier": notifier.Name()}
+			for key, value := range fields {
+				notifierFields[key] = value
+			}
+			scheduleNotificationRetry(notifier, notification, 1, err, notifierFields)
+		}
+	}
+}
+
+var (
+	notificationsRetriedTotal = NewCounterVec("kicd_notifications_retried_total", "Retries of failed notifications per notifier.", "notifier")
+	notificationsDroppedTotal = NewCounterVec("kicd_notifications_dropped_total", "Notifications which were given up per notifier and reason.", "notifier", "reason")
+)
+
+// Retries of failed notifications, 0 disables retrying
+var notificationRetryAttempts = 5
+
+// Backoff before the first retry of a failed notification, doubled for each further retry
+var notificationRetryBackoff = 2 * time.Second
+
+// Maximum fraction added randomly to each backoff, so notifications failing together aren't retried at once
+var notificationRetryJitter = 0.0
+
+// Maximum number of notifications waiting for a retry, further failed notifications are dropped
+const notificationRetryQueueSize = 100
+
+var pendingNotificationRetries int32
+
+// Retries the failed notification after an exponential backoff (2s, 4s, 8s, ... by default) or drops it
+// after the last attempt or if too many notifications are waiting for a retry
+func scheduleNotificationRetry(notifier Notifier, notification Notification, attempt int, err error, fields LogFields) {
+	logger := globalLogger.With(fields)
+	if attempt > notificationRetryAttempts {
+		logger.Warning(fmt.Sprintf("Couldn't notify %s, dropping the notification after %d attempts: %s", notifier.Name(), attempt, err))
+		errorReporter.Capture(err, fields)
+		notificationsDroppedTotal.Inc(notifier.Name(), "attempts")
+		return
+	}
+	if atomic.AddInt32(&pendingNotificationRetries, 1) > notificationRetryQueueSize {
+		atomic.AddInt32(&pendingNotificationRetries, -1)
+		logger.Warning(fmt.Sprintf("Couldn't notify %s, dropping the notification as the retry queue is full: %s", notifier.Name(), err))
+		errorReporter.Capture(err, fields)
+		notificationsDroppedTotal.Inc(notifier.Name(), "queue")
+		return
+	}
+
+	backoff := wait.Jitter(notificationRetryBackoff*time.Duration(1<<uint(attempt-1)), notificationRetryJitter)
+	logger.Warning(fmt.Sprintf("Couldn't notify %s, retrying in %s: %s", notifier.Name(), backoff, err))
+	time.AfterFunc(backoff, func() {
+		atomic.AddInt32(&pendingNotificationRetries, -1)
+		notificationsRetriedTotal.Inc(notifier.Name())
+		if err := notifier.Notify(notification); err != nil {
+			scheduleNotificationRetry(notifier, notification, attempt+1, err, fields)
+		}
+	})
+}
+
+// Returns the text of the notification followed by its request ID
+func notificationText(notification Notification) string {
+	if notification.Event.RequestID == "" {
+		return notification.Text
+	}
+
+	return fmt.Sprintf("%s (request %s)", notification.Text, notification.Event.RequestID)
+}
+
+// Returns the url comparing the commit deployed before with the commit of the event, the sha before
+// the push or the tag of the previous images if they are all the same sha. Empty if unknown.
+func (n Notification) CompareURL() string {
+	base := n.Event.Before
+	if base == "" {
+		results := n.Results
+		if n.Result != nil {
+			results = []TargetResult{*n.Result}
+		}
+		for _, result := range results {
+			previousSha := ImageTag(result.PreviousImage)
+			if result.PreviousImage == "" || !shaPattern.MatchString(previousSha) || (base != "" && base != previousSha) {
+				return ""
+			}
+			base = previousSha
+		}
+	}
+	// New branches were pushed on top of the zero sha
+	if strings.Trim(base, "0") == "" || n.Event.Sha == "" || base == n.Event.Sha {
+		return ""
+	}
+	if n.Event.Provider == ProviderGitLab {
+		return fmt.Sprintf("%s/%s/-/compare/%s...%s", gitlabURL, n.Event.Repository, base, n.Event.Sha)
+	}
+
+	return fmt.Sprintf("%s/%s/compare/%s...%s", githubURL, n.Event.Repository, base, n.Event.Sha)
+}
+
+// Returns the first line of the commit message of the event, shortened to the length
+func commitSubject(event DeployEvent, length int) string {
+	subject := strings.TrimSpace(strings.SplitN(strings.TrimSpace(event.CommitMessage), "\n", 2)[0])
+	if len(subject) > length {
+		subject = subject[:length-3] + "..."
+	}
+
+	return subject
+}
+
+// Posts the json payload to the url
+func postJSON(url string, payload interface{}) error {
+	return postJSONWithHeaders(url, nil, payload)
+}
+
+// Posts the json payload to the url with additional request headers
+func postJSONWithHeaders(url string, headers map[string]string, payload interface{}) error {
+	return sendJSON(http.MethodPost, url, headers, payload)
+}
+
+// Sends the json payload to the url with the given method and additional request headers
+func sendJSON(method string, url string, headers map[string]string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// Requests the url with GET and additional request headers, expecting a successful status
+func getURL(url string, headers map[string]string) error {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	for key, value := range headers {
+		request.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+// DiscordNotifier posts to a discord webhook
+type DiscordNotifier struct {
+	URL string
+}
+
+func (n *DiscordNotifier) Notify(notification Notification) error {
+	return postJSON(n.URL, map[string]interface{}{
+		"username": "kubernetes-internal-cd",
+		"content":  notificationText(notification),
+		// Only mention what is part of the content, never @everyone from repository names
+		"allowed_mentions": map[string][]string{"parse": {}},
+	})
+}
+
+func (n *DiscordNotifier) Name() string {
+	return "discord"
+}
+
+// TeamsNotifier posts adaptive cards to a microsoft teams incoming webhook
+type TeamsNotifier struct {
+	URL string
+}
+
+func (n *TeamsNotifier) Notify(notification Notification) error {
+	event := notification.Event
+	facts := []map[string]string{
+		{"title": "Repository", "value": event.Repository},
+		{"title": "Image", "value": event.Image},
+	}
+	if event.Branch != "" {
+		facts = append(facts, map[string]string{"title": "Branch", "value": event.Branch})
+	}
+	if notification.Result != nil {
+		facts = append(facts, map[string]string{"title": "Target", "value": notification.Result.Target.String()})
+	}
+	if event.RequestID != "" {
+		facts = append(facts, map[string]string{"title": "Request", "value": event.RequestID})
+	}
+
+	color := "Attention"
+	switch notification.Type {
+	case NotificationSucceeded, NotificationDeployed, NotificationRolloutSucceeded:
+		color = "Good"
+	}
+
+	return postJSON(n.URL, map[string]interface{}{
+		"type": "message",
+		"attachments": []map[string]interface{}{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]interface{}{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body": []map[string]interface{}{
+					{"type": "TextBlock", "text": notification.Text, "wrap": true, "weight": "Bolder", "color": color},
+					{"type": "FactSet", "facts": facts},
+				},
+			},
+		}},
+	})
+}
+
+func (n *TeamsNotifier) Name() string {
+	return "teams"
+}
+
+// TelegramNotifier sends messages to a telegram chat with a bot
+type TelegramNotifier struct {
+	BotToken string
+	ChatID   string
+}
+
+func (n *TelegramNotifier) Notify(notification Notification) error {
+	return postJSON("https://api.telegram.org/bot"+n.BotToken+"/sendMessage", map[string]interface{}{
+		"chat_id":                  n.ChatID,
+		"text":                     notificationText(notification),
+		"disable_web_page_preview": true,
+	})
+}
+
+// Verifies the bot token with getMe
+func (n *TelegramNotifier) Check() error {
+	return getURL("https://api.telegram.org/bot"+n.BotToken+"/getMe", nil)
+}
+
+func (n *TelegramNotifier) Name() string {
+	return "telegram"
+}
+
+// MatrixNotifier sends messages to a matrix room with the access token of a (bot) user
+type MatrixNotifier struct {
+	HomeserverURL string
+	AccessToken   string
+	RoomID        string
+}
+
+func (n *MatrixNotifier) Notify(notification Notification) error {
+	// The transaction ID makes retries of the same message idempotent
+	transactionID := "kicd-" + notification.ID
+	messageURL := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", n.HomeserverURL, url.PathEscape(n.RoomID), transactionID)
+
+	return sendJSON(http.MethodPut, messageURL, map[string]string{"authorization": "Bearer " + n.AccessToken}, map[string]string{
+		"msgtype": "m.notice",
+		"body":    notificationText(notification),
+	})
+}
+
+// Verifies the access token with whoami
+func (n *MatrixNotifier) Check() error {
+	return getURL(n.HomeserverURL+"/_matrix/client/v3/account/whoami", map[string]string{"authorization": "Bearer " + n.AccessToken})
+}
+
+func (n *MatrixNotifier) Name() string {
+	return "matrix"
+}
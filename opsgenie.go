@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+const (
+	DefaultOpsgenieURL      = "https://api.opsgenie.com"
+	DefaultOpsgeniePriority = "P3"
+)
+
+// OpsgenieNotifier creates alerts for failed updates and rollouts and closes them once a rollout of the
+// target succeeded again
+type OpsgenieNotifier struct {
+	APIKey string
+	// Api url, https://api.eu.opsgenie.com for the eu instance
+	URL string
+	// Priorities (P1 to P5) of alerts by environment of the target
+	Priorities map[string]string
+}
+
+// Parses environment priorities in the format environment=priority,environment=priority
+func ParseOpsgeniePriorities(value string) (map[string]string, error) {
+	priorities := make(map[string]string)
+	for _, entry := range splitList(value) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("malformed priority %s, environment=priority is required", entry)
+		}
+		priority := strings.ToUpper(strings.TrimSpace(parts[1]))
+		switch priority {
+		case "P1", "P2", "P3", "P4", "P5":
+		default:
+			return nil, fmt.Errorf("unknown priority %s, P1 to P5 are supported", parts[1])
+		}
+		priorities[strings.ToLower(strings.TrimSpace(parts[0]))] = priority
+	}
+
+	return priorities, nil
+}
+
+// Returns the alert priority of the target
+func (n *OpsgenieNotifier) priority(target Target) string {
+	if priority, ok := n.Priorities[strings.ToLower(target.Environment)]; ok {
+		return priority
+	}
+
+	return DefaultOpsgeniePriority
+}
+
+func (n *OpsgenieNotifier) Notify(notification Notification) error {
+	if notification.Result == nil {
+		return nil
+	}
+	target := notification.Result.Target
+	headers := map[string]string{"authorization": "GenieKey " + n.APIKey}
+	// Alerts are deduplicated per workload
+	alias := DedupKey(target)
+
+	// Like PagerDuty incidents, alerts are only closed by completed rollouts
+	if notification.Type == NotificationRolloutSucceeded {
+		return postJSONWithHeaders(fmt.Sprintf("%s/v2/alerts/%s/close?identifierType=alias", n.URL, url.PathEscape(alias)), headers, map[string]string{
+			"source": "kubernetes-internal-cd",
+			"note":   notificationText(notification),
+		})
+	}
+
+	message := notification.Text
+	// Opsgenie limits the message to 130 characters
+	if len(message) > 130 {
+		message = message[:127] + "..."
+	}
+	tags := []string{"kubernetes-internal-cd", target.Namespace}
+	if target.Environment != "" {
+		tags = append(tags, target.Environment)
+	}
+
+	return postJSONWithHeaders(n.URL+"/v2/alerts", headers, map[string]interface{}{
+		"message":     message,
+		"alias":       alias,
+		"description": notificationText(notification),
+		"priority":    n.priority(target),
+		"source":      "kubernetes-internal-cd",
+		"entity":      target.String(),
+		"tags":        tags,
+		"details": map[string]string{
+			"repository":    notification.Event.Repository,
+			"branch":        notification.Event.Branch,
+			"image":         notification.Event.Image,
+			"previousImage": notification.Result.PreviousImage,
+			"error":         notification.Result.Error,
+			"requestId":     notification.Event.RequestID,
+		},
+	})
+}
+
+func (n *OpsgenieNotifier) Name() string {
+	return "opsgenie"
+}
+
+func (n *OpsgenieNotifier) Types() []string {
+	return []string{NotificationFailed, NotificationRolloutFailed, NotificationRolledBack, NotificationRolloutSucceeded, NotificationDrifted}
+}
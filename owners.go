@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// OwnerConfig describes a controller owning workloads and where it expects the image,
+// so that the owner is patched instead of the workload it would revert.
+type OwnerConfig struct {
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	// Plural resource name of the owner, e.g. myapps
+	Resource string `json:"resource"`
+	// Dot separated path of the field to set, e.g. spec.image
+	FieldPath string `json:"fieldPath"`
+	// Either image (default) to set the full image or tag to set only the tag
+	Value string `json:"value,omitempty"`
+}
+
+func (o OwnerConfig) validate() error {
+	if o.APIVersion == "" || o.Kind == "" || o.Resource == "" || o.FieldPath == "" {
+		return fmt.Errorf("apiVersion, kind, resource and fieldPath are required")
+	}
+	if _, err := schema.ParseGroupVersion(o.APIVersion); err != nil {
+		return err
+	}
+	if o.Value != "" && o.Value != "image" && o.Value != "tag" {
+		return fmt.Errorf("value must be image or tag")
+	}
+
+	return nil
+}
+
+// Returns the controlling owner reference of a workload and the owner configuration
+// responsible for it, if any.
+func ControllerOwner(ownerReferences []metav1.OwnerReference) (*metav1.OwnerReference, *OwnerConfig) {
+	for i, ownerReference := range ownerReferences {
+		if ownerReference.Controller == nil || !*ownerReference.Controller {
+			continue
+		}
+
+		if globalConfig != nil {
+			for j, ownerConfig := range globalConfig.Owners {
+				if ownerConfig.APIVersion == ownerReference.APIVersion && ownerConfig.Kind == ownerReference.Kind {
+					return &ownerReferences[i], &globalConfig.Owners[j]
+				}
+			}
+		}
+
+		return &ownerReferences[i], nil
+	}
+
+	return nil, nil
+}
+
+// Returns the tag of the given image, e.g. the sha of images built by ki-cd
+func ImageTag(image string) string {
+	position := strings.LastIndex(image, ":")
+	if position < 0 || strings.Contains(image[position:], "/") {
+		return "latest"
+	}
+
+	return image[position+1:]
+}
+
+// Sets the image at the configured field path of the owner of the target with a merge patch, along with the
+// annotations on the owner. Returns the image the owner had before, the owner isn't patched if it's the same.
+func PatchOwner(ctx context.Context, cluster *Cluster, target Target, owner metav1.OwnerReference, ownerConfig OwnerConfig, image string, annotations map[string]string) (string, error) {
+	groupVersion, err := schema.ParseGroupVersion(ownerConfig.APIVersion)
+	if err != nil {
+		return "", err
+	}
+	resource := cluster.Dynamic.Resource(groupVersion.WithResource(ownerConfig.Resource)).Namespace(target.Namespace)
+
+	object, err := resource.Get(ctx, owner.Name, metav1.GetOptions{})
+	if err != nil {
+		return "", err
+	}
+	fields := strings.Split(ownerConfig.FieldPath, ".")
+	current, _, err := unstructured.NestedString(object.Object, fields...)
+	if err != nil {
+		return "", fmt.Errorf("could not read %s of %s %s: %s", ownerConfig.FieldPath, owner.Kind, owner.Name, err)
+	}
+
+	var value interface{} = image
+	previousImage := current
+	if ownerConfig.Value == "tag" {
+		value = ImageTag(image)
+		if current != "" {
+			previousImage = ImageRepository(image) + ":" + current
+		}
+	}
+	// Webhook retries and replays don't touch the owner
+	if previousImage == image {
+		return previousImage, nil
+	}
+
+	// Build {"a": {"b": value}} for the field path a.b
+	for i := len(fields) - 1; i >= 0; i-- {
+		value = map[string]interface{}{fields[i]: value}
+	}
+	if len(annotations) > 0 {
+		value.(map[string]interface{})["metadata"] = map[string]interface{}{"annotations": annotations}
+	}
+	patch, err := json.Marshal(value)
+	if err != nil {
+		return previousImage, err
+	}
+
+	if dryRun {
+		globalLogger.Info(fmt.Sprintf("Dry run, not patching %s %s which owns %s: %s", owner.Kind, owner.Name, target, patch))
+		return previousImage, nil
+	}
+	globalLogger.Info(fmt.Sprintf("Patching %s %s which owns %s instead of the %s itself", owner.Kind, owner.Name, target, target.Kind))
+
+	_, err = resource.Patch(ctx, owner.Name, types.MergePatchType, patch, metav1.PatchOptions{})
+
+	return previousImage, err
+}
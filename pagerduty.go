@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// PagerDutyNotifier triggers incidents via the events api v2 when updates or rollouts of production targets fail,
+// and resolves them once a rollout of the target succeeded again
+type PagerDutyNotifier struct {
+	RoutingKey string
+	// Environments of targets which page, targets in protected namespaces always page
+	Environments []string
+}
+
+// Returns whether failures of the target page
+func (n *PagerDutyNotifier) pages(target Target) bool {
+	if NamespaceProtected(target.Namespace) {
+		return true
+	}
+	for _, environment := range n.Environments {
+		if strings.EqualFold(environment, target.Environment) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Returns the deduplication key of incidents of the target, one per workload
+func DedupKey(target Target) string {
+	if target.Cluster != "" {
+		return fmt.Sprintf("kubernetes-internal-cd/%s/%s/%s/%s", target.Cluster, target.Namespace, target.Kind, target.Name)
+	}
+	return fmt.Sprintf("kubernetes-internal-cd/%s/%s/%s", target.Namespace, target.Kind, target.Name)
+}
+
+func (n *PagerDutyNotifier) Notify(notification Notification) error {
+	if notification.Result == nil || !n.pages(notification.Result.Target) {
+		return nil
+	}
+	target := notification.Result.Target
+
+	event := map[string]interface{}{
+		"routing_key": n.RoutingKey,
+		"dedup_key":   DedupKey(target),
+	}
+	// Updated workloads may still fail to roll out, only completed rollouts resolve
+	if notification.Type == NotificationRolloutSucceeded {
+		event["event_action"] = "resolve"
+	} else {
+		event["event_action"] = "trigger"
+		event["payload"] = map[string]interface{}{
+			"summary":   notificationText(notification),
+			"source":    "kubernetes-internal-cd",
+			"severity":  "critical",
+			"component": target.Name,
+			"group":     target.Namespace,
+			"class":     notification.Type,
+			"custom_details": map[string]string{
+				"repository":    notification.Event.Repository,
+				"branch":        notification.Event.Branch,
+				"image":         notification.Event.Image,
+				"previousImage": notification.Result.PreviousImage,
+				"error":         notification.Result.Error,
+				"requestId":     notification.Event.RequestID,
+			},
+		}
+	}
+
+	return postJSON(pagerDutyEventsURL, event)
+}
+
+func (n *PagerDutyNotifier) Name() string {
+	return "pagerduty"
+}
+
+func (n *PagerDutyNotifier) Types() []string {
+	return []string{NotificationFailed, NotificationRolloutFailed, NotificationRolledBack, NotificationRolloutSucceeded, NotificationDrifted}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"k8s.io/apimachinery/pkg/types"
+)
+
+// Returns the annotation key pausing deploys of workloads, with who paused them as value
+func PausedAnnotationKey() string {
+	return labelPrefix + "paused"
+}
+
+// Returned instead of changing workloads in dry run mode, so callers don't report a change which didn't happen
+var errDryRun = errors.New("dry run, the workload was not changed")
+
+// Pauses deploys of the target workload, or resumes them if by is empty. Returns errDryRun in dry run mode.
+func SetPaused(ctx context.Context, target Target, by string) error {
+	if dryRun {
+		return errDryRun
+	}
+	cluster, err := ClusterFor(target.Cluster)
+	if err != nil {
+		return err
+	}
+
+	var value interface{}
+	if by != "" {
+		value = by
+	}
+	patch, err := annotationsPatch(map[string]interface{}{PausedAnnotationKey(): value}, "")
+	if err != nil {
+		return err
+	}
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+
+	return patchWorkload(ctx, cluster, target, types.MergePatchType, patch)
+}
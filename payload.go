@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	PayloadVersion1 = 1
+	PayloadVersion2 = 2
+	PayloadVersion3 = 3
+)
+
+var (
+	repositoryPattern  = regexp.MustCompile(`^[A-Za-z0-9_.-]+(/[A-Za-z0-9_.-]+)+$`)
+	shaPattern         = regexp.MustCompile(`^[0-9a-f]{7,64}$`)
+	imageTagPattern    = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]{0,127}$`)
+	metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,63}$`)
+	// Registry, path, tag and digest of an image like registry.example.com:5000/group/api:tag@sha256:...
+	imageReferencePattern = regexp.MustCompile(`^[A-Za-z0-9]+(?:[.-][A-Za-z0-9]+)*(?::[0-9]+)?(?:/[a-z0-9]+(?:(?:[._]|__|-+)[a-z0-9]+)*)*(?::[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?(?:@sha256:[0-9a-fA-F]{64})?$`)
+)
+
+const maxMetadataEntries = 20
+const maxMetadataValueLength = 256
+const maxCommitMessageLength = 4096
+
+// MessageV2 is the flat version 2 payload. Unknown fields are rejected, so typos don't go unnoticed.
+type MessageV2 struct {
+	Version    int    `json:"version"`
+	Repository string `json:"repository"`
+	// Optional git provider of the repository, github (default) or gitlab
+	Provider string `json:"provider,omitempty"`
+	// Pushed ref, refs/heads/<branch>
+	Ref           string `json:"ref"`
+	DefaultBranch string `json:"defaultBranch,omitempty"`
+	Sha           string `json:"sha"`
+	// Image without a tag
+	Image string `json:"image"`
+	// Optional tag of the image, the sha by default
+	Tag             string `json:"tag,omitempty"`
+	CommitTimestamp int64  `json:"commitTimestamp,omitempty"`
+	Timestamp       int64  `json:"timestamp,omitempty"`
+	Nonce           string `json:"nonce,omitempty"`
+	// Optional metadata of the deploy, e.g. the pipeline, passed to notifications and the audit log
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+func (m MessageV2) validate() error {
+	if !repositoryPattern.MatchString(m.Repository) {
+		return errors.New("repository must be <owner>/<repository>")
+	}
+	if m.Provider != "" && m.Provider != ProviderGitHub && m.Provider != ProviderGitLab {
+		return errors.New("unknown provider")
+	}
+	if !strings.HasPrefix(m.Ref, "refs/heads/") || m.Ref == "refs/heads/" {
+		return errors.New("ref must be refs/heads/<branch>")
+	}
+	if !shaPattern.MatchString(m.Sha) {
+		return errors.New("sha must be a lowercase hex commit sha")
+	}
+	if m.Image == "" || strings.Contains(m.Image, "@") || strings.Contains(m.Image[strings.LastIndex(m.Image, "/")+1:], ":") {
+		return errors.New("image is required without a tag or digest")
+	}
+	if m.Tag != "" && !imageTagPattern.MatchString(m.Tag) {
+		return errors.New("tag is not a valid image tag")
+	}
+	if m.CommitTimestamp < 0 || m.Timestamp < 0 {
+		return errors.New("timestamps must not be negative")
+	}
+	if len(m.Metadata) > maxMetadataEntries {
+		return fmt.Errorf("at most %d metadata entries are allowed", maxMetadataEntries)
+	}
+	for key, value := range m.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("metadata key %q is invalid", key)
+		}
+		if len(value) > maxMetadataValueLength {
+			return fmt.Errorf("metadata value of %s exceeds %d characters", key, maxMetadataValueLength)
+		}
+	}
+
+	return nil
+}
+
+// Converts the payload to the version 1 message handled by the webhook
+func (m MessageV2) Message() Message {
+	return Message{Data: MessageData{
+		Github: MessageGithub{
+			Sha:             m.Sha,
+			Repository:      m.Repository,
+			Ref:             m.Ref,
+			DefaultBranch:   m.DefaultBranch,
+			CommitTimestamp: m.CommitTimestamp,
+		},
+		Image:     m.Image,
+		Provider:  m.Provider,
+		Timestamp: m.Timestamp,
+		Nonce:     m.Nonce,
+		Tag:       m.Tag,
+		Metadata:  m.Metadata,
+	}}
+}
+
+// MessageV3 is the version 2 payload with the message and author of the commit and the sha the
+// branch pointed to before the push, shown in notifications
+type MessageV3 struct {
+	MessageV2
+	CommitMessage string `json:"commitMessage,omitempty"`
+	CommitAuthor  string `json:"commitAuthor,omitempty"`
+	Before        string `json:"before,omitempty"`
+}
+
+func (m MessageV3) validate() error {
+	if err := m.MessageV2.validate(); err != nil {
+		return err
+	}
+	if len(m.CommitMessage) > maxCommitMessageLength {
+		return fmt.Errorf("commitMessage exceeds %d characters", maxCommitMessageLength)
+	}
+	if len(m.CommitAuthor) > maxMetadataValueLength {
+		return fmt.Errorf("commitAuthor exceeds %d characters", maxMetadataValueLength)
+	}
+	if m.Before != "" && !shaPattern.MatchString(m.Before) {
+		return errors.New("before must be a lowercase hex commit sha")
+	}
+
+	return nil
+}
+
+// Converts the payload to the version 1 message handled by the webhook
+func (m MessageV3) Message() Message {
+	message := m.MessageV2.Message()
+	message.Data.Github.Message = m.CommitMessage
+	message.Data.Github.Author = m.CommitAuthor
+	message.Data.Github.Before = m.Before
+
+	return message
+}
+
+// Decodes a webhook payload of any supported version. Payloads without a version are version 1.
+func ParseMessage(payload []byte) (Message, error) {
+	var versioned struct {
+		Version int `json:"version"`
+	}
+	if err := json.Unmarshal(payload, &versioned); err != nil {
+		return Message{}, err
+	}
+
+	switch versioned.Version {
+	case 0, PayloadVersion1:
+		var message Message
+		if err := json.Unmarshal(payload, &message); err != nil {
+			return Message{}, err
+		}
+		if message.Data.Provider != "" && message.Data.Provider != ProviderGitHub && message.Data.Provider != ProviderGitLab {
+			return Message{}, errors.New("unknown provider")
+		}
+
+		return message, nil
+	case PayloadVersion2:
+		var message MessageV2
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&message); err != nil {
+			return Message{}, err
+		}
+		if err := message.validate(); err != nil {
+			return Message{}, err
+		}
+
+		return message.Message(), nil
+	case PayloadVersion3:
+		var message MessageV3
+		decoder := json.NewDecoder(bytes.NewReader(payload))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&message); err != nil {
+			return Message{}, err
+		}
+		if err := message.validate(); err != nil {
+			return Message{}, err
+		}
+
+		return message.Message(), nil
+	}
+
+	return Message{}, fmt.Errorf("unsupported payload version %d", versioned.Version)
+}
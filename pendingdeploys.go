@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+)
+
+var deployRetriesTotal = NewCounterVec("kicd_deploy_retries_total", "Deploys retried after a transient failure.")
+
+// Returns whether the error is likely to go away on its own, e.g. an unreachable or overloaded api
+func transientError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, errCircuitOpen) || errors.As(err, &netErr) ||
+		apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) || apierrors.IsTooManyRequests(err) ||
+		apierrors.IsServiceUnavailable(err) || apierrors.IsInternalError(err) || apierrors.IsUnexpectedServerError(err)
+}
+
+// Returns whether the deploy failed transiently, finding its targets or updating any of them
+func retryableDeploy(results []TargetResult, err error) bool {
+	if err != nil {
+		return transientError(err)
+	}
+	for _, result := range results {
+		if result.Retryable {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Deploy of a webhook with its audit entry and the number of retries so far
+type pendingDeployJob struct {
+	Event   DeployEvent `json:"event"`
+	Audit   AuditEntry  `json:"audit"`
+	Attempt int         `json:"attempt,omitempty"`
+}
+
+// PendingDeploys retries deploys of the memory queue which failed transiently with an exponential
+// backoff. With a database, webhooks are kept in it until they were deployed, so deploys which
+// were queued, waiting for a retry or in progress when the replica died are resumed on startup.
+type PendingDeploys struct {
+	// Retries of a transiently failed deploy, 0 disables retrying
+	Attempts int
+	// Backoff before the first retry, doubled for each further retry
+	Backoff time.Duration
+}
+
+// Queues the deploy of a webhook, returns the error of the memory queue if it can't be queued
+func (p *PendingDeploys) Enqueue(ctx context.Context, event DeployEvent, audit AuditEntry) error {
+	job := pendingDeployJob{Event: event, Audit: audit}
+	if err := p.save(job); err != nil {
+		globalLogger.Error(fmt.Sprintf("Could not persist the deploy %s: %s", audit.ID, err))
+	}
+	if err := p.enqueue(ctx, job); err != nil {
+		p.remove(job)
+		return err
+	}
+	forwardToAgents(event)
+
+	return nil
+}
+
+func (p *PendingDeploys) enqueue(ctx context.Context, job pendingDeployJob) error {
+	return deployQueue.Enqueue(ctx, job.Event, func(results []TargetResult, err error) {
+		p.done(job, results, err)
+	})
+}
+
+// Schedules a retry of a transiently failed deploy or records its final outcome
+func (p *PendingDeploys) done(job pendingDeployJob, results []TargetResult, err error) {
+	if retryableDeploy(results, err) && job.Attempt < p.Attempts {
+		p.retry(job)
+		return
+	}
+
+	audit := job.Audit
+	if err != nil {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+	} else {
+		audit.SetResults(results)
+	}
+	auditLog.Record(audit)
+	p.remove(job)
+}
+
+// Queues the deploy again after the backoff of its attempt, also if the queue was full or the
+// replica lost the leadership
+func (p *PendingDeploys) retry(job pendingDeployJob) {
+	job.Attempt++
+	if err := p.save(job); err != nil {
+		globalLogger.Error(fmt.Sprintf("Could not persist the deploy %s: %s", job.Audit.ID, err))
+	}
+	backoff := p.Backoff * time.Duration(1<<uint(job.Attempt-1))
+	globalLogger.With(LogFields{"requestId": job.Event.RequestID, "repository": job.Event.Repository}).Warning(fmt.Sprintf("Deploy of %s failed transiently, retrying in %s (attempt %d of %d)", job.Event.Image, backoff, job.Attempt, p.Attempts))
+
+	// Shutdowns don't wait for retries, they are resumed from the database on startup
+	time.AfterFunc(backoff, func() {
+		if !beginDeploy() {
+			if store == nil {
+				p.done(job, nil, errShuttingDown)
+			}
+			return
+		}
+		defer deploysInFlight.Done()
+		deployRetriesTotal.Inc()
+		if err := p.enqueue(context.Background(), job); err != nil {
+			p.done(job, nil, err)
+		}
+	})
+}
+
+func (p *PendingDeploys) save(job pendingDeployJob) error {
+	if store == nil {
+		return nil
+	}
+	value, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	return store.SavePendingDeploy(job.Audit.ID, job.Event.ReceivedAt, value)
+}
+
+func (p *PendingDeploys) remove(job pendingDeployJob) {
+	if store == nil {
+		return
+	}
+	if err := store.DeletePendingDeploy(job.Audit.ID); err != nil {
+		globalLogger.Error(fmt.Sprintf("Could not remove the deploy %s from the database: %s", job.Audit.ID, err))
+	}
+}
+
+// Resumes the deploys of the database once this replica deploys and its caches are synced
+func (p *PendingDeploys) Resume() {
+	if store == nil {
+		return
+	}
+	go func() {
+		for !leaderElection.IsLeader() || len(UnsyncedCaches()) > 0 {
+			time.Sleep(time.Second)
+		}
+
+		values, err := store.PendingDeploys()
+		if err != nil {
+			globalLogger.Error("Could not load the pending deploys: " + err.Error())
+			return
+		}
+		for _, value := range values {
+			var job pendingDeployJob
+			if err := json.Unmarshal(value, &job); err != nil {
+				globalLogger.Error("Dropping a malformed pending deploy: " + err.Error())
+				continue
+			}
+			if !beginDeploy() {
+				return
+			}
+			globalLogger.With(LogFields{"requestId": job.Event.RequestID, "repository": job.Event.Repository}).Info(fmt.Sprintf("Resuming the deploy of %s", job.Event.Image))
+			if err := p.enqueue(context.Background(), job); err != nil {
+				p.retry(job)
+			}
+			deploysInFlight.Done()
+		}
+	}()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Permission required on the kubernetes api, in all namespaces if the namespace is empty
+type preflightPermission struct {
+	Namespace string
+	Group     string
+	Resource  string
+	Name      string
+	Verbs     []string
+}
+
+func (p preflightPermission) String() string {
+	resource := p.Resource
+	if p.Group != "" {
+		resource += "." + p.Group
+	}
+	if p.Name != "" {
+		resource += " " + p.Name
+	}
+	if p.Namespace == "" {
+		return resource + " in all namespaces"
+	}
+
+	return resource + " in namespace " + p.Namespace
+}
+
+// Verifies on startup that the api of each cluster is reachable and grants all permissions deploys
+// need, that the signing keys can be read and that notifiers accept their credentials, so
+// misconfigurations fail the start instead of the first webhook. Keys are not checked if nil.
+// Returns the problems found.
+func Preflight(keys KeySource) []string {
+	var problems []string
+	report := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	for _, cluster := range AllClusters() {
+		name := cluster.Name
+		if name == "" {
+			name = LocalClusterName
+		}
+
+		ctx, cancel := apiContext(context.Background())
+		_, err := cluster.Kube.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Raw()
+		cancel()
+		if err != nil {
+			report("cluster %s: the kubernetes api at %s is not reachable: %s", name, cluster.Config.Host, err)
+			continue
+		}
+
+		var permissions []preflightPermission
+		for _, namespace := range ListNamespaces("") {
+			permissions = append(permissions,
+				preflightPermission{Namespace: namespace, Group: "apps", Resource: "deployments", Verbs: []string{"get", "list", "watch", "patch"}},
+				preflightPermission{Namespace: namespace, Group: "apps", Resource: "statefulsets", Verbs: []string{"get", "list", "watch", "patch"}},
+				preflightPermission{Namespace: namespace, Resource: "events", Verbs: []string{"create"}},
+			)
+			if pullSecretValidation {
+				permissions = append(permissions,
+					preflightPermission{Namespace: namespace, Resource: "secrets", Verbs: []string{"get"}},
+					preflightPermission{Namespace: namespace, Resource: "serviceaccounts", Verbs: []string{"get"}},
+				)
+			}
+		}
+		if cluster.Name == "" {
+			permissions = append(permissions, localPermissions(keys)...)
+			// Helm releases are only upgraded in the local cluster
+			helmPermissions, err := releasePermissions(cluster)
+			if err != nil {
+				report("cluster %s: could not list the workloads of helm releases: %s", name, err)
+			}
+			permissions = append(permissions, helmPermissions...)
+		}
+		for _, permission := range permissions {
+			for _, verb := range permission.Verbs {
+				allowed, err := cluster.Allowed(permission, verb)
+				if err != nil {
+					report("cluster %s: could not review the permission to %s %s: %s", name, verb, permission, err)
+				} else if !allowed {
+					report("cluster %s: the service account may not %s %s, grant it in its role (see kube/)", name, verb, permission)
+				}
+			}
+		}
+	}
+
+	if keys != nil {
+		if values, err := keys.Keys(); err != nil {
+			report("could not read the signing keys: %s", err)
+		} else if len(values) == 0 {
+			report("there are no signing keys, add master_key, shared_secret or repo_... keys")
+		}
+	}
+
+	for _, notifier := range notifiers {
+		if checked, ok := notifier.(interface{ Check() error }); ok {
+			if err := checked.Check(); err != nil {
+				report("notifier %s is misconfigured: %s", notifier.Name(), err)
+			}
+		}
+	}
+
+	return problems
+}
+
+// Returns the permissions on the local cluster needed by the configured key source, audit log,
+// notification templates, leader election and flux image automation
+func localPermissions(keys KeySource) []preflightPermission {
+	var permissions []preflightPermission
+	if secretKeySource, ok := keys.(*SecretKeySource); ok {
+		permissions = append(permissions, preflightPermission{Namespace: secretKeySource.Namespace, Resource: "secrets", Name: secretKeySource.Name, Verbs: []string{"get", "list", "watch"}})
+	}
+	if auditLog != nil && auditLog.persistent() && store == nil {
+		permissions = append(permissions, preflightPermission{Namespace: auditLog.Namespace, Resource: "configmaps", Verbs: []string{"get", "create", "update"}})
+	}
+	if notificationTemplates != nil {
+		permissions = append(permissions, preflightPermission{Namespace: notificationTemplates.Namespace, Resource: "configmaps", Name: notificationTemplates.Name, Verbs: []string{"get", "list", "watch"}})
+	}
+	if leaderElection != nil {
+		permissions = append(permissions, preflightPermission{Namespace: leaderElection.Namespace, Group: "coordination.k8s.io", Resource: "leases", Verbs: []string{"get", "create", "update"}})
+	}
+	if fluxAutomation != nil {
+		for _, namespace := range ListNamespaces("") {
+			for _, resource := range []string{"imagerepositories", "imagepolicies", "imageupdateautomations"} {
+				permissions = append(permissions, preflightPermission{Namespace: namespace, Group: "image.toolkit.fluxcd.io", Resource: resource, Verbs: []string{"get", "list", "patch"}})
+			}
+		}
+		if fluxAutomation.Namespace != "" {
+			for _, resource := range []string{"imagerepositories", "imagepolicies"} {
+				permissions = append(permissions, preflightPermission{Namespace: fluxAutomation.Namespace, Group: "image.toolkit.fluxcd.io", Resource: resource, Verbs: []string{"create"}})
+			}
+		}
+	}
+
+	return permissions
+}
+
+// Returns the permissions helm needs to upgrade the releases of the workloads with a helm-chart
+// annotation, on the secrets storing the releases and the workloads of the charts. Permissions on
+// the other resources of the charts aren't checked.
+func releasePermissions(cluster *Cluster) ([]preflightPermission, error) {
+	workloads, err := listValidationWorkloads(context.Background(), cluster, "", metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	var permissions []preflightPermission
+	namespaces := make(map[string]bool)
+	for _, workload := range workloads {
+		release := HelmReleaseOf(workload.Meta)
+		if release == nil || namespaces[release.Namespace] {
+			continue
+		}
+		namespaces[release.Namespace] = true
+		permissions = append(permissions,
+			preflightPermission{Namespace: release.Namespace, Resource: "secrets", Verbs: []string{"get", "list", "create", "update", "delete"}},
+			preflightPermission{Namespace: release.Namespace, Group: "apps", Resource: "deployments", Verbs: []string{"create", "update", "delete"}},
+			preflightPermission{Namespace: release.Namespace, Group: "apps", Resource: "statefulsets", Verbs: []string{"create", "update", "delete"}},
+		)
+	}
+
+	return permissions, nil
+}
+
+// Returns whether the service account may perform the verb with a SelfSubjectAccessReview
+func (c *Cluster) Allowed(permission preflightPermission, verb string) (bool, error) {
+	ctx, cancel := apiContext(context.Background())
+	defer cancel()
+	review, err := c.Kube.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx, &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Namespace: permission.Namespace,
+				Verb:      verb,
+				Group:     permission.Group,
+				Resource:  permission.Resource,
+				Name:      permission.Name,
+			},
+		},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return false, err
+	}
+
+	return review.Status.Allowed, nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Whether updates verify that the pods of a workload can pull the new image before patching
+var pullSecretValidation = false
+
+// Registries pulled from without credentials, e.g. public registries or registries the nodes
+// authenticate to on their own
+var publicRegistries []string
+
+// Returns the registry of the image, docker.io for images without a registry
+func ImageRegistry(image string) string {
+	return normalizeRegistry(strings.SplitN(NormalizeImage(image), "/", 2)[0])
+}
+
+// Returns the registry host of a server of a docker config, which may be a url
+func normalizeRegistry(server string) string {
+	server = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(server), "https://"), "http://")
+	if position := strings.Index(server, "/"); position >= 0 {
+		server = server[:position]
+	}
+	switch server {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "docker.io"
+	}
+
+	return server
+}
+
+// Returns whether the registry matches the server of a docker config, which may be a glob like
+// *.azurecr.io as supported by the kubelet
+func registryMatches(server string, registry string) bool {
+	server = normalizeRegistry(server)
+	if matched, err := path.Match(server, registry); err == nil && matched {
+		return true
+	}
+
+	return server == registry
+}
+
+// Returns the servers the image pull secret has credentials of
+func pullSecretServers(secret *corev1.Secret) ([]string, error) {
+	var auths map[string]json.RawMessage
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config struct {
+			Auths map[string]json.RawMessage `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			return nil, err
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("type %s is not an image pull secret", secret.Type)
+	}
+
+	var servers []string
+	for server := range auths {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	return servers, nil
+}
+
+// Verifies that the pods of the workload can pull the image, before patching it produces pods in
+// ImagePullBackOff: the registry of the image is public or an image pull secret of the pod spec or
+// its service account has credentials of the registry. Images the container already runs aren't
+// checked, so retries and replays don't fail.
+func validatePullSecrets(ctx context.Context, cluster *Cluster, target Target, podSpec corev1.PodSpec, image string) error {
+	if len(podSpec.Containers) <= target.ContainerPosition || podSpec.Containers[target.ContainerPosition].Image == image {
+		return nil
+	}
+	registry := ImageRegistry(image)
+	for _, public := range publicRegistries {
+		if registryMatches(public, registry) {
+			return nil
+		}
+	}
+
+	var names []string
+	for _, reference := range podSpec.ImagePullSecrets {
+		names = append(names, reference.Name)
+	}
+	serviceAccountName := podSpec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	serviceAccount, err := cluster.Kube.CoreV1().ServiceAccounts(target.Namespace).Get(ctx, serviceAccountName, metav1.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	} else if err == nil {
+		for _, reference := range serviceAccount.ImagePullSecrets {
+			names = append(names, reference.Name)
+		}
+	}
+
+	var problems []string
+	for _, name := range names {
+		secret, err := cluster.Kube.CoreV1().Secrets(target.Namespace).Get(ctx, name, metav1.GetOptions{})
+		if apierrors.IsNotFound(err) {
+			problems = append(problems, fmt.Sprintf("secret %s does not exist", name))
+			continue
+		} else if err != nil {
+			return err
+		}
+		servers, err := pullSecretServers(secret)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("secret %s is malformed: %s", name, err))
+			continue
+		}
+		for _, server := range servers {
+			if registryMatches(server, registry) {
+				return nil
+			}
+		}
+	}
+
+	message := fmt.Sprintf("no image pull secret of %s or its service account %s has credentials of the registry %s of %s, add one or add the registry to PUBLIC_REGISTRIES", target, serviceAccountName, registry, image)
+	if len(problems) > 0 {
+		message += " (" + strings.Join(problems, ", ") + ")"
+	}
+
+	return errors.New(message)
+}
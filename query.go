@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Upper bound of the limit parameter of paginated endpoints
+const maxQueryLimit = 1000
+
+// Number of rows read from the database at once while filtering
+const storeQueryBatch = 200
+
+// AuditQuery filters audit entries and history entries, which are returned newest first in pages
+type AuditQuery struct {
+	Repository string
+	// Namespace of any target of the entry
+	Namespace string
+	Outcome   string
+	Since     time.Time
+	Until     time.Time
+	// Cursor returned with the previous page, only older entries are returned
+	Cursor string
+	Limit  int
+}
+
+func parseQueryTime(values url.Values, name string) (time.Time, error) {
+	value := values.Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.New(name + " must be an RFC 3339 time")
+	}
+
+	return parsed, nil
+}
+
+// Parses the repository, namespace, outcome, since, until, cursor and limit parameters
+func ParseAuditQuery(values url.Values, defaultLimit int) (AuditQuery, error) {
+	query := AuditQuery{
+		Repository: values.Get("repository"),
+		Namespace:  values.Get("namespace"),
+		Outcome:    values.Get("outcome"),
+		Cursor:     values.Get("cursor"),
+		Limit:      defaultLimit,
+	}
+
+	var err error
+	if query.Since, err = parseQueryTime(values, "since"); err != nil {
+		return query, err
+	}
+	if query.Until, err = parseQueryTime(values, "until"); err != nil {
+		return query, err
+	}
+	if limit := values.Get("limit"); limit != "" {
+		query.Limit, err = strconv.Atoi(limit)
+		if err != nil || query.Limit < 1 {
+			return query, errors.New("limit must be a positive number")
+		}
+	}
+	if query.Limit > maxQueryLimit {
+		query.Limit = maxQueryLimit
+	}
+
+	return query, nil
+}
+
+func (q AuditQuery) matchesTime(t time.Time) bool {
+	if !q.Since.IsZero() && t.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && t.After(q.Until) {
+		return false
+	}
+
+	return true
+}
+
+// Returns whether the entry matches the filters and is older than the cursor
+func (q AuditQuery) Matches(entry AuditEntry) bool {
+	if q.Cursor != "" && entry.ID >= q.Cursor {
+		return false
+	}
+	if q.Repository != "" && !strings.EqualFold(entry.Repository, q.Repository) {
+		return false
+	}
+	if q.Outcome != "" && entry.Outcome != q.Outcome {
+		return false
+	}
+	if q.Namespace != "" {
+		found := false
+		for _, result := range entry.Targets {
+			if result.Target.Namespace == q.Namespace {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return q.matchesTime(entry.Time)
+}
+
+// Returns a page of the entries matching the query, newest first, and the cursor of the next page
+// if there are more. Reads the database if configured, which keeps more entries than the memory.
+func (a *AuditLog) Query(query AuditQuery) ([]AuditEntry, string, error) {
+	matched := []AuditEntry{}
+	if store == nil {
+		for _, entry := range a.Entries() {
+			if !query.Matches(entry) {
+				continue
+			}
+			matched = append(matched, entry)
+			if len(matched) > query.Limit {
+				break
+			}
+		}
+	} else {
+		// The database filters everything but the namespace, which is checked batch by batch
+		cursor := query.Cursor
+		for len(matched) <= query.Limit {
+			batch, err := store.QueryDeliveries(query, cursor, storeQueryBatch)
+			if err != nil {
+				return nil, "", err
+			}
+			for _, entry := range batch {
+				cursor = entry.ID
+				if query.Matches(entry) {
+					matched = append(matched, entry)
+					if len(matched) > query.Limit {
+						break
+					}
+				}
+			}
+			if len(batch) < storeQueryBatch {
+				break
+			}
+		}
+	}
+
+	if len(matched) <= query.Limit {
+		return matched, "", nil
+	}
+	matched = matched[:query.Limit]
+
+	return matched, matched[len(matched)-1].ID, nil
+}
+
+// Returns a page of the history entries matching the outcome and time range of the query and the
+// cursor of the next page if there are more. The history has to be newest first.
+func (q AuditQuery) HistoryPage(history []HistoryEntry) ([]HistoryEntry, string, error) {
+	var cursor time.Time
+	if q.Cursor != "" {
+		nanos, err := strconv.ParseInt(q.Cursor, 10, 64)
+		if err != nil {
+			return nil, "", errors.New("invalid cursor")
+		}
+		cursor = time.Unix(0, nanos)
+	}
+
+	matched := []HistoryEntry{}
+	for _, entry := range history {
+		if !cursor.IsZero() && !entry.Time.Before(cursor) {
+			continue
+		}
+		if q.Outcome != "" && entry.Outcome != q.Outcome {
+			continue
+		}
+		if !q.matchesTime(entry.Time) {
+			continue
+		}
+		matched = append(matched, entry)
+		if len(matched) > q.Limit {
+			break
+		}
+	}
+
+	if len(matched) <= q.Limit {
+		return matched, "", nil
+	}
+	matched = matched[:q.Limit]
+
+	return matched, strconv.FormatInt(matched[len(matched)-1].Time.UnixNano(), 10), nil
+}
+
+// Writes a page as json with the cursor of the next page in the x-next-cursor header
+func WritePage(w http.ResponseWriter, page interface{}, next string) {
+	if next != "" {
+		w.Header().Set("x-next-cursor", next)
+	}
+	WriteJSON(w, 200, page)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+type keyedLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter limits requests per key, e.g. per source address or repository
+type RateLimiter struct {
+	limit rate.Limit
+	burst int
+
+	mutex    sync.Mutex
+	limiters map[string]*keyedLimiter
+}
+
+func NewRateLimiter(perMinute float64, burst int) *RateLimiter {
+	limiter := &RateLimiter{
+		limit:    rate.Limit(perMinute / 60),
+		burst:    burst,
+		limiters: make(map[string]*keyedLimiter),
+	}
+
+	// Forget keys which weren't seen for a while
+	go func() {
+		for range time.Tick(10 * time.Minute) {
+			limiter.mutex.Lock()
+			for key, keyed := range limiter.limiters {
+				if time.Since(keyed.lastSeen) > 10*time.Minute {
+					delete(limiter.limiters, key)
+				}
+			}
+			limiter.mutex.Unlock()
+		}
+	}()
+
+	return limiter
+}
+
+// Returns whether another request for the given key is allowed right now
+func (l *RateLimiter) Allow(key string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	keyed, ok := l.limiters[key]
+	if !ok {
+		keyed = &keyedLimiter{limiter: rate.NewLimiter(l.limit, l.burst)}
+		l.limiters[key] = keyed
+	}
+	keyed.lastSeen = time.Now()
+
+	return keyed.limiter.Allow()
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+const redacted = "[REDACTED]"
+
+// Patterns of secret material which must never be logged
+var redactionPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Signatures like sha1=... and sha256=...
+	{regexp.MustCompile(`(?i)(sha1|sha256)=[0-9a-f]{16,}`), "${1}=" + redacted},
+	// Bearer tokens
+	{regexp.MustCompile(`(?i)(bearer)\s+[^\s"']+`), "${1} " + redacted},
+	// JWTs without scheme
+	{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), redacted},
+}
+
+// Parts of header and field names holding secrets
+var sensitiveNames = []string{"authorization", "signature", "token", "secret", "password", "cookie"}
+
+var secretsMutex sync.RWMutex
+var registeredSecrets = make(map[string]bool)
+
+// Registers a secret value, e.g. a signing key, which is redacted from all logs
+func RegisterSecret(secret string) {
+	// Short values would redact unrelated text
+	if len(secret) < 8 {
+		return
+	}
+
+	secretsMutex.RLock()
+	registered := registeredSecrets[secret]
+	secretsMutex.RUnlock()
+	if registered {
+		return
+	}
+
+	secretsMutex.Lock()
+	registeredSecrets[secret] = true
+	secretsMutex.Unlock()
+}
+
+// Removes signatures, tokens and registered secrets from the text
+func Redact(text string) string {
+	for _, redaction := range redactionPatterns {
+		text = redaction.pattern.ReplaceAllString(text, redaction.replacement)
+	}
+
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+	for secret := range registeredSecrets {
+		if strings.Contains(text, secret) {
+			text = strings.Replace(text, secret, redacted, -1)
+		}
+	}
+
+	return text
+}
+
+// Returns whether a header or field of the given name holds secrets
+func IsSensitiveName(name string) bool {
+	name = strings.ToLower(name)
+	for _, sensitiveName := range sensitiveNames {
+		if strings.Contains(name, sensitiveName) {
+			return true
+		}
+	}
+
+	return false
+}
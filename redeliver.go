@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedeliveryStore keeps the verified deploy events of the recent deliveries, so they can be deployed again
+// after transient errors without triggering the pipeline again
+type RedeliveryStore struct {
+	size int
+
+	mutex  sync.Mutex
+	events map[string]DeployEvent
+	order  []string
+}
+
+func NewRedeliveryStore(size int) *RedeliveryStore {
+	return &RedeliveryStore{size: size, events: make(map[string]DeployEvent)}
+}
+
+// Keeps the event of a verified delivery, dropping the oldest beyond the size of the store
+func (s *RedeliveryStore) Add(event DeployEvent) {
+	if s == nil || event.Delivery == "" {
+		return
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.events[event.Delivery] = event
+	s.order = append(s.order, event.Delivery)
+	for len(s.order) > s.size {
+		delete(s.events, s.order[0])
+		s.order = s.order[1:]
+	}
+}
+
+// Returns the event of the delivery with the given audit or request ID
+func (s *RedeliveryStore) Get(id string) (DeployEvent, bool) {
+	if s == nil {
+		return DeployEvent{}, false
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if event, ok := s.events[id]; ok {
+		return event, true
+	}
+	for _, event := range s.events {
+		if event.RequestID == id {
+			return event, true
+		}
+	}
+
+	return DeployEvent{}, false
+}
+
+// Re-runs the deploy of the delivery of POST /admin/deliveries/<id>/redeliver and responds with the
+// results of all targets. The delivery was verified when it was received, including its production signature.
+func RedeliverHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	id := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/deliveries/"), "/redeliver")
+	event, ok := redeliveryStore.Get(id)
+	if !ok {
+		http.Error(w, "delivery not found or no longer stored for redeliveries", 404)
+		return
+	}
+
+	requestID := RequestID(r)
+	w.Header().Set("x-request-id", requestID)
+	ctx, span := tracer.StartSpan(ContextWithTraceparent(r.Context(), r.Header.Get("traceparent")), "redeliver", SpanKindServer)
+	defer span.Finish()
+
+	audit := AuditEntry{
+		Time:       time.Now(),
+		Source:     ClientIP(r).String(),
+		RequestID:  requestID,
+		Repository: event.Repository,
+		Branch:     event.Branch,
+		Sha:        event.Sha,
+		Image:      event.Image,
+		Verified:   true,
+		Reason:     "redelivery of " + event.Delivery,
+		Headers:    HeaderSummary(r),
+		Metadata:   event.Metadata,
+	}
+	audit.ID = AuditID(audit.Time)
+
+	// The policy may have changed since the delivery
+	if imagePolicy != nil && !imagePolicy.Allowed(event.Image) {
+		audit.Outcome = AuditOutcomeRejected
+		audit.Status = 403
+		auditLog.Record(audit)
+		http.Error(w, "image is not allowed", 403)
+		return
+	}
+
+	globalLogger.With(LogFields{"requestId": requestID, "repository": event.Repository, "branch": event.Branch, "image": event.Image, "source": audit.Source}).Info(fmt.Sprintf("Redelivering %s requested by %s", event.Delivery, audit.Source))
+	event.Source = audit.Source
+	event.ReceivedAt = audit.Time
+	event.Delivery = audit.ID
+	event.RequestID = requestID
+	if queueSharedDeploy(w, event, audit) {
+		return
+	}
+	results, err := deployQueue.Run(ctx, event)
+	if err == errDeployQueueFull {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+		audit.Status = 429
+		auditLog.Record(audit)
+		w.Header().Set("Retry-After", strconv.Itoa(int(deployQueue.RetryAfter().Seconds())))
+		http.Error(w, err.Error(), 429)
+		return
+	}
+	if err == errNotLeader || err == errCircuitOpen {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = err.Error()
+		audit.Status = 503
+		auditLog.Record(audit)
+		w.Header().Set("Retry-After", "5")
+		http.Error(w, err.Error(), 503)
+		return
+	}
+	if err != nil {
+		span.SetError(err)
+		audit.Outcome = AuditOutcomeError
+		audit.Reason += ": " + err.Error()
+		audit.Status = 500
+		auditLog.Record(audit)
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	audit.SetResults(results)
+	audit.Status = 200
+	auditLog.Record(audit)
+
+	WriteJSON(w, 200, ManualDeployResponse{RequestID: requestID, Delivery: audit.ID, Results: results})
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ReplayGuard rejects signed payloads which are too old or whose nonce was seen before.
+// Nonces are kept in the store if one is set, so all replicas share them. Otherwise
+// they are only known to the replica which received them.
+type ReplayGuard struct {
+	Window  time.Duration
+	Require bool
+	Store   *Store
+
+	mutex  sync.Mutex
+	nonces map[string]time.Time
+}
+
+func NewReplayGuard(window time.Duration, require bool) *ReplayGuard {
+	guard := &ReplayGuard{Window: window, Require: require, nonces: make(map[string]time.Time)}
+
+	// Nonces only need to be remembered as long as their timestamp is accepted
+	go func() {
+		for range time.Tick(window) {
+			guard.mutex.Lock()
+			for nonce, expiry := range guard.nonces {
+				if time.Now().After(expiry) {
+					delete(guard.nonces, nonce)
+				}
+			}
+			guard.mutex.Unlock()
+		}
+	}()
+
+	return guard
+}
+
+// Checks the timestamp (unix seconds) and nonce of a verified payload of the given repository
+func (g *ReplayGuard) Check(repository string, timestamp int64, nonce string) error {
+	if timestamp == 0 && nonce == "" {
+		if g.Require {
+			return errors.New("timestamp and nonce are required")
+		}
+		return nil
+	}
+	if timestamp == 0 || nonce == "" {
+		return errors.New("timestamp and nonce must be sent together")
+	}
+
+	sent := time.Unix(timestamp, 0)
+	if skew := time.Since(sent); skew > g.Window || skew < -g.Window {
+		return fmt.Errorf("timestamp is outside of the accepted window of %s", g.Window)
+	}
+
+	key := repository + "/" + nonce
+	if g.Store != nil {
+		used, err := g.Store.UseNonce(key, sent.Add(g.Window))
+		if err != nil {
+			globalLogger.Error("Could not save the nonce in the database: " + err.Error())
+			return errors.New("could not check the nonce")
+		}
+		if !used {
+			return errors.New("nonce was already used")
+		}
+		return nil
+	}
+
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+
+	if _, ok := g.nonces[key]; ok {
+		return errors.New("nonce was already used")
+	}
+	g.nonces[key] = sent.Add(g.Window)
+
+	return nil
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+)
+
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// Returns the ID of the request, accepted from X-Request-ID or X-GitHub-Delivery if well-formed, otherwise generated
+func RequestID(r *http.Request) string {
+	for _, header := range []string{"x-request-id", "x-github-delivery"} {
+		if id := r.Header.Get(header); requestIDRegexp.MatchString(id) {
+			return id
+		}
+	}
+
+	return randomHex(16)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// RollbackRequest re-applies the image of a previous deploy of a workload
+type RollbackRequest struct {
+	Kind      string `json:"kind,omitempty"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	// Sha of a successful deploy in the history of the workload
+	Sha string `json:"sha"`
+	// Optional container position if the workload is mapped more than once
+	Container *int `json:"container,omitempty"`
+	// Optional cluster of the workload, the local cluster by default
+	Cluster string `json:"cluster,omitempty"`
+	// Whether to roll back a workload whose deploys are paused
+	Force bool `json:"force,omitempty"`
+}
+
+// Returns the managed target of the workload of the rollback request
+func rollbackTarget(ctx context.Context, request RollbackRequest) (ManagedTarget, error) {
+	targets, err := ListManagedTargets(ctx)
+	if err != nil {
+		return ManagedTarget{}, err
+	}
+
+	var matches []ManagedTarget
+	for _, target := range targets {
+		if target.Kind != request.Kind || target.Namespace != request.Namespace || target.Name != request.Name || target.Cluster != request.Cluster {
+			continue
+		}
+		if request.Container != nil && target.ContainerPosition != *request.Container {
+			continue
+		}
+		matches = append(matches, target)
+	}
+
+	switch len(matches) {
+	case 0:
+		return ManagedTarget{}, fmt.Errorf("%s %s in namespace %s is not a target", request.Kind, request.Name, request.Namespace)
+	case 1:
+		return matches[0], nil
+	}
+	if request.Container == nil {
+		return ManagedTarget{}, errors.New("the workload is mapped more than once, container is required")
+	}
+
+	// Mapped by label and config, the target is the same
+	return matches[0], nil
+}
+
+// Returns the image of the latest successful deploy of the sha in the history
+func rollbackImage(history []HistoryEntry, sha string) (string, bool) {
+	for _, entry := range history {
+		if entry.Sha == sha && entry.Outcome == AuditOutcomeSucceeded {
+			return entry.Image, true
+		}
+	}
+
+	return "", false
+}
+
+// Rolls the workload of the posted RollbackRequest back (or forward) to the image of a sha from its history.
+// The image was deployed before, so protected namespaces don't require the production signature.
+func RollbackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	requestID := RequestID(r)
+	w.Header().Set("x-request-id", requestID)
+	ctx, span := tracer.StartSpan(ContextWithTraceparent(r.Context(), r.Header.Get("traceparent")), "rollback", SpanKindServer)
+	defer span.Finish()
+
+	bytes, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	var request RollbackRequest
+	if err := json.Unmarshal(bytes, &request); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if request.Kind == "" {
+		request.Kind = KindDeployment
+	}
+	if request.Cluster == LocalClusterName {
+		request.Cluster = ""
+	}
+	if request.Namespace == "" || request.Name == "" || request.Sha == "" {
+		http.Error(w, "namespace, name and sha are required", 400)
+		return
+	}
+	if !NamespaceAllowed(request.Namespace) {
+		http.Error(w, "namespace is not in WATCH_NAMESPACES", 403)
+		return
+	}
+
+	managed, err := rollbackTarget(ctx, request)
+	if err != nil {
+		http.Error(w, err.Error(), 404)
+		return
+	}
+	history, err := TargetHistory(ctx, request.Cluster, request.Kind, request.Namespace, request.Name)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	image, ok := rollbackImage(history, request.Sha)
+	if !ok {
+		http.Error(w, fmt.Sprintf("no successful deploy of %s in the history of the workload", request.Sha), 404)
+		return
+	}
+
+	response, err := Rollback(ctx, managed, request.Sha, image, ClientIP(r).String(), requestID, HeaderSummary(r), request.Force)
+	if err != nil {
+		status := rollbackStatus(err)
+		switch status {
+		case 429:
+			w.Header().Set("Retry-After", strconv.Itoa(int(rollbackRetryAfter().Seconds())))
+		case 503:
+			w.Header().Set("Retry-After", "5")
+		case 500:
+			span.SetError(err)
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	if response.Queued {
+		WriteJSON(w, 202, response)
+		return
+	}
+
+	WriteJSON(w, 200, response)
+}
+
+var errImageNotAllowed = errors.New("image is not allowed")
+
+// Returns the status of the response to a failed rollback
+func rollbackStatus(err error) int {
+	switch err {
+	case errImageNotAllowed:
+		return 403
+	case errDeployQueueFull:
+		return 429
+	case errNotLeader, errCircuitOpen:
+		return 503
+	}
+
+	return 500
+}
+
+// Returns how long to wait before retrying a rollback rejected by a full queue
+func rollbackRetryAfter() time.Duration {
+	if sharedQueue != nil {
+		return sharedQueue.RetryAfter()
+	}
+
+	return deployQueue.RetryAfter()
+}
+
+// Rolls the target back (or forward) to the image of a previous deploy of the sha. Rollbacks are deployed
+// by the deploy queue like webhooks, so they wait for the leader, the kubernetes api and a free worker,
+// and deploys of the repository in the database queue run in order with them. Paused targets are only
+// rolled back if forced. Returns the result of the target, or only the ID of the audit entry if the
+// rollback was queued in the database.
+func Rollback(ctx context.Context, managed ManagedTarget, sha string, image string, source string, requestID string, headers map[string]string, force bool) (ManualDeployResponse, error) {
+	target := managed.Target
+	event := DeployEvent{Repository: managed.Repository, Branch: managed.Branch, Sha: sha, Image: image, Source: source, ReceivedAt: time.Now(), RequestID: requestID, Rollback: &target, Force: force}
+	audit := AuditEntry{Time: event.ReceivedAt, Source: event.Source, RequestID: requestID, Repository: event.Repository, Branch: event.Branch, Sha: event.Sha, Image: image, Verified: true, Reason: "rollback of " + target.String(), Headers: headers}
+	audit.ID = AuditID(audit.Time)
+	event.Delivery = audit.ID
+	response := ManualDeployResponse{RequestID: requestID, Delivery: audit.ID}
+
+	if imagePolicy != nil && !imagePolicy.Allowed(image) {
+		audit.Outcome = AuditOutcomeRejected
+		audit.Status = 403
+		auditLog.Record(audit)
+		return response, errImageNotAllowed
+	}
+
+	globalLogger.With(LogFields{"requestId": requestID, "namespace": target.Namespace, "workload": target.Name, "image": image, "source": event.Source}).Info(fmt.Sprintf("Rollback of %s to %s requested", target, image))
+	var results []TargetResult
+	var err error
+	if sharedQueue != nil {
+		audit.Status = 202
+		if err = sharedQueue.Enqueue(event, audit); err == nil {
+			response.Queued = true
+			return response, nil
+		}
+	} else {
+		results, err = deployQueue.Run(ctx, event)
+	}
+	if err != nil {
+		audit.Outcome = AuditOutcomeError
+		audit.Reason = fmt.Sprintf("rollback of %s: %s", target, err)
+		audit.Status = rollbackStatus(err)
+		auditLog.Record(audit)
+		return response, err
+	}
+
+	response.Results = results
+	audit.SetResults(results)
+	audit.Status = 200
+	if len(results) == 1 && results[0].Error != "" {
+		err = errors.New(results[0].Error)
+		audit.Status = 500
+	}
+	auditLog.Record(audit)
+
+	return response, err
+}
+
+// Updates the target of a rollback event to its image, recording its history and event and notifying
+// about the outcome. Called by Deploy for rollback events.
+func deployRollback(ctx context.Context, event DeployEvent, logger *Logger) TargetResult {
+	target := *event.Rollback
+	image := event.Image
+	logger = logger.With(LogFields{"namespace": target.Namespace, "workload": target.Name, "kind": target.Kind})
+
+	if target.Paused != "" && !event.Force {
+		logger.Warning(fmt.Sprintf("Not rolling back %s. Deploys are paused by %s.", target, target.Paused))
+		result := TargetResult{Target: target, Image: image, Error: "deploys are paused by " + target.Paused}
+		Notify(ctx, Notification{Type: NotificationSkipped, Text: fmt.Sprintf("Not rolling back %s. Deploys are paused by %s.", target, target.Paused), Event: event, Result: &result})
+		return result
+	}
+
+	logger.Info(fmt.Sprintf("Rolling %s back to %s", target, image))
+	targetsDeploying.begin(target)
+	defer targetsDeploying.end(target)
+	_, updateSpan := tracer.StartSpan(ctx, "update target", SpanKindClient)
+	updateSpan.SetAttribute("target", target)
+	previousImage, err := UpdateTarget(ctx, target, image, CommitAnnotations(event))
+	updateSpan.SetError(err)
+	updateSpan.Finish()
+
+	result := TargetResult{Target: target, PreviousImage: previousImage, Image: image}
+	historyEntry := HistoryEntry{Time: time.Now(), Sha: event.Sha, Image: image, PreviousImage: previousImage, Outcome: AuditOutcomeSucceeded, Delivery: event.Delivery, RequestID: event.RequestID, Rollback: true}
+	eventType, reason, message := corev1.EventTypeNormal, "RolledBack", fmt.Sprintf("Rolled back image to %s (request %s)", image, event.RequestID)
+	if err != nil {
+		result.Error = err.Error()
+		result.Retryable = transientError(err)
+		historyEntry.Outcome = AuditOutcomeFailed
+		historyEntry.Error = err.Error()
+		eventType, reason, message = corev1.EventTypeWarning, "RollbackFailed", fmt.Sprintf("Could not roll back image to %s: %s (request %s)", image, err, event.RequestID)
+	}
+	if historyErr := RecordHistory(ctx, target, historyEntry); historyErr != nil {
+		logger.Warning(fmt.Sprintf("Could not record the history of %s: %s", target, historyErr))
+	}
+	if eventErr := RecordEvent(ctx, target, eventType, reason, message); eventErr != nil {
+		logger.Warning(fmt.Sprintf("Could not record an event for %s: %s", target, eventErr))
+	}
+
+	if err != nil {
+		logger.Error(fmt.Sprintf("Failure rolling back %s: %s", target, err))
+		Notify(ctx, Notification{Type: NotificationFailed, Text: fmt.Sprintf("Failed to roll back %s to %s: %s", target, image, err), Event: event, Result: &result})
+		return result
+	}
+
+	Notify(ctx, Notification{Type: NotificationRolledBack, Text: fmt.Sprintf("Rolled back %s from %s to %s.", target, ImageTag(previousImage), ImageTag(image)), Event: event, Result: &result})
+	if !dryRun {
+		go trackRollouts(event, []TargetResult{result})
+	}
+
+	return result
+}
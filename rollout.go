@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Returns whether the rollout of the target completed, or an error if it failed
+func RolloutStatus(ctx context.Context, target Target) (bool, error) {
+	cluster, err := ClusterFor(target.Cluster)
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := apiContext(ctx)
+	defer cancel()
+
+	switch target.Kind {
+	case KindDeployment:
+		result, err := cluster.Kube.AppsV1().Deployments(target.Namespace).Get(ctx, target.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return deploymentRolloutStatus(result)
+	case KindStatefulSet:
+		result, err := cluster.Kube.AppsV1().StatefulSets(target.Namespace).Get(ctx, target.Name, metav1.GetOptions{})
+		if err != nil {
+			return false, err
+		}
+		return statefulSetRolloutStatus(result), nil
+	}
+
+	return false, fmt.Errorf("unknown target kind %s", target.Kind)
+}
+
+// Returns whether the rollout of the deployment completed, or an error if it failed
+func deploymentRolloutStatus(result *appsv1.Deployment) (bool, error) {
+	for _, condition := range result.Status.Conditions {
+		if condition.Type == "Progressing" && condition.Reason == "ProgressDeadlineExceeded" {
+			return false, errors.New("progress deadline exceeded")
+		}
+	}
+	replicas := int32(1)
+	if result.Spec.Replicas != nil {
+		replicas = *result.Spec.Replicas
+	}
+	status := result.Status
+
+	return status.ObservedGeneration >= result.Generation &&
+		status.UpdatedReplicas == replicas &&
+		status.Replicas == replicas &&
+		status.AvailableReplicas == replicas, nil
+}
+
+// Returns whether the rollout of the stateful set completed
+func statefulSetRolloutStatus(result *appsv1.StatefulSet) bool {
+	replicas := int32(1)
+	if result.Spec.Replicas != nil {
+		replicas = *result.Spec.Replicas
+	}
+	status := result.Status
+	if status.ObservedGeneration < result.Generation {
+		return false
+	}
+	// Pods of OnDelete stateful sets are only replaced manually
+	if result.Spec.UpdateStrategy.Type == "OnDelete" {
+		return true
+	}
+
+	return status.UpdatedReplicas == replicas &&
+		status.ReadyReplicas == replicas &&
+		status.CurrentRevision == status.UpdateRevision
+}
+
+// Waits until the rollout of the target completed, failed or the timeout passed
+func WaitForRollout(ctx context.Context, target Target, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		complete, err := RolloutStatus(ctx, target)
+		if err != nil {
+			return err
+		}
+		if complete {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("rollout did not complete within %s", timeout)
+		}
+
+		time.Sleep(5 * time.Second)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/util/retry"
+)
+
+// Annotation of the signing secret holding the creation time of every key version
+const keyCreationAnnotation = "ki-cd/key-creation-times"
+
+type KeyRotation struct {
+	Namespace string
+	Name      string
+	// The key to rotate, e.g. master_key
+	Key string
+	// Rotate if the current key is older than this
+	Interval time.Duration
+	// How long previous keys stay valid after they were replaced
+	GracePeriod time.Duration
+	// How many previous keys are kept at most
+	Keep int
+}
+
+func generateKey() ([]byte, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return []byte(hex.EncodeToString(key)), nil
+}
+
+// Rotates the key if it is due (or forced) and removes previous keys whose grace period passed.
+// Returns whether a new key was generated.
+func (k KeyRotation) Run(force bool) (bool, error) {
+	rotated := false
+
+	err := retry.RetryOnConflict(kubeRetry, func() error {
+		rotated = false
+		ctx, cancel := apiContext(context.Background())
+		defer cancel()
+
+		secret, err := kubeSet.CoreV1().Secrets(k.Namespace).Get(ctx, k.Name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if secret.Data == nil {
+			secret.Data = make(map[string][]byte)
+		}
+		if secret.Annotations == nil {
+			secret.Annotations = make(map[string]string)
+		}
+
+		created := make(map[string]time.Time)
+		if value, ok := secret.Annotations[keyCreationAnnotation]; ok {
+			if err := json.Unmarshal([]byte(value), &created); err != nil {
+				return fmt.Errorf("malformed annotation %s: %s", keyCreationAnnotation, err)
+			}
+		}
+
+		now := time.Now()
+		names := KeyVersionNames(k.Key, k.Keep)
+		changed := false
+
+		// Keys without a known creation time are treated as new
+		for _, name := range names {
+			if _, ok := secret.Data[name]; ok && created[name].IsZero() {
+				created[name] = now
+				changed = true
+			}
+		}
+
+		if _, ok := secret.Data[k.Key]; force || !ok || now.Sub(created[k.Key]) >= k.Interval {
+			for i := len(names) - 1; i > 0; i-- {
+				if key, ok := secret.Data[names[i-1]]; ok {
+					secret.Data[names[i]] = key
+					created[names[i]] = created[names[i-1]]
+				}
+			}
+			key, err := generateKey()
+			if err != nil {
+				return err
+			}
+			secret.Data[k.Key] = key
+			created[k.Key] = now
+			rotated = true
+			changed = true
+		}
+
+		// A previous key is valid until the grace period after its successor was created
+		for i := 1; i < len(names); i++ {
+			if _, ok := secret.Data[names[i]]; ok && now.After(created[names[i-1]].Add(k.GracePeriod)) {
+				delete(secret.Data, names[i])
+				delete(created, names[i])
+				changed = true
+			}
+		}
+		// Previous keys beyond the number to keep, but no other keys starting with <key>_old
+		previousName := regexp.MustCompile(`^` + regexp.QuoteMeta(k.Key) + `_old(_\d+)?$`)
+		for name := range secret.Data {
+			if previousName.MatchString(name) && !containsString(names, name) {
+				delete(secret.Data, name)
+				delete(created, name)
+				changed = true
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+
+		annotation, err := json.Marshal(created)
+		if err != nil {
+			return err
+		}
+		secret.Annotations[keyCreationAnnotation] = string(annotation)
+		_, err = kubeSet.CoreV1().Secrets(k.Namespace).Update(ctx, secret, metav1.UpdateOptions{})
+
+		return err
+	})
+
+	return rotated, err
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+type KeyUsage struct {
+	Key        string    `json:"key"`
+	Repository string    `json:"repository"`
+	Source     string    `json:"source"`
+	Count      int       `json:"count"`
+	LastUsed   time.Time `json:"lastUsed"`
+}
+
+// KeyUsageTracker remembers which senders still sign with previous keys
+type KeyUsageTracker struct {
+	mutex  sync.Mutex
+	usages map[string]*KeyUsage
+}
+
+func NewKeyUsageTracker() *KeyUsageTracker {
+	return &KeyUsageTracker{usages: make(map[string]*KeyUsage)}
+}
+
+func (t *KeyUsageTracker) Record(key SigningKey, repository string, source string) {
+	if !key.IsPrevious() {
+		return
+	}
+
+	globalLogger.Warning(fmt.Sprintf("Repository %s from %s still signs with the previous key %s", repository, source, key.Name))
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	id := key.Name + "/" + strings.ToLower(repository) + "/" + source
+	usage, ok := t.usages[id]
+	if !ok {
+		usage = &KeyUsage{Key: key.Name, Repository: repository, Source: source}
+		t.usages[id] = usage
+	}
+	usage.Count++
+	usage.LastUsed = time.Now()
+}
+
+func (t *KeyUsageTracker) Usages() []KeyUsage {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	usages := make([]KeyUsage, 0, len(t.usages))
+	for _, usage := range t.usages {
+		usages = append(usages, *usage)
+	}
+	sort.Slice(usages, func(i, j int) bool { return usages[i].LastUsed.After(usages[j].LastUsed) })
+
+	return usages
+}
+
+// GET lists senders still using previous keys, POST rotates the key immediately
+func KeysHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		WriteJSON(w, 200, keyUsageTracker.Usages())
+	case "POST":
+		if keyRotation == nil {
+			http.Error(w, "key rotation is only supported for kubernetes secrets", 400)
+			return
+		}
+		if _, err := keyRotation.Run(true); err != nil {
+			globalLogger.Error("Could not rotate key: " + err.Error())
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		globalLogger.Info(fmt.Sprintf("Rotated key %s", keyRotation.Key))
+		WriteJSON(w, 200, ResponseMessage{Success: true, Message: "Rotated key " + keyRotation.Key})
+	default:
+		http.Error(w, "method not allowed", 405)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// SentryReporter sends errors and panics to Sentry (or a compatible service) via its store api
+type SentryReporter struct {
+	Environment string
+
+	storeURL  string
+	publicKey string
+	client    http.Client
+}
+
+// Creates a reporter from a DSN of the form https://<key>@<host>/<project>
+func NewSentryReporter(dsn string, environment string) (*SentryReporter, error) {
+	parsed, err := url.Parse(dsn)
+	if err != nil {
+		return nil, err
+	}
+	if parsed.User == nil || parsed.User.Username() == "" {
+		return nil, errors.New("dsn contains no public key")
+	}
+	project := strings.TrimPrefix(parsed.Path, "/")
+	if project == "" {
+		return nil, errors.New("dsn contains no project")
+	}
+
+	// Projects can be served under a path prefix
+	prefix := ""
+	if i := strings.LastIndex(project, "/"); i != -1 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+
+	return &SentryReporter{
+		Environment: environment,
+		storeURL:    fmt.Sprintf("%s://%s%s/api/%s/store/", parsed.Scheme, parsed.Host, prefix, project),
+		publicKey:   parsed.User.Username(),
+		client:      http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+// Reports the error with the given fields (e.g. repository, namespace, workload) as tags. Reports are sent asynchronously.
+func (s *SentryReporter) Capture(err error, fields LogFields) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.send("error", fmt.Sprintf("%T", err), err.Error(), "", fields)
+}
+
+// Reports a recovered panic with its stack trace
+func (s *SentryReporter) CapturePanic(recovered interface{}, fields LogFields) {
+	if s == nil {
+		return
+	}
+
+	s.send("fatal", "panic", fmt.Sprint(recovered), string(debug.Stack()), fields)
+}
+
+func (s *SentryReporter) send(level string, errorType string, message string, stack string, fields LogFields) {
+	message, stack = Redact(message), Redact(stack)
+	tags := make(map[string]string)
+	for key, value := range fields {
+		tags[key] = Redact(fmt.Sprint(value))
+	}
+	event := map[string]interface{}{
+		"event_id":    randomHex(16),
+		"timestamp":   time.Now().UTC().Format(time.RFC3339),
+		"level":       level,
+		"platform":    "go",
+		"logger":      "kubernetes-internal-cd",
+		"environment": s.Environment,
+		"tags":        tags,
+		"exception": map[string]interface{}{
+			"values": []map[string]string{{"type": errorType, "value": message}},
+		},
+	}
+	if stack != "" {
+		event["extra"] = map[string]string{"stack": stack}
+	}
+
+	go func() {
+		body, err := json.Marshal(event)
+		if err != nil {
+			globalLogger.Warning("Could not encode sentry event: " + err.Error())
+			return
+		}
+		request, err := http.NewRequest("POST", s.storeURL, bytes.NewReader(body))
+		if err != nil {
+			globalLogger.Warning("Could not create sentry request: " + err.Error())
+			return
+		}
+		request.Header.Set("content-type", "application/json")
+		request.Header.Set("x-sentry-auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=kubernetes-internal-cd/1.0, sentry_key=%s", s.publicKey))
+
+		response, err := s.client.Do(request)
+		if err != nil {
+			globalLogger.Warning("Could not send sentry event: " + err.Error())
+			return
+		}
+		response.Body.Close()
+		if response.StatusCode >= 300 {
+			globalLogger.Warning(fmt.Sprintf("Unexpected status %d sending sentry event", response.StatusCode))
+		}
+	}()
+}
+
+// Wraps a handler to report panics before they are handled by the http server
+func RecoverHandler(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				if recovered != http.ErrAbortHandler {
+					errorReporter.CapturePanic(recovered, LogFields{"path": r.URL.Path, "requestId": w.Header().Get("x-request-id")})
+				}
+				panic(recovered)
+			}
+		}()
+
+		handler.ServeHTTP(w, r)
+	})
+}
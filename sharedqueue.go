@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Deploy waiting in the shared queue with the audit entry of its webhook, which is recorded by the
+// replica deploying it
+type sharedDeployJob struct {
+	Event   DeployEvent `json:"event"`
+	Audit   AuditEntry  `json:"audit"`
+	Attempt int         `json:"attempt,omitempty"`
+}
+
+// SharedQueue keeps webhooks in a table of the database, from which the workers of all replicas
+// claim deploys. Deploys of a repository are claimed in order, one at a time, so its targets are
+// never updated out of order, while webhooks of any replica are deployed by any replica.
+type SharedQueue struct {
+	// Identity of this replica in claims
+	Identity string
+	Size     int
+	// Claims of replicas which didn't complete their deploy in this time are taken over
+	ClaimTimeout time.Duration
+	PollInterval time.Duration
+	// Retries of transiently failed deploys after an exponential backoff, 0 disables retrying
+	RetryAttempts int
+	RetryBackoff  time.Duration
+
+	workers int
+}
+
+// Adds the deploy of a webhook to the queue, returns errDeployQueueFull if the queue is full
+func (q *SharedQueue) Enqueue(event DeployEvent, audit AuditEntry) error {
+	job, err := json.Marshal(sharedDeployJob{Event: event, Audit: audit})
+	if err != nil {
+		return err
+	}
+
+	// Audit IDs are receive times, which webhooks received by several replicas at once may share
+	return store.EnqueueDeploy(audit.ID+"-"+randomHex(8), strings.ToLower(event.Repository), event.ReceivedAt, job, q.Size)
+}
+
+// Returns how long senders of deploys rejected with errDeployQueueFull should wait before retrying,
+// the estimated time until the workers of this replica deployed the full queue
+func (q *SharedQueue) RetryAfter() time.Duration {
+	return queuedDeployDurations.wait(q.Size, q.workers)
+}
+
+// Starts the given number of workers claiming and deploying queued deploys
+func (q *SharedQueue) Work(workers int) {
+	q.workers = workers
+	for i := 0; i < workers; i++ {
+		go func() {
+			for {
+				// Deploys stay queued while the kubernetes api is unavailable
+				if ShuttingDown() || len(OpenCircuits()) > 0 || !q.next() {
+					time.Sleep(q.PollInterval)
+				}
+			}
+		}()
+	}
+}
+
+// Claims and deploys the next deploy, returns whether there was one
+func (q *SharedQueue) next() bool {
+	if !beginDeploy() {
+		return false
+	}
+	defer deploysInFlight.Done()
+
+	id, value, err := store.ClaimDeploy(q.Identity, time.Now().Add(-q.ClaimTimeout))
+	if err != nil {
+		globalLogger.Error("Could not claim a queued deploy: " + err.Error())
+		return false
+	}
+	if id == "" {
+		return false
+	}
+
+	var job sharedDeployJob
+	if err := json.Unmarshal(value, &job); err != nil {
+		globalLogger.Error(fmt.Sprintf("Dropping malformed queued deploy %s: %s", id, err))
+	} else {
+		audit := job.Audit
+		if job.Attempt == 0 {
+			forwardToAgents(job.Event)
+		}
+		started := time.Now()
+		results, err := Deploy(context.Background(), job.Event)
+		queuedDeployDurations.observe(time.Since(started))
+		if retryableDeploy(results, err) && job.Attempt < q.RetryAttempts {
+			q.retry(id, job)
+			return true
+		}
+		if err != nil {
+			audit.Outcome = AuditOutcomeError
+			audit.Reason = err.Error()
+		} else {
+			audit.SetResults(results)
+		}
+		auditLog.Record(audit)
+	}
+
+	if err := store.CompleteDeploy(id); err != nil {
+		globalLogger.Error(fmt.Sprintf("Could not remove deploy %s from the queue: %s", id, err))
+	}
+
+	return true
+}
+
+// Keeps a transiently failed deploy in the queue, claimable again after the backoff of its attempt.
+// Later deploys of the repository keep waiting for it.
+func (q *SharedQueue) retry(id string, job sharedDeployJob) {
+	job.Attempt++
+	backoff := q.RetryBackoff * time.Duration(1<<uint(job.Attempt-1))
+	globalLogger.With(LogFields{"requestId": job.Event.RequestID, "repository": job.Event.Repository}).Warning(fmt.Sprintf("Deploy of %s failed transiently, retrying in %s (attempt %d of %d)", job.Event.Image, backoff, job.Attempt, q.RetryAttempts))
+	deployRetriesTotal.Inc()
+
+	value, err := json.Marshal(job)
+	if err == nil {
+		err = store.RetryDeploy(id, value, time.Now().Add(backoff), q.ClaimTimeout)
+	}
+	if err != nil {
+		globalLogger.Error(fmt.Sprintf("Could not retry the queued deploy %s, it is retried once its claim expired: %s", id, err))
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var shuttingDown int32
+
+// Held while starting a deploy, so no deploy starts once the shutdown waits for deploysInFlight
+var shutdownLock sync.RWMutex
+
+var errShuttingDown = errors.New("shutting down")
+
+// Deploys in progress, including those forwarded by a hub
+var deploysInFlight sync.WaitGroup
+
+// Returns whether the server received SIGTERM and stopped accepting webhooks
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Adds a deploy starting outside of a request to deploysInFlight, returns false without adding it
+// once shutting down. Requests don't need to, the shutdown waits for them before the deploys.
+func beginDeploy() bool {
+	shutdownLock.RLock()
+	defer shutdownLock.RUnlock()
+	if ShuttingDown() {
+		return false
+	}
+	deploysInFlight.Add(1)
+
+	return true
+}
+
+// Waits for the group until it is done or the context expires
+func waitContext(ctx context.Context, wait *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wait.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Waits until all pending notification retries were sent or dropped, or the context expires
+func flushNotificationRetries(ctx context.Context) error {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for atomic.LoadInt32(&pendingNotificationRetries) > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return fmt.Errorf("%d notifications are still waiting for a retry", atomic.LoadInt32(&pendingNotificationRetries))
+		}
+	}
+
+	return nil
+}
+
+// Shuts the server down gracefully on SIGTERM or SIGINT. New webhooks are rejected, in-flight
+// requests and deploys finish and pending notifications and spans are flushed within the timeout.
+// The returned channel is closed once the shutdown completed.
+func HandleShutdown(server *http.Server, timeout time.Duration) <-chan struct{} {
+	done := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	go func() {
+		received := <-signals
+		shutdownLock.Lock()
+		atomic.StoreInt32(&shuttingDown, 1)
+		shutdownLock.Unlock()
+		globalLogger.Info(fmt.Sprintf("Received %s, shutting down within %s...", received, timeout))
+
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+
+		if err := server.Shutdown(ctx); err != nil {
+			globalLogger.Warning("Requests didn't finish in time: " + err.Error())
+		}
+		if err := waitContext(ctx, &deploysInFlight); err != nil {
+			globalLogger.Warning("Deploys didn't finish in time: " + err.Error())
+		}
+		if err := StopManager(ctx); err != nil {
+			globalLogger.Warning("Could not stop the manager and release the lease: " + err.Error())
+		}
+		if err := auditLog.Flush(ctx); err != nil {
+			globalLogger.Warning("Could not persist the audit log: " + err.Error())
+		}
+		if err := flushNotificationRetries(ctx); err != nil {
+			globalLogger.Warning("Could not flush the notifications: " + err.Error())
+		}
+		if tracer != nil {
+			if err := tracer.Flush(); err != nil {
+				globalLogger.Warning("Could not export spans: " + err.Error())
+			}
+		}
+
+		globalLogger.Info("Shutdown complete")
+		close(done)
+	}()
+
+	return done
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Keys are derived per repository from the master key
+	SignatureModeDerived = "derived"
+	// Payloads are signed directly with the shared secret, exactly like GitHub does
+	SignatureModeShared = "shared"
+)
+
+// Create a signature hash "sha256=..." of the input with the given key
+func CreateSignatureHash256(input []byte, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write(input)
+
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// Escapes repository names for secret data keys. "." and "_" are escaped with a leading "." before "/"
+// becomes "_", so group/sub_repo (repo_group_sub._repo) and group/sub/repo (repo_group_sub_repo) don't collide.
+var repositoryKeyReplacer = strings.NewReplacer(".", "..", "_", "._", "/", "_")
+
+// Returns the secret data key holding the dedicated signing key of a repository
+func RepositoryKeyName(repository string) string {
+	return "repo_" + repositoryKeyReplacer.Replace(strings.ToLower(repository))
+}
+
+// SigningKey is a key accepted to sign payloads and the name of the key it was read or derived from
+type SigningKey struct {
+	Name string
+	Key  []byte
+	// Whether the key is a previous version of a rotated key
+	Previous bool
+}
+
+// Returns the names of the current and all previous versions of a key,
+// i.e. <name>, <name>_old, <name>_old_2, <name>_old_3, ...
+func KeyVersionNames(name string, previous int) []string {
+	names := []string{name}
+	for i := 1; i <= previous; i++ {
+		if i == 1 {
+			names = append(names, name+"_old")
+		} else {
+			names = append(names, fmt.Sprintf("%s_old_%d", name, i))
+		}
+	}
+
+	return names
+}
+
+// Returns all present versions of the given key, current first
+func keyVersions(secretData map[string][]byte, name string) []SigningKey {
+	var keys []SigningKey
+	for i, versionName := range KeyVersionNames(name, len(secretData)) {
+		key, ok := secretData[versionName]
+		if !ok || len(key) == 0 {
+			// Only the current version may be missing
+			if i > 0 {
+				break
+			}
+			continue
+		}
+		keys = append(keys, SigningKey{Name: versionName, Key: key, Previous: i > 0})
+	}
+
+	return keys
+}
+
+// Returns whether the key is a previous version of a rotated key. Names aren't parsed, as
+// repository names may contain _old themselves.
+func (k SigningKey) IsPrevious() bool {
+	return k.Previous
+}
+
+// Returns all keys which are accepted to sign payloads of the given repository.
+// A dedicated repository key replaces the keys derived from the master key.
+func SigningKeys(secretData map[string][]byte, repository string) []SigningKey {
+	if signatureMode == SignatureModeShared {
+		return keyVersions(secretData, "shared_secret")
+	}
+
+	keys := keyVersions(secretData, RepositoryKeyName(repository))
+	if len(keys) > 0 || requireRepositoryKeys {
+		return keys
+	}
+
+	for _, masterKey := range keyVersions(secretData, "master_key") {
+		derivedKey := hex.EncodeToString(CreateSignature([]byte(repository), masterKey.Key))
+		keys = append(keys, SigningKey{Name: masterKey.Name, Key: []byte(derivedKey), Previous: masterKey.Previous})
+	}
+
+	return keys
+}
+
+// Checks the signature headers against all accepted signing keys of the repository and returns the matching key.
+// The sha256 signature in x-hub-signature-256 is preferred over the sha1 one in x-hub-signature.
+// Keys derived for a repository are only redacted from logs once they verified a payload, as
+// the repository of unverified payloads can be anything.
+func VerifySignature(secretData map[string][]byte, repository string, payload []byte, header http.Header) (SigningKey, bool) {
+	signatureHeader := header.Get("x-hub-signature-256")
+	useSha256 := signatureHeader != ""
+	if !useSha256 {
+		signatureHeader = header.Get("x-hub-signature")
+	}
+
+	for _, key := range SigningKeys(secretData, repository) {
+		var signature string
+		if useSha256 {
+			signature = CreateSignatureHash256(payload, key.Key)
+		} else {
+			signature = CreateSignatureHash(CreateSignature(payload, key.Key))
+		}
+		if subtle.ConstantTimeCompare([]byte(signatureHeader), []byte(signature)) == 1 {
+			RegisterSecret(string(key.Key))
+			return key, true
+		}
+	}
+
+	return SigningKey{}, false
+}
+
+// Checks the production signature header of payloads deploying into protected namespaces.
+// It is created like x-hub-signature-256, but with the separate production_key of the secret.
+func VerifyProductionSignature(secretData map[string][]byte, payload []byte, header http.Header) bool {
+	signatureHeader := header.Get("x-production-signature-256")
+	if signatureHeader == "" {
+		return false
+	}
+
+	for _, key := range keyVersions(secretData, "production_key") {
+		if subtle.ConstantTimeCompare([]byte(signatureHeader), []byte(CreateSignatureHash256(payload, key.Key))) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	payload := []byte(`{"data":{"github":{"repository":"example/api"}}}`)
+	masterKey := []byte("master-key-current")
+	oldMasterKey := []byte("master-key-previous")
+	repositoryKey := []byte("repository-key-current")
+	// Keys derived from a master key are the hex encoded hmac of the repository
+	derived := func(masterKey []byte, repository string) []byte {
+		return []byte(hex.EncodeToString(CreateSignature([]byte(repository), masterKey)))
+	}
+	sha256Header := func(key []byte) http.Header {
+		return http.Header{"X-Hub-Signature-256": {CreateSignatureHash256(payload, key)}}
+	}
+
+	tests := []struct {
+		name       string
+		mode       string
+		secretData map[string][]byte
+		repository string
+		header     http.Header
+		valid      bool
+		keyName    string
+		previous   bool
+	}{
+		{
+			name:       "derived key",
+			secretData: map[string][]byte{"master_key": masterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(masterKey, "example/api")),
+			valid:      true,
+			keyName:    "master_key",
+		},
+		{
+			name:       "key derived for another repository",
+			secretData: map[string][]byte{"master_key": masterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(masterKey, "example/web")),
+		},
+		{
+			name:       "bad signature",
+			secretData: map[string][]byte{"master_key": masterKey},
+			repository: "example/api",
+			header:     http.Header{"X-Hub-Signature-256": {"sha256=0123456789abcdef"}},
+		},
+		{
+			name:       "missing signature",
+			secretData: map[string][]byte{"master_key": masterKey},
+			repository: "example/api",
+			header:     http.Header{},
+		},
+		{
+			name:       "previous master key",
+			secretData: map[string][]byte{"master_key": masterKey, "master_key_old": oldMasterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(oldMasterKey, "example/api")),
+			valid:      true,
+			keyName:    "master_key_old",
+			previous:   true,
+		},
+		{
+			name:       "previous key without a current key",
+			secretData: map[string][]byte{"master_key_old": oldMasterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(oldMasterKey, "example/api")),
+			valid:      true,
+			keyName:    "master_key_old",
+			previous:   true,
+		},
+		{
+			name:       "key older than a missing previous version",
+			secretData: map[string][]byte{"master_key": masterKey, "master_key_old_2": oldMasterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(oldMasterKey, "example/api")),
+		},
+		{
+			name:       "repository key",
+			secretData: map[string][]byte{"master_key": masterKey, "repo_example_api": repositoryKey},
+			repository: "Example/API",
+			header:     sha256Header(repositoryKey),
+			valid:      true,
+			keyName:    "repo_example_api",
+		},
+		{
+			name:       "repository key replaces the master key",
+			secretData: map[string][]byte{"master_key": masterKey, "repo_example_api": repositoryKey},
+			repository: "example/api",
+			header:     sha256Header(derived(masterKey, "example/api")),
+		},
+		{
+			name:       "repository named like a previous key",
+			secretData: map[string][]byte{"repo_example_api._old": repositoryKey},
+			repository: "example/api_old",
+			header:     sha256Header(repositoryKey),
+			valid:      true,
+			keyName:    "repo_example_api._old",
+		},
+		{
+			name:       "previous key of another repository",
+			secretData: map[string][]byte{"repo_example_api_old": repositoryKey},
+			repository: "example/api_old",
+			header:     sha256Header(repositoryKey),
+		},
+		{
+			name:       "sha1 signature",
+			secretData: map[string][]byte{"repo_example_api": repositoryKey},
+			repository: "example/api",
+			header:     http.Header{"X-Hub-Signature": {CreateSignatureHash(CreateSignature(payload, repositoryKey))}},
+			valid:      true,
+			keyName:    "repo_example_api",
+		},
+		{
+			name:       "sha256 preferred over a valid sha1 signature",
+			secretData: map[string][]byte{"repo_example_api": repositoryKey},
+			repository: "example/api",
+			header: http.Header{
+				"X-Hub-Signature":     {CreateSignatureHash(CreateSignature(payload, repositoryKey))},
+				"X-Hub-Signature-256": {CreateSignatureHash256(payload, []byte("another-key-value"))},
+			},
+		},
+		{
+			name:       "sha256 preferred over an invalid sha1 signature",
+			secretData: map[string][]byte{"repo_example_api": repositoryKey},
+			repository: "example/api",
+			header: http.Header{
+				"X-Hub-Signature":     {"sha1=0123456789abcdef"},
+				"X-Hub-Signature-256": {CreateSignatureHash256(payload, repositoryKey)},
+			},
+			valid:   true,
+			keyName: "repo_example_api",
+		},
+		{
+			name:       "shared secret",
+			mode:       SignatureModeShared,
+			secretData: map[string][]byte{"shared_secret": repositoryKey, "master_key": masterKey},
+			repository: "example/api",
+			header:     sha256Header(repositoryKey),
+			valid:      true,
+			keyName:    "shared_secret",
+		},
+		{
+			name:       "derived key in shared mode",
+			mode:       SignatureModeShared,
+			secretData: map[string][]byte{"shared_secret": repositoryKey, "master_key": masterKey},
+			repository: "example/api",
+			header:     sha256Header(derived(masterKey, "example/api")),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			signatureMode = test.mode
+			defer func() { signatureMode = "" }()
+
+			key, valid := VerifySignature(test.secretData, test.repository, payload, test.header)
+			if valid != test.valid {
+				t.Fatalf("got valid %t, want %t", valid, test.valid)
+			}
+			if key.Name != test.keyName {
+				t.Errorf("got key %q, want %q", key.Name, test.keyName)
+			}
+			if key.IsPrevious() != test.previous {
+				t.Errorf("got previous %t, want %t", key.IsPrevious(), test.previous)
+			}
+		})
+	}
+}
+
+func TestVerifyProductionSignature(t *testing.T) {
+	payload := []byte(`{"data":{"github":{"repository":"example/api"}}}`)
+	secretData := map[string][]byte{
+		"master_key":         []byte("master-key-current"),
+		"production_key":     []byte("production-key-current"),
+		"production_key_old": []byte("production-key-previous"),
+	}
+
+	tests := []struct {
+		name      string
+		signature string
+		valid     bool
+	}{
+		{"current key", CreateSignatureHash256(payload, secretData["production_key"]), true},
+		{"previous key", CreateSignatureHash256(payload, secretData["production_key_old"]), true},
+		{"master key", CreateSignatureHash256(payload, secretData["master_key"]), false},
+		{"bad signature", "sha256=0123456789abcdef", false},
+		{"missing signature", "", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header := http.Header{}
+			if test.signature != "" {
+				header.Set("x-production-signature-256", test.signature)
+			}
+			if valid := VerifyProductionSignature(secretData, payload, header); valid != test.valid {
+				t.Errorf("got valid %t, want %t", valid, test.valid)
+			}
+		})
+	}
+}
+
+func TestRepositoryKeyName(t *testing.T) {
+	tests := []struct {
+		repository string
+		keyName    string
+	}{
+		{"example/api", "repo_example_api"},
+		{"Example/API", "repo_example_api"},
+		{"group/sub/repo", "repo_group_sub_repo"},
+		{"group/sub_repo", "repo_group_sub._repo"},
+		{"group/sub.repo", "repo_group_sub..repo"},
+		{"group/sub._repo", "repo_group_sub..._repo"},
+		{"group/sub/.repo", "repo_group_sub_..repo"},
+	}
+
+	keyNames := map[string]string{}
+	for _, test := range tests {
+		keyName := RepositoryKeyName(test.repository)
+		if keyName != test.keyName {
+			t.Errorf("got %q for %s, want %q", keyName, test.repository, test.keyName)
+		}
+		if other, ok := keyNames[keyName]; ok && !strings.EqualFold(other, test.repository) {
+			t.Errorf("%s and %s share the key %q", other, test.repository, keyName)
+		}
+		keyNames[keyName] = test.repository
+	}
+}
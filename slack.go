@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Colors of the slack message by notification type
+var slackColors = map[string]string{
+	NotificationStarted:          "#439fe0",
+	NotificationSucceeded:        "#2eb67d",
+	NotificationFailed:           "#e01e5a",
+	NotificationRolloutFailed:    "#e01e5a",
+	NotificationRolloutSucceeded: "#2eb67d",
+	NotificationRejected:         "#ecb22e",
+	NotificationSkipped:          "#ecb22e",
+	NotificationDeployed:         "#2eb67d",
+	NotificationRolledBack:       "#ecb22e",
+	NotificationDrifted:          "#ecb22e",
+	NotificationAPIUnavailable:   "#e01e5a",
+	NotificationAPIRecovered:     "#2eb67d",
+}
+
+// Human readable rollout status by notification type
+var slackStatuses = map[string]string{
+	NotificationStarted:          ":hourglass_flowing_sand: Started",
+	NotificationSucceeded:        ":rocket: Image updated, rolling out",
+	NotificationFailed:           ":x: Update failed",
+	NotificationRolloutFailed:    ":x: Rollout failed",
+	NotificationRolloutSucceeded: ":white_check_mark: Rolled out",
+	NotificationRejected:         ":no_entry: Rejected",
+	NotificationSkipped:          ":warning: Skipped",
+	NotificationDeployed:         ":rocket: Images updated, rolling out",
+	NotificationRolledBack:       ":rewind: Rolled back, rolling out",
+	NotificationDrifted:          ":warning: Drifted",
+	NotificationAPIUnavailable:   ":x: Deploys paused",
+	NotificationAPIRecovered:     ":white_check_mark: Deploys resumed",
+}
+
+// Returns the url of the commit of the repository
+func CommitURL(repository string, sha string) string {
+	return fmt.Sprintf("%s/%s/commit/%s", githubURL, repository, sha)
+}
+
+// SlackRoute sends notifications about targets in a namespace to their own channel or webhook
+type SlackRoute struct {
+	Namespace string `json:"namespace"`
+	// Channel to post to with SLACK_BOT_TOKEN
+	Channel string `json:"channel,omitempty"`
+	// Incoming webhook url to post to without SLACK_BOT_TOKEN
+	URL string `json:"url,omitempty"`
+}
+
+func (r SlackRoute) validate() error {
+	if r.Namespace == "" {
+		return errors.New("namespace is required")
+	}
+	if r.Channel == "" && r.URL == "" {
+		return errors.New("either channel or url is required")
+	}
+
+	return nil
+}
+
+// Returns the annotation key holding the slack channel of notifications about workloads
+func SlackChannelAnnotationKey() string {
+	return labelPrefix + "slack-channel"
+}
+
+// Escapes the characters with a special meaning in slack mrkdwn
+func slackEscape(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+// SlackNotifier posts block kit messages to a slack incoming webhook or, with a bot token, to a channel.
+// With a bot token all updates of a deploy in a channel are threaded under its first message there.
+type SlackNotifier struct {
+	URL string
+	// Bot token and channel to post with chat.postMessage instead of the webhook
+	Token   string
+	Channel string
+	// Channels or webhooks by namespace of the target
+	Routes []SlackRoute
+
+	mutex sync.Mutex
+	// Thread timestamps of the started messages by deploy
+	threads map[string]slackThread
+}
+
+type slackThread struct {
+	Timestamp string
+	Created   time.Time
+}
+
+// Threads of deploys older than this are forgotten
+const slackThreadTTL = 24 * time.Hour
+
+// Returns the key identifying the deploy of the notification in the channel
+func slackThreadKey(channel string, event DeployEvent) string {
+	if event.RequestID != "" {
+		return channel + "/" + event.RequestID
+	}
+
+	return channel + "/" + event.Repository + "@" + event.Sha
+}
+
+// Returns the route of the namespace, if any
+func (n *SlackNotifier) route(namespace string) (SlackRoute, bool) {
+	for _, route := range n.Routes {
+		if route.Namespace == namespace {
+			return route, true
+		}
+	}
+
+	return SlackRoute{}, false
+}
+
+// Returns the channel of the notification: the channel of the target, of its namespace or the default channel
+func (n *SlackNotifier) channel(notification Notification) string {
+	if notification.Result != nil {
+		if notification.Result.Target.SlackChannel != "" {
+			return notification.Result.Target.SlackChannel
+		}
+		if route, ok := n.route(notification.Result.Target.Namespace); ok && route.Channel != "" {
+			return route.Channel
+		}
+	}
+
+	return n.Channel
+}
+
+// Returns the webhook url of the notification: the url of the namespace of the target or the default url
+func (n *SlackNotifier) url(notification Notification) string {
+	if notification.Result != nil {
+		if route, ok := n.route(notification.Result.Target.Namespace); ok && route.URL != "" {
+			return route.URL
+		}
+	}
+
+	return n.URL
+}
+
+// Returns the block kit blocks of the notification
+func slackBlocks(notification Notification) []map[string]interface{} {
+	event := notification.Event
+	field := func(title string, value string) map[string]string {
+		return map[string]string{"type": "mrkdwn", "text": fmt.Sprintf("*%s*\n%s", title, value)}
+	}
+
+	var fields []map[string]string
+	if event.Repository != "" {
+		fields = append(fields, field("Repository", slackEscape(event.Repository)))
+	}
+	if event.Branch != "" {
+		fields = append(fields, field("Branch", slackEscape(event.Branch)))
+	}
+	if event.Sha != "" {
+		shortSha := event.Sha
+		if len(shortSha) > 7 {
+			shortSha = shortSha[:7]
+		}
+		fields = append(fields, field("Commit", fmt.Sprintf("<%s|`%s`>", event.CommitURL(), slackEscape(shortSha))))
+	}
+	if event.CommitAuthor != "" {
+		fields = append(fields, field("Author", slackEscape(event.CommitAuthor)))
+	}
+	if compareURL := notification.CompareURL(); compareURL != "" {
+		fields = append(fields, field("Changes", fmt.Sprintf("<%s|Compare>", compareURL)))
+	}
+	if result := notification.Result; result != nil {
+		fields = append(fields, field("Workload", slackEscape(fmt.Sprintf("%s/%s", result.Target.Namespace, result.Target.Name))))
+		if result.PreviousImage != "" {
+			fields = append(fields, field("Image", slackEscape(fmt.Sprintf("`%s` → `%s`", ImageTag(result.PreviousImage), ImageTag(result.Image)))))
+		} else {
+			fields = append(fields, field("Image", slackEscape(fmt.Sprintf("`%s`", result.Image))))
+		}
+	} else if len(notification.Results) > 0 {
+		var workloads []string
+		for _, result := range notification.Results {
+			workloads = append(workloads, slackEscape(fmt.Sprintf("%s/%s", result.Target.Namespace, result.Target.Name)))
+		}
+		fields = append(fields, field("Workloads", strings.Join(workloads, "\n")))
+		fields = append(fields, field("Image", slackEscape(fmt.Sprintf("`%s`", event.Image))))
+	} else if event.Image != "" {
+		fields = append(fields, field("Image", slackEscape(fmt.Sprintf("`%s`", event.Image))))
+	}
+	if status, ok := slackStatuses[notification.Type]; ok {
+		fields = append(fields, field("Status", status))
+	}
+
+	blocks := []map[string]interface{}{
+		{"type": "section", "text": map[string]string{"type": "mrkdwn", "text": slackEscape(notification.Text)}},
+		// Sections allow at most 10 fields
+		{"type": "section", "fields": fields},
+	}
+	if subject := commitSubject(event, 150); subject != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "context",
+			"elements": []map[string]string{{"type": "mrkdwn", "text": "> " + slackEscape(subject)}},
+		})
+	}
+	// Buttons rolling the workloads back to their previous image, handled by the slack app
+	if slackApp != nil {
+		if buttons := slackRollbackButtons(notification); len(buttons) > 0 {
+			blocks = append(blocks, map[string]interface{}{"type": "actions", "elements": buttons})
+		}
+	}
+	if event.RequestID != "" {
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "context",
+			"elements": []map[string]string{{"type": "mrkdwn", "text": "Request " + slackEscape(event.RequestID)}},
+		})
+	}
+
+	return blocks
+}
+
+func (n *SlackNotifier) Notify(notification Notification) error {
+	color, ok := slackColors[notification.Type]
+	if !ok {
+		color = "#cccccc"
+	}
+	message := map[string]interface{}{
+		// Fallback of push notifications and clients without block support
+		"text": notificationText(notification),
+		"attachments": []map[string]interface{}{{
+			"color":  color,
+			"blocks": slackBlocks(notification),
+		}},
+	}
+
+	if n.Token == "" {
+		url := n.url(notification)
+		if url == "" {
+			return nil
+		}
+		return postJSON(url, message)
+	}
+
+	channel := n.channel(notification)
+	if channel == "" {
+		return nil
+	}
+	message["channel"] = channel
+	key := slackThreadKey(channel, notification.Event)
+	threadTimestamp := n.thread(key)
+	if threadTimestamp != "" {
+		message["thread_ts"] = threadTimestamp
+		// Failures are shown in the channel as well
+		if notification.Type == NotificationFailed || notification.Type == NotificationRolloutFailed {
+			message["reply_broadcast"] = true
+		}
+	}
+
+	timestamp, err := n.postMessage(message)
+	if err != nil {
+		return err
+	}
+	// The first message of the deploy in a channel starts its thread there
+	if threadTimestamp == "" {
+		n.setThread(key, timestamp)
+	}
+
+	return nil
+}
+
+// Returns the thread timestamp of the deploy, if its started message was posted
+func (n *SlackNotifier) thread(key string) string {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	return n.threads[key].Timestamp
+}
+
+func (n *SlackNotifier) setThread(key string, timestamp string) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	if n.threads == nil {
+		n.threads = make(map[string]slackThread)
+	}
+	for threadKey, thread := range n.threads {
+		if time.Since(thread.Created) > slackThreadTTL {
+			delete(n.threads, threadKey)
+		}
+	}
+	n.threads[key] = slackThread{Timestamp: timestamp, Created: time.Now()}
+}
+
+// Posts the message with chat.postMessage and returns its timestamp
+func (n *SlackNotifier) postMessage(message map[string]interface{}) (string, error) {
+	var result struct {
+		Timestamp string `json:"ts"`
+	}
+	if err := n.callAPI("chat.postMessage", message, &result); err != nil {
+		return "", err
+	}
+
+	return result.Timestamp, nil
+}
+
+// Verifies the bot token with auth.test. Webhooks can't be verified without posting.
+func (n *SlackNotifier) Check() error {
+	if n.Token == "" {
+		return nil
+	}
+
+	return n.callAPI("auth.test", map[string]interface{}{}, &struct{}{})
+}
+
+// Calls a method of the slack web api with the bot token and decodes its result
+func (n *SlackNotifier) callAPI(method string, payload map[string]interface{}, result interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	request, err := http.NewRequest(http.MethodPost, "https://slack.com/api/"+method, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json; charset=utf-8")
+	request.Header.Set("authorization", "Bearer "+n.Token)
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	body, err = ioutil.ReadAll(response.Body)
+	if err != nil {
+		return err
+	}
+	var status struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return err
+	}
+	if !status.OK {
+		return errors.New("slack error " + status.Error)
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+func (n *SlackNotifier) Name() string {
+	return "slack"
+}
+
+func (n *SlackNotifier) Types() []string {
+	if n.Token == "" {
+		return defaultNotificationTypes()
+	}
+
+	return []string{NotificationStarted, NotificationSucceeded, NotificationFailed, NotificationRolloutSucceeded, NotificationRolloutFailed, NotificationRolledBack, NotificationSkipped, NotificationRejected, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered}
+}
@@ -0,0 +1,527 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Requests of slack with an older timestamp are rejected as replays
+const slackRequestWindow = 5 * time.Minute
+
+// Prefix of the action IDs of rollback buttons
+const slackRollbackAction = "rollback"
+
+// Notifications about more workloads only get buttons for the first ones
+const maxSlackRollbackButtons = 5
+
+// SlackApp handles the slash command of a slack app, e.g. /kicd status api
+type SlackApp struct {
+	SigningSecret string
+	// Slack user IDs allowed to deploy, pause and resume. Everyone in the workspace may use status.
+	Users []string
+}
+
+// Verifies the signature of a request of slack with the signing secret of the app
+func (a *SlackApp) verify(header http.Header, body []byte) error {
+	timestamp := header.Get("x-slack-request-timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errors.New("missing request timestamp")
+	}
+	if skew := time.Since(time.Unix(seconds, 0)); skew > slackRequestWindow || skew < -slackRequestWindow {
+		return errors.New("request timestamp is outside of the accepted window")
+	}
+
+	expected := "v0=" + hex.EncodeToString(hmacSHA256([]byte(a.SigningSecret), "v0:"+timestamp+":"+string(body)))
+	if !hmac.Equal([]byte(expected), []byte(header.Get("x-slack-signature"))) {
+		return errors.New("invalid signature")
+	}
+
+	return nil
+}
+
+// Returns whether the slack user may change deploys
+func (a *SlackApp) authorized(userID string) bool {
+	for _, user := range a.Users {
+		if user == userID {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Writes a slash command response, visible to everyone in the channel or only to the user
+func slackReply(w http.ResponseWriter, inChannel bool, text string) {
+	responseType := "ephemeral"
+	if inChannel {
+		responseType = "in_channel"
+	}
+	WriteJSON(w, 200, map[string]string{"response_type": responseType, "text": text})
+}
+
+// Returns the targets of the app, given as <owner>/<repository> or only the repository name
+func slackAppTargets(ctx context.Context, app string) ([]ManagedTarget, error) {
+	targets, err := ListManagedTargets(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	app = strings.ToLower(app)
+	var matched []ManagedTarget
+	repositories := make(map[string]bool)
+	for _, target := range targets {
+		repository := strings.ToLower(target.Repository)
+		if repository != app && repository[strings.LastIndex(repository, "/")+1:] != app {
+			continue
+		}
+		if !NamespaceAllowed(target.Namespace) {
+			continue
+		}
+		matched = append(matched, target)
+		repositories[repository] = true
+	}
+
+	switch len(repositories) {
+	case 0:
+		return nil, fmt.Errorf("no targets of %s", app)
+	case 1:
+		return matched, nil
+	}
+	var names []string
+	for repository := range repositories {
+		names = append(names, repository)
+	}
+	sort.Strings(names)
+
+	return nil, fmt.Errorf("%s matches more than one repository, use one of %s", app, strings.Join(names, ", "))
+}
+
+// Returns the image of the targets without tag or digest, which has to be the same for all of them
+func slackAppImage(targets []ManagedTarget) (string, error) {
+	image := ""
+	for _, target := range targets {
+		targetImage := target.Image
+		if position := strings.Index(targetImage, "@"); position >= 0 {
+			targetImage = targetImage[:position]
+		}
+		if position := strings.LastIndex(targetImage, ":"); position >= 0 && !strings.Contains(targetImage[position:], "/") {
+			targetImage = targetImage[:position]
+		}
+		if image != "" && targetImage != image {
+			return "", fmt.Errorf("the targets run different images, %s and %s", image, targetImage)
+		}
+		image = targetImage
+	}
+	if image == "" {
+		return "", errors.New("the image of the targets is unknown")
+	}
+
+	return image, nil
+}
+
+// Returns the summary of the results of a deploy
+func slackResultsText(results []TargetResult) string {
+	var lines []string
+	for _, result := range results {
+		if result.Succeeded() {
+			lines = append(lines, fmt.Sprintf("• %s: `%s` → `%s`", result.Target, ImageTag(result.PreviousImage), ImageTag(result.Image)))
+		} else {
+			lines = append(lines, fmt.Sprintf("• %s: failed, %s", result.Target, result.Error))
+		}
+	}
+
+	return slackEscape(strings.Join(lines, "\n"))
+}
+
+func (a *SlackApp) status(ctx context.Context, app string) string {
+	targets, err := slackAppTargets(ctx, app)
+	if err != nil {
+		return slackEscape(err.Error())
+	}
+
+	lines := []string{fmt.Sprintf("*%s*", slackEscape(targets[0].Repository))}
+	for _, target := range targets {
+		line := fmt.Sprintf("• %s: `%s`, rollout %s", target.Target, ImageTag(target.Image), target.rollout)
+		if target.LastDeployed != nil {
+			line += fmt.Sprintf(", last deploy %s %s", formatTime(target.LastDeployed), target.LastOutcome)
+		}
+		if target.Paused != "" {
+			line += ", paused by " + target.Paused
+		}
+		lines = append(lines, slackEscape(line))
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Deploys the sha of the default branch to the targets of the app and posts the results to the response url
+func (a *SlackApp) deploy(r *http.Request, app string, sha string, userName string, responseURL string) (string, error) {
+	if !shaPattern.MatchString(sha) {
+		return "", errors.New("sha must be a lowercase hex commit sha")
+	}
+	targets, err := slackAppTargets(r.Context(), app)
+	if err != nil {
+		return "", err
+	}
+	image, err := slackAppImage(targets)
+	if err != nil {
+		return "", err
+	}
+
+	requestID := RequestID(r)
+	repository := targets[0].Repository
+	audit := AuditEntry{
+		Time:       time.Now(),
+		Source:     "slack " + userName,
+		RequestID:  requestID,
+		Repository: repository,
+		Branch:     defaultBranch,
+		Sha:        sha,
+		Image:      image + ":" + sha,
+		Verified:   true,
+		Reason:     "slack deploy by " + userName,
+	}
+	audit.ID = AuditID(audit.Time)
+
+	if imagePolicy != nil && !imagePolicy.Allowed(audit.Image) {
+		audit.Outcome = AuditOutcomeRejected
+		audit.Status = 403
+		auditLog.Record(audit)
+		return "", errors.New("image is not allowed")
+	}
+
+	event := DeployEvent{
+		Repository:    repository,
+		Branch:        defaultBranch,
+		DefaultBranch: defaultBranch,
+		Sha:           sha,
+		Image:         audit.Image,
+		Source:        audit.Source,
+		ReceivedAt:    audit.Time,
+		Delivery:      audit.ID,
+		RequestID:     requestID,
+	}
+	redeliveryStore.Add(event)
+	globalLogger.With(LogFields{"requestId": requestID, "repository": repository, "image": audit.Image, "source": audit.Source}).Info(fmt.Sprintf("Slack deploy of %s requested by %s", audit.Image, userName))
+
+	// Queued deploys run on any replica, their results are in the audit log and notifications
+	if sharedQueue != nil {
+		audit.Status = 202
+		if err := sharedQueue.Enqueue(event, audit); err != nil {
+			audit.Outcome = AuditOutcomeError
+			audit.Reason += ": " + err.Error()
+			audit.Status = 503
+			if err == errDeployQueueFull {
+				audit.Status = 429
+			}
+			auditLog.Record(audit)
+			return "", fmt.Errorf("could not queue the deploy: %s", err)
+		}
+		return slackEscape(fmt.Sprintf("%s queued the deploy of %s to %d targets of %s.", userName, audit.Image, len(targets), repository)), nil
+	}
+
+	// The shutdown doesn't wait for the command, only for the deploy
+	if !beginDeploy() {
+		return "", errShuttingDown
+	}
+	go func() {
+		defer deploysInFlight.Done()
+		results, err := deployQueue.Run(context.Background(), event)
+		text := ""
+		if err != nil {
+			audit.Outcome = AuditOutcomeError
+			audit.Reason += ": " + err.Error()
+			audit.Status = 500
+			text = slackEscape(fmt.Sprintf("Deploy of %s failed: %s", audit.Image, err))
+		} else {
+			audit.SetResults(results)
+			audit.Status = 200
+			text = slackEscape(fmt.Sprintf("Deploy of %s %s:", audit.Image, audit.Outcome)) + "\n" + slackResultsText(results)
+		}
+		auditLog.Record(audit)
+
+		if responseURL != "" {
+			if err := postJSON(responseURL, map[string]string{"response_type": "in_channel", "text": text}); err != nil {
+				globalLogger.Warning("Could not respond to the slack command: " + err.Error())
+			}
+		}
+	}()
+
+	return slackEscape(fmt.Sprintf("%s is deploying %s to %d targets of %s...", userName, audit.Image, len(targets), repository)), nil
+}
+
+// Pauses the deploys of all targets of the app, or resumes them if by is empty
+func (a *SlackApp) pause(ctx context.Context, app string, by string) (string, error) {
+	targets, err := slackAppTargets(ctx, app)
+	if err != nil {
+		return "", err
+	}
+
+	var failures []string
+	for _, target := range targets {
+		err := SetPaused(ctx, target.Target, by)
+		if err == errDryRun {
+			return slackEscape(fmt.Sprintf("Dry run, deploys of the %d targets of %s were not changed.", len(targets), targets[0].Repository)), nil
+		}
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", target.Target, err))
+		}
+	}
+	if len(failures) > 0 {
+		return "", errors.New(strings.Join(failures, "\n"))
+	}
+
+	if by == "" {
+		return slackEscape(fmt.Sprintf("Resumed deploys of %d targets of %s.", len(targets), targets[0].Repository)), nil
+	}
+	return slackEscape(fmt.Sprintf("Paused deploys of %d targets of %s. They are skipped until resumed.", len(targets), targets[0].Repository)), nil
+}
+
+// Handles the slash command: status <app>, deploy <app> <sha>, pause <app> and resume <app>.
+// Requests are verified with the signing secret of the app.
+func (a *SlackApp) CommandHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := a.verify(r.Header, body); err != nil {
+		globalLogger.Warning(fmt.Sprintf("Slack command from %s rejected: %s", r.RemoteAddr, err))
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	command := form.Get("command")
+	fields := strings.Fields(form.Get("text"))
+	userID := form.Get("user_id")
+	userName := form.Get("user_name")
+	usage := fmt.Sprintf("Usage: `%[1]s status <app>`, `%[1]s deploy <app> <sha>`, `%[1]s pause <app>` or `%[1]s resume <app>`", command)
+	if len(fields) < 2 {
+		slackReply(w, false, usage)
+		return
+	}
+
+	action, app := fields[0], fields[1]
+	if (action == "deploy" || action == "pause" || action == "resume") && !a.authorized(userID) {
+		globalLogger.Warning(fmt.Sprintf("Slack user %s (%s) is not allowed to %s %s", userName, userID, action, app))
+		slackReply(w, false, "You are not allowed to "+slackEscape(action)+" apps.")
+		return
+	}
+
+	var text string
+	switch {
+	case action == "status" && len(fields) == 2:
+		slackReply(w, false, a.status(r.Context(), app))
+		return
+	case action == "deploy" && len(fields) == 3:
+		if ShuttingDown() {
+			slackReply(w, false, "The server is shutting down, try again in a moment.")
+			return
+		}
+		text, err = a.deploy(r, app, fields[2], userName, form.Get("response_url"))
+	case action == "pause" && len(fields) == 2:
+		globalLogger.Info(fmt.Sprintf("Slack user %s pauses the deploys of %s", userName, app))
+		text, err = a.pause(r.Context(), app, userName+" via slack")
+	case action == "resume" && len(fields) == 2:
+		globalLogger.Info(fmt.Sprintf("Slack user %s resumes the deploys of %s", userName, app))
+		text, err = a.pause(r.Context(), app, "")
+	default:
+		slackReply(w, false, usage)
+		return
+	}
+	if err != nil {
+		slackReply(w, false, slackEscape(err.Error()))
+		return
+	}
+
+	slackReply(w, true, text)
+}
+
+// slackRollback is the value of a rollback button, the workload and its previous image
+type slackRollback struct {
+	Cluster   string `json:"cluster,omitempty"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace"`
+	Name      string `json:"name"`
+	Container int    `json:"container"`
+	Image     string `json:"image"`
+}
+
+// Returns the buttons rolling the updated workloads of the notification back to their previous image
+func slackRollbackButtons(notification Notification) []map[string]interface{} {
+	results := notification.Results
+	if notification.Result != nil {
+		results = []TargetResult{*notification.Result}
+	}
+
+	var buttons []map[string]interface{}
+	for _, result := range results {
+		if result.PreviousImage == "" || result.PreviousImage == result.Image {
+			continue
+		}
+		if len(buttons) == maxSlackRollbackButtons {
+			break
+		}
+
+		target := result.Target
+		value, err := json.Marshal(slackRollback{Cluster: target.Cluster, Kind: target.Kind, Namespace: target.Namespace, Name: target.Name, Container: target.ContainerPosition, Image: result.PreviousImage})
+		if err != nil {
+			continue
+		}
+		label := "Roll back " + target.Name
+		if len(label) > 75 {
+			label = label[:75]
+		}
+		buttons = append(buttons, map[string]interface{}{
+			"type":      "button",
+			"action_id": fmt.Sprintf("%s-%d", slackRollbackAction, len(buttons)),
+			"text":      map[string]string{"type": "plain_text", "text": label},
+			"style":     "danger",
+			"value":     string(value),
+			"confirm": map[string]interface{}{
+				"title":   map[string]string{"type": "plain_text", "text": "Roll back?"},
+				"text":    map[string]string{"type": "mrkdwn", "text": slackEscape(fmt.Sprintf("Roll %s back to `%s`?", target, ImageTag(result.PreviousImage)))},
+				"confirm": map[string]string{"type": "plain_text", "text": "Roll back"},
+				"deny":    map[string]string{"type": "plain_text", "text": "Cancel"},
+			},
+		})
+	}
+
+	return buttons
+}
+
+// Posts a message to the response url of a slash command or interaction
+func slackRespond(responseURL string, inChannel bool, text string) {
+	if responseURL == "" {
+		return
+	}
+	responseType := "ephemeral"
+	if inChannel {
+		responseType = "in_channel"
+	}
+	message := map[string]interface{}{"response_type": responseType, "replace_original": false, "text": text}
+	if err := postJSON(responseURL, message); err != nil {
+		globalLogger.Warning("Could not respond to slack: " + err.Error())
+	}
+}
+
+// Rolls the workload of a clicked rollback button back to its previous image
+func (a *SlackApp) rollback(value string, userID string, userName string, responseURL string) {
+	if !a.authorized(userID) {
+		globalLogger.Warning(fmt.Sprintf("Slack user %s (%s) is not allowed to roll back", userName, userID))
+		slackRespond(responseURL, false, "You are not allowed to roll back workloads.")
+		return
+	}
+	var button slackRollback
+	if err := json.Unmarshal([]byte(value), &button); err != nil {
+		slackRespond(responseURL, false, "Invalid rollback button.")
+		return
+	}
+	if !NamespaceAllowed(button.Namespace) {
+		slackRespond(responseURL, false, "The namespace is not in WATCH_NAMESPACES.")
+		return
+	}
+
+	ctx := context.Background()
+	managed, err := rollbackTarget(ctx, RollbackRequest{Kind: button.Kind, Namespace: button.Namespace, Name: button.Name, Container: &button.Container, Cluster: button.Cluster})
+	if err != nil {
+		slackRespond(responseURL, false, slackEscape(err.Error()))
+		return
+	}
+
+	globalLogger.Info(fmt.Sprintf("Slack user %s rolls %s back to %s", userName, managed.Target, button.Image))
+	// The interaction was answered already, so the shutdown waits for the rollback
+	if !beginDeploy() {
+		slackRespond(responseURL, false, slackEscape(fmt.Sprintf("Could not roll back %s: %s", managed.Target, errShuttingDown)))
+		return
+	}
+	defer deploysInFlight.Done()
+	response, err := Rollback(ctx, managed, ImageTag(button.Image), button.Image, "slack "+userName, randomHex(16), nil, false)
+	if err != nil {
+		slackRespond(responseURL, false, slackEscape(fmt.Sprintf("Could not roll back %s: %s", managed.Target, err)))
+		return
+	}
+	if response.Queued {
+		slackRespond(responseURL, true, slackEscape(fmt.Sprintf("%s queued a rollback of %s to %s.", userName, managed.Target, ImageTag(button.Image))))
+		return
+	}
+
+	slackRespond(responseURL, true, slackEscape(fmt.Sprintf("%s rolled %s back to %s.", userName, managed.Target, ImageTag(button.Image))))
+}
+
+// Handles the interactions of the slack app, the rollback buttons of notifications. Only the users
+// of SLACK_COMMAND_USERS may roll back. Requests are verified with the signing secret of the app.
+func (a *SlackApp) InteractionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBodySize))
+	defer r.Body.Close()
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	if err := a.verify(r.Header, body); err != nil {
+		globalLogger.Warning(fmt.Sprintf("Slack interaction from %s rejected: %s", r.RemoteAddr, err))
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	var payload struct {
+		Type string `json:"type"`
+		User struct {
+			ID       string `json:"id"`
+			Username string `json:"username"`
+		} `json:"user"`
+		Actions []struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+		} `json:"actions"`
+		ResponseURL string `json:"response_url"`
+	}
+	if err := json.Unmarshal([]byte(form.Get("payload")), &payload); err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+
+	// Slack expects a response within 3 seconds, the rollback responds through the response url
+	if payload.Type == "block_actions" {
+		for _, action := range payload.Actions {
+			if strings.HasPrefix(action.ActionID, slackRollbackAction+"-") {
+				go a.rollback(action.Value, payload.User.ID, payload.User.Username, payload.ResponseURL)
+			}
+		}
+	}
+
+	w.WriteHeader(200)
+}
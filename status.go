@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+const (
+	RolloutStateComplete    = "complete"
+	RolloutStateProgressing = "progressing"
+	RolloutStateFailed      = "failed"
+	// The workload doesn't run the requested sha (yet)
+	RolloutStatePending = "pending"
+)
+
+var rolloutStateRanks = map[string]int{
+	RolloutStateComplete:    0,
+	RolloutStateProgressing: 1,
+	RolloutStatePending:     2,
+	RolloutStateFailed:      3,
+}
+
+// TargetStatus is the current state of a target of a repository
+type TargetStatus struct {
+	ManagedTarget
+	Rollout string `json:"rollout"`
+	Error   string `json:"error,omitempty"`
+}
+
+// RepositoryStatus is the latest deploy of a repository and the current state of its targets
+type RepositoryStatus struct {
+	Repository string `json:"repository"`
+	// Overall rollout state of all targets
+	State   string         `json:"state"`
+	Targets []TargetStatus `json:"targets"`
+	// The latest deploy request of the repository, if still in the audit log
+	LastEvent *AuditEntry `json:"lastEvent,omitempty"`
+}
+
+// Returns the latest verified audit entry of the repository
+func lastRepositoryEvent(repository string) *AuditEntry {
+	for _, entry := range auditLog.Entries() {
+		if entry.Verified && strings.EqualFold(entry.Repository, repository) {
+			return &entry
+		}
+	}
+
+	return nil
+}
+
+// Returns the current state of the targets of the repository. With a sha, targets running another
+// sha are pending.
+func CurrentRepositoryStatus(ctx context.Context, repository string, sha string) (RepositoryStatus, error) {
+	status := RepositoryStatus{Repository: repository, State: RolloutStateComplete, Targets: []TargetStatus{}, LastEvent: lastRepositoryEvent(repository)}
+
+	targets, err := ListManagedTargets(ctx)
+	if err != nil {
+		return status, err
+	}
+	for _, target := range targets {
+		if !strings.EqualFold(target.Repository, repository) {
+			continue
+		}
+
+		targetStatus := TargetStatus{ManagedTarget: target, Rollout: RolloutStateProgressing}
+		if complete, err := RolloutStatus(ctx, target.Target); err != nil {
+			targetStatus.Rollout = RolloutStateFailed
+			targetStatus.Error = err.Error()
+		} else if complete {
+			targetStatus.Rollout = RolloutStateComplete
+		}
+		if sha != "" && target.Sha != sha && targetStatus.Rollout != RolloutStateFailed {
+			targetStatus.Rollout = RolloutStatePending
+		}
+		status.Targets = append(status.Targets, targetStatus)
+
+		// The overall state is the worst state of all targets
+		if rolloutStateRanks[targetStatus.Rollout] > rolloutStateRanks[status.State] {
+			status.State = targetStatus.Rollout
+		}
+	}
+
+	return status, nil
+}
+
+// Serves the status of the repository under /status/<owner>/<repository>, optionally for ?sha=.
+// Requires admin credentials or a webhook token issued for the repository, so CI pipelines can poll
+// for the completion of their deploy.
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", 405)
+		return
+	}
+
+	repository := strings.Trim(strings.TrimPrefix(r.URL.Path, "/status/"), "/")
+	if strings.Count(repository, "/") < 1 {
+		http.Error(w, "repository is required as /status/<owner>/<repository>", 400)
+		return
+	}
+
+	token := BearerToken(r)
+	authorized := jwtVerifier != nil && token != "" && jwtVerifier.Verify(token, repository) == nil
+	if !authorized && !AdminAuthorized(r) {
+		globalLogger.Warning(r.Method, " ", r.URL.Path, " from ", r.RemoteAddr, " without valid credentials")
+		http.Error(w, "unauthorized", 401)
+		return
+	}
+
+	status, err := CurrentRepositoryStatus(r.Context(), repository, r.URL.Query().Get("sha"))
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	WriteJSON(w, 200, status)
+}
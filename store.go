@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// Tables are only ever added, so existing databases keep working after upgrades
+var storeMigrations = []string{
+	`CREATE TABLE IF NOT EXISTS deliveries (
+		id TEXT PRIMARY KEY,
+		time BIGINT NOT NULL,
+		repository TEXT NOT NULL,
+		outcome TEXT NOT NULL,
+		entry TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS deliveries_time ON deliveries (time)`,
+	`CREATE TABLE IF NOT EXISTS deploys (
+		cluster TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		namespace TEXT NOT NULL,
+		name TEXT NOT NULL,
+		time BIGINT NOT NULL,
+		entry TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS deploys_target ON deploys (cluster, kind, namespace, name, time)`,
+	`CREATE TABLE IF NOT EXISTS outcomes (
+		repository TEXT NOT NULL,
+		time BIGINT NOT NULL,
+		lead_time BIGINT NOT NULL,
+		failed INTEGER NOT NULL,
+		restore_time BIGINT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS outcomes_time ON outcomes (time)`,
+	`CREATE TABLE IF NOT EXISTS deploy_queue (
+		id TEXT PRIMARY KEY,
+		queue_key TEXT NOT NULL,
+		time BIGINT NOT NULL,
+		job TEXT NOT NULL,
+		claimed_by TEXT,
+		claimed_at BIGINT
+	)`,
+	`CREATE INDEX IF NOT EXISTS deploy_queue_key ON deploy_queue (queue_key, time)`,
+	`CREATE TABLE IF NOT EXISTS pending_deploys (
+		id TEXT PRIMARY KEY,
+		time BIGINT NOT NULL,
+		job TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS nonces (
+		nonce TEXT PRIMARY KEY,
+		expires BIGINT NOT NULL
+	)`,
+}
+
+// Store keeps deliveries, the deploy history of targets and deploy outcomes in SQLite or Postgres,
+// so they survive restarts without being limited by the size of annotations and ConfigMaps.
+type Store struct {
+	// Rows older than the retention are pruned
+	Retention time.Duration
+
+	db       *sql.DB
+	postgres bool
+}
+
+// Opens the database of the url, sqlite://<path> or postgres://..., and creates missing tables
+func OpenStore(url string, retention time.Duration) (*Store, error) {
+	store := &Store{Retention: retention}
+
+	var db *sql.DB
+	var err error
+	switch {
+	case strings.HasPrefix(url, "sqlite://"):
+		path := strings.TrimPrefix(url, "sqlite://")
+		if path == "" {
+			return nil, errors.New("sqlite url requires a path")
+		}
+		if !strings.Contains(path, "?") {
+			path += "?_busy_timeout=5000"
+		}
+		db, err = sql.Open("sqlite3", path)
+		if err == nil {
+			// SQLite allows a single writer anyway
+			db.SetMaxOpenConns(1)
+		}
+	case strings.HasPrefix(url, "postgres://") || strings.HasPrefix(url, "postgresql://"):
+		store.postgres = true
+		db, err = sql.Open("postgres", url)
+	default:
+		return nil, errors.New("url must start with sqlite:// or postgres://")
+	}
+	if err != nil {
+		return nil, err
+	}
+	store.db = db
+
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, migration := range storeMigrations {
+		if _, err := db.Exec(migration); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("could not migrate: %s", err)
+		}
+	}
+
+	return store, nil
+}
+
+// Replaces the ? placeholders with $1, $2... for postgres
+func (s *Store) query(query string) string {
+	if !s.postgres {
+		return query
+	}
+
+	var result strings.Builder
+	n := 0
+	for _, char := range query {
+		if char == '?' {
+			n++
+			result.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		result.WriteRune(char)
+	}
+
+	return result.String()
+}
+
+func (s *Store) exec(query string, args ...interface{}) error {
+	_, err := s.db.Exec(s.query(query), args...)
+	return err
+}
+
+// Saves an audit entry, which makes the store an audit sink
+func (s *Store) Send(record []byte, entry AuditEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(
+		`INSERT INTO deliveries (id, time, repository, outcome, entry) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET outcome = excluded.outcome, entry = excluded.entry`,
+		entry.ID, entry.Time.UnixNano(), strings.ToLower(entry.Repository), entry.Outcome, string(value),
+	)
+}
+
+func (s *Store) String() string {
+	return "database"
+}
+
+func scanDeliveries(rows *sql.Rows) ([]AuditEntry, error) {
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			globalLogger.Warning("Skipping malformed stored delivery: " + err.Error())
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
+
+// Returns the latest audit entries, oldest first
+func (s *Store) Deliveries(limit int) ([]AuditEntry, error) {
+	rows, err := s.db.Query(s.query(`SELECT entry FROM deliveries ORDER BY time DESC LIMIT ?`), limit)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanDeliveries(rows)
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
+// Returns up to limit audit entries older than the cursor matching the query, newest first.
+// The namespace of the query isn't filtered.
+func (s *Store) QueryDeliveries(query AuditQuery, cursor string, limit int) ([]AuditEntry, error) {
+	conditions := []string{"1 = 1"}
+	var args []interface{}
+	if query.Repository != "" {
+		conditions = append(conditions, "repository = ?")
+		args = append(args, strings.ToLower(query.Repository))
+	}
+	if query.Outcome != "" {
+		conditions = append(conditions, "outcome = ?")
+		args = append(args, query.Outcome)
+	}
+	if !query.Since.IsZero() {
+		conditions = append(conditions, "time >= ?")
+		args = append(args, query.Since.UnixNano())
+	}
+	if !query.Until.IsZero() {
+		conditions = append(conditions, "time <= ?")
+		args = append(args, query.Until.UnixNano())
+	}
+	if cursor != "" {
+		conditions = append(conditions, "id < ?")
+		args = append(args, cursor)
+	}
+	args = append(args, limit)
+
+	rows, err := s.db.Query(s.query(`SELECT entry FROM deliveries WHERE `+strings.Join(conditions, " AND ")+` ORDER BY id DESC LIMIT ?`), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return scanDeliveries(rows)
+}
+
+// Saves a deploy of the target
+func (s *Store) RecordDeploy(target Target, entry HistoryEntry) error {
+	value, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return s.exec(
+		`INSERT INTO deploys (cluster, kind, namespace, name, time, entry) VALUES (?, ?, ?, ?, ?, ?)`,
+		target.Cluster, target.Kind, target.Namespace, target.Name, entry.Time.UnixNano(), string(value),
+	)
+}
+
+// Returns the deploy history of the workload, newest first
+func (s *Store) History(cluster string, kind string, namespace string, name string) ([]HistoryEntry, error) {
+	rows, err := s.db.Query(
+		s.query(`SELECT entry FROM deploys WHERE cluster = ? AND kind = ? AND namespace = ? AND name = ? ORDER BY time DESC`),
+		cluster, kind, namespace, name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []HistoryEntry{}
+	for rows.Next() {
+		var value string
+		if err := rows.Scan(&value); err != nil {
+			return nil, err
+		}
+		var entry HistoryEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			globalLogger.Warning("Skipping malformed stored history entry: " + err.Error())
+			continue
+		}
+		history = append(history, entry)
+	}
+
+	return history, rows.Err()
+}
+
+// Saves the outcome of a completed deploy
+func (s *Store) RecordOutcome(record DoraRecord) error {
+	failed := 0
+	if record.Failed {
+		failed = 1
+	}
+
+	return s.exec(
+		`INSERT INTO outcomes (repository, time, lead_time, failed, restore_time) VALUES (?, ?, ?, ?, ?)`,
+		record.Repository, record.Time.UnixNano(), int64(record.LeadTime), failed, int64(record.RestoreTime),
+	)
+}
+
+// Returns the outcomes since the given time, oldest first
+func (s *Store) Outcomes(since time.Time) ([]DoraRecord, error) {
+	rows, err := s.db.Query(
+		s.query(`SELECT repository, time, lead_time, failed, restore_time FROM outcomes WHERE time >= ? ORDER BY time`),
+		since.UnixNano(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var records []DoraRecord
+	for rows.Next() {
+		var record DoraRecord
+		var at, leadTime, restoreTime int64
+		var failed int
+		if err := rows.Scan(&record.Repository, &at, &leadTime, &failed, &restoreTime); err != nil {
+			return nil, err
+		}
+		record.Time = time.Unix(0, at)
+		record.LeadTime = time.Duration(leadTime)
+		record.Failed = failed == 1
+		record.RestoreTime = time.Duration(restoreTime)
+		records = append(records, record)
+	}
+
+	return records, rows.Err()
+}
+
+// Adds a deploy to the shared queue, unless it holds size deploys already
+func (s *Store) EnqueueDeploy(id string, key string, at time.Time, job []byte, size int) error {
+	if !s.postgres {
+		return errors.New("the shared deploy queue requires postgres")
+	}
+
+	// Replicas enqueue one at a time, so concurrent webhooks can't exceed the size together
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext('deploy_queue'))`); err != nil {
+		return err
+	}
+
+	var queued int
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM deploy_queue`).Scan(&queued); err != nil {
+		return err
+	}
+	if queued >= size {
+		return errDeployQueueFull
+	}
+	if _, err := tx.Exec(
+		s.query(`INSERT INTO deploy_queue (id, queue_key, time, job) VALUES (?, ?, ?, ?)`),
+		id, key, at.UnixNano(), string(job),
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Claims the oldest queued deploy whose key has no older deploy, which is unclaimed or whose claim
+// expired before the given time. Returns an empty id if no deploy can be claimed.
+func (s *Store) ClaimDeploy(owner string, expired time.Time) (string, []byte, error) {
+	if !s.postgres {
+		return "", nil, errors.New("the shared deploy queue requires postgres")
+	}
+
+	var id, job string
+	err := s.db.QueryRow(s.query(`UPDATE deploy_queue SET claimed_by = ?, claimed_at = ? WHERE id = (
+		SELECT q.id FROM deploy_queue q
+		WHERE (q.claimed_by IS NULL OR q.claimed_at < ?) AND NOT EXISTS (
+			SELECT 1 FROM deploy_queue p WHERE p.queue_key = q.queue_key AND (p.time < q.time OR (p.time = q.time AND p.id < q.id))
+		)
+		ORDER BY q.time LIMIT 1 FOR UPDATE SKIP LOCKED
+	) RETURNING id, job`), owner, time.Now().UnixNano(), expired.UnixNano()).Scan(&id, &job)
+	if err == sql.ErrNoRows {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	return id, []byte(job), nil
+}
+
+// Removes a deploy from the shared queue once it was deployed
+func (s *Store) CompleteDeploy(id string) error {
+	return s.exec(`DELETE FROM deploy_queue WHERE id = ?`, id)
+}
+
+// Releases the claim of a deploy of the shared queue with its updated job, so it can be claimed
+// again after the given time
+func (s *Store) RetryDeploy(id string, job []byte, claimableAt time.Time, claimTimeout time.Duration) error {
+	// Claims expire after the claim timeout, so the claim is backdated by it
+	return s.exec(
+		`UPDATE deploy_queue SET job = ?, claimed_at = ? WHERE id = ?`,
+		string(job), claimableAt.Add(-claimTimeout).UnixNano(), id,
+	)
+}
+
+// Saves or updates a deploy of the memory queue until it was deployed
+func (s *Store) SavePendingDeploy(id string, at time.Time, job []byte) error {
+	return s.exec(
+		`INSERT INTO pending_deploys (id, time, job) VALUES (?, ?, ?) ON CONFLICT (id) DO UPDATE SET job = excluded.job`,
+		id, at.UnixNano(), string(job),
+	)
+}
+
+// Removes a deploy of the memory queue once it was deployed
+func (s *Store) DeletePendingDeploy(id string) error {
+	return s.exec(`DELETE FROM pending_deploys WHERE id = ?`, id)
+}
+
+// Returns the jobs of the deploys of the memory queue which weren't deployed yet, oldest first
+func (s *Store) PendingDeploys() ([][]byte, error) {
+	rows, err := s.db.Query(`SELECT job FROM pending_deploys ORDER BY time`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var jobs [][]byte
+	for rows.Next() {
+		var job string
+		if err := rows.Scan(&job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, []byte(job))
+	}
+
+	return jobs, rows.Err()
+}
+
+// Saves a nonce of the replay protection until it expires. Returns false if it's already saved and not expired.
+func (s *Store) UseNonce(nonce string, expires time.Time) (bool, error) {
+	now := time.Now().UnixNano()
+	result, err := s.db.Exec(s.query(
+		`INSERT INTO nonces (nonce, expires) VALUES (?, ?) ON CONFLICT (nonce) DO UPDATE SET expires = excluded.expires WHERE nonces.expires < ?`,
+	), nonce, expires.UnixNano(), now)
+	if err != nil {
+		return false, err
+	}
+	saved, err := result.RowsAffected()
+
+	return saved == 1, err
+}
+
+// Deletes the rows older than the retention and expired nonces
+func (s *Store) Prune() error {
+	before := time.Now().Add(-s.Retention).UnixNano()
+	for _, table := range []string{"deliveries", "deploys", "outcomes"} {
+		if err := s.exec(`DELETE FROM `+table+` WHERE time < ?`, before); err != nil {
+			return fmt.Errorf("%s: %s", table, err)
+		}
+	}
+	if err := s.exec(`DELETE FROM nonces WHERE expires < ?`, time.Now().UnixNano()); err != nil {
+		return fmt.Errorf("nonces: %s", err)
+	}
+
+	return nil
+}
+
+// Prunes old rows in the given interval
+func (s *Store) PruneEvery(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.Prune(); err != nil {
+				globalLogger.Error("Could not prune the database: " + err.Error())
+			}
+		}
+	}()
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulSet"
+)
+
+type Target struct {
+	Kind              string `json:"kind"`
+	Name              string `json:"name"`
+	Namespace         string `json:"namespace"`
+	ContainerPosition int    `json:"container"`
+	Environment       string `json:"environment,omitempty"`
+	// Comma separated email recipients of notifications about this target
+	Email string `json:"email,omitempty"`
+	// Slack channel of notifications about this target, instead of SLACK_CHANNEL
+	SlackChannel string `json:"slackChannel,omitempty"`
+	// Configured cluster of the workload, empty for the local cluster
+	Cluster string `json:"cluster,omitempty"`
+	// Who paused deploys of the workload, which are skipped while set
+	Paused string `json:"paused,omitempty"`
+}
+
+func (t Target) String() string {
+	description := fmt.Sprintf("%s %s in namespace %s", t.Kind, t.Name, t.Namespace)
+	if t.Cluster != "" {
+		description += " of cluster " + t.Cluster
+	}
+	if t.Environment != "" {
+		description += " (" + t.Environment + ")"
+	}
+
+	return description
+}
+
+const DefaultLabelPrefix = "ki-cd/"
+
+// Field manager of the fields ki-cd writes to workloads
+const fieldManager = "ki-cd"
+
+// Returns the label key used to mark workloads for the given repository
+func LabelKey(repository string) string {
+	return labelPrefix + strings.Replace(strings.ToLower(repository), "/", "_", -1)
+}
+
+// Returns the label key used to set the environment of labeled workloads
+func EnvironmentLabelKey() string {
+	return labelPrefix + "environment"
+}
+
+// Finds all workloads which should be updated for a push to the given repository and branch.
+// Workloads are either marked with the ki-cd label in any cluster or matched by a configured selector in its clusters.
+// Also returns the problems of workloads which were skipped because their label is malformed.
+func FindTargets(ctx context.Context, repository string, branch string, isDefaultBranch bool) ([]Target, []string, error) {
+	var targets []Target
+
+	var problems []string
+	for _, cluster := range AllClusters() {
+		labelTargets, labelProblems, err := findLabelTargets(ctx, cluster, repository, branch, isDefaultBranch)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets = append(targets, labelTargets...)
+		problems = append(problems, labelProblems...)
+	}
+
+	for _, targetConfig := range globalConfig.TargetsFor(repository, branch, isDefaultBranch) {
+		for _, clusterName := range targetConfig.TargetClusters() {
+			cluster, err := ClusterFor(clusterName)
+			if err != nil {
+				return nil, nil, err
+			}
+			selectorTargets, err := findSelectorTargets(ctx, cluster, targetConfig)
+			if err != nil {
+				return nil, nil, err
+			}
+			targets = append(targets, selectorTargets...)
+		}
+	}
+
+	return uniqueTargets(targets), problems, nil
+}
+
+// Removes targets which were matched more than once, e.g. by label and by selector
+func uniqueTargets(targets []Target) []Target {
+	seen := make(map[Target]bool)
+	var unique []Target
+	for _, target := range targets {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		unique = append(unique, target)
+	}
+
+	return unique
+}
+
+func findLabelTargets(ctx context.Context, cluster *Cluster, repository string, branch string, isDefaultBranch bool) ([]Target, []string, error) {
+	labelKey := LabelKey(repository)
+
+	deployments, err := ListDeployments(ctx, cluster, "", metav1.ListOptions{LabelSelector: labelKey})
+	if err != nil {
+		globalLogger.Error("Could not get deployments")
+		return nil, nil, err
+	}
+	globalLogger.Info(fmt.Sprintf("Got %d deployments with the correct cd label", len(deployments)))
+
+	statefulSets, err := ListStatefulSets(ctx, cluster, "", metav1.ListOptions{LabelSelector: labelKey})
+	if err != nil {
+		globalLogger.Error("Could not get stateful sets")
+		return nil, nil, err
+	}
+	globalLogger.Info(fmt.Sprintf("Got %d stateful sets with the correct cd label", len(statefulSets)))
+
+	var targets []Target
+	var problems []string
+	for _, deployment := range deployments {
+		target, ok, err := parseLabelTarget(KindDeployment, deployment.ObjectMeta, labelKey, branch, isDefaultBranch)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if ok {
+			target.Cluster = cluster.Name
+			targets = append(targets, target)
+		}
+	}
+	for _, statefulSet := range statefulSets {
+		target, ok, err := parseLabelTarget(KindStatefulSet, statefulSet.ObjectMeta, labelKey, branch, isDefaultBranch)
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if ok {
+			target.Cluster = cluster.Name
+			targets = append(targets, target)
+		}
+	}
+
+	return targets, problems, nil
+}
+
+// Parses a label value. Currently <branchName>.<containerPosition>, or only <containerPosition>
+// to follow the default branch of the repository, in which case the returned branch is empty.
+func ParseLabelValue(labelValue string) (string, int, error) {
+	labelValues := strings.Split(labelValue, ".")
+	if len(labelValues) != 1 && len(labelValues) != 2 {
+		return "", 0, errors.New("one or two dot separated values are required")
+	}
+	containerPosition, err := strconv.Atoi(labelValues[len(labelValues)-1])
+	if err != nil || containerPosition < 0 {
+		return "", 0, errors.New("container position is required to be a non-negative integer")
+	}
+	if len(labelValues) == 1 {
+		return "", containerPosition, nil
+	}
+
+	return labelValues[0], containerPosition, nil
+}
+
+// Converts the label value of a workload to a Target if it matches the pushed branch.
+// Returns an error if the label is malformed.
+func parseLabelTarget(kind string, meta metav1.ObjectMeta, labelKey string, branch string, isDefaultBranch bool) (Target, bool, error) {
+	labelBranchName, labelContainerPosition, err := ParseLabelValue(meta.Labels[labelKey])
+	if err != nil {
+		globalLogger.Warning("Label value for " + kind + " " + meta.Name + " in namespace " + meta.Namespace + " is malformed: " + err.Error() + ". Skipping the " + kind + "...")
+		return Target{}, false, fmt.Errorf("label value of %s %s in namespace %s is malformed: %s", kind, meta.Name, meta.Namespace, err)
+	}
+
+	if labelBranchName == "" && !isDefaultBranch {
+		globalLogger.Info(fmt.Sprintf("Skipping %s %s in namespace %s. Not the default branch.", kind, meta.Name, meta.Namespace))
+		return Target{}, false, nil
+	}
+	if labelBranchName != "" && labelBranchName != branch {
+		globalLogger.Info(fmt.Sprintf("Skipping %s %s in namespace %s. Branch mismatch.", kind, meta.Name, meta.Namespace))
+		return Target{}, false, nil
+	}
+
+	return Target{
+		Kind:              kind,
+		Name:              meta.Name,
+		Namespace:         meta.Namespace,
+		ContainerPosition: labelContainerPosition,
+		Environment:       meta.Labels[EnvironmentLabelKey()],
+		Email:             meta.Annotations[EmailAnnotationKey()],
+		SlackChannel:      meta.Annotations[SlackChannelAnnotationKey()],
+		Paused:            meta.Annotations[PausedAnnotationKey()],
+	}, true, nil
+}
+
+func findSelectorTargets(ctx context.Context, cluster *Cluster, targetConfig TargetConfig) ([]Target, error) {
+	listOptions := metav1.ListOptions{LabelSelector: targetConfig.Selector}
+
+	deployments, err := ListDeployments(ctx, cluster, targetConfig.Namespace, listOptions)
+	if err != nil {
+		globalLogger.Error("Could not get deployments for selector " + targetConfig.Selector)
+		return nil, err
+	}
+	statefulSets, err := ListStatefulSets(ctx, cluster, targetConfig.Namespace, listOptions)
+	if err != nil {
+		globalLogger.Error("Could not get stateful sets for selector " + targetConfig.Selector)
+		return nil, err
+	}
+	globalLogger.Info(fmt.Sprintf("Got %d deployments and %d stateful sets for selector %s", len(deployments), len(statefulSets), targetConfig.Selector))
+
+	var targets []Target
+	for _, deployment := range deployments {
+		targets = append(targets, targetConfig.Target(cluster.Name, KindDeployment, deployment.ObjectMeta))
+	}
+	for _, statefulSet := range statefulSets {
+		targets = append(targets, targetConfig.Target(cluster.Name, KindStatefulSet, statefulSet.ObjectMeta))
+	}
+
+	return targets, nil
+}
+
+// Returns a json patch setting the image of the targets container in the given pod template and the
+// annotations of the workload and the pod template, and the previous image. The patch tests the
+// name of the container, so it fails instead of updating another container if the containers
+// changed since the pod template was read.
+func containerImagePatch(target Target, meta metav1.ObjectMeta, template corev1.PodTemplateSpec, image string, annotations map[string]string) (string, []byte, error) {
+	if len(template.Spec.Containers) <= target.ContainerPosition {
+		globalLogger.Warning(fmt.Sprintf("Target contains an invalid container position %d for %s", target.ContainerPosition, target))
+
+		return "", nil, errors.New("target contains invalid container position")
+	}
+
+	container := template.Spec.Containers[target.ContainerPosition]
+	path := fmt.Sprintf("/spec/template/spec/containers/%d", target.ContainerPosition)
+	operations := []map[string]interface{}{
+		{"op": "test", "path": path + "/name", "value": container.Name},
+		{"op": "replace", "path": path + "/image", "value": image},
+	}
+	operations = append(operations, annotationOperations("/metadata", meta.Annotations, annotations)...)
+	operations = append(operations, annotationOperations("/spec/template/metadata", template.Annotations, annotations)...)
+	patch, err := json.Marshal(operations)
+
+	return container.Image, patch, err
+}
+
+// Returns a server-side apply configuration of only the image of the targets container, which is
+// identified by its name, and the annotations of the workload and its pod template
+func containerImageApply(target Target, container string, image string, annotations map[string]string) ([]byte, error) {
+	kind := "Deployment"
+	if target.Kind == KindStatefulSet {
+		kind = "StatefulSet"
+	}
+
+	metadata := map[string]interface{}{"name": target.Name, "namespace": target.Namespace}
+	template := map[string]interface{}{
+		"spec": map[string]interface{}{
+			"containers": []map[string]string{{"name": container, "image": image}},
+		},
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+		template["metadata"] = map[string]interface{}{"annotations": annotations}
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"apiVersion": "apps/v1",
+		"kind":       kind,
+		"metadata":   metadata,
+		"spec":       map[string]interface{}{"template": template},
+	})
+}
+
+// Applies the patch to the workload of the target as the ki-cd field manager
+func patchWorkload(ctx context.Context, cluster *Cluster, target Target, patchType types.PatchType, patch []byte) error {
+	options := metav1.PatchOptions{FieldManager: fieldManager}
+	var err error
+	switch target.Kind {
+	case KindDeployment:
+		_, err = cluster.Kube.AppsV1().Deployments(target.Namespace).Patch(ctx, target.Name, patchType, patch, options)
+	case KindStatefulSet:
+		_, err = cluster.Kube.AppsV1().StatefulSets(target.Namespace).Patch(ctx, target.Name, patchType, patch, options)
+	default:
+		err = fmt.Errorf("unknown target kind %s", target.Kind)
+	}
+
+	return err
+}
+
+// Returns a merge patch setting the annotations of a workload, removing those with a nil value.
+// With a resource version the patch conflicts if the workload changed since it was read.
+func annotationsPatch(annotations map[string]interface{}, resourceVersion string) ([]byte, error) {
+	metadata := map[string]interface{}{"annotations": annotations}
+	if resourceVersion != "" {
+		metadata["resourceVersion"] = resourceVersion
+	}
+
+	return json.Marshal(map[string]interface{}{"metadata": metadata})
+}
+
+// Reads the metadata and pod template of the workload of the target
+func getWorkload(ctx context.Context, cluster *Cluster, target Target) (metav1.ObjectMeta, corev1.PodTemplateSpec, error) {
+	switch target.Kind {
+	case KindDeployment:
+		result, err := cluster.Kube.AppsV1().Deployments(target.Namespace).Get(ctx, target.Name, metav1.GetOptions{})
+		if err != nil {
+			return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, err
+		}
+		return result.ObjectMeta, result.Spec.Template, nil
+	case KindStatefulSet:
+		result, err := cluster.Kube.AppsV1().StatefulSets(target.Namespace).Get(ctx, target.Name, metav1.GetOptions{})
+		if err != nil {
+			return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, err
+		}
+		return result.ObjectMeta, result.Spec.Template, nil
+	}
+
+	return metav1.ObjectMeta{}, corev1.PodTemplateSpec{}, fmt.Errorf("unknown target kind %s", target.Kind)
+}
+
+// Sets the image of the container with server-side apply without forcing, so it fails if another
+// field manager like a GitOps tool owns the image instead of overwriting it
+func applyContainerImage(ctx context.Context, cluster *Cluster, target Target, container string, image string, annotations map[string]string) error {
+	patch, err := containerImageApply(target, container, image, annotations)
+	if err != nil {
+		return err
+	}
+	err = patchWorkload(ctx, cluster, target, types.ApplyPatchType, patch)
+	if apierrors.IsConflict(err) {
+		return fmt.Errorf("the image of %s is managed by another field manager: %s", target, err)
+	}
+
+	return err
+}
+
+// Updates the container image of the given target with a json patch of only the image, so changes
+// of other controllers to the workload are neither conflicts nor overwritten. Retries if the
+// containers changed between reading and patching. Returns the previous image, which equals the
+// image if the container already runs it and nothing was updated. Workloads of helm releases with a
+// chart annotation are updated by upgrading their release instead. With git write-back the image is
+// also committed to the manifest of the target, or only committed in GIT_WRITE_BACK=only mode.
+// The annotations, e.g. the commit metadata of the deploy, are set on the workload and its pod
+// template in the same patch as the image.
+func UpdateTarget(ctx context.Context, target Target, image string, annotations map[string]string) (string, error) {
+	var previousImage, gitPath string
+	var helmRelease *HelmRelease
+	if !NamespaceAllowed(target.Namespace) {
+		return "", fmt.Errorf("namespace %s is not in WATCH_NAMESPACES", target.Namespace)
+	}
+	cluster, err := ClusterFor(target.Cluster)
+	if err != nil {
+		return "", err
+	}
+
+	// A failed test of the patch is invalid
+	err = retry.OnError(kubeRetry, apierrors.IsInvalid, func() error {
+		ctx, cancel := apiContext(ctx)
+		defer cancel()
+
+		meta, template, err := getWorkload(ctx, cluster, target)
+		if err != nil {
+			return err
+		}
+		gitPath = meta.Annotations[GitPathAnnotationKey()]
+		if pullSecretValidation {
+			if err := validatePullSecrets(ctx, cluster, target, template.Spec, image); err != nil {
+				return err
+			}
+		}
+		// The GitOps tool updates the workload from the commit, helm from the upgraded release
+		if helmRelease = HelmReleaseOf(meta); helmRelease != nil || (gitWriteBack != nil && gitWriteBack.Only) {
+			previousImage, _, err = containerImagePatch(target, meta, template, image, nil)
+			return err
+		}
+		if owner, ownerConfig := ControllerOwner(meta.OwnerReferences); ownerConfig != nil {
+			previousImage, err = PatchOwner(ctx, cluster, target, *owner, *ownerConfig, image, annotations)
+			return err
+		} else if owner != nil {
+			globalLogger.Warning(fmt.Sprintf("%s is controlled by %s %s which may revert the update", target, owner.Kind, owner.Name))
+		}
+		var patch []byte
+		if previousImage, patch, err = containerImagePatch(target, meta, template, image, annotations); err != nil {
+			return err
+		}
+		// Webhook retries and replays don't restart the workload
+		if previousImage == image {
+			return nil
+		}
+		if dryRun {
+			globalLogger.Info(fmt.Sprintf("Dry run, not updating %s from %s to %s", target, previousImage, image))
+			return nil
+		}
+		if serverSideApply {
+			return applyContainerImage(ctx, cluster, target, template.Spec.Containers[target.ContainerPosition].Name, image, annotations)
+		}
+
+		return patchWorkload(ctx, cluster, target, types.JSONPatchType, patch)
+	})
+	if err != nil || previousImage == image {
+		return previousImage, err
+	}
+
+	if helmRelease != nil {
+		if target.Cluster != "" {
+			return previousImage, errors.New("helm releases can only be upgraded in the local cluster")
+		}
+		if dryRun {
+			globalLogger.Info(fmt.Sprintf("Dry run, not upgrading the helm release %s of %s to %s", helmRelease.Name, target, image))
+		} else if err := helmRelease.Upgrade(ctx, image, previousImage); err != nil {
+			return previousImage, fmt.Errorf("could not upgrade the helm release %s: %s", helmRelease.Name, err)
+		}
+	}
+
+	if gitWriteBack != nil {
+		if dryRun {
+			globalLogger.Info(fmt.Sprintf("Dry run, not committing %s of %s", image, target))
+		} else if err := gitWriteBack.Commit(ctx, target, gitPath, image); err != nil {
+			return previousImage, fmt.Errorf("could not commit the image to git: %s", err)
+		}
+	}
+
+	return previousImage, nil
+}
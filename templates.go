@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/tools/cache"
+)
+
+// Key of the template used for notification types without their own template
+const DefaultTemplateKey = "default"
+
+var notificationTemplateFuncs = template.FuncMap{
+	"json":      webhookTemplateFuncs["json"],
+	"imageTag":  ImageTag,
+	"commitURL": CommitURL,
+	"shortSha": func(sha string) string {
+		if len(sha) > 7 {
+			return sha[:7]
+		}
+		return sha
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+}
+
+// NotificationTemplates overrides the text of notifications with go templates read from a ConfigMap.
+// The keys of the ConfigMap are notification types (or default), the templates receive the notification.
+type NotificationTemplates struct {
+	Namespace string
+	Name      string
+
+	mutex     sync.RWMutex
+	templates map[string]*template.Template
+	informer  cache.Controller
+}
+
+// Parses the templates of the ConfigMap data
+func ParseNotificationTemplates(data map[string]string) (map[string]*template.Template, error) {
+	templates := make(map[string]*template.Template)
+	for key, text := range data {
+		switch key {
+		case DefaultTemplateKey, NotificationStarted, NotificationSucceeded, NotificationFailed, NotificationRejected, NotificationRolloutSucceeded, NotificationRolloutFailed, NotificationSkipped, NotificationDeployed, NotificationRolledBack, NotificationCompleted, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered:
+		default:
+			return nil, fmt.Errorf("unknown notification type %s", key)
+		}
+		parsed, err := template.New(key).Funcs(notificationTemplateFuncs).Option("missingkey=error").Parse(text)
+		if err != nil {
+			return nil, fmt.Errorf("template %s: %s", key, err)
+		}
+		templates[key] = parsed
+	}
+
+	return templates, nil
+}
+
+// Replaces the templates with the ones of the ConfigMap. Invalid templates keep the previous ones.
+func (t *NotificationTemplates) load(configMap *corev1.ConfigMap) {
+	templates, err := ParseNotificationTemplates(configMap.Data)
+	if err != nil {
+		globalLogger.Error(fmt.Sprintf("Invalid notification templates in ConfigMap %s/%s, keeping the previous templates: %s", t.Namespace, t.Name, err))
+		return
+	}
+
+	t.mutex.Lock()
+	t.templates = templates
+	t.mutex.Unlock()
+	globalLogger.Info(fmt.Sprintf("Loaded %d notification templates from ConfigMap %s/%s", len(templates), t.Namespace, t.Name))
+}
+
+// Starts watching the ConfigMap and waits until it was loaded initially
+func (t *NotificationTemplates) Watch(resync time.Duration) error {
+	listWatch := cache.NewListWatchFromClient(kubeSet.CoreV1().RESTClient(), "configmaps", t.Namespace, fields.OneTermEqualSelector("metadata.name", t.Name))
+	_, t.informer = cache.NewInformer(listWatch, &corev1.ConfigMap{}, resync, cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			t.load(obj.(*corev1.ConfigMap))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			if oldObj.(*corev1.ConfigMap).ResourceVersion != newObj.(*corev1.ConfigMap).ResourceVersion {
+				t.load(newObj.(*corev1.ConfigMap))
+			}
+		},
+		DeleteFunc: func(obj interface{}) {
+			globalLogger.Warning(fmt.Sprintf("Notification template ConfigMap %s/%s was deleted, using the default texts", t.Namespace, t.Name))
+			t.mutex.Lock()
+			t.templates = nil
+			t.mutex.Unlock()
+		},
+	})
+
+	go t.informer.Run(make(chan struct{}))
+	if !cache.WaitForCacheSync(make(chan struct{}), t.informer.HasSynced) {
+		return errors.New("could not sync the notification template ConfigMap")
+	}
+
+	return nil
+}
+
+// Returns the text of the notification rendered with its template, or its default text without a template
+func (t *NotificationTemplates) Render(notification Notification) string {
+	if t == nil {
+		return notification.Text
+	}
+
+	t.mutex.RLock()
+	parsed, ok := t.templates[notification.Type]
+	if !ok {
+		parsed, ok = t.templates[DefaultTemplateKey]
+	}
+	t.mutex.RUnlock()
+	if !ok {
+		return notification.Text
+	}
+
+	var text bytes.Buffer
+	if err := parsed.Execute(&text, notification); err != nil {
+		globalLogger.Warning(fmt.Sprintf("Could not render the %s notification template, using the default text: %s", notification.Type, err))
+		return notification.Text
+	}
+
+	return strings.TrimSpace(text.String())
+}
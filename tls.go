@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Creates the tls config of the webhook listener. If a client CA bundle is given,
+// all clients are required to present a certificate signed by one of its CAs.
+func NewTLSConfig(clientCAPath string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAPath == "" {
+		return config, nil
+	}
+
+	bundle, err := ioutil.ReadFile(clientCAPath)
+	if err != nil {
+		return nil, err
+	}
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(bundle) {
+		return nil, errors.New("no certificates found in client CA bundle " + clientCAPath)
+	}
+	config.ClientCAs = clientCAs
+	config.ClientAuth = tls.RequireAndVerifyClientCert
+
+	return config, nil
+}
+
+// CertificateReloader serves the current certificate of a listener and reloads it when it was rotated.
+// The certificate is either read from files or from a kubernetes tls secret.
+type CertificateReloader struct {
+	CertPath        string
+	KeyPath         string
+	SecretNamespace string
+	SecretName      string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	loaded      []byte
+}
+
+func (c *CertificateReloader) read() ([]byte, []byte, error) {
+	if c.SecretName != "" {
+		ctx, cancel := apiContext(context.Background())
+		defer cancel()
+		secret, err := kubeSet.CoreV1().Secrets(c.SecretNamespace).Get(ctx, c.SecretName, metav1.GetOptions{})
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return secret.Data[corev1.TLSCertKey], secret.Data[corev1.TLSPrivateKeyKey], nil
+	}
+
+	certPEM, err := ioutil.ReadFile(c.CertPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := ioutil.ReadFile(c.KeyPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return certPEM, keyPEM, nil
+}
+
+// Reads the certificate and replaces the served one if it changed
+func (c *CertificateReloader) Reload() error {
+	certPEM, keyPEM, err := c.read()
+	if err != nil {
+		return err
+	}
+	loaded := append(append([]byte{}, certPEM...), keyPEM...)
+
+	c.mutex.RLock()
+	unchanged := bytes.Equal(loaded, c.loaded)
+	c.mutex.RUnlock()
+	if unchanged {
+		return nil
+	}
+
+	certificate, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.certificate = &certificate
+	c.loaded = loaded
+	c.mutex.Unlock()
+
+	if leaf, err := x509.ParseCertificate(certificate.Certificate[0]); err == nil {
+		globalLogger.Info(fmt.Sprintf("Loaded tls certificate for %s valid until %s", leaf.Subject.CommonName, leaf.NotAfter))
+	}
+
+	return nil
+}
+
+// Loads the certificate initially and checks for a rotated one in the given interval
+func (c *CertificateReloader) Watch(interval time.Duration) error {
+	if err := c.Reload(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := c.Reload(); err != nil {
+				globalLogger.Error("Could not reload the tls certificate: " + err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+// Returns the current certificate, to be used as tls.Config.GetCertificate
+func (c *CertificateReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return c.certificate, nil
+}
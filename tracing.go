@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Span kinds of the OTLP protocol
+const (
+	SpanKindInternal = 1
+	SpanKindServer   = 2
+	SpanKindClient   = 3
+)
+
+var traceparentRegexp = regexp.MustCompile(`^00-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}$`)
+
+type spanContextKey struct{}
+
+// Span is a single traced operation, exported as OpenTelemetry span
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	Kind         int
+	Start        time.Time
+	End          time.Time
+	Attributes   map[string]string
+	Error        string
+
+	tracer *Tracer
+}
+
+// Tracer exports spans in batches to an OTLP/HTTP endpoint using the json encoding
+type Tracer struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+
+	mutex  sync.Mutex
+	spans  []*Span
+	client http.Client
+}
+
+func randomHex(length int) string {
+	buffer := make([]byte, length)
+	rand.Read(buffer)
+
+	return hex.EncodeToString(buffer)
+}
+
+// Returns a context continuing the trace of an incoming W3C traceparent header, if valid
+func ContextWithTraceparent(ctx context.Context, traceparent string) context.Context {
+	matches := traceparentRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(traceparent)))
+	if matches == nil || strings.Trim(matches[1], "0") == "" || strings.Trim(matches[2], "0") == "" {
+		return ctx
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, &Span{TraceID: matches[1], SpanID: matches[2]})
+}
+
+// Starts a span as child of the span in the context. Without tracer, the returned span is nil and all its methods are no-ops.
+func (t *Tracer) StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{SpanID: randomHex(8), Name: name, Kind: kind, Start: time.Now(), Attributes: make(map[string]string), tracer: t}
+	if parent, ok := ctx.Value(spanContextKey{}).(*Span); ok && parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = randomHex(16)
+	}
+
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+// Sets an attribute of the span
+func (s *Span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.Attributes[key] = fmt.Sprint(value)
+}
+
+// Marks the span as failed
+func (s *Span) SetError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.Error = err.Error()
+}
+
+// Ends the span and queues it for export
+func (s *Span) Finish() {
+	if s == nil {
+		return
+	}
+	s.End = time.Now()
+
+	s.tracer.mutex.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mutex.Unlock()
+}
+
+// Exports the queued spans in the given interval
+func (t *Tracer) Run(interval time.Duration) {
+	t.client = http.Client{Timeout: 10 * time.Second}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := t.Flush(); err != nil {
+				globalLogger.Warning("Could not export spans: " + err.Error())
+			}
+		}
+	}()
+}
+
+type otlpAttribute struct {
+	Key   string `json:"key"`
+	Value struct {
+		StringValue string `json:"stringValue"`
+	} `json:"value"`
+}
+
+func otlpAttributes(attributes map[string]string) []otlpAttribute {
+	var result []otlpAttribute
+	for key, value := range attributes {
+		attribute := otlpAttribute{Key: key}
+		attribute.Value.StringValue = value
+		result = append(result, attribute)
+	}
+
+	return result
+}
+
+// Exports all queued spans
+func (t *Tracer) Flush() error {
+	t.mutex.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mutex.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	type otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	type otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            otlpStatus      `json:"status"`
+	}
+
+	var exported []otlpSpan
+	for _, span := range spans {
+		status := otlpStatus{Code: 1}
+		if span.Error != "" {
+			status = otlpStatus{Code: 2, Message: span.Error}
+		}
+		exported = append(exported, otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            status,
+		})
+	}
+
+	payload := map[string]interface{}{
+		"resourceSpans": []interface{}{
+			map[string]interface{}{
+				"resource": map[string]interface{}{
+					"attributes": otlpAttributes(map[string]string{"service.name": t.ServiceName}),
+				},
+				"scopeSpans": []interface{}{
+					map[string]interface{}{
+						"scope": map[string]string{"name": "kubernetes-internal-cd"},
+						"spans": exported,
+					},
+				},
+			},
+		},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest("POST", t.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	for key, value := range t.Headers {
+		request.Header.Set(key, value)
+	}
+	response, err := t.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d exporting %d spans to %s", response.StatusCode, len(spans), t.Endpoint)
+	}
+
+	return nil
+}
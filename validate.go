@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type validationWorkload struct {
+	Cluster string
+	Kind    string
+	Meta    metav1.ObjectMeta
+	PodSpec corev1.PodSpec
+	// Whether the rollout of the workload completed when it was listed, or why it failed
+	Complete     bool
+	RolloutError error
+}
+
+type validationMapping struct {
+	Source    string
+	Workload  validationWorkload
+	Container int
+}
+
+// Lists all labeled and configured targets of the cluster and reports malformed label values,
+// out-of-range container positions and duplicate mappings. Returns the number of problems found.
+func Validate() (int, error) {
+	problems := 0
+	report := func(format string, args ...interface{}) {
+		problems++
+		fmt.Printf("ERROR "+format+"\n", args...)
+	}
+
+	ctx := context.Background()
+	var workloads []validationWorkload
+	for _, cluster := range AllClusters() {
+		clusterWorkloads, err := listValidationWorkloads(ctx, cluster, "", metav1.ListOptions{})
+		if err != nil {
+			return 0, err
+		}
+		workloads = append(workloads, clusterWorkloads...)
+	}
+
+	var mappings []validationMapping
+
+	// Labeled workloads
+	for _, workload := range workloads {
+		for key, value := range workload.Meta.Labels {
+			if !strings.HasPrefix(key, labelPrefix) || key == EnvironmentLabelKey() {
+				continue
+			}
+
+			branch, containerPosition, err := ParseLabelValue(value)
+			if err != nil {
+				report("%s %s in namespace %s: label %s=%s is malformed: %s", workload.Kind, workload.Meta.Name, workload.Meta.Namespace, key, value, err)
+				continue
+			}
+			if branch == "" {
+				branch = "<default branch>"
+			}
+
+			mappings = append(mappings, validationMapping{
+				Source:    fmt.Sprintf("label %s (branch %s)", key, branch),
+				Workload:  workload,
+				Container: containerPosition,
+			})
+		}
+	}
+
+	// Configured targets
+	var targetConfigs []TargetConfig
+	if globalConfig != nil {
+		targetConfigs = globalConfig.Targets
+	}
+	for i, targetConfig := range targetConfigs {
+		branch := targetConfig.Branch
+		if targetConfig.DefaultBranch {
+			branch = "<default branch>"
+		}
+
+		var selected []validationWorkload
+		for _, clusterName := range targetConfig.TargetClusters() {
+			cluster, err := ClusterFor(clusterName)
+			if err != nil {
+				return problems, err
+			}
+			clusterSelected, err := listValidationWorkloads(ctx, cluster, targetConfig.Namespace, metav1.ListOptions{LabelSelector: targetConfig.Selector})
+			if err != nil {
+				return problems, err
+			}
+			selected = append(selected, clusterSelected...)
+		}
+		if len(selected) == 0 {
+			report("config target %d (%s, branch %s): selector %s matches no workloads", i, targetConfig.Repository, branch, targetConfig.Selector)
+		}
+
+		for _, workload := range selected {
+			mappings = append(mappings, validationMapping{
+				Source:    fmt.Sprintf("config target %d (%s, branch %s)", i, targetConfig.Repository, branch),
+				Workload:  workload,
+				Container: targetConfig.Container,
+			})
+		}
+	}
+
+	seen := make(map[string]validationMapping)
+	for _, mapping := range mappings {
+		workload := mapping.Workload
+		containers := workload.PodSpec.Containers
+		if mapping.Container >= len(containers) {
+			report("%s %s in namespace %s: %s references container %d but only %d containers exist", workload.Kind, workload.Meta.Name, workload.Meta.Namespace, mapping.Source, mapping.Container, len(containers))
+			continue
+		}
+
+		key := fmt.Sprintf("%s/%s/%s/%s/%d", workload.Cluster, workload.Kind, workload.Meta.Namespace, workload.Meta.Name, mapping.Container)
+		if previous, ok := seen[key]; ok {
+			report("%s %s in namespace %s: container %d is mapped by both %s and %s", workload.Kind, workload.Meta.Name, workload.Meta.Namespace, mapping.Container, previous.Source, mapping.Source)
+			continue
+		}
+		seen[key] = mapping
+
+		fmt.Printf("OK    %s %s in namespace %s: %s, container %s (%s)\n", workload.Kind, workload.Meta.Name, workload.Meta.Namespace, mapping.Source, containers[mapping.Container].Name, containers[mapping.Container].Image)
+	}
+
+	return problems, nil
+}
+
+func listValidationWorkloads(ctx context.Context, cluster *Cluster, namespace string, listOptions metav1.ListOptions) ([]validationWorkload, error) {
+	deployments, err := ListDeployments(ctx, cluster, namespace, listOptions)
+	if err != nil {
+		return nil, err
+	}
+	statefulSets, err := ListStatefulSets(ctx, cluster, namespace, listOptions)
+	if err != nil {
+		return nil, err
+	}
+
+	var workloads []validationWorkload
+	for i, deployment := range deployments {
+		complete, err := deploymentRolloutStatus(&deployments[i])
+		workloads = append(workloads, validationWorkload{Cluster: cluster.Name, Kind: KindDeployment, Meta: deployment.ObjectMeta, PodSpec: deployment.Spec.Template.Spec, Complete: complete, RolloutError: err})
+	}
+	for i, statefulSet := range statefulSets {
+		workloads = append(workloads, validationWorkload{Cluster: cluster.Name, Kind: KindStatefulSet, Meta: statefulSet.ObjectMeta, PodSpec: statefulSet.Spec.Template.Spec, Complete: statefulSetRolloutStatus(&statefulSets[i])})
+	}
+
+	return workloads, nil
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const serviceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// VaultKeySource reads the signing keys from a Vault KV secret and transit keys and re-reads them periodically
+type VaultKeySource struct {
+	Address string
+	// token, approle or kubernetes
+	Auth      string
+	AuthMount string
+	Token     string
+	Role      string
+	RoleID    string
+	SecretID  string
+	KVMount   string
+	KVPath    string
+	KVVersion int
+	// Names of exportable HMAC keys of the transit secrets engine, used as signing keys of the same name
+	TransitMount string
+	TransitKeys  []string
+
+	client http.Client
+	mutex  sync.RWMutex
+	keys   map[string][]byte
+
+	// Token of the last login and when it expires, zero if it doesn't. Only used by
+	// Refresh, which never runs concurrently.
+	loginToken   string
+	loginExpires time.Time
+	loginTTL     time.Duration
+	renewable    bool
+}
+
+// vaultAuth is the auth block of login and renew responses
+type vaultAuth struct {
+	ClientToken   string `json:"client_token"`
+	LeaseDuration int64  `json:"lease_duration"`
+	Renewable     bool   `json:"renewable"`
+}
+
+func (v *VaultKeySource) setLogin(auth vaultAuth) {
+	v.loginToken = auth.ClientToken
+	v.loginTTL = time.Duration(auth.LeaseDuration) * time.Second
+	v.renewable = auth.Renewable
+	v.loginExpires = time.Time{}
+	if v.loginTTL > 0 {
+		v.loginExpires = time.Now().Add(v.loginTTL)
+	}
+}
+
+func (v *VaultKeySource) request(method string, path string, token string, body interface{}, result interface{}) error {
+	var reader *bytes.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	} else {
+		reader = bytes.NewReader(nil)
+	}
+
+	request, err := http.NewRequest(method, strings.TrimRight(v.Address, "/")+"/v1/"+path, reader)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		request.Header.Set("X-Vault-Token", token)
+	}
+
+	response, err := v.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("vault responded with status %d for %s", response.StatusCode, path)
+	}
+
+	return json.NewDecoder(response.Body).Decode(result)
+}
+
+// Returns a token for the configured auth method. The token of the last login is reused and renewed
+// once half of its TTL has passed, only logging in again if it can't be renewed.
+func (v *VaultKeySource) token() (string, error) {
+	if v.Auth == "" || v.Auth == "token" {
+		return v.Token, nil
+	}
+
+	if v.loginToken != "" {
+		if v.loginExpires.IsZero() || time.Until(v.loginExpires) > v.loginTTL/2 {
+			return v.loginToken, nil
+		}
+		if v.renewable && time.Now().Before(v.loginExpires) {
+			var result struct {
+				Auth vaultAuth `json:"auth"`
+			}
+			err := v.request("POST", "auth/token/renew-self", v.loginToken, nil, &result)
+			if err == nil && result.Auth.ClientToken == v.loginToken {
+				v.setLogin(result.Auth)
+				return v.loginToken, nil
+			}
+			globalLogger.Warning(fmt.Sprintf("Could not renew the vault token, logging in again: %v", err))
+		}
+	}
+
+	return v.login()
+}
+
+// Logs in with the configured auth method and returns the new token
+func (v *VaultKeySource) login() (string, error) {
+	var body map[string]string
+	switch v.Auth {
+	case "approle":
+		body = map[string]string{"role_id": v.RoleID, "secret_id": v.SecretID}
+	case "kubernetes":
+		jwt, err := ioutil.ReadFile(serviceAccountTokenPath)
+		if err != nil {
+			return "", err
+		}
+		body = map[string]string{"role": v.Role, "jwt": string(jwt)}
+	default:
+		return "", fmt.Errorf("unknown vault auth method %s", v.Auth)
+	}
+
+	mount := v.AuthMount
+	if mount == "" {
+		mount = v.Auth
+	}
+
+	var result struct {
+		Auth vaultAuth `json:"auth"`
+	}
+	if err := v.request("POST", "auth/"+mount+"/login", "", body, &result); err != nil {
+		return "", err
+	}
+	if result.Auth.ClientToken == "" {
+		return "", errors.New("vault login returned no token")
+	}
+
+	RegisterSecret(result.Auth.ClientToken)
+	v.setLogin(result.Auth)
+
+	return result.Auth.ClientToken, nil
+}
+
+// Reads the signing keys of the KV secret
+func (v *VaultKeySource) kvKeys(token string, keys map[string][]byte) error {
+	path := v.KVMount + "/" + v.KVPath
+	if v.KVVersion != 1 {
+		path = v.KVMount + "/data/" + v.KVPath
+	}
+
+	var result struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	if err := v.request("GET", path, token, nil, &result); err != nil {
+		return err
+	}
+
+	data := result.Data
+	if v.KVVersion != 1 {
+		data, _ = result.Data["data"].(map[string]interface{})
+	}
+
+	for name, value := range data {
+		if stringValue, ok := value.(string); ok {
+			keys[name] = []byte(stringValue)
+		}
+	}
+
+	return nil
+}
+
+// Exports the HMAC keys of the transit engine. The latest version of a key becomes <name>,
+// the versions before <name>_old, <name>_old_2, ... down to the minimum decryption version.
+func (v *VaultKeySource) transitKeys(token string, keys map[string][]byte) error {
+	for _, name := range v.TransitKeys {
+		var result struct {
+			Data struct {
+				Keys map[string]string `json:"keys"`
+			} `json:"data"`
+		}
+		if err := v.request("GET", v.TransitMount+"/export/hmac-key/"+name, token, nil, &result); err != nil {
+			return fmt.Errorf("could not export the transit key %s: %s", name, err)
+		}
+
+		var versions []int
+		for version := range result.Data.Keys {
+			number, err := strconv.Atoi(version)
+			if err != nil {
+				return fmt.Errorf("unexpected version %s of the transit key %s", version, name)
+			}
+			versions = append(versions, number)
+		}
+		sort.Sort(sort.Reverse(sort.IntSlice(versions)))
+
+		for i, versionName := range KeyVersionNames(name, len(versions)-1) {
+			key, err := base64.StdEncoding.DecodeString(result.Data.Keys[strconv.Itoa(versions[i])])
+			if err != nil {
+				return fmt.Errorf("could not decode version %d of the transit key %s: %s", versions[i], name, err)
+			}
+			keys[versionName] = key
+		}
+	}
+
+	return nil
+}
+
+// Reads the keys from vault
+func (v *VaultKeySource) Refresh() error {
+	token, err := v.token()
+	if err != nil {
+		return err
+	}
+
+	keys := make(map[string][]byte)
+	if v.KVPath != "" {
+		err = v.kvKeys(token, keys)
+	}
+	if err == nil {
+		err = v.transitKeys(token, keys)
+	}
+	if err != nil {
+		// The token may have been revoked, the next refresh logs in again
+		v.loginToken = ""
+		return err
+	}
+
+	registerSigningKeys(keys)
+	v.mutex.Lock()
+	v.keys = keys
+	v.mutex.Unlock()
+
+	return nil
+}
+
+// Reads the keys initially and re-reads them in the given interval to pick up rotated keys
+func (v *VaultKeySource) Watch(interval time.Duration) error {
+	v.client = http.Client{Timeout: 10 * time.Second}
+	if err := v.Refresh(); err != nil {
+		return err
+	}
+
+	go func() {
+		for range time.Tick(interval) {
+			if err := v.Refresh(); err != nil {
+				globalLogger.Error("Could not refresh signing keys from vault: " + err.Error())
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *VaultKeySource) Keys() (map[string][]byte, error) {
+	v.mutex.RLock()
+	defer v.mutex.RUnlock()
+
+	if v.keys == nil {
+		return nil, errors.New("signing keys were not loaded from vault yet")
+	}
+
+	return v.keys, nil
+}
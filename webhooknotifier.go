@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+const (
+	NotificationStarted = "started"
+	NotificationFailed  = "failed"
+)
+
+// WebhookConfig configures a generic notifier posting a json payload to an arbitrary url
+type WebhookConfig struct {
+	URL string `json:"url"`
+	// Go template rendering the json payload. Defaults to the notification as json.
+	Template string `json:"template,omitempty"`
+	// Notification types to send. Defaults to started, succeeded and failed.
+	Events  []string          `json:"events,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+}
+
+var webhookTemplateFuncs = template.FuncMap{
+	// Encodes a value as json, e.g. to embed strings safely
+	"json": func(value interface{}) (string, error) {
+		bytes, err := json.Marshal(value)
+		return string(bytes), err
+	},
+}
+
+func (c WebhookConfig) validate() error {
+	if c.URL == "" {
+		return fmt.Errorf("url is required")
+	}
+	if _, err := template.New("webhook").Funcs(webhookTemplateFuncs).Parse(c.Template); err != nil {
+		return fmt.Errorf("invalid template: %s", err)
+	}
+	for _, event := range c.Events {
+		switch event {
+		case NotificationStarted, NotificationSucceeded, NotificationFailed, NotificationRejected, NotificationRolloutSucceeded, NotificationRolloutFailed, NotificationSkipped, NotificationDeployed, NotificationRolledBack, NotificationCompleted, NotificationDrifted, NotificationAPIUnavailable, NotificationAPIRecovered:
+		default:
+			return fmt.Errorf("unknown event %s", event)
+		}
+	}
+
+	return nil
+}
+
+// WebhookNotifier posts a templated json payload to an arbitrary url
+type WebhookNotifier struct {
+	Config WebhookConfig
+
+	template *template.Template
+}
+
+func NewWebhookNotifier(config WebhookConfig) (*WebhookNotifier, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if len(config.Events) == 0 {
+		config.Events = []string{NotificationStarted, NotificationSucceeded, NotificationFailed}
+	}
+
+	notifier := &WebhookNotifier{Config: config}
+	if config.Template != "" {
+		notifier.template = template.Must(template.New("webhook").Funcs(webhookTemplateFuncs).Parse(config.Template))
+	}
+
+	return notifier, nil
+}
+
+func (n *WebhookNotifier) Notify(notification Notification) error {
+	var body []byte
+	if n.template != nil {
+		var buffer bytes.Buffer
+		if err := n.template.Execute(&buffer, notification); err != nil {
+			return err
+		}
+		if !json.Valid(buffer.Bytes()) {
+			return fmt.Errorf("template rendered invalid json")
+		}
+		body = buffer.Bytes()
+	} else {
+		var err error
+		if body, err = json.Marshal(notification); err != nil {
+			return err
+		}
+	}
+
+	request, err := http.NewRequest("POST", n.Config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("content-type", "application/json")
+	for key, value := range n.Config.Headers {
+		request.Header.Set(key, value)
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", response.StatusCode)
+	}
+
+	return nil
+}
+
+func (n *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (n *WebhookNotifier) Types() []string {
+	return n.Config.Events
+}
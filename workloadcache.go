@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/scheme"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/cluster"
+	"sigs.k8s.io/controller-runtime/pkg/manager"
+)
+
+// WorkloadCache keeps the deployments and stateful sets of a cluster in the informer cache of a
+// controller-runtime cluster, so matching targets doesn't list all workloads of the cluster on
+// every request
+type WorkloadCache struct {
+	cache  cache.Cache
+	synced []func() bool
+}
+
+// Adds a cache of the workloads of the cluster in the allowed namespaces to the manager, only
+// caching workloads matching the selector if set. The cache is used once synced, which is a
+// readiness check.
+func (c *Cluster) WatchWorkloads(mgr manager.Manager, selector string, resync time.Duration) error {
+	parsed, err := labels.Parse(selector)
+	if err != nil {
+		return err
+	}
+	options := cache.Options{Scheme: scheme.Scheme, SyncPeriod: &resync, DefaultLabelSelector: parsed}
+	if namespaces := ListNamespaces(""); len(namespaces) > 1 || namespaces[0] != "" {
+		options.DefaultNamespaces = make(map[string]cache.Config)
+		for _, namespace := range namespaces {
+			options.DefaultNamespaces[namespace] = cache.Config{}
+		}
+	}
+
+	workloadCluster, err := cluster.New(c.Config, func(clusterOptions *cluster.Options) {
+		clusterOptions.Scheme = scheme.Scheme
+		clusterOptions.Cache = options
+	})
+	if err != nil {
+		return err
+	}
+	// The caches start with the manager
+	if err := mgr.Add(workloadCluster); err != nil {
+		return err
+	}
+
+	workloads := &WorkloadCache{cache: workloadCluster.GetCache()}
+	for _, object := range []client.Object{&appsv1.Deployment{}, &appsv1.StatefulSet{}} {
+		informer, err := workloads.cache.GetInformer(context.Background(), object, cache.BlockUntilSynced(false))
+		if err != nil {
+			return err
+		}
+		workloads.synced = append(workloads.synced, informer.HasSynced)
+	}
+
+	name := c.Name
+	if name == "" {
+		name = LocalClusterName
+	}
+	RegisterCacheSync("workloads of cluster "+name, workloads.Synced)
+	c.Workloads = workloads
+
+	return nil
+}
+
+// Returns whether all informers of the cache are synced
+func (w *WorkloadCache) Synced() bool {
+	for _, synced := range w.synced {
+		if !synced() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Lists the cached deployments of the namespace, all namespaces if empty
+func (w *WorkloadCache) Deployments(namespace string, selector labels.Selector) ([]appsv1.Deployment, error) {
+	var deployments appsv1.DeploymentList
+	if err := w.cache.List(context.Background(), &deployments, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	return deployments.Items, nil
+}
+
+// Lists the cached stateful sets of the namespace, all namespaces if empty
+func (w *WorkloadCache) StatefulSets(namespace string, selector labels.Selector) ([]appsv1.StatefulSet, error) {
+	var statefulSets appsv1.StatefulSetList
+	if err := w.cache.List(context.Background(), &statefulSets, client.InNamespace(namespace), client.MatchingLabelsSelector{Selector: selector}); err != nil {
+		return nil, err
+	}
+
+	return statefulSets.Items, nil
+}